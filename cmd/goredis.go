@@ -1,19 +1,81 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/marcinwyszynski/goredis/lib"
 	"github.com/sirupsen/logrus"
 )
 
 type config struct {
-	DynamoTable string `envconfig:"DYNAMO_TABLE" required:"true"`
-	Port        int    `envconfig:"PORT" default:"6379"`
+	CacheMaxMemory     int           `envconfig:"CACHE_MAXMEMORY" default:"0"`
+	CachePolicy        string        `envconfig:"CACHE_MAXMEMORY_POLICY" default:"allkeys-lru"`
+	CacheSamples       int           `envconfig:"CACHE_MAXMEMORY_SAMPLES" default:"5"`
+	CacheStaleness     string        `envconfig:"CACHE_POLICIES"`
+	Circuit            bool          `envconfig:"CIRCUIT_BREAKER" default:"false"`
+	CircuitFailureRate float64       `envconfig:"CIRCUIT_FAILURE_RATE" default:"0.5"`
+	CircuitMinCalls    int           `envconfig:"CIRCUIT_MIN_CALLS" default:"20"`
+	CircuitOpenFor     time.Duration `envconfig:"CIRCUIT_OPEN_FOR" default:"10s"`
+	CircuitProbes      int           `envconfig:"CIRCUIT_PROBES" default:"5"`
+	CircuitSlowCall    time.Duration `envconfig:"CIRCUIT_SLOW_CALL" default:"500ms"`
+	CircuitSlowRate    float64       `envconfig:"CIRCUIT_SLOW_RATE" default:"0.5"`
+	CircuitWindow      int           `envconfig:"CIRCUIT_WINDOW" default:"100"`
+	ClusterBusAddr     string        `envconfig:"CLUSTER_BUS_ADDR"`
+	ClusterPeers       []string      `envconfig:"CLUSTER_PEERS"`
+	Compression        string        `envconfig:"COMPRESSION"`
+	CompressionFrame   bool          `envconfig:"COMPRESSION_FRAME_VALUES" default:"false"`
+	CompressionMinSize int           `envconfig:"COMPRESSION_THRESHOLD" default:"1024"`
+	CompressionStrict  bool          `envconfig:"COMPRESSION_REQUIRE_HEADER" default:"false"`
+	Databases          int           `envconfig:"DATABASES" default:"16"`
+	DynamoAttempts     int           `envconfig:"DYNAMO_MAX_ATTEMPTS" default:"4"`
+	DynamoCheckTable   bool          `envconfig:"DYNAMO_CHECK_TABLE" default:"true"`
+	DynamoChunkSize    int           `envconfig:"DYNAMO_CHUNK_SIZE" default:"358400"`
+	DynamoConsistent   bool          `envconfig:"DYNAMO_CONSISTENT_READS" default:"false"`
+	DynamoCreateTable  bool          `envconfig:"DYNAMO_CREATE_TABLE" default:"false"`
+	DynamoKeyName      string        `envconfig:"DYNAMO_KEY_ATTRIBUTE" default:"key"`
+	DynamoMigrate      bool          `envconfig:"DYNAMO_MIGRATE_VALUES" default:"false"`
+	DynamoReadUnits    int64         `envconfig:"DYNAMO_READ_CAPACITY" default:"0"`
+	DynamoReadTimeout  time.Duration `envconfig:"DYNAMO_READ_TIMEOUT" default:"1s"`
+	DynamoRetryBase    time.Duration `envconfig:"DYNAMO_RETRY_BASE_DELAY" default:"25ms"`
+	DynamoRetryMax     time.Duration `envconfig:"DYNAMO_RETRY_MAX_DELAY" default:"1s"`
+	DynamoSegments     int           `envconfig:"DYNAMO_SCAN_SEGMENTS" default:"1"`
+	DynamoSortKeyName  string        `envconfig:"DYNAMO_SORT_KEY_ATTRIBUTE"`
+	DynamoSortKeyValue string        `envconfig:"DYNAMO_SORT_KEY_VALUE"`
+	DynamoStreams      []string      `envconfig:"DYNAMO_STREAM_ARN"`
+	DynamoTable        string        `envconfig:"DYNAMO_TABLE" required:"true"`
+	DynamoTables       string        `envconfig:"DYNAMO_TABLES"`
+	DynamoTombstoneTTL time.Duration `envconfig:"DYNAMO_TOMBSTONE_TTL" default:"168h"`
+	DynamoTTLAttribute string        `envconfig:"DYNAMO_TTL_ATTRIBUTE"`
+	DynamoValueName    string        `envconfig:"DYNAMO_VALUE_ATTRIBUTE" default:"value"`
+	DynamoVersionName  string        `envconfig:"DYNAMO_VERSION_ATTRIBUTE" default:"version"`
+	DynamoWriteUnits   int64         `envconfig:"DYNAMO_WRITE_CAPACITY" default:"0"`
+	DynamoWriteTimeout time.Duration `envconfig:"DYNAMO_WRITE_TIMEOUT" default:"1s"`
+	EncryptionKeyTTL   time.Duration `envconfig:"ENCRYPTION_DATA_KEY_TTL" default:"5m"`
+	EncryptionKeyring  string        `envconfig:"ENCRYPTION_KEYRING"`
+	EncryptionKMSKey   string        `envconfig:"ENCRYPTION_KMS_KEY_ID"`
+	EncryptionRewrite  bool          `envconfig:"ENCRYPTION_REENCRYPT" default:"false"`
+	EncryptionRequired bool          `envconfig:"ENCRYPTION_REQUIRED" default:"false"`
+	FlushTimeLimit     time.Duration `envconfig:"FLUSH_TIME_LIMIT" default:"5s"`
+	LuaTimeLimit       time.Duration `envconfig:"LUA_TIME_LIMIT" default:"5s"`
+	MissingKeys        int           `envconfig:"NEGATIVE_CACHE_SIZE" default:"100000"`
+	MissingKeysTTL     time.Duration `envconfig:"NEGATIVE_CACHE_TTL" default:"30s"`
+	Port               int           `envconfig:"PORT" default:"6379"`
+	PubSubHardLimit    int           `envconfig:"PUBSUB_HARD_LIMIT" default:"33554432"`
+	PubSubSoftLimit    int           `envconfig:"PUBSUB_SOFT_LIMIT" default:"8388608"`
+	PubSubSoftSeconds  time.Duration `envconfig:"PUBSUB_SOFT_SECONDS" default:"60s"`
+	WriteBehindBatch   int           `envconfig:"WRITE_BEHIND_BATCH" default:"100"`
+	WriteBehindDir     string        `envconfig:"WRITE_BEHIND_DIR"`
+	WriteBehindFlush   time.Duration `envconfig:"WRITE_BEHIND_INTERVAL" default:"100ms"`
+	WriteBehindOutages bool          `envconfig:"WRITE_BEHIND_WHEN_UNAVAILABLE" default:"false"`
 }
 
 func main() {
@@ -24,10 +86,248 @@ func main() {
 
 	session := session.Must(session.NewSession())
 
-	store := lib.NewCachingStore(
-		&lib.DynamoDBStore{API: dynamodb.New(session), TableName: cfg.DynamoTable},
-		lib.NewInMemoryStore(),
-	)
+	// The cache is unbounded unless given a memory budget.
+	cache := lib.NewInMemoryStore()
+	if cfg.CacheMaxMemory > 0 {
+		policy, known := lib.EvictionPolicyByName(cfg.CachePolicy)
+		if !known {
+			log.Fatalf("Unknown cache eviction policy: %s", cfg.CachePolicy)
+		}
+
+		bounded := lib.NewBoundedStore(cfg.CacheMaxMemory, policy)
+		bounded.SetSamples(cfg.CacheSamples)
+		cache = bounded
+	}
+
+	// Requests are retried by the store, which knows better than the SDK
+	// when retrying would only make matters worse.
+	retries := lib.NewRetryPolicy(cfg.DynamoAttempts)
+	retries.BaseDelay = cfg.DynamoRetryBase
+	retries.MaxDelay = cfg.DynamoRetryMax
+
+	// Existing tables are used as they are, with keys, values and versions in
+	// whichever attributes they're kept. With a sort key, keys are held by
+	// the item whose sort key is DYNAMO_SORT_KEY_VALUE, with {key} replaced
+	// by the key, or by the key itself if it's not set. With a TTL
+	// attribute, tombstones of deleted keys expire after DYNAMO_TOMBSTONE_TTL,
+	// which has to outlast any WATCH, and are kept forever otherwise.
+	schema := lib.DynamoDBSchema{
+		KeyAttribute:     cfg.DynamoKeyName,
+		ValueAttribute:   cfg.DynamoValueName,
+		VersionAttribute: cfg.DynamoVersionName,
+		SortKeyAttribute: cfg.DynamoSortKeyName,
+		TTLAttribute:     cfg.DynamoTTLAttribute,
+	}
+	if cfg.DynamoSortKeyValue != "" {
+		schema.SortKey = lib.SortKeyTemplate(cfg.DynamoSortKeyValue)
+	}
+
+	tables, err := lib.ParseDynamoDBTables(cfg.DynamoTables, schema)
+	if err != nil {
+		log.Fatalf("Invalid DynamoDB tables: %v", err)
+	}
+
+	dynamo := &lib.DynamoDBStore{
+		API:             dynamodb.New(session, aws.NewConfig().WithMaxRetries(0)),
+		TableName:       cfg.DynamoTable,
+		Schema:          schema,
+		Tables:          tables,
+		ScanSegments:    cfg.DynamoSegments,
+		ConsistentReads: cfg.DynamoConsistent,
+		ReadTimeout:     cfg.DynamoReadTimeout,
+		WriteTimeout:    cfg.DynamoWriteTimeout,
+		Retries:         retries,
+		ChunkSize:       cfg.DynamoChunkSize,
+		TombstoneTTL:    cfg.DynamoTombstoneTTL,
+	}
+
+	// A misconfigured table would otherwise only show up as API errors once
+	// clients come along. Without capacity, created tables are on-demand.
+	// Every table needs its stream followed for caches to stay coherent.
+	if cfg.DynamoCheckTable || cfg.DynamoCreateTable {
+		streamARNs, err := dynamo.EnsureTable(context.Background(), lib.DynamoDBTableSpec{
+			Create:        cfg.DynamoCreateTable,
+			ReadCapacity:  cfg.DynamoReadUnits,
+			WriteCapacity: cfg.DynamoWriteUnits,
+			Stream:        len(cfg.DynamoStreams) > 0,
+			TTLAttribute:  cfg.DynamoTTLAttribute,
+		})
+		if err != nil {
+			log.Fatalf("DynamoDB table not ready: %v", err)
+		}
+
+		unmatched := make(map[string]bool)
+		for _, streamARN := range cfg.DynamoStreams {
+			unmatched[streamARN] = true
+		}
+		for _, streamARN := range streamARNs {
+			if len(cfg.DynamoStreams) > 0 && !unmatched[streamARN] {
+				log.Warnf("Not following %s, so writes of other nodes to its table may be served stale", streamARN)
+			}
+			delete(unmatched, streamARN)
+		}
+		for streamARN := range unmatched {
+			log.Fatalf("DYNAMO_STREAM_ARN has %s, which is not the stream of any table", streamARN)
+		}
+	}
+
+	// Values written by earlier versions are stored as strings, and are
+	// rewritten as binary in the background, while being served as they are.
+	if cfg.DynamoMigrate {
+		go func() {
+			migrated, err := dynamo.MigrateValues(context.Background())
+			if err != nil {
+				log.Errorf("Could not migrate values to binary: %v", err)
+				return
+			}
+			log.Infof("Migrated %d value(s) to binary", migrated)
+		}()
+	}
+
+	var authority lib.Store = dynamo
+
+	// Values are encrypted with master keys from KMS, or from a keyring file
+	// outside of production, if either is given.
+	var keys lib.KeyProvider
+	if cfg.EncryptionKMSKey != "" {
+		keys = &lib.KMSKeyProvider{API: kms.New(session), KeyID: cfg.EncryptionKMSKey}
+	} else if cfg.EncryptionKeyring != "" {
+		keyring, err := lib.LoadKeyring(cfg.EncryptionKeyring)
+		if err != nil {
+			log.Fatalf("Could not load keyring: %v", err)
+		}
+		keys = keyring
+	}
+
+	if keys != nil {
+		encrypting := lib.NewEncryptingStore(authority, keys)
+		encrypting.DataKeyTTL = cfg.EncryptionKeyTTL
+		encrypting.RequireEncrypted = cfg.EncryptionRequired
+		authority = encrypting
+
+		// Values written in plaintext, or with a master key since rotated,
+		// are encrypted anew in the background. Once none are left in
+		// plaintext, values which aren't encrypted may be rejected.
+		if cfg.EncryptionRewrite {
+			go func() {
+				reencrypted, err := encrypting.Reencrypt(context.Background())
+				if err != nil {
+					log.Errorf("Could not re-encrypt values: %v", err)
+					return
+				}
+				log.Infof("Re-encrypted %d value(s)", reencrypted)
+			}()
+		}
+	}
+
+	// Values are stored as they are unless a codec is given. Compressed values
+	// are only decompressed while compression is enabled, with any codec, so
+	// once enabled it has to stay that way. Values written before that are
+	// read as they are, and given a header in the background once every node
+	// has compression enabled, after which headers may be required.
+	if cfg.Compression != "" {
+		if cfg.CompressionFrame {
+			framing := authority
+			go func() {
+				framed, err := lib.FrameValues(context.Background(), framing)
+				if err != nil {
+					log.Errorf("Could not frame values for compression: %v", err)
+					return
+				}
+				log.Infof("Framed %d value(s) for compression", framed)
+			}()
+		}
+
+		compressing, err := lib.NewCompressingStore(authority, cfg.Compression)
+		if err != nil {
+			log.Fatalf("Invalid compression: %v", err)
+		}
+		compressing.Threshold = cfg.CompressionMinSize
+		compressing.RequireHeader = cfg.CompressionStrict
+		authority = compressing
+	}
+
+	// With a circuit breaker, cached values are served for as long as
+	// DynamoDB is unavailable, however stale.
+	if cfg.Circuit {
+		breaker := lib.NewCircuitBreaker(authority)
+		breaker.FailureRate = cfg.CircuitFailureRate
+		breaker.SlowRate = cfg.CircuitSlowRate
+		breaker.SlowCall = cfg.CircuitSlowCall
+		breaker.MinCalls = cfg.CircuitMinCalls
+		breaker.OpenFor = cfg.CircuitOpenFor
+		breaker.Probes = cfg.CircuitProbes
+		breaker.SetWindow(cfg.CircuitWindow)
+		authority = breaker
+	}
+
+	store := lib.NewCachingStore(authority, cache)
+	store.KnownMissing = lib.NewNegativeCache(cfg.MissingKeys, cfg.MissingKeysTTL)
+
+	policies, err := lib.ParseCachePolicies(cfg.CacheStaleness)
+	if err != nil {
+		log.Fatalf("Invalid cache policies: %v", err)
+	}
+	store.Policies = policies
+
+	// Writes go straight to DynamoDB unless there's somewhere to log them.
+	if cfg.WriteBehindDir != "" {
+		if cfg.WriteBehindBatch < 1 || cfg.WriteBehindBatch > lib.DefaultWriteBehindBatchSize {
+			log.Fatalf("WRITE_BEHIND_BATCH must be between 1 and %d", lib.DefaultWriteBehindBatchSize)
+		}
+
+		writeBehind, err := lib.OpenWriteBehind(cfg.WriteBehindDir, log.WithField("component", "write-behind"))
+		if err != nil {
+			log.Fatalf("Could not open write-ahead log: %v", err)
+		}
+		writeBehind.BatchSize = cfg.WriteBehindBatch
+		writeBehind.FlushInterval = cfg.WriteBehindFlush
+		writeBehind.WhenUnavailable = cfg.WriteBehindOutages
+		store.WriteBehind = writeBehind
+
+		log.Infof("Writing behind via %s, with %d write(s) pending", cfg.WriteBehindDir, writeBehind.Len())
+		go store.RunWriteBehind(context.Background())
+	}
+
+	server := lib.NewServer(store)
+
+	// Each stream is followed by a subscriber of its own, which reads its
+	// records with the schema of the table it belongs to.
+	for _, streamARN := range cfg.DynamoStreams {
+		streamSchema, err := dynamo.StreamSchema(streamARN)
+		if err != nil {
+			log.Fatalf("Invalid DYNAMO_STREAM_ARN: %v", err)
+		}
+
+		subscriber := lib.NewStreamSubscriber(dynamodbstreams.New(session), streamARN, store, log.WithField("component", "stream"))
+		subscriber.Schema = streamSchema
+
+		log.Infof("Following writes of other nodes via %s", streamARN)
+		go subscriber.Run(context.Background())
+	}
+
+	server.PubSubOutputLimits = lib.OutputBufferLimits{
+		HardLimit:   cfg.PubSubHardLimit,
+		SoftLimit:   cfg.PubSubSoftLimit,
+		SoftSeconds: cfg.PubSubSoftSeconds,
+	}
+
+	server.Databases = cfg.Databases
+	server.ScriptTimeLimit = cfg.LuaTimeLimit
+	server.FlushTimeLimit = cfg.FlushTimeLimit
+
+	// Peers on the bus are not authenticated, so its address must only be
+	// reachable by the other nodes.
+	if cfg.ClusterBusAddr != "" {
+		bus, err := lib.NewTCPBus(cfg.ClusterBusAddr, cfg.ClusterPeers, log.WithField("component", "bus"))
+		if err != nil {
+			log.Fatalf("Could not set up cluster bus: %v", err)
+		}
+		defer bus.Close()
+
+		log.Infof("Exchanging pub/sub messages with %d peer(s) via %s", len(cfg.ClusterPeers), bus.Addr())
+		server.PubSub.Join(bus)
+	}
 
 	port := fmt.Sprintf(":%d", cfg.Port)
 	log.Infof("About to start serving on port %s", port)
@@ -46,6 +346,6 @@ func main() {
 		logger := log.WithField("remote", conn.RemoteAddr())
 		logger.Infoln("Accepted connection")
 
-		go (lib.NewSessionHandler(conn, logger, store)).Handle()
+		go (lib.NewSessionHandler(conn, logger, server)).Handle()
 	}
 }
@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"container/list"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// lfuInitValue is the access counter of new keys, which gives them a
+	// chance to be accessed again before looking cold.
+	lfuInitValue = 5
+
+	// lfuLogFactor controls how quickly incrementing the access counter gets
+	// less likely as it grows. With the Redis default of 10, the counter
+	// saturates at around a million accesses.
+	lfuLogFactor = 10
+
+	// lfuDecayTime is how long a key has to sit idle for its access counter
+	// to be decremented.
+	lfuDecayTime = time.Minute
+
+	// maxTrackedKeys is the number of keys whose accesses are remembered.
+	maxTrackedKeys = 1000000
+
+	// accessTrackerShards is the number of shards keys are hashed into.
+	accessTrackerShards = 64
+)
+
+// keyAccess describes how recently and how frequently a key was accessed,
+// using the same logarithmic counter Redis uses for its LFU eviction.
+type keyAccess struct {
+	accessed time.Time
+	counter  uint8
+}
+
+// frequency returns the access counter, decayed by the time the key has been
+// idle.
+func (a *keyAccess) frequency(now time.Time) uint8 {
+	periods := int64(now.Sub(a.accessed) / lfuDecayTime)
+	if periods >= int64(a.counter) {
+		return 0
+	}
+	return a.counter - uint8(periods)
+}
+
+func (a *keyAccess) touch(now time.Time, random float64) {
+	counter := a.frequency(now)
+
+	if counter < 255 {
+		base := float64(counter) - lfuInitValue
+		if base < 0 {
+			base = 0
+		}
+
+		if random < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+
+	a.accessed, a.counter = now, counter
+}
+
+// accessTracker records key accesses made through this node. Accesses made
+// through other nodes sharing the store are not taken into account. Keys are
+// spread over shards, each with a lock of its own, and each shard only
+// remembers its most recently accessed keys, so that keys deleted through
+// other nodes are eventually forgotten. Forgotten keys are treated as new once
+// accessed again, like keys not accessed through this node yet.
+type accessTracker struct {
+	shards [accessTrackerShards]*accessShard
+	now    func() time.Time
+	random func() float64
+}
+
+// accessShard orders keys by when they were last accessed, most recent first.
+type accessShard struct {
+	maxKeys int
+	keys    map[string]*list.Element
+	order   *list.List
+	lock    *sync.Mutex
+}
+
+// trackedAccess is the access history of a key, as held in a shard.
+type trackedAccess struct {
+	key string
+	keyAccess
+}
+
+func newAccessTracker(maxKeys int) *accessTracker {
+	ret := &accessTracker{now: time.Now, random: rand.Float64}
+	for i := range ret.shards {
+		ret.shards[i] = &accessShard{
+			maxKeys: (maxKeys + accessTrackerShards - 1) / accessTrackerShards,
+			keys:    make(map[string]*list.Element),
+			order:   list.New(),
+			lock:    new(sync.Mutex),
+		}
+	}
+	return ret
+}
+
+// touch records an access to each of the keys.
+func (t *accessTracker) touch(keys ...string) {
+	now := t.now()
+	for _, key := range keys {
+		shard := t.shard(key)
+
+		shard.lock.Lock()
+		shard.get(key, now).touch(now, t.random())
+		shard.lock.Unlock()
+	}
+}
+
+// rename moves the access history of a key to its new name.
+func (t *accessTracker) rename(from, to string) {
+	source := t.shard(from)
+
+	source.lock.Lock()
+	element, exists := source.keys[from]
+	if exists {
+		source.remove(element)
+	}
+	source.lock.Unlock()
+
+	if !exists {
+		return
+	}
+
+	target := t.shard(to)
+
+	target.lock.Lock()
+	defer target.lock.Unlock()
+
+	*target.get(to, t.now()) = element.Value.(*trackedAccess).keyAccess
+}
+
+// restore replaces the access history of a key, as when it's restored from
+// a DUMP payload. A negative idle time or frequency leaves the respective
+// default for new keys in place.
+func (t *accessTracker) restore(key string, idle time.Duration, frequency int) {
+	access := keyAccess{accessed: t.now(), counter: lfuInitValue}
+	if idle > 0 {
+		access.accessed = access.accessed.Add(-idle)
+	}
+	if frequency >= 0 {
+		access.counter = uint8(frequency)
+	}
+
+	shard := t.shard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	*shard.get(key, access.accessed) = access
+}
+
+// lookup returns how long the key has been idle and its access frequency,
+// without counting as an access. Keys not accessed through this node yet are
+// treated as new.
+func (t *accessTracker) lookup(key string) (idle time.Duration, frequency uint8) {
+	shard := t.shard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	now := t.now()
+	access := shard.get(key, now)
+	return now.Sub(access.accessed), access.frequency(now)
+}
+
+// forgetDatabases drops the access history of all keys in the databases, as
+// when they're flushed.
+func (t *accessTracker) forgetDatabases(dbs ...int) {
+	forgotten := make(map[int]bool, len(dbs))
+	for _, db := range dbs {
+		forgotten[db] = true
+	}
+
+	for _, shard := range t.shards {
+		shard.lock.Lock()
+		for key, element := range shard.keys {
+			if forgotten[accessKeyDatabase(key)] {
+				shard.remove(element)
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
+
+func (t *accessTracker) shard(key string) *accessShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return t.shards[hash.Sum32()%accessTrackerShards]
+}
+
+// get returns the access history of the key, which moves to the front, and
+// forgets the least recently accessed key if the shard is full. It must be
+// called with the lock held.
+func (s *accessShard) get(key string, now time.Time) *keyAccess {
+	if element, exists := s.keys[key]; exists {
+		s.order.MoveToFront(element)
+		return &element.Value.(*trackedAccess).keyAccess
+	}
+
+	access := &trackedAccess{key: key, keyAccess: keyAccess{accessed: now, counter: lfuInitValue}}
+	s.keys[key] = s.order.PushFront(access)
+
+	if s.order.Len() > s.maxKeys {
+		s.remove(s.order.Back())
+	}
+	return &access.keyAccess
+}
+
+// remove must be called with the lock held.
+func (s *accessShard) remove(element *list.Element) {
+	delete(s.keys, element.Value.(*trackedAccess).key)
+	s.order.Remove(element)
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type accessTrackerTestSuite struct {
+	suite.Suite
+
+	now    time.Time
+	random float64
+
+	sut *accessTracker
+}
+
+func (a *accessTrackerTestSuite) SetupTest() {
+	a.now = time.Unix(1500000000, 0)
+	a.random = 0
+
+	a.sut = newAccessTracker(maxTrackedKeys)
+	a.sut.now = func() time.Time { return a.now }
+	a.sut.random = func() float64 { return a.random }
+}
+
+func (a *accessTrackerTestSuite) TestLookup_NewKey() {
+	idle, frequency := a.sut.lookup("bacon")
+	a.Zero(idle)
+	a.Equal(uint8(lfuInitValue), frequency)
+}
+
+func (a *accessTrackerTestSuite) TestTouch() {
+	a.sut.touch("bacon")
+	a.now = a.now.Add(30 * time.Second)
+
+	idle, frequency := a.sut.lookup("bacon")
+	a.Equal(30*time.Second, idle)
+	a.Equal(uint8(lfuInitValue+1), frequency)
+}
+
+func (a *accessTrackerTestSuite) TestTouch_Logarithmic() {
+	a.sut.touch("bacon")
+
+	// With a counter of 6, the chance of incrementing it is 1 in 11.
+	a.random = 0.1
+	a.sut.touch("bacon")
+
+	_, frequency := a.sut.lookup("bacon")
+	a.Equal(uint8(lfuInitValue+1), frequency)
+
+	a.random = 0.05
+	a.sut.touch("bacon")
+
+	_, frequency = a.sut.lookup("bacon")
+	a.Equal(uint8(lfuInitValue+2), frequency)
+}
+
+func (a *accessTrackerTestSuite) TestTouch_Saturates() {
+	a.sut.restore("bacon", 0, 255)
+
+	a.sut.touch("bacon")
+
+	_, frequency := a.sut.lookup("bacon")
+	a.Equal(uint8(255), frequency)
+}
+
+func (a *accessTrackerTestSuite) TestDecay() {
+	a.sut.touch("bacon")
+
+	a.now = a.now.Add(3*lfuDecayTime + time.Second)
+	_, frequency := a.sut.lookup("bacon")
+	a.Equal(uint8(lfuInitValue-2), frequency)
+
+	a.now = a.now.Add(time.Hour)
+	_, frequency = a.sut.lookup("bacon")
+	a.Zero(frequency)
+}
+
+func (a *accessTrackerTestSuite) TestRename() {
+	a.sut.touch("bacon")
+	a.now = a.now.Add(time.Minute)
+
+	a.sut.rename("bacon", "cabbage")
+	a.NotContains(a.sut.shard("bacon").keys, "bacon")
+
+	idle, _ := a.sut.lookup("cabbage")
+	a.Equal(time.Minute, idle)
+}
+
+func (a *accessTrackerTestSuite) TestRestore() {
+	a.sut.touch("bacon")
+
+	a.sut.restore("bacon", time.Hour, -1)
+	idle, frequency := a.sut.lookup("bacon")
+	a.Equal(time.Hour, idle)
+	a.Zero(frequency)
+
+	a.sut.restore("bacon", -1, 42)
+	idle, frequency = a.sut.lookup("bacon")
+	a.Zero(idle)
+	a.Equal(uint8(42), frequency)
+}
+
+func (a *accessTrackerTestSuite) TestEviction() {
+	a.sut = newAccessTracker(2 * accessTrackerShards)
+	a.sut.now = func() time.Time { return a.now }
+
+	shard := a.sut.shard("key:0")
+	var keys []string
+	for i := 0; len(keys) < 3; i++ {
+		if key := fmt.Sprintf("key:%d", i); a.sut.shard(key) == shard {
+			keys = append(keys, key)
+		}
+	}
+
+	a.sut.touch(keys[0], keys[1])
+	a.now = a.now.Add(time.Minute)
+	a.sut.touch(keys[0], keys[2])
+
+	a.Len(shard.keys, 2)
+	a.NotContains(shard.keys, keys[1])
+
+	idle, _ := a.sut.lookup(keys[0])
+	a.Zero(idle)
+}
+
+func (a *accessTrackerTestSuite) TestForgetDatabases() {
+	a.sut.touch(accessKey(0, "bacon"), accessKey(1, "bacon"), accessKey(2, "bacon"), accessKey(12, "bacon"))
+
+	a.sut.forgetDatabases(1, 12)
+
+	a.Contains(a.sut.shard(accessKey(0, "bacon")).keys, accessKey(0, "bacon"))
+	a.NotContains(a.sut.shard(accessKey(1, "bacon")).keys, accessKey(1, "bacon"))
+	a.Contains(a.sut.shard(accessKey(2, "bacon")).keys, accessKey(2, "bacon"))
+	a.NotContains(a.sut.shard(accessKey(12, "bacon")).keys, accessKey(12, "bacon"))
+}
+
+func TestAccessTracker(t *testing.T) {
+	suite.Run(t, new(accessTrackerTestSuite))
+}
@@ -0,0 +1,342 @@
+package lib
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEvictionSamples is how many keys are sampled to pick each key to
+	// evict, as with the Redis default for maxmemory-samples.
+	DefaultEvictionSamples = 5
+
+	// boundedEntryOverhead approximates the memory used by a cache entry on
+	// top of its key and value: the map bucket slot, the entry itself and the
+	// string headers.
+	boundedEntryOverhead = 64
+)
+
+// CacheEntry describes a key held by a BoundedStore to its EvictionPolicy.
+type CacheEntry struct {
+	Key string
+
+	// Size is the number of bytes the entry counts towards the budget.
+	Size int
+
+	// Accessed is when the key was last read or written.
+	Accessed time.Time
+
+	// Frequency is the logarithmic access counter, as in OBJECT FREQ.
+	Frequency uint8
+
+	// Expires is when the key expires. goredis does not support expiration,
+	// so it's always zero.
+	Expires time.Time
+}
+
+// EvictionPolicy picks which keys a BoundedStore evicts when it runs out of
+// memory, like the maxmemory-policy setting in Redis.
+type EvictionPolicy interface {
+	// Name is the name of the policy as reported by INFO.
+	Name() string
+
+	// Evict returns the index of the candidate to evict, or -1 if none of
+	// them can be evicted.
+	Evict(candidates []CacheEntry) int
+}
+
+type lruPolicy struct{}
+
+func (lruPolicy) Name() string { return "allkeys-lru" }
+
+func (lruPolicy) Evict(candidates []CacheEntry) int {
+	ret := -1
+	for i, candidate := range candidates {
+		if ret < 0 || candidate.Accessed.Before(candidates[ret].Accessed) {
+			ret = i
+		}
+	}
+	return ret
+}
+
+type lfuPolicy struct{}
+
+func (lfuPolicy) Name() string { return "allkeys-lfu" }
+
+// Evict breaks ties between equally frequently accessed keys by evicting the
+// least recently accessed one.
+func (lfuPolicy) Evict(candidates []CacheEntry) int {
+	ret := -1
+	for i, candidate := range candidates {
+		if ret < 0 || candidate.Frequency < candidates[ret].Frequency ||
+			candidate.Frequency == candidates[ret].Frequency && candidate.Accessed.Before(candidates[ret].Accessed) {
+			ret = i
+		}
+	}
+	return ret
+}
+
+type volatileTTLPolicy struct{}
+
+func (volatileTTLPolicy) Name() string { return "volatile-ttl" }
+
+// Evict only considers keys with an expiration time. None have one in
+// goredis, so once the budget is used up, new keys are not cached at all.
+func (volatileTTLPolicy) Evict(candidates []CacheEntry) int {
+	ret := -1
+	for i, candidate := range candidates {
+		if candidate.Expires.IsZero() {
+			continue
+		}
+		if ret < 0 || candidate.Expires.Before(candidates[ret].Expires) {
+			ret = i
+		}
+	}
+	return ret
+}
+
+type randomPolicy struct{}
+
+func (randomPolicy) Name() string { return "allkeys-random" }
+
+func (randomPolicy) Evict(candidates []CacheEntry) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	return rand.Intn(len(candidates))
+}
+
+// Built-in eviction policies, named as in Redis.
+var (
+	AllKeysLRU    EvictionPolicy = lruPolicy{}
+	AllKeysLFU    EvictionPolicy = lfuPolicy{}
+	VolatileTTL   EvictionPolicy = volatileTTLPolicy{}
+	AllKeysRandom EvictionPolicy = randomPolicy{}
+)
+
+// EvictionPolicyByName returns the built-in eviction policy with the given
+// name.
+func EvictionPolicyByName(name string) (EvictionPolicy, bool) {
+	for _, policy := range []EvictionPolicy{AllKeysLRU, AllKeysLFU, VolatileTTL, AllKeysRandom} {
+		if policy.Name() == name {
+			return policy, true
+		}
+	}
+	return nil, false
+}
+
+type boundedEntry struct {
+	value   string
+	version uint64
+	access  keyAccess
+}
+
+// BoundedStore is an in-memory Store which keeps the memory used by its keys
+// and values within a budget, evicting keys when it's exceeded. It's meant to
+// be used as the cache of a CachingStore: evicted keys are simply gone, and
+// so are their versions.
+//
+// As in Redis, keys to evict are picked by sampling a few keys and letting the
+// policy choose among them, rather than keeping all keys ordered.
+type BoundedStore struct {
+	maxBytes int
+	policy   EvictionPolicy
+	samples  int
+
+	entries   map[string]*boundedEntry
+	used      int
+	evictions uint64
+
+	now    func() time.Time
+	random func() float64
+	lock   *sync.Mutex
+}
+
+// NewBoundedStore returns a BoundedStore keeping within maxBytes, evicting
+// keys according to the policy and sampling the default number of keys.
+func NewBoundedStore(maxBytes int, policy EvictionPolicy) *BoundedStore {
+	return &BoundedStore{
+		maxBytes: maxBytes,
+		policy:   policy,
+		samples:  DefaultEvictionSamples,
+		entries:  make(map[string]*boundedEntry),
+		now:      time.Now,
+		random:   rand.Float64,
+		lock:     new(sync.Mutex),
+	}
+}
+
+// SetSamples changes how many keys are sampled to pick each key to evict.
+// More samples make eviction more accurate, and slower.
+func (b *BoundedStore) SetSamples(samples int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if samples < 1 {
+		samples = 1
+	}
+	b.samples = samples
+}
+
+// Get counts as an access to the key.
+func (b *BoundedStore) Get(key string) (value string, found bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	entry, found := b.entries[key]
+	if !found {
+		return "", false, nil
+	}
+
+	now := b.now()
+	entry.access.touch(now, b.random())
+	return entry.value, true, nil
+}
+
+func (b *BoundedStore) Set(key string, value string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.write(Write{Key: key, Value: value})
+	return nil
+}
+
+func (b *BoundedStore) Version(key string) (uint64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if entry, exists := b.entries[key]; exists {
+		return entry.version, nil
+	}
+	return 0, nil
+}
+
+func (b *BoundedStore) Apply(writes []Write, conditions []Condition) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, condition := range conditions {
+		var version uint64
+		if entry, exists := b.entries[condition.Key]; exists {
+			version = entry.version
+		}
+		if version != condition.Version {
+			return ErrConditionFailed
+		}
+	}
+
+	for _, write := range writes {
+		b.write(write)
+	}
+	return nil
+}
+
+// Scan iterates over keys in lexicographical order, the same way the
+// in-memory store does.
+func (b *BoundedStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var after string
+	if cursor != "" {
+		after = cursor[1:]
+	}
+
+	for key := range b.entries {
+		if cursor == "" || key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if count < 1 {
+		count = 1
+	}
+
+	if len(keys) > count {
+		keys = keys[:count]
+		next = ">" + keys[count-1]
+	}
+
+	return keys, next, nil
+}
+
+// write must be called with the lock held. A value which can't be made to
+// fit is not cached, and neither is the previous value of the key, which
+// would otherwise be stale.
+func (b *BoundedStore) write(write Write) {
+	var version uint64
+	if entry, exists := b.entries[write.Key]; exists {
+		version = entry.version
+		b.remove(write.Key)
+	}
+
+	if write.Delete {
+		return
+	}
+
+	size := entrySize(write.Key, write.Value)
+	if size > b.maxBytes || !b.makeRoom(size) {
+		return
+	}
+
+	now := b.now()
+	entry := &boundedEntry{value: write.Value, version: version + 1, access: keyAccess{accessed: now, counter: lfuInitValue}}
+	b.entries[write.Key] = entry
+	b.used += size
+}
+
+// makeRoom evicts keys until there are size bytes left within the budget.
+// It reports whether it succeeded.
+func (b *BoundedStore) makeRoom(size int) bool {
+	for b.used+size > b.maxBytes {
+		now := b.now()
+
+		candidates := make([]CacheEntry, 0, b.samples)
+		for key, entry := range b.entries {
+			candidates = append(candidates, CacheEntry{
+				Key:       key,
+				Size:      entrySize(key, entry.value),
+				Accessed:  entry.access.accessed,
+				Frequency: entry.access.frequency(now),
+			})
+			if len(candidates) == b.samples {
+				break
+			}
+		}
+
+		victim := b.policy.Evict(candidates)
+		if victim < 0 || victim >= len(candidates) {
+			return false
+		}
+
+		b.remove(candidates[victim].Key)
+		b.evictions++
+	}
+	return true
+}
+
+// remove must be called with the lock held.
+func (b *BoundedStore) remove(key string) {
+	if entry, exists := b.entries[key]; exists {
+		b.used -= entrySize(key, entry.value)
+		delete(b.entries, key)
+	}
+}
+
+// reportInfo adds the memory usage and eviction counter of the cache to INFO.
+func (b *BoundedStore) reportInfo(info *serverInfo) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	info.add("memory", "used_memory", b.used)
+	info.add("memory", "maxmemory", b.maxBytes)
+	info.add("memory", "maxmemory_policy", b.policy.Name())
+	info.add("stats", "evicted_keys", b.evictions)
+}
+
+func entrySize(key, value string) int {
+	return len(key) + len(value) + boundedEntryOverhead
+}
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type boundedStoreTestSuite struct {
+	suite.Suite
+
+	now time.Time
+
+	sut *BoundedStore
+}
+
+func (b *boundedStoreTestSuite) SetupTest() {
+	b.now = time.Unix(1500000000, 0)
+	b.sut = b.newStore(AllKeysLRU)
+}
+
+// newStore returns a store with room for three entries with single byte keys
+// and values, sampling all of them.
+func (b *boundedStoreTestSuite) newStore(policy EvictionPolicy) *BoundedStore {
+	ret := NewBoundedStore(3*entrySize("a", "1"), policy)
+	ret.SetSamples(10)
+	ret.now = func() time.Time { return b.now }
+	ret.random = func() float64 { return 0 }
+	return ret
+}
+
+func (b *boundedStoreTestSuite) set(keys ...string) {
+	for _, key := range keys {
+		b.now = b.now.Add(time.Second)
+		b.NoError(b.sut.Set(key, "1"))
+	}
+}
+
+func (b *boundedStoreTestSuite) get(key string) bool {
+	b.now = b.now.Add(time.Second)
+	_, found, err := b.sut.Get(key)
+	b.NoError(err)
+	return found
+}
+
+func (b *boundedStoreTestSuite) keys() []string {
+	keys, _, err := b.sut.Scan("", 10)
+	b.NoError(err)
+	return keys
+}
+
+func (b *boundedStoreTestSuite) TestRoundTrip() {
+	b.NoError(b.sut.Set("a", "1"))
+
+	value, found, err := b.sut.Get("a")
+	b.Equal("1", value)
+	b.True(found)
+	b.NoError(err)
+
+	version, err := b.sut.Version("a")
+	b.Equal(uint64(1), version)
+	b.NoError(err)
+}
+
+func (b *boundedStoreTestSuite) TestWithinBudget() {
+	b.set("a", "b", "c")
+
+	b.Equal([]string{"a", "b", "c"}, b.keys())
+	b.Equal(uint64(0), b.sut.evictions)
+	b.Equal(3*entrySize("a", "1"), b.sut.used)
+}
+
+func (b *boundedStoreTestSuite) TestOverwriteDoesNotEvict() {
+	b.set("a", "b", "c", "a")
+
+	b.Equal([]string{"a", "b", "c"}, b.keys())
+	b.Equal(uint64(0), b.sut.evictions)
+}
+
+func (b *boundedStoreTestSuite) TestLRU() {
+	b.set("a", "b", "c")
+	b.True(b.get("a"))
+
+	b.set("d")
+
+	b.Equal([]string{"a", "c", "d"}, b.keys())
+	b.Equal(uint64(1), b.sut.evictions)
+}
+
+func (b *boundedStoreTestSuite) TestLFU() {
+	b.sut = b.newStore(AllKeysLFU)
+
+	b.set("a", "b", "c")
+	b.True(b.get("c"))
+	b.True(b.get("a"))
+	b.True(b.get("a"))
+
+	b.set("d")
+
+	b.Equal([]string{"a", "c", "d"}, b.keys())
+}
+
+func (b *boundedStoreTestSuite) TestRandom() {
+	b.sut = b.newStore(AllKeysRandom)
+
+	b.set("a", "b", "c", "d", "e")
+
+	b.Len(b.keys(), 3)
+	b.Equal(uint64(2), b.sut.evictions)
+	b.True(b.get("e"))
+}
+
+func (b *boundedStoreTestSuite) TestVolatileTTL_DoesNotCache() {
+	b.sut = b.newStore(VolatileTTL)
+
+	b.set("a", "b", "c", "d")
+
+	b.Equal([]string{"a", "b", "c"}, b.keys())
+	b.Equal(uint64(0), b.sut.evictions)
+}
+
+func (b *boundedStoreTestSuite) TestValueTooLarge() {
+	b.set("a")
+	b.NoError(b.sut.Set("a", string(make([]byte, b.sut.maxBytes))))
+
+	// The previous value must not be served from the cache either.
+	b.False(b.get("a"))
+	b.Zero(b.sut.used)
+}
+
+func (b *boundedStoreTestSuite) TestDelete() {
+	b.set("a", "b")
+
+	b.NoError(b.sut.Apply([]Write{{Key: "a", Delete: true}}, nil))
+
+	b.Equal([]string{"b"}, b.keys())
+	b.Equal(entrySize("b", "1"), b.sut.used)
+}
+
+func (b *boundedStoreTestSuite) TestApply_ConditionFailed() {
+	b.set("a")
+
+	err := b.sut.Apply([]Write{{Key: "a", Value: "2"}}, []Condition{{Key: "a", Version: 0}})
+	b.Equal(ErrConditionFailed, err)
+}
+
+func (b *boundedStoreTestSuite) TestReportInfo() {
+	b.set("a", "b", "c", "d")
+
+	info := newServerInfo()
+	b.sut.reportInfo(info)
+
+	b.Equal(
+		"# Memory\r\n"+
+			"used_memory:198\r\n"+
+			"maxmemory:198\r\n"+
+			"maxmemory_policy:allkeys-lru\r\n"+
+			"\r\n"+
+			"# Stats\r\n"+
+			"evicted_keys:1\r\n",
+		info.render(infoSections),
+	)
+}
+
+func (b *boundedStoreTestSuite) TestEvictionPolicyByName() {
+	for _, name := range []string{"allkeys-lru", "allkeys-lfu", "volatile-ttl", "allkeys-random"} {
+		policy, found := EvictionPolicyByName(name)
+		b.True(found)
+		b.Equal(name, policy.Name())
+	}
+
+	_, found := EvictionPolicyByName("noeviction")
+	b.False(found)
+}
+
+func TestBoundedStore(t *testing.T) {
+	suite.Run(t, new(boundedStoreTestSuite))
+}
@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cachedAtSize is the size of the timestamp prepended to values cached under
+// a CachePolicy.
+const cachedAtSize = 8
+
+// CachePolicy controls how long a CachingStore serves values from its cache
+// before reading them from the authority again.
+type CachePolicy struct {
+	// MaxAge is how long a value is served from the cache as it is. Zero
+	// means values never go stale.
+	MaxAge time.Duration
+
+	// StaleWhileRevalidate is how long past MaxAge a stale value is still
+	// served, while it's read again from the authority in the background.
+	StaleWhileRevalidate time.Duration
+
+	// RefreshAhead is the fraction of MaxAge after which a value is read
+	// again in the background when it's served, so that values which keep
+	// being read never go stale. Zero disables refreshing ahead.
+	RefreshAhead float64
+}
+
+type cacheFreshness int
+
+const (
+	cacheFresh cacheFreshness = iota
+	cacheRevalidate
+	cacheExpired
+)
+
+// freshness tells whether a value cached for age can be served, and whether
+// it should be read again in the background.
+func (p CachePolicy) freshness(age time.Duration) cacheFreshness {
+	switch {
+	case p.MaxAge <= 0:
+		return cacheFresh
+	case age < p.MaxAge:
+		if p.RefreshAhead > 0 && age >= time.Duration(float64(p.MaxAge)*p.RefreshAhead) {
+			return cacheRevalidate
+		}
+		return cacheFresh
+	case age < p.MaxAge+p.StaleWhileRevalidate:
+		return cacheRevalidate
+	}
+	return cacheExpired
+}
+
+// ParseCachePolicies parses policies by key prefix, separated by semicolons.
+// Each one is a prefix followed by directives separated by commas, modelled
+// after HTTP Cache-Control, with durations as understood by time.Duration:
+//
+//	config: max-age=1h, stale-while-revalidate=5m; session: max-age=10s, refresh-ahead=0.8
+//
+// The prefix * applies to all keys.
+func ParseCachePolicies(spec string) (map[string]CachePolicy, error) {
+	ret := make(map[string]CachePolicy)
+
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		fields := strings.SplitN(entry, " ", 2)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("no directives for cache policy %q", entry)
+		}
+
+		prefix := fields[0]
+		if prefix == "*" {
+			prefix = ""
+		}
+
+		var policy CachePolicy
+		for _, directive := range strings.Split(fields[1], ",") {
+			if err := policy.parseDirective(strings.TrimSpace(directive)); err != nil {
+				return nil, errors.Wrapf(err, "invalid cache policy for %q", fields[0])
+			}
+		}
+
+		ret[prefix] = policy
+	}
+
+	return ret, nil
+}
+
+func (p *CachePolicy) parseDirective(directive string) error {
+	parts := strings.SplitN(directive, "=", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("malformed directive %q", directive)
+	}
+
+	var err error
+	switch name, value := parts[0], parts[1]; name {
+	case "max-age":
+		p.MaxAge, err = time.ParseDuration(value)
+	case "stale-while-revalidate":
+		p.StaleWhileRevalidate, err = time.ParseDuration(value)
+	case "refresh-ahead":
+		if p.RefreshAhead, err = strconv.ParseFloat(value, 64); err == nil && (p.RefreshAhead <= 0 || p.RefreshAhead >= 1) {
+			err = errors.New("refresh-ahead must be between 0 and 1")
+		}
+	default:
+		err = errors.Errorf("unknown directive %q", name)
+	}
+	return err
+}
+
+// encodeCached prepends the time a value was cached at to the value.
+func encodeCached(at time.Time, value string) string {
+	var ret [cachedAtSize]byte
+	binary.BigEndian.PutUint64(ret[:], uint64(at.UnixNano()))
+	return string(ret[:]) + value
+}
+
+// decodeCached returns the time a value was cached at, along with the value.
+// It reports whether the payload could be decoded.
+func decodeCached(payload string) (at time.Time, value string, ok bool) {
+	if len(payload) < cachedAtSize {
+		return time.Time{}, "", false
+	}
+
+	nanos := binary.BigEndian.Uint64([]byte(payload[:cachedAtSize]))
+	return time.Unix(0, int64(nanos)), payload[cachedAtSize:], true
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type cachePolicyTestSuite struct {
+	suite.Suite
+}
+
+func (c *cachePolicyTestSuite) TestFreshness() {
+	policy := CachePolicy{MaxAge: 10 * time.Second, StaleWhileRevalidate: 5 * time.Second, RefreshAhead: 0.8}
+
+	c.Equal(cacheFresh, policy.freshness(0))
+	c.Equal(cacheFresh, policy.freshness(7*time.Second))
+	c.Equal(cacheRevalidate, policy.freshness(8*time.Second))
+	c.Equal(cacheRevalidate, policy.freshness(14*time.Second))
+	c.Equal(cacheExpired, policy.freshness(15*time.Second))
+}
+
+func (c *cachePolicyTestSuite) TestFreshness_MaxAgeOnly() {
+	policy := CachePolicy{MaxAge: 10 * time.Second}
+
+	c.Equal(cacheFresh, policy.freshness(9*time.Second))
+	c.Equal(cacheExpired, policy.freshness(10*time.Second))
+}
+
+func (c *cachePolicyTestSuite) TestFreshness_NoMaxAge() {
+	c.Equal(cacheFresh, CachePolicy{}.freshness(time.Hour))
+}
+
+func (c *cachePolicyTestSuite) TestParse() {
+	policies, err := ParseCachePolicies("config: max-age=1h, stale-while-revalidate=5m; session: max-age=10s,refresh-ahead=0.8; * max-age=1m;")
+
+	c.NoError(err)
+	c.Equal(map[string]CachePolicy{
+		"config:":  {MaxAge: time.Hour, StaleWhileRevalidate: 5 * time.Minute},
+		"session:": {MaxAge: 10 * time.Second, RefreshAhead: 0.8},
+		"":         {MaxAge: time.Minute},
+	}, policies)
+}
+
+func (c *cachePolicyTestSuite) TestParse_Empty() {
+	policies, err := ParseCachePolicies("")
+
+	c.NoError(err)
+	c.Empty(policies)
+}
+
+func (c *cachePolicyTestSuite) TestParse_Invalid() {
+	for spec, message := range map[string]string{
+		"config:":                         `no directives for cache policy "config:"`,
+		"config: max-age":                 `invalid cache policy for "config:": malformed directive "max-age"`,
+		"config: max-age=forever":         `invalid cache policy for "config:": time: invalid duration "forever"`,
+		"config: refresh-ahead=1":         `invalid cache policy for "config:": refresh-ahead must be between 0 and 1`,
+		"config: must-revalidate=1s":      `invalid cache policy for "config:": unknown directive "must-revalidate"`,
+		"* stale-while-revalidate=sooner": `invalid cache policy for "*": time: invalid duration "sooner"`,
+	} {
+		_, err := ParseCachePolicies(spec)
+		c.EqualError(err, message, spec)
+	}
+}
+
+func (c *cachePolicyTestSuite) TestEncodeCached() {
+	at := time.Unix(1500000000, 123)
+
+	cachedAt, value, ok := decodeCached(encodeCached(at, "tasty"))
+
+	c.True(ok)
+	c.True(at.Equal(cachedAt))
+	c.Equal("tasty", value)
+}
+
+func (c *cachePolicyTestSuite) TestDecodeCached_Malformed() {
+	_, _, ok := decodeCached("tasty")
+	c.False(ok)
+}
+
+func TestCachePolicy(t *testing.T) {
+	suite.Run(t, new(cachePolicyTestSuite))
+}
@@ -1,6 +1,12 @@
 package lib
 
-import "github.com/pkg/errors"
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 // CachingStore is a Store with two layers - one being a more expensive, slower
 // to access authoritative source of data, and the other being a local cache.
@@ -8,55 +14,317 @@ type CachingStore struct {
 	Authority Store
 	Cache     Store
 
-	KnownMissing map[string]struct{}
+	KnownMissing *NegativeCache
+
+	// Policies control how long values are served from the cache, by key
+	// prefix, with the longest matching prefix winning. Prefixes match keys
+	// as stored, so keys of databases other than 0 start with the namespace
+	// of their database. Values of keys matching no prefix are served until
+	// evicted or invalidated.
+	//
+	// Values are cached along with the time they were cached at when there's
+	// a policy for them, so policies must be set before the store is used.
+	Policies map[string]CachePolicy
+
+	// WriteBehind, if set, makes writes without conditions return as soon as
+	// they're cached and logged locally, leaving them to be flushed to the
+	// authority by RunWriteBehind. Anything else which relies on the
+	// authority - versions, conditional writes and scans - flushes pending
+	// writes first.
+	//
+	// Unless WriteBehind is set, writes are rejected while the authority is
+	// a CircuitBreaker which is open. Reads are served from the cache then,
+	// even if their policy says the cached value has expired.
+	WriteBehind *WriteBehind
+
+	now   func() time.Time
+	reads *readCoalescer
 }
 
 // NewCachingStore returns a fully functional implementation of Store, using two
-// stores.
+// stores, and remembering missing keys with the default limits.
 func NewCachingStore(authority, cache Store) *CachingStore {
 	return &CachingStore{
 		Authority:    authority,
 		Cache:        cache,
-		KnownMissing: make(map[string]struct{}),
+		KnownMissing: NewNegativeCache(DefaultNegativeCacheSize, DefaultNegativeCacheTTL),
+		now:          time.Now,
+		reads:        newReadCoalescer(),
 	}
 }
 
 // Get is a layered implementation of the Store's Get method.
 func (l *CachingStore) Get(key string) (value string, found bool, err error) {
-	if _, missing := l.KnownMissing[key]; missing {
-		return
+	return l.GetContext(context.Background(), key)
+}
+
+// GetContext is Get which gives up once the context is done. Concurrent
+// cache misses for the same key are served by a single authority read,
+// which is only cancelled once all of them have given up. Consistent reads
+// bypass the cache, since it may not have caught up with writes made through
+// other nodes, and are not shared, since a read in flight may have started
+// before them.
+func (l *CachingStore) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	if l.WriteBehind != nil {
+		if write, pending := l.WriteBehind.lookup(key); pending {
+			return write.Value, !write.Delete, nil
+		}
 	}
 
-	if value, found, err = l.Cache.Get(key); found || err != nil {
-		err = errors.Wrap(err, "could not retrieve value from cache")
-		return
+	if consistentRead(ctx) {
+		value, found, err = getContext(ctx, l.Authority, key)
+		return value, found, errors.Wrap(err, "could not retrieve value from authority")
 	}
 
-	if value, found, err = l.Authority.Get(key); err != nil {
-		err = errors.Wrap(err, "could not retrieve value from authority")
+	if l.KnownMissing.Contains(key) {
 		return
 	}
 
+	generation := l.KnownMissing.Generation(key)
+
+	cached, found, err := l.Cache.Get(key)
+	if err != nil {
+		return "", false, errors.Wrap(err, "could not retrieve value from cache")
+	}
+
+	policy, limited := l.policy(key)
+	if found && !limited {
+		return cached, true, nil
+	}
+
+	var stale string
+	var expired bool
 	if found {
-		err = l.cache(key, value)
-	} else {
-		l.KnownMissing[key] = struct{}{}
+		if cachedAt, value, ok := decodeCached(cached); ok {
+			switch policy.freshness(l.now().Sub(cachedAt)) {
+			case cacheFresh:
+				return value, true, nil
+			case cacheRevalidate:
+				// Errors reading the value again go unnoticed until it
+				// expires and has to be read in the foreground.
+				l.reads.refresh(key, l.fetch(key), l.keep(key, generation))
+				return value, true, nil
+			}
+			stale, expired = value, true
+		}
 	}
 
-	return
+	result := l.reads.read(ctx, key, l.fetch(key), l.keep(key, generation))
+	if expired && errors.Cause(result.err) == ErrCircuitOpen {
+		return stale, true, nil
+	}
+	return result.value, result.found, result.err
+}
+
+func (l *CachingStore) fetch(key string) func(ctx context.Context) readResult {
+	return func(ctx context.Context) (ret readResult) {
+		ret.value, ret.found, ret.err = getContext(ctx, l.Authority, key)
+		ret.err = errors.Wrap(ret.err, "could not retrieve value from authority")
+		return
+	}
 }
 
-// Set is a layered implementation of the Store's Set method.
+// keep caches what's been read from the authority. Values cached under a
+// policy may have expired in the meantime, so they're deleted if the key is
+// missing.
+func (l *CachingStore) keep(key string, generation uint64) func(readResult) readResult {
+	return func(ret readResult) readResult {
+		if ret.err != nil {
+			return ret
+		} else if ret.found {
+			ret.err = l.cache(key, ret.value)
+			return ret
+		}
+
+		l.KnownMissing.Add(key, generation)
+		if _, limited := l.policy(key); limited {
+			err := l.Cache.Apply([]Write{{Key: key, Delete: true}}, nil)
+			ret.err = errors.Wrap(err, "could not delete value from cache")
+		}
+		return ret
+	}
+}
+
+// Set is a layered implementation of the Store's Set method. The key is no
+// longer known missing once it's written to the authority, and reads of it in
+// flight are not cached, since they may have missed the write.
 func (l *CachingStore) Set(key string, value string) error {
-	delete(l.KnownMissing, key)
+	if l.writesBehind() {
+		return l.writeBehind([]Write{{Key: key, Value: value}})
+	}
 
-	if err := l.Authority.Set(key, value); err != nil {
+	err := l.Authority.Set(key, value)
+	if l.queuesWhenUnavailable(err) {
+		return l.writeBehind([]Write{{Key: key, Value: value}})
+	}
+	l.KnownMissing.Remove(key)
+	l.reads.invalidate(key)
+
+	if err != nil {
 		return errors.Wrap(err, "could not set value in authority")
 	}
 
 	return l.cache(key, value)
 }
 
+// Version is a layered implementation of the Store's Version method. Versions
+// always come from the authority, since other writers may share it.
+func (l *CachingStore) Version(key string) (uint64, error) {
+	if err := l.Flush(); err != nil {
+		return 0, errors.Wrap(err, "could not flush pending writes")
+	}
+
+	version, err := l.Authority.Version(key)
+	return version, errors.Wrap(err, "could not retrieve version from authority")
+}
+
+// Apply is a layered implementation of the Store's Apply method. Writes are
+// applied atomically to the authority, and then to the cache. Conditions are
+// only checked by the authority. Deleted keys are marked missing unless any
+// key was written in the meantime, and then written keys are no longer known
+// missing, as in Set.
+func (l *CachingStore) Apply(writes []Write, conditions []Condition) error {
+	if l.writesBehind() && len(conditions) == 0 {
+		return l.writeBehind(writes)
+	} else if err := l.Flush(); err != nil {
+		return errors.Wrap(err, "could not flush pending writes")
+	}
+
+	generations := make([]uint64, len(writes))
+	for i, write := range writes {
+		generations[i] = l.KnownMissing.Generation(write.Key)
+	}
+
+	err := l.Authority.Apply(writes, conditions)
+	if len(conditions) == 0 && l.queuesWhenUnavailable(err) {
+		return l.writeBehind(writes)
+	}
+
+	for i, write := range writes {
+		if write.Delete && err == nil {
+			l.KnownMissing.Add(write.Key, generations[i])
+		}
+	}
+	for _, write := range writes {
+		if !write.Delete {
+			l.KnownMissing.Remove(write.Key)
+		}
+		l.reads.invalidate(write.Key)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "could not apply writes to authority")
+	}
+
+	return l.applyToCache(writes)
+}
+
+// Scan is a layered implementation of the Store's Scan method. Only the
+// authority knows all the keys, so the cache is not involved.
+func (l *CachingStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	if err := l.Flush(); err != nil {
+		return nil, "", errors.Wrap(err, "could not flush pending writes")
+	}
+
+	keys, next, err = l.Authority.Scan(cursor, count)
+	err = errors.Wrap(err, "could not scan authority")
+	return
+}
+
+// Invalidate drops the key from the cache, along with the knowledge that it's
+// missing, as when it's been written through another node sharing the
+// authority. Reads of the key in flight are not cached either.
+func (l *CachingStore) Invalidate(key string) error {
+	l.reads.invalidate(key)
+	l.KnownMissing.Remove(key)
+
+	err := l.Cache.Apply([]Write{{Key: key, Delete: true}}, nil)
+	return errors.Wrap(err, "could not delete value from cache")
+}
+
+// InvalidateAll drops everything the CachingStore knows, as when writes made
+// through other nodes may have been missed.
+func (l *CachingStore) InvalidateAll() error {
+	l.reads.invalidateAll()
+	l.KnownMissing.Clear()
+
+	var cursor string
+	for {
+		keys, next, err := l.Cache.Scan(cursor, keyspacePageSize)
+		if err != nil {
+			return errors.Wrap(err, "could not scan cache")
+		}
+
+		writes := make([]Write, 0, len(keys))
+		for _, key := range keys {
+			writes = append(writes, Write{Key: key, Delete: true})
+		}
+
+		if err := l.Cache.Apply(writes, nil); err != nil {
+			return errors.Wrap(err, "could not delete values from cache")
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// writesBehind tells whether writes without conditions go to WriteBehind
+// first. Writes only written behind while the authority is unavailable keep
+// going there until the ones already pending are flushed, so that they reach
+// the authority in order.
+func (l *CachingStore) writesBehind() bool {
+	return l.WriteBehind != nil && (!l.WriteBehind.WhenUnavailable || l.WriteBehind.Len() > 0)
+}
+
+// queuesWhenUnavailable tells whether a write the authority failed because
+// its circuit breaker is open can be written behind instead.
+func (l *CachingStore) queuesWhenUnavailable(err error) bool {
+	return l.WriteBehind != nil && errors.Cause(err) == ErrCircuitOpen
+}
+
 func (l *CachingStore) cache(key string, value string) error {
+	if _, limited := l.policy(key); limited {
+		value = encodeCached(l.now(), value)
+	}
 	return errors.Wrap(l.Cache.Set(key, value), "could not set value in cache")
 }
+
+func (l *CachingStore) applyToCache(writes []Write) error {
+	cached := make([]Write, 0, len(writes))
+	for _, write := range writes {
+		if _, limited := l.policy(write.Key); limited && !write.Delete {
+			write.Value = encodeCached(l.now(), write.Value)
+		}
+		cached = append(cached, write)
+	}
+
+	return errors.Wrap(l.Cache.Apply(cached, nil), "could not apply writes to cache")
+}
+
+// policy returns the policy for the key, if there's one.
+func (l *CachingStore) policy(key string) (policy CachePolicy, found bool) {
+	var longest string
+	for prefix, candidate := range l.Policies {
+		if strings.HasPrefix(key, prefix) && (!found || len(prefix) > len(longest)) {
+			policy, longest, found = candidate, prefix, true
+		}
+	}
+	return
+}
+
+// reportInfo passes INFO on to whichever layers have something to report.
+func (l *CachingStore) reportInfo(info *serverInfo) {
+	if l.WriteBehind != nil {
+		info.add("persistence", "write_behind_pending_writes", l.WriteBehind.Len())
+		info.add("persistence", "write_behind_set_aside_writes", l.WriteBehind.SetAside())
+	}
+
+	for _, layer := range []Store{l.Authority, l.Cache} {
+		if reporter, ok := layer.(infoReporter); ok {
+			reporter.reportInfo(info)
+		}
+	}
+}
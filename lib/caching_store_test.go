@@ -1,9 +1,14 @@
 package lib
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -22,10 +27,14 @@ func (c *cachingStoreTestSuite) SetupTest() {
 	c.sut = NewCachingStore(c.authority, c.cache)
 }
 
+func (c *cachingStoreTestSuite) markMissing(key string) {
+	c.Require().True(c.sut.KnownMissing.Add(key, c.sut.KnownMissing.Generation(key)))
+}
+
 func (c *cachingStoreTestSuite) TestGet_KnownMissing() {
 	const key = "key"
 
-	c.sut.KnownMissing[key] = struct{}{}
+	c.markMissing(key)
 
 	ret, found, err := c.sut.Get(key)
 
@@ -46,7 +55,7 @@ func (c *cachingStoreTestSuite) TestGet_FoundInCache() {
 	c.True(found)
 	c.NoError(err)
 
-	c.Empty(c.sut.KnownMissing)
+	c.Zero(c.sut.KnownMissing.Len())
 }
 
 func (c *cachingStoreTestSuite) TestGet_ErrorQueryingCache() {
@@ -60,7 +69,7 @@ func (c *cachingStoreTestSuite) TestGet_ErrorQueryingCache() {
 	c.False(found)
 	c.EqualError(err, "could not retrieve value from cache: bacon")
 
-	c.Empty(c.sut.KnownMissing)
+	c.Zero(c.sut.KnownMissing.Len())
 }
 
 func (c *cachingStoreTestSuite) TestGet_ErrorQueryingAuthority() {
@@ -75,7 +84,7 @@ func (c *cachingStoreTestSuite) TestGet_ErrorQueryingAuthority() {
 	c.False(found)
 	c.EqualError(err, "could not retrieve value from authority: bacon")
 
-	c.Empty(c.sut.KnownMissing)
+	c.Zero(c.sut.KnownMissing.Len())
 }
 
 func (c *cachingStoreTestSuite) TestGet_NotFoundInAuthority() {
@@ -90,7 +99,130 @@ func (c *cachingStoreTestSuite) TestGet_NotFoundInAuthority() {
 	c.False(found)
 	c.NoError(err)
 
-	c.NotEmpty(c.sut.KnownMissing)
+	c.True(c.sut.KnownMissing.Contains(key))
+}
+
+func (c *cachingStoreTestSuite) TestGet_NotFoundWhileWritten() {
+	const key = "key"
+
+	c.cache.On("Get", key).Return("", false, nil)
+	c.authority.On("Get", key).Return("", false, nil).Run(func(mock.Arguments) {
+		// A concurrent Set gets to the key before the lookup is done.
+		c.sut.KnownMissing.Remove(key)
+	})
+
+	_, found, err := c.sut.Get(key)
+
+	c.False(found)
+	c.NoError(err)
+	c.False(c.sut.KnownMissing.Contains(key))
+}
+
+func (c *cachingStoreTestSuite) TestGet_NotFoundWhileOthersWritten() {
+	const key = "key"
+
+	c.cache.On("Get", key).Return("", false, nil)
+	c.authority.On("Get", key).Return("", false, nil).Run(func(mock.Arguments) {
+		// Concurrent Sets get to other keys before the lookup is done.
+		for i := 0; i < 100; i++ {
+			if other := fmt.Sprintf("other%d", i); negativeCacheBucket(other) != negativeCacheBucket(key) {
+				c.sut.KnownMissing.Remove(other)
+			}
+		}
+	})
+
+	_, found, err := c.sut.Get(key)
+
+	c.False(found)
+	c.NoError(err)
+	c.True(c.sut.KnownMissing.Contains(key))
+}
+
+func (c *cachingStoreTestSuite) TestGet_CoalescesAuthorityReads() {
+	const key = "key"
+	const value = "value"
+
+	release := make(chan struct{})
+
+	c.cache.
+		On("Get", key).Return("", false, nil).
+		On("Set", key, value).Return(nil).Once()
+
+	c.authority.On("Get", key).Return(value, true, nil).Once().Run(func(mock.Arguments) {
+		<-release
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ret, found, err := c.sut.Get(key)
+			c.Equal(value, ret)
+			c.True(found)
+			c.NoError(err)
+		}()
+	}
+
+	c.Require().True(c.waitForWaiters(key, 10))
+	close(release)
+	wg.Wait()
+
+	c.authority.AssertNumberOfCalls(c.T(), "Get", 1)
+	c.cache.AssertNumberOfCalls(c.T(), "Set", 1)
+}
+
+func (c *cachingStoreTestSuite) TestGetContext_GiveUp() {
+	const key = "key"
+
+	release := make(chan struct{})
+	defer close(release)
+
+	c.cache.On("Get", key).Return("", false, nil)
+	c.authority.On("Get", key).Return("", false, nil).Run(func(mock.Arguments) {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, found, err := c.sut.GetContext(ctx, key)
+
+	c.False(found)
+	c.Equal(context.DeadlineExceeded, err)
+}
+
+func (c *cachingStoreTestSuite) TestGetContext_ConsistentRead() {
+	const key = "key"
+
+	c.markMissing(key)
+	c.authority.On("Get", key).Return("value", true, nil)
+
+	ret, found, err := c.sut.GetContext(WithConsistentRead(context.Background()), key)
+
+	c.Equal("value", ret)
+	c.True(found)
+	c.NoError(err)
+
+	c.cache.AssertNotCalled(c.T(), "Get", key)
+	c.cache.AssertNotCalled(c.T(), "Set", key, "value")
+}
+
+// waitForWaiters reports whether the authority read of the key got the given
+// number of callers waiting for it in time.
+func (c *cachingStoreTestSuite) waitForWaiters(key string, waiters int) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.sut.reads.lock.Lock()
+		read, exists := c.sut.reads.reads[key]
+		done := exists && read.waiters == waiters
+		c.sut.reads.lock.Unlock()
+
+		if done {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *cachingStoreTestSuite) TestGet_FoundInAuthority() {
@@ -109,7 +241,7 @@ func (c *cachingStoreTestSuite) TestGet_FoundInAuthority() {
 	c.True(found)
 	c.NoError(err)
 
-	c.Empty(c.sut.KnownMissing)
+	c.Zero(c.sut.KnownMissing.Len())
 }
 
 func (c *cachingStoreTestSuite) TestGet_ErrorSettingCache() {
@@ -133,13 +265,13 @@ func (c *cachingStoreTestSuite) TestSet_OK() {
 	const key = "key"
 	const value = "value"
 
-	c.sut.KnownMissing[key] = struct{}{}
+	c.markMissing(key)
 
 	c.authority.On("Set", key, value).Return(nil)
 	c.cache.On("Set", key, value).Return(nil)
 
 	c.NoError(c.sut.Set(key, value))
-	c.Empty(c.sut.KnownMissing)
+	c.Zero(c.sut.KnownMissing.Len())
 }
 
 func (c *cachingStoreTestSuite) TestSet_AuthorityError() {
@@ -161,6 +293,368 @@ func (c *cachingStoreTestSuite) TestSet_CacheError() {
 	c.EqualError(c.sut.Set(key, value), "could not set value in cache: bacon")
 }
 
+func (c *cachingStoreTestSuite) TestVersion_OK() {
+	c.authority.On("Version", "key").Return(uint64(3), nil)
+
+	version, err := c.sut.Version("key")
+
+	c.Equal(uint64(3), version)
+	c.NoError(err)
+}
+
+func (c *cachingStoreTestSuite) TestVersion_AuthorityError() {
+	c.authority.On("Version", "key").Return(uint64(0), errors.New("bacon"))
+
+	_, err := c.sut.Version("key")
+
+	c.EqualError(err, "could not retrieve version from authority: bacon")
+}
+
+func (c *cachingStoreTestSuite) TestApply_OK() {
+	writes := []Write{{Key: "key", Value: "value"}}
+	conditions := []Condition{{Key: "key", Version: 1}}
+
+	c.markMissing("key")
+
+	c.authority.On("Apply", writes, conditions).Return(nil)
+	c.cache.On("Apply", writes, []Condition(nil)).Return(nil)
+
+	c.NoError(c.sut.Apply(writes, conditions))
+	c.Zero(c.sut.KnownMissing.Len())
+}
+
+func (c *cachingStoreTestSuite) TestApply_Delete() {
+	writes := []Write{{Key: "bacon", Delete: true}, {Key: "cabbage", Value: "tasty"}}
+
+	c.markMissing("cabbage")
+
+	c.authority.On("Apply", writes, []Condition(nil)).Return(nil)
+	c.cache.On("Apply", writes, []Condition(nil)).Return(nil)
+
+	c.NoError(c.sut.Apply(writes, nil))
+	c.True(c.sut.KnownMissing.Contains("bacon"))
+	c.False(c.sut.KnownMissing.Contains("cabbage"))
+}
+
+func (c *cachingStoreTestSuite) TestApply_AuthorityError() {
+	writes := []Write{{Key: "key", Value: "value"}}
+
+	c.authority.On("Apply", writes, []Condition(nil)).Return(errors.New("bacon"))
+
+	c.EqualError(c.sut.Apply(writes, nil), "could not apply writes to authority: bacon")
+}
+
+func (c *cachingStoreTestSuite) TestApply_CacheError() {
+	writes := []Write{{Key: "key", Value: "value"}}
+
+	c.authority.On("Apply", writes, []Condition(nil)).Return(nil)
+	c.cache.On("Apply", writes, []Condition(nil)).Return(errors.New("bacon"))
+
+	c.EqualError(c.sut.Apply(writes, nil), "could not apply writes to cache: bacon")
+}
+
+func (c *cachingStoreTestSuite) TestScan_OK() {
+	c.authority.On("Scan", "cursor", 10).Return([]string{"bacon"}, "next", nil)
+
+	keys, next, err := c.sut.Scan("cursor", 10)
+
+	c.Equal([]string{"bacon"}, keys)
+	c.Equal("next", next)
+	c.NoError(err)
+	c.cache.AssertNotCalled(c.T(), "Scan", mock.Anything, mock.Anything)
+}
+
+func (c *cachingStoreTestSuite) TestScan_AuthorityError() {
+	c.authority.On("Scan", "", 10).Return([]string(nil), "", errors.New("bacon"))
+
+	_, _, err := c.sut.Scan("", 10)
+
+	c.EqualError(err, "could not scan authority: bacon")
+}
+
+func (c *cachingStoreTestSuite) TestInvalidate() {
+	c.markMissing("key")
+	c.cache.On("Apply", []Write{{Key: "key", Delete: true}}, []Condition(nil)).Return(nil)
+
+	c.NoError(c.sut.Invalidate("key"))
+	c.False(c.sut.KnownMissing.Contains("key"))
+}
+
+func (c *cachingStoreTestSuite) TestInvalidate_ReadInFlight() {
+	const key = "key"
+
+	release := make(chan struct{})
+
+	c.cache.
+		On("Get", key).Return("", false, nil).
+		On("Apply", []Write{{Key: key, Delete: true}}, []Condition(nil)).Return(nil)
+	c.authority.On("Get", key).Return("stale", true, nil).Run(func(mock.Arguments) {
+		<-release
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ret, _, err := c.sut.Get(key)
+		c.Equal("stale", ret)
+		c.NoError(err)
+	}()
+
+	c.Require().True(c.waitForWaiters(key, 1))
+	c.NoError(c.sut.Invalidate(key))
+	close(release)
+	<-done
+
+	// The value read before the key was invalidated is not cached.
+	c.cache.AssertNotCalled(c.T(), "Set", key, "stale")
+}
+
+func (c *cachingStoreTestSuite) TestInvalidateAll() {
+	cache := NewInMemoryStore()
+	c.sut.Cache = cache
+
+	for i := 0; i < keyspacePageSize+1; i++ {
+		c.NoError(cache.Set(fmt.Sprintf("key%d", i), "value"))
+	}
+	c.markMissing("missing")
+
+	c.NoError(c.sut.InvalidateAll())
+
+	keys, _, err := cache.Scan("", 10)
+	c.Empty(keys)
+	c.NoError(err)
+	c.Zero(c.sut.KnownMissing.Len())
+}
+
+func (c *cachingStoreTestSuite) TestInvalidateAll_ScanError() {
+	c.cache.On("Scan", "", keyspacePageSize).Return([]string(nil), "", errors.New("bacon"))
+
+	c.EqualError(c.sut.InvalidateAll(), "could not scan cache: bacon")
+}
+
+// cachingStorePolicyTestSuite uses in-memory stores, since policies are all
+// about what ends up served from the cache over time.
+type cachingStorePolicyTestSuite struct {
+	suite.Suite
+
+	authority Store
+	now       time.Time
+	lock      *sync.Mutex
+
+	sut *CachingStore
+}
+
+func (c *cachingStorePolicyTestSuite) SetupTest() {
+	c.authority = NewInMemoryStore()
+	c.now = time.Unix(1500000000, 0)
+	c.lock = new(sync.Mutex)
+
+	c.sut = NewCachingStore(c.authority, NewInMemoryStore())
+	c.sut.now = func() time.Time {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.now
+	}
+	c.sut.Policies = map[string]CachePolicy{
+		"config:": {MaxAge: 10 * time.Second},
+		"hot:":    {MaxAge: 10 * time.Second, RefreshAhead: 0.5},
+		"stale:":  {MaxAge: 10 * time.Second, StaleWhileRevalidate: 10 * time.Second},
+		"stale:x": {MaxAge: time.Minute},
+	}
+}
+
+func (c *cachingStorePolicyTestSuite) advance(by time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(by)
+}
+
+func (c *cachingStorePolicyTestSuite) get(key string) string {
+	value, _, err := c.sut.Get(key)
+	c.Require().NoError(err)
+	return value
+}
+
+// cachedValue returns what's in the cache for the key, without the time it
+// was cached at.
+func (c *cachingStorePolicyTestSuite) cachedValue(key string) string {
+	payload, found, err := c.sut.Cache.Get(key)
+	c.Require().NoError(err)
+	if !found {
+		return ""
+	}
+
+	_, value, ok := decodeCached(payload)
+	c.Require().True(ok)
+	return value
+}
+
+// eventuallyCached waits for a background refresh to cache the value.
+func (c *cachingStorePolicyTestSuite) eventuallyCached(key, value string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if c.cachedValue(key) == value {
+			return
+		}
+	}
+	c.FailNow("value not refreshed in time")
+}
+
+func (c *cachingStorePolicyTestSuite) TestNoPolicy() {
+	c.NoError(c.sut.Set("other", "tasty"))
+
+	value, _, err := c.sut.Cache.Get("other")
+	c.Equal("tasty", value)
+	c.NoError(err)
+}
+
+func (c *cachingStorePolicyTestSuite) TestMaxAge() {
+	c.NoError(c.sut.Set("config:bacon", "stale"))
+	c.NoError(c.authority.Set("config:bacon", "fresh"))
+
+	c.advance(9 * time.Second)
+	c.Equal("stale", c.get("config:bacon"))
+
+	c.advance(time.Second)
+	c.Equal("fresh", c.get("config:bacon"))
+	c.Equal("fresh", c.cachedValue("config:bacon"))
+}
+
+func (c *cachingStorePolicyTestSuite) TestMaxAge_DeletedInAuthority() {
+	c.NoError(c.sut.Set("config:bacon", "stale"))
+	c.NoError(c.authority.Apply([]Write{{Key: "config:bacon", Delete: true}}, nil))
+
+	c.advance(10 * time.Second)
+
+	_, found, err := c.sut.Get("config:bacon")
+	c.False(found)
+	c.NoError(err)
+
+	_, cached, _ := c.sut.Cache.Get("config:bacon")
+	c.False(cached)
+}
+
+func (c *cachingStorePolicyTestSuite) TestStaleWhileRevalidate() {
+	c.NoError(c.sut.Set("stale:bacon", "stale"))
+	c.NoError(c.authority.Set("stale:bacon", "fresh"))
+
+	c.advance(15 * time.Second)
+	c.Equal("stale", c.get("stale:bacon"))
+	c.eventuallyCached("stale:bacon", "fresh")
+	c.Equal("fresh", c.get("stale:bacon"))
+}
+
+func (c *cachingStorePolicyTestSuite) TestStaleWhileRevalidate_Expired() {
+	c.NoError(c.sut.Set("stale:bacon", "stale"))
+	c.NoError(c.authority.Set("stale:bacon", "fresh"))
+
+	c.advance(20 * time.Second)
+	c.Equal("fresh", c.get("stale:bacon"))
+}
+
+func (c *cachingStorePolicyTestSuite) TestRefreshAhead() {
+	c.NoError(c.sut.Set("hot:bacon", "stale"))
+	c.NoError(c.authority.Set("hot:bacon", "fresh"))
+
+	c.advance(4 * time.Second)
+	c.Equal("stale", c.get("hot:bacon"))
+	c.Equal("stale", c.cachedValue("hot:bacon"))
+
+	c.advance(time.Second)
+	c.Equal("stale", c.get("hot:bacon"))
+	c.eventuallyCached("hot:bacon", "fresh")
+}
+
+func (c *cachingStorePolicyTestSuite) TestLongestPrefix() {
+	c.NoError(c.sut.Set("stale:xylophone", "stale"))
+	c.NoError(c.authority.Set("stale:xylophone", "fresh"))
+
+	c.advance(30 * time.Second)
+	c.Equal("stale", c.get("stale:xylophone"))
+}
+
+func (c *cachingStorePolicyTestSuite) TestApply() {
+	c.NoError(c.sut.Apply([]Write{{Key: "config:bacon", Value: "stale"}, {Key: "other", Value: "tasty"}}, nil))
+	c.NoError(c.authority.Set("config:bacon", "fresh"))
+
+	c.advance(10 * time.Second)
+	c.Equal("fresh", c.get("config:bacon"))
+	c.Equal("tasty", c.get("other"))
+}
+
+// cachingStoreUnavailableTestSuite has an authority behind an open circuit
+// breaker.
+type cachingStoreUnavailableTestSuite struct {
+	suite.Suite
+
+	authority Store
+	breaker   *CircuitBreaker
+	now       time.Time
+
+	sut *CachingStore
+}
+
+func (c *cachingStoreUnavailableTestSuite) SetupTest() {
+	c.authority = NewInMemoryStore()
+	c.now = time.Unix(1500000000, 0)
+
+	c.breaker = NewCircuitBreaker(c.authority)
+	c.breaker.now = func() time.Time { return c.now }
+
+	c.sut = NewCachingStore(c.breaker, NewInMemoryStore())
+	c.sut.now = c.breaker.now
+	c.sut.Policies = map[string]CachePolicy{"config:": {MaxAge: 10 * time.Second}}
+
+	c.Require().NoError(c.sut.Set("config:bacon", "stale"))
+	c.Require().NoError(c.sut.Set("other", "tasty"))
+	c.Require().NoError(c.authority.Set("config:bacon", "fresh"))
+
+	c.breaker.lock.Lock()
+	c.breaker.trip()
+	c.breaker.lock.Unlock()
+}
+
+func (c *cachingStoreUnavailableTestSuite) get(key string) string {
+	value, _, err := c.sut.Get(key)
+	c.Require().NoError(err)
+	return value
+}
+
+func (c *cachingStoreUnavailableTestSuite) TestServesExpired() {
+	c.now = c.now.Add(c.breaker.OpenFor - time.Second)
+	c.Equal("stale", c.get("config:bacon"))
+	c.Equal("tasty", c.get("other"))
+}
+
+func (c *cachingStoreUnavailableTestSuite) TestNotCached() {
+	_, _, err := c.sut.Get("cabbage")
+	c.EqualError(err, "could not retrieve value from authority: authority unavailable, circuit breaker open")
+}
+
+func (c *cachingStoreUnavailableTestSuite) TestConsistentRead() {
+	_, _, err := c.sut.GetContext(WithConsistentRead(context.Background()), "other")
+	c.Equal(ErrCircuitOpen, errors.Cause(err))
+}
+
+func (c *cachingStoreUnavailableTestSuite) TestRejectsWrites() {
+	c.Equal(ErrCircuitOpen, errors.Cause(c.sut.Set("other", "yuck")))
+	c.Equal(ErrCircuitOpen, errors.Cause(c.sut.Apply([]Write{{Key: "other", Delete: true}}, nil)))
+	c.Equal("tasty", c.get("other"))
+}
+
+func (c *cachingStoreUnavailableTestSuite) TestClosesAgain() {
+	c.now = c.now.Add(c.breaker.OpenFor)
+	c.Equal("fresh", c.get("config:bacon"))
+}
+
+func TestCachingStoreUnavailable(t *testing.T) {
+	suite.Run(t, new(cachingStoreUnavailableTestSuite))
+}
+
+func TestCachingStorePolicy(t *testing.T) {
+	suite.Run(t, new(cachingStorePolicyTestSuite))
+}
+
 func TestCachingStore(t *testing.T) {
 	suite.Run(t, new(cachingStoreTestSuite))
 }
@@ -0,0 +1,317 @@
+package lib
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultCircuitWindow is the number of most recent calls the circuit
+	// breaker looks at.
+	DefaultCircuitWindow = 100
+
+	// DefaultCircuitMinCalls is the number of calls in the window needed for
+	// the circuit breaker to trip, so that a few failures right after it's
+	// closed don't trip it again.
+	DefaultCircuitMinCalls = 20
+
+	// DefaultCircuitFailureRate and DefaultCircuitSlowRate are the fractions
+	// of failed and slow calls in the window which trip the circuit breaker.
+	DefaultCircuitFailureRate = 0.5
+	DefaultCircuitSlowRate    = 0.5
+
+	// DefaultCircuitSlowCall is how long a call has to take to count as slow.
+	DefaultCircuitSlowCall = 500 * time.Millisecond
+
+	// DefaultCircuitOpenFor is how long the circuit breaker stays open before
+	// letting probe calls through.
+	DefaultCircuitOpenFor = 10 * time.Second
+
+	// DefaultCircuitProbes is the number of probe calls which have to
+	// succeed for the circuit breaker to close again.
+	DefaultCircuitProbes = 5
+)
+
+// ErrCircuitOpen is returned by a CircuitBreaker instead of calling the store
+// while it's open.
+var ErrCircuitOpen = errors.New("authority unavailable, circuit breaker open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// availabilityReporter is implemented by stores which know that calls to
+// them would fail right away.
+type availabilityReporter interface {
+	available() bool
+}
+
+// circuitOutcome is how a single call in the window went.
+type circuitOutcome struct {
+	failed bool
+	slow   bool
+}
+
+// CircuitBreaker is a Store which stops calling the underlying store once
+// too many of the latest calls failed or were slow, failing fast with
+// ErrCircuitOpen instead. Once it's been open for a while, a few probe calls
+// are let through, and the circuit breaker closes again if all of them
+// succeed in time, or stays open for another while otherwise.
+//
+// Only calls which time out, are throttled or fail in a transient way count as
+// failures, classified as by the RetryPolicy. Others, like failed conditions,
+// writes rejected as too large and calls given up by their callers, say
+// nothing about the health of the store.
+type CircuitBreaker struct {
+	Store
+
+	// FailureRate and SlowRate are the fractions of failed and slow calls
+	// among the latest ones which trip the circuit breaker. Zero disables
+	// either condition.
+	FailureRate float64
+	SlowRate    float64
+
+	SlowCall time.Duration
+	MinCalls int
+	OpenFor  time.Duration
+	Probes   int
+
+	state    circuitState
+	window   []circuitOutcome
+	next     int
+	calls    int
+	failures int
+	slow     int
+	openedAt time.Time
+	probing  int
+	probed   int
+	trips    int
+	now      func() time.Time
+	lock     *sync.Mutex
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker in front of the store,
+// with the default thresholds.
+func NewCircuitBreaker(store Store) *CircuitBreaker {
+	return &CircuitBreaker{
+		Store:       store,
+		FailureRate: DefaultCircuitFailureRate,
+		SlowRate:    DefaultCircuitSlowRate,
+		SlowCall:    DefaultCircuitSlowCall,
+		MinCalls:    DefaultCircuitMinCalls,
+		OpenFor:     DefaultCircuitOpenFor,
+		Probes:      DefaultCircuitProbes,
+		window:      make([]circuitOutcome, DefaultCircuitWindow),
+		now:         time.Now,
+		lock:        new(sync.Mutex),
+	}
+}
+
+// SetWindow sets the number of most recent calls the circuit breaker looks
+// at, forgetting the calls made so far.
+func (c *CircuitBreaker) SetWindow(calls int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if calls < 1 {
+		calls = 1
+	}
+	c.window = make([]circuitOutcome, calls)
+	c.reset()
+}
+
+// Get is a guarded implementation of the Store's Get method.
+func (c *CircuitBreaker) Get(key string) (value string, found bool, err error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is Get which gives up once the context is done.
+func (c *CircuitBreaker) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	err = c.call(func() (err error) {
+		value, found, err = getContext(ctx, c.Store, key)
+		return err
+	})
+	return
+}
+
+// Set is a guarded implementation of the Store's Set method.
+func (c *CircuitBreaker) Set(key string, value string) error {
+	return c.call(func() error { return c.Store.Set(key, value) })
+}
+
+// Version is a guarded implementation of the Store's Version method.
+func (c *CircuitBreaker) Version(key string) (version uint64, err error) {
+	err = c.call(func() (err error) {
+		version, err = c.Store.Version(key)
+		return err
+	})
+	return
+}
+
+// Apply is a guarded implementation of the Store's Apply method.
+func (c *CircuitBreaker) Apply(writes []Write, conditions []Condition) error {
+	return c.call(func() error { return c.Store.Apply(writes, conditions) })
+}
+
+// Scan is a guarded implementation of the Store's Scan method.
+func (c *CircuitBreaker) Scan(cursor string, count int) (keys []string, next string, err error) {
+	err = c.call(func() (err error) {
+		keys, next, err = c.Store.Scan(cursor, count)
+		return err
+	})
+	return
+}
+
+func (c *CircuitBreaker) call(request func() error) error {
+	probe, allowed := c.allow()
+	if !allowed {
+		return ErrCircuitOpen
+	}
+
+	start := c.now()
+	err := request()
+	c.record(probe, c.now().Sub(start), err)
+
+	return err
+}
+
+// allow tells whether a call can be made, and whether it's a probe.
+func (c *CircuitBreaker) allow() (probe, allowed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != c.currentState() {
+		c.state, c.probing, c.probed = circuitHalfOpen, 0, 0
+	}
+
+	switch c.state {
+	case circuitClosed:
+		return false, true
+	case circuitHalfOpen:
+		if c.probing+c.probed < c.Probes {
+			c.probing++
+			return true, true
+		}
+	}
+	return false, false
+}
+
+func (c *CircuitBreaker) record(probe bool, took time.Duration, err error) {
+	outcome := circuitOutcome{
+		failed: err != nil && isUnavailability(err),
+		slow:   c.SlowCall > 0 && took >= c.SlowCall,
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if probe {
+		c.probing--
+		if c.state != circuitHalfOpen {
+			return
+		} else if outcome.failed || outcome.slow {
+			c.trip()
+		} else if c.probed++; c.probed >= c.Probes {
+			c.state = circuitClosed
+			c.reset()
+		}
+		return
+	}
+
+	// Calls let through before the circuit breaker tripped don't count
+	// once it has.
+	if c.state != circuitClosed {
+		return
+	}
+
+	if c.calls == len(c.window) {
+		c.forget(c.window[c.next])
+	} else {
+		c.calls++
+	}
+	c.window[c.next] = outcome
+	c.next = (c.next + 1) % len(c.window)
+
+	if outcome.failed {
+		c.failures++
+	}
+	if outcome.slow {
+		c.slow++
+	}
+
+	if c.calls < c.MinCalls {
+		return
+	}
+
+	calls := float64(c.calls)
+	if (c.FailureRate > 0 && float64(c.failures)/calls >= c.FailureRate) || (c.SlowRate > 0 && float64(c.slow)/calls >= c.SlowRate) {
+		c.trip()
+	}
+}
+
+// trip must be called with the lock held.
+func (c *CircuitBreaker) trip() {
+	c.state, c.openedAt = circuitOpen, c.now()
+	c.trips++
+	c.reset()
+}
+
+// reset must be called with the lock held.
+func (c *CircuitBreaker) reset() {
+	c.next, c.calls, c.failures, c.slow = 0, 0, 0, 0
+}
+
+// forget must be called with the lock held.
+func (c *CircuitBreaker) forget(outcome circuitOutcome) {
+	if outcome.failed {
+		c.failures--
+	}
+	if outcome.slow {
+		c.slow--
+	}
+}
+
+// available tells whether calls would be let through right now.
+func (c *CircuitBreaker) available() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.currentState() != circuitOpen
+}
+
+// currentState must be called with the lock held. The circuit breaker only
+// turns half-open on the next call, but it's reported as such once it would.
+func (c *CircuitBreaker) currentState() circuitState {
+	if c.state == circuitOpen && c.now().Sub(c.openedAt) >= c.OpenFor {
+		return circuitHalfOpen
+	}
+	return c.state
+}
+
+func (c *CircuitBreaker) reportInfo(info *serverInfo) {
+	c.lock.Lock()
+	info.add("stats", "circuit_breaker_state", c.currentState())
+	info.add("stats", "circuit_breaker_trips", c.trips)
+	c.lock.Unlock()
+
+	if reporter, ok := c.Store.(infoReporter); ok {
+		reporter.reportInfo(info)
+	}
+}
@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+// flakyStore fails calls with err when it's set, and makes them take took
+// on the clock of the test.
+type flakyStore struct {
+	Store
+
+	err  error
+	took time.Duration
+	now  *time.Time
+}
+
+func (f *flakyStore) Set(key string, value string) error {
+	*f.now = f.now.Add(f.took)
+	if f.err != nil {
+		return f.err
+	}
+	return f.Store.Set(key, value)
+}
+
+// errUnavailable is an error of DynamoDB having trouble of its own.
+var errUnavailable = awserr.New(dynamodb.ErrCodeInternalServerError, "bacon", nil)
+
+type circuitBreakerTestSuite struct {
+	suite.Suite
+
+	now   time.Time
+	store *flakyStore
+
+	sut *CircuitBreaker
+}
+
+func (c *circuitBreakerTestSuite) SetupTest() {
+	c.now = time.Unix(1500000000, 0)
+	c.store = &flakyStore{Store: NewInMemoryStore(), now: &c.now}
+
+	c.sut = NewCircuitBreaker(c.store)
+	c.sut.MinCalls = 4
+	c.sut.Probes = 2
+	c.sut.SetWindow(4)
+	c.sut.now = func() time.Time { return c.now }
+}
+
+func (c *circuitBreakerTestSuite) set(times int) (errs []error) {
+	for i := 0; i < times; i++ {
+		errs = append(errs, c.sut.Set("bacon", "tasty"))
+	}
+	return
+}
+
+func (c *circuitBreakerTestSuite) state() string {
+	info := newServerInfo()
+	c.sut.reportInfo(info)
+	return info.render([]string{"stats"})
+}
+
+func (c *circuitBreakerTestSuite) trip() {
+	c.store.err = errUnavailable
+	c.set(4)
+	c.Require().Equal(circuitOpen, c.sut.state)
+	c.store.err = nil
+}
+
+func (c *circuitBreakerTestSuite) TestClosed() {
+	for _, err := range c.set(10) {
+		c.NoError(err)
+	}
+
+	value, found, err := c.sut.Get("bacon")
+	c.Equal("tasty", value)
+	c.True(found)
+	c.NoError(err)
+
+	c.Equal(circuitClosed, c.sut.state)
+}
+
+func (c *circuitBreakerTestSuite) TestTrips_OnFailures() {
+	c.store.err = errUnavailable
+	c.set(3)
+	c.Equal(circuitClosed, c.sut.state)
+
+	c.set(1)
+	c.Equal(circuitOpen, c.sut.state)
+
+	c.store.err = nil
+	c.Equal(ErrCircuitOpen, c.sut.Set("bacon", "tasty"))
+	_, _, err := c.sut.Get("bacon")
+	c.Equal(ErrCircuitOpen, err)
+}
+
+func (c *circuitBreakerTestSuite) TestTrips_OnFailureRate() {
+	c.store.err = errUnavailable
+	c.set(1)
+	c.store.err = nil
+	c.set(3)
+	c.Equal(circuitClosed, c.sut.state)
+
+	// Failures drop out of the window as new calls come in.
+	c.store.err = errUnavailable
+	c.set(1)
+	c.Equal(circuitClosed, c.sut.state)
+	c.set(1)
+	c.Equal(circuitOpen, c.sut.state)
+}
+
+func (c *circuitBreakerTestSuite) TestTrips_OnLatency() {
+	c.store.took = c.sut.SlowCall
+	c.set(2)
+	c.store.took = 0
+	c.set(1)
+	c.Equal(circuitClosed, c.sut.state)
+
+	c.store.took = c.sut.SlowCall
+	c.set(1)
+	c.Equal(circuitOpen, c.sut.state)
+}
+
+func (c *circuitBreakerTestSuite) TestIgnoresFailedConditions() {
+	c.NoError(c.sut.Set("bacon", "tasty"))
+
+	for i := 0; i < 10; i++ {
+		err := c.sut.Apply([]Write{{Key: "bacon", Delete: true}}, []Condition{{Key: "bacon", Version: 0}})
+		c.Equal(ErrConditionFailed, errors.Cause(err))
+	}
+	c.Equal(circuitClosed, c.sut.state)
+}
+
+func (c *circuitBreakerTestSuite) TestTrips_OnThrottlingAndTimeouts() {
+	for _, err := range []error{
+		errors.WithMessage(ErrThrottled, "bacon"),
+		ErrTimeout,
+		awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "bacon", nil),
+		errors.Wrap(context.DeadlineExceeded, "bacon"),
+	} {
+		c.store.err = err
+		c.set(1)
+	}
+	c.Equal(circuitOpen, c.sut.state)
+}
+
+func (c *circuitBreakerTestSuite) TestIgnoresRejectedCalls() {
+	for _, err := range []error{
+		ErrValueTooLarge,
+		errors.Wrap(ErrTransactionTooLarge, "bacon"),
+		errors.Wrap(awserr.New("ValidationException", "bacon", nil), apiErrorMessage),
+		errors.New("bacon"),
+	} {
+		c.store.err = err
+		c.set(4)
+	}
+	c.Equal(circuitClosed, c.sut.state)
+}
+
+func (c *circuitBreakerTestSuite) TestIgnoresCancelledCalls() {
+	c.store.err = errors.Wrap(context.Canceled, "bacon")
+	c.set(10)
+	c.Equal(circuitClosed, c.sut.state)
+}
+
+func (c *circuitBreakerTestSuite) TestHalfOpen_Closes() {
+	c.trip()
+
+	c.now = c.now.Add(c.sut.OpenFor)
+	c.NoError(c.sut.Set("bacon", "tasty"))
+	c.Equal(circuitHalfOpen, c.sut.state)
+
+	c.NoError(c.sut.Set("bacon", "tasty"))
+	c.Equal(circuitClosed, c.sut.state)
+}
+
+func (c *circuitBreakerTestSuite) TestHalfOpen_Reopens() {
+	c.trip()
+
+	c.now = c.now.Add(c.sut.OpenFor)
+	c.NoError(c.sut.Set("bacon", "tasty"))
+
+	c.store.took = c.sut.SlowCall
+	c.NoError(c.sut.Set("bacon", "tasty"))
+	c.Equal(circuitOpen, c.sut.state)
+
+	c.store.took = 0
+	c.Equal(ErrCircuitOpen, c.sut.Set("bacon", "tasty"))
+}
+
+func (c *circuitBreakerTestSuite) TestHalfOpen_LimitsProbes() {
+	c.trip()
+	c.now = c.now.Add(c.sut.OpenFor)
+
+	probe, allowed := c.sut.allow()
+	c.True(probe)
+	c.True(allowed)
+
+	probe, allowed = c.sut.allow()
+	c.True(probe)
+	c.True(allowed)
+
+	_, allowed = c.sut.allow()
+	c.False(allowed)
+}
+
+func (c *circuitBreakerTestSuite) TestReportInfo() {
+	c.Equal("# Stats\r\ncircuit_breaker_state:closed\r\ncircuit_breaker_trips:0\r\n", c.state())
+
+	c.trip()
+	c.Equal("# Stats\r\ncircuit_breaker_state:open\r\ncircuit_breaker_trips:1\r\n", c.state())
+	c.False(c.sut.available())
+
+	c.now = c.now.Add(c.sut.OpenFor)
+	c.Equal("# Stats\r\ncircuit_breaker_state:half-open\r\ncircuit_breaker_trips:1\r\n", c.state())
+	c.True(c.sut.available())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	suite.Run(t, new(circuitBreakerTestSuite))
+}
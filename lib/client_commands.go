@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// handleClient supports the subcommands of CLIENT which make sense for
+// goredis, starting with CONSISTENCY, which has no Redis counterpart. It makes
+// reads of the client either strongly consistent or eventually consistent,
+// which is the default, and with no mode it replies with the current one.
+func (s *SessionHandler) handleClient(args []string) error {
+	subcommand := strings.ToLower(args[0])
+	if subcommand != "consistency" {
+		_, err := fmt.Fprintf(s.writer, "-ERR unknown subcommand '%s'\n", args[0])
+		return err
+	}
+
+	switch len(args) {
+	case 1:
+		mode := "eventual"
+		if s.consistent {
+			mode = "strong"
+		}
+		_, err := io.WriteString(s.writer, bulkString(mode))
+		return err
+	case 2:
+	default:
+		return s.badArgs("client|" + subcommand)
+	}
+
+	switch mode := strings.ToLower(args[1]); mode {
+	case "strong", "eventual":
+		s.consistent = mode == "strong"
+	default:
+		_, err := fmt.Fprintf(s.writer, "-ERR unknown consistency mode '%s'\n", args[1])
+		return err
+	}
+
+	s.use(s.root, s.db)
+
+	_, err := fmt.Fprintln(s.writer, "+OK")
+	return err
+}
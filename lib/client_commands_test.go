@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+)
+
+// consistencyStore records whether reads asked for strong consistency.
+type consistencyStore struct {
+	Store
+
+	consistent []bool
+}
+
+func (c *consistencyStore) Get(key string) (value string, found bool, err error) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *consistencyStore) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	c.consistent = append(c.consistent, consistentRead(ctx))
+	return c.Store.Get(key)
+}
+
+func (s *sessionHandlerTestSuite) withConsistencyStore() *consistencyStore {
+	store := &consistencyStore{Store: NewInMemoryStore()}
+	s.server.Store = store
+	s.sut.use(store, 0)
+	return store
+}
+
+func (s *sessionHandlerTestSuite) TestClientConsistency() {
+	store := s.withConsistencyStore()
+
+	fmt.Fprint(s.conn, "CLIENT CONSISTENCY\nGET bacon\nCLIENT CONSISTENCY strong\nCLIENT CONSISTENCY\nGET bacon\nCLIENT CONSISTENCY EVENTUAL\nGET bacon\n")
+
+	s.handleLines(7)
+	s.responded("$8\neventual\n$-1\n+OK\n$6\nstrong\n$-1\n+OK\n$-1")
+
+	// Each GET reads the database mapping first, which is always strongly
+	// consistent.
+	s.Equal([]bool{true, false, true, true, true, false}, store.consistent)
+}
+
+func (s *sessionHandlerTestSuite) TestClientConsistency_KeptAcrossSelect() {
+	store := s.withConsistencyStore()
+
+	fmt.Fprint(s.conn, "CLIENT CONSISTENCY strong\nSELECT 1\nGET bacon\n")
+
+	s.handleLines(3)
+	s.responded("+OK\n+OK\n$-1")
+	s.Equal([]bool{true, true}, store.consistent[len(store.consistent)-2:])
+}
+
+func (s *sessionHandlerTestSuite) TestRename_ReadsConsistently() {
+	store := s.withConsistencyStore()
+	store.Set("bacon", "tasty")
+
+	fmt.Fprintln(s.conn, "RENAME bacon cabbage")
+
+	s.True(s.sut.handleLine())
+	s.responded("+OK")
+
+	// The mapping is read along with the value, which is written again
+	// conditionally on its version.
+	s.Equal([]bool{true, true, true, true}, store.consistent)
+}
+
+func (s *sessionHandlerTestSuite) TestExec_ReadsWatchedKeysConsistently() {
+	store := s.withConsistencyStore()
+
+	fmt.Fprint(s.conn, "WATCH bacon\nMULTI\nGET bacon\nGET cabbage\nEXEC\n")
+
+	s.handleLines(5)
+	s.responded("+OK\n+OK\n+QUEUED\n+QUEUED\n*2\n$-1\n$-1")
+
+	// The mapping is watched along with the keys.
+	s.Equal([]bool{true, true, true, false}, store.consistent[len(store.consistent)-4:])
+}
+
+func (s *sessionHandlerTestSuite) TestClientConsistency_UnknownMode() {
+	fmt.Fprintln(s.conn, "CLIENT CONSISTENCY linearizable")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR unknown consistency mode 'linearizable'")
+	s.False(s.sut.consistent)
+}
+
+func (s *sessionHandlerTestSuite) TestClientConsistency_InvalidArgs() {
+	fmt.Fprintln(s.conn, "CLIENT CONSISTENCY strong eventual")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR wrong number of arguments for 'client|consistency' command")
+}
+
+func (s *sessionHandlerTestSuite) TestClient_UnknownSubcommand() {
+	fmt.Fprintln(s.conn, "CLIENT KILL")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR unknown subcommand 'KILL'")
+}
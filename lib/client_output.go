@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrOutputBufferLimit is returned for writes to a client which has been
+// disconnected for overcoming its output buffer limits.
+var ErrOutputBufferLimit = errors.New("client output buffer limit reached")
+
+// OutputBufferLimits mirror the Redis client-output-buffer-limit setting. The
+// client is disconnected as soon as the amount of data waiting to be written
+// to it exceeds HardLimit, or if it stays above SoftLimit for longer than
+// SoftSeconds. Zero values disable the respective limit.
+type OutputBufferLimits struct {
+	HardLimit   int
+	SoftLimit   int
+	SoftSeconds time.Duration
+}
+
+// DefaultPubSubOutputLimits are the limits Redis applies to pub/sub clients
+// by default.
+var DefaultPubSubOutputLimits = OutputBufferLimits{
+	HardLimit:   32 * 1024 * 1024,
+	SoftLimit:   8 * 1024 * 1024,
+	SoftSeconds: 60 * time.Second,
+}
+
+// clientOutput serializes everything written to a single client connection.
+// Replies written by the session itself block until they hit the wire, while
+// messages pushed from other goroutines are queued and written in the
+// background, so a slow subscriber never blocks a publisher.
+type clientOutput struct {
+	limits     OutputBufferLimits
+	onOverflow func()
+	writer     io.Writer
+
+	lock      *sync.Mutex
+	flushed   *sync.Cond
+	queue     [][]byte
+	pending   int
+	enqueued  uint64
+	written   uint64
+	writing   bool
+	softSince time.Time
+	err       error
+}
+
+func newClientOutput(writer io.Writer, limits OutputBufferLimits, onOverflow func()) *clientOutput {
+	lock := new(sync.Mutex)
+
+	return &clientOutput{
+		limits:     limits,
+		onOverflow: onOverflow,
+		writer:     writer,
+		lock:       lock,
+		flushed:    sync.NewCond(lock),
+	}
+}
+
+// Write queues a reply and waits until it has been written to the client.
+func (o *clientOutput) Write(p []byte) (int, error) {
+	return o.writeWith(func() []byte { return p })
+}
+
+// writeWith builds and queues a reply atomically with respect to pushed
+// messages, so that e.g. a subscription confirmation is guaranteed to reach
+// the client before any message published to the newly subscribed channel.
+func (o *clientOutput) writeWith(build func() []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	p := build()
+
+	if o.err != nil {
+		return 0, o.err
+	}
+
+	seq := o.enqueue(p)
+
+	if !o.writing {
+		o.writing = true
+		o.drainLocked()
+	}
+
+	for o.written < seq && o.err == nil {
+		o.flushed.Wait()
+	}
+
+	if o.err != nil {
+		return 0, o.err
+	}
+
+	return len(p), nil
+}
+
+// push queues a message for background delivery, enforcing output buffer
+// limits. It returns false if the message could not be queued.
+func (o *clientOutput) push(p []byte) bool {
+	o.lock.Lock()
+
+	if o.err != nil {
+		o.lock.Unlock()
+		return false
+	}
+
+	if o.exceedsLimits(len(p)) {
+		o.err = ErrOutputBufferLimit
+		o.queue, o.pending = nil, 0
+		o.flushed.Broadcast()
+		o.lock.Unlock()
+
+		if o.onOverflow != nil {
+			o.onOverflow()
+		}
+		return false
+	}
+
+	o.enqueue(p)
+
+	if !o.writing {
+		o.writing = true
+		go o.drain()
+	}
+
+	o.lock.Unlock()
+	return true
+}
+
+// wait blocks until everything queued so far has been written or dropped.
+func (o *clientOutput) wait() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for o.writing {
+		o.flushed.Wait()
+	}
+}
+
+func (o *clientOutput) enqueue(p []byte) uint64 {
+	o.queue = append(o.queue, append([]byte(nil), p...))
+	o.pending += len(p)
+	o.enqueued++
+	return o.enqueued
+}
+
+func (o *clientOutput) exceedsLimits(extra int) bool {
+	size := o.pending + extra
+
+	if o.limits.HardLimit > 0 && size > o.limits.HardLimit {
+		return true
+	}
+
+	if o.limits.SoftLimit <= 0 || size <= o.limits.SoftLimit {
+		o.softSince = time.Time{}
+		return false
+	}
+
+	if o.softSince.IsZero() {
+		o.softSince = time.Now()
+		return false
+	}
+
+	return time.Since(o.softSince) > o.limits.SoftSeconds
+}
+
+func (o *clientOutput) drain() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.drainLocked()
+}
+
+// drainLocked must be called with the lock held, and with the writing flag
+// set by the caller. It releases the lock for the duration of each write.
+func (o *clientOutput) drainLocked() {
+	for len(o.queue) > 0 && o.err == nil {
+		p := o.queue[0]
+		o.queue[0] = nil
+		o.queue = o.queue[1:]
+
+		o.lock.Unlock()
+		_, err := o.writer.Write(p)
+		o.lock.Lock()
+
+		if o.pending -= len(p); o.pending < 0 {
+			// The queue was dropped while this write was in flight.
+			o.pending = 0
+		}
+		o.written++
+
+		if err != nil && o.err == nil {
+			o.err = err
+		}
+
+		o.flushed.Broadcast()
+	}
+
+	o.writing = false
+	o.flushed.Broadcast()
+}
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type clientOutputTestSuite struct {
+	suite.Suite
+
+	buffer     *bytes.Buffer
+	overflowed bool
+}
+
+func (c *clientOutputTestSuite) SetupTest() {
+	c.buffer = bytes.NewBuffer(nil)
+	c.overflowed = false
+}
+
+func (c *clientOutputTestSuite) TestWrite() {
+	sut := c.output(OutputBufferLimits{})
+
+	n, err := sut.Write([]byte("+OK\n"))
+
+	c.Equal(4, n)
+	c.NoError(err)
+	c.Equal("+OK\n", c.buffer.String())
+}
+
+func (c *clientOutputTestSuite) TestPushAndWrite() {
+	sut := c.output(OutputBufferLimits{})
+
+	c.True(sut.push([]byte("first\n")))
+	_, err := sut.Write([]byte("second\n"))
+
+	c.NoError(err)
+	c.Equal("first\nsecond\n", c.buffer.String())
+}
+
+func (c *clientOutputTestSuite) TestPush_HardLimit() {
+	sut := c.output(OutputBufferLimits{HardLimit: 5})
+	sut.writing = true // Pretend a slow write is in progress.
+
+	c.True(sut.push([]byte("1234")))
+	c.False(sut.push([]byte("56")))
+	c.True(c.overflowed)
+
+	_, err := sut.Write([]byte("+OK\n"))
+	c.Equal(ErrOutputBufferLimit, err)
+}
+
+func (c *clientOutputTestSuite) TestPush_SoftLimit() {
+	sut := c.output(OutputBufferLimits{SoftLimit: 2, SoftSeconds: time.Millisecond})
+	sut.writing = true // Pretend a slow write is in progress.
+
+	c.True(sut.push([]byte("123")))
+	time.Sleep(2 * time.Millisecond)
+	c.False(sut.push([]byte("4")))
+	c.True(c.overflowed)
+}
+
+func (c *clientOutputTestSuite) TestWrite_Error() {
+	sut := newClientOutput(failingWriter{}, OutputBufferLimits{}, nil)
+
+	_, err := sut.Write([]byte("+OK\n"))
+	c.EqualError(err, "bacon")
+
+	c.False(sut.push([]byte("message")))
+}
+
+func (c *clientOutputTestSuite) output(limits OutputBufferLimits) *clientOutput {
+	return newClientOutput(c.buffer, limits, func() { c.overflowed = true })
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("bacon")
+}
+
+func TestClientOutput(t *testing.T) {
+	suite.Run(t, new(clientOutputTestSuite))
+}
@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type commandFlags int
+
+const (
+	// flagWrite marks commands which may modify the keyspace.
+	flagWrite commandFlags = 1 << iota
+
+	// flagPubSub marks commands allowed while the client is subscribed to
+	// at least one channel or pattern.
+	flagPubSub
+
+	// flagNoMulti marks commands which can not be queued in a transaction.
+	flagNoMulti
+
+	// flagSkipQueue marks commands executed right away even within a
+	// transaction, like the transaction commands themselves.
+	flagSkipQueue
+
+	// flagExclusive marks commands which run with no other commands being
+	// executed concurrently by other sessions.
+	flagExclusive
+
+	// flagNoScript marks commands which can not be called from scripts.
+	flagNoScript
+
+	// flagAllowBusy marks commands which do not touch the keyspace. They run
+	// without taking the server lock, so they're available while a script
+	// is busy, which is what makes SCRIPT KILL possible.
+	flagAllowBusy
+)
+
+// command describes a single command supported by the SessionHandler.
+type command struct {
+	// arity follows the Redis convention: a positive number is the exact
+	// number of arguments including the command name, a negative number is
+	// the minimum number of arguments.
+	arity   int
+	flags   commandFlags
+	handler func(s *SessionHandler, args []string) error
+
+	// firstKey, lastKey and keyStep tell which arguments are keys, counting
+	// the command name as argument zero, as in Redis. A negative lastKey
+	// counts from the end, and a zero firstKey means there are no keys.
+	firstKey int
+	lastKey  int
+	keyStep  int
+}
+
+func (c *command) validArity(argc int) bool {
+	if c.arity < 0 {
+		return argc >= -c.arity
+	}
+	return argc == c.arity
+}
+
+func (c *command) is(flag commandFlags) bool {
+	return c.flags&flag != 0
+}
+
+// reservedKey returns the first key of the command reserved for goredis
+// itself, if any. Only goredis reads and writes those, never clients.
+func (c *command) reservedKey(args []string) (string, bool) {
+	if c.firstKey == 0 {
+		return "", false
+	}
+
+	last := c.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	for i := c.firstKey; i <= last && i < len(args); i += c.keyStep {
+		if internalKey(args[i]) {
+			return args[i], true
+		}
+	}
+	return "", false
+}
+
+// reservedKeyError is the error replied to commands with reserved keys.
+func reservedKeyError(key string) string {
+	return fmt.Sprintf("ERR key %q is reserved for goredis", key)
+}
+
+// commands is the table used to dispatch all client commands. It's populated
+// in init since some handlers (like EXEC) dispatch through it themselves.
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"client":       {arity: -2, flags: flagNoScript, handler: (*SessionHandler).handleClient},
+		"copy":         {arity: -3, flags: flagWrite, handler: (*SessionHandler).handleCopy, firstKey: 1, lastKey: 2, keyStep: 1},
+		"dbsize":       {arity: 1, handler: (*SessionHandler).handleDBSize},
+		"discard":      {arity: 1, flags: flagSkipQueue | flagNoScript, handler: (*SessionHandler).handleDiscard},
+		"dump":         {arity: 2, handler: (*SessionHandler).handleDump, firstKey: 1, lastKey: 1, keyStep: 1},
+		"eval":         {arity: -3, flags: flagWrite | flagExclusive | flagNoScript, handler: (*SessionHandler).handleEval},
+		"evalsha":      {arity: -3, flags: flagWrite | flagExclusive | flagNoScript, handler: (*SessionHandler).handleEvalSHA},
+		"exec":         {arity: 1, flags: flagSkipQueue | flagExclusive | flagNoScript, handler: (*SessionHandler).handleExec},
+		"fcall":        {arity: -3, flags: flagWrite | flagExclusive | flagNoScript, handler: (*SessionHandler).handleFCall},
+		"fcall_ro":     {arity: -3, flags: flagExclusive | flagNoScript, handler: (*SessionHandler).handleFCallRO},
+		"flushall":     {arity: -1, flags: flagWrite | flagNoMulti | flagNoScript, handler: (*SessionHandler).handleFlushAll},
+		"flushdb":      {arity: -1, flags: flagWrite | flagNoMulti | flagNoScript, handler: (*SessionHandler).handleFlushDB},
+		"function":     {arity: -2, flags: flagWrite | flagExclusive | flagNoScript, handler: (*SessionHandler).handleFunction},
+		"get":          {arity: 2, handler: (*SessionHandler).handleGet, firstKey: 1, lastKey: 1, keyStep: 1},
+		"info":         {arity: -1, handler: (*SessionHandler).handleInfo},
+		"keys":         {arity: 2, handler: (*SessionHandler).handleKeys},
+		"move":         {arity: 3, flags: flagWrite, handler: (*SessionHandler).handleMove, firstKey: 1, lastKey: 1, keyStep: 1},
+		"multi":        {arity: 1, flags: flagSkipQueue | flagNoScript, handler: (*SessionHandler).handleMulti},
+		"object":       {arity: -2, handler: (*SessionHandler).handleObject, firstKey: 2, lastKey: 2, keyStep: 1},
+		"ping":         {arity: -1, flags: flagPubSub, handler: (*SessionHandler).handlePing},
+		"psubscribe":   {arity: -2, flags: flagPubSub | flagNoMulti | flagNoScript, handler: (*SessionHandler).handlePSubscribe},
+		"publish":      {arity: 3, handler: (*SessionHandler).handlePublish},
+		"pubsub":       {arity: -2, handler: (*SessionHandler).handlePubSub},
+		"punsubscribe": {arity: -1, flags: flagPubSub | flagNoMulti | flagNoScript, handler: (*SessionHandler).handlePUnsubscribe},
+		"randomkey":    {arity: 1, handler: (*SessionHandler).handleRandomKey},
+		"quit":         {arity: -1, flags: flagPubSub | flagSkipQueue | flagNoScript | flagAllowBusy, handler: (*SessionHandler).handleQuit},
+		"rename":       {arity: 3, flags: flagWrite, handler: (*SessionHandler).handleRename, firstKey: 1, lastKey: 2, keyStep: 1},
+		"renamenx":     {arity: 3, flags: flagWrite, handler: (*SessionHandler).handleRenameNX, firstKey: 1, lastKey: 2, keyStep: 1},
+		"restore":      {arity: -4, flags: flagWrite, handler: (*SessionHandler).handleRestore, firstKey: 1, lastKey: 1, keyStep: 1},
+		"scan":         {arity: -2, handler: (*SessionHandler).handleScan},
+		"script":       {arity: -2, flags: flagNoScript | flagAllowBusy, handler: (*SessionHandler).handleScript},
+		"select":       {arity: 2, handler: (*SessionHandler).handleSelect},
+		"set":          {arity: -3, flags: flagWrite, handler: (*SessionHandler).handleSet, firstKey: 1, lastKey: 1, keyStep: 1},
+		"subscribe":    {arity: -2, flags: flagPubSub | flagNoMulti | flagNoScript, handler: (*SessionHandler).handleSubscribe},
+		"swapdb":       {arity: 3, flags: flagWrite, handler: (*SessionHandler).handleSwapDB},
+		"touch":        {arity: -2, handler: (*SessionHandler).handleTouch, firstKey: 1, lastKey: -1, keyStep: 1},
+		"type":         {arity: 2, handler: (*SessionHandler).handleType, firstKey: 1, lastKey: 1, keyStep: 1},
+		"unsubscribe":  {arity: -1, flags: flagPubSub | flagNoMulti | flagNoScript, handler: (*SessionHandler).handleUnsubscribe},
+		"unwatch":      {arity: 1, flags: flagNoScript, handler: (*SessionHandler).handleUnwatch},
+		"watch":        {arity: -2, flags: flagSkipQueue | flagNoScript, handler: (*SessionHandler).handleWatch, firstKey: 1, lastKey: -1, keyStep: 1},
+	}
+}
+
+// dispatch looks the command up, validates it and either executes or queues
+// it, depending on whether the session is in a transaction.
+func (s *SessionHandler) dispatch(args []string) error {
+	name := strings.ToLower(args[0])
+
+	cmd, known := commands[name]
+	if !known {
+		s.flagTransaction()
+		return s.handleUnknown(args)
+	}
+
+	if !cmd.is(flagAllowBusy) && s.server.scripts.busy(s.server.ScriptTimeLimit) {
+		_, err := fmt.Fprintln(s.writer, "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+		return err
+	}
+
+	if s.subscribed() && !cmd.is(flagPubSub) {
+		_, err := fmt.Fprintf(s.writer, "-ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\n", name)
+		return err
+	}
+
+	if !cmd.validArity(len(args)) {
+		s.flagTransaction()
+		return s.badArgs(name)
+	}
+
+	if key, reserved := cmd.reservedKey(args); reserved {
+		s.flagTransaction()
+		_, err := io.WriteString(s.writer, errorString(reservedKeyError(key)))
+		return err
+	}
+
+	if s.multi != nil && !cmd.is(flagSkipQueue) {
+		return s.queue(cmd, name, args)
+	}
+
+	if cmd.is(flagAllowBusy) {
+		return s.replyStoreError(cmd.handler(s, args[1:]))
+	} else if cmd.is(flagExclusive) {
+		s.server.lock.Lock()
+		defer s.server.lock.Unlock()
+	} else {
+		s.server.lock.RLock()
+		defer s.server.lock.RUnlock()
+	}
+
+	return s.replyStoreError(cmd.handler(s, args[1:]))
+}
@@ -0,0 +1,396 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// ErrMalformedCompressedValue is returned when reading a value without a
+// header, or which doesn't decompress, while headers are required.
+var ErrMalformedCompressedValue = errors.New("malformed compressed value")
+
+const (
+	// DefaultCompressionThreshold is the size of the smallest value
+	// compressed, since compressing smaller ones saves little, if anything.
+	DefaultCompressionThreshold = 1 << 10
+
+	// compressionKey holds how far FrameValues got, and that it's done.
+	compressionKey = internalKeyPrefix + "goredis:compression"
+
+	// framingPrefix starts the cursor FrameValues carries on from, and
+	// framedValues replaces it once every value has a header.
+	framingPrefix = "framing:"
+	framedValues  = "framed"
+
+	// frameBatch is the number of values given a header at a time, along
+	// with the progress, well within the limits of a single transaction.
+	frameBatch = 50
+)
+
+// Values written by a CompressingStore all start with a header byte telling
+// whether, and how, they're compressed. Values without a header, written
+// before compression was enabled, are read as they are, which is always right
+// for text, since no header byte ever starts valid UTF-8. Binary values may
+// start with a header byte, though, and the few of them which also decompress
+// are read as if they had a header.
+const (
+	headerUncompressed byte = 0xf8 + iota
+	headerGzip
+	headerSnappy
+	headerZstd
+)
+
+// compressionCodec compresses values, and decompresses them, refusing to
+// produce more than MaxValueSize.
+type compressionCodec struct {
+	name       string
+	header     byte
+	compress   func(value []byte) ([]byte, error)
+	decompress func(compressed []byte) ([]byte, error)
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxValueSize))
+
+	compressionCodecs = []compressionCodec{
+		{name: "gzip", header: headerGzip, compress: gzipCompress, decompress: gzipDecompress},
+		{name: "snappy", header: headerSnappy, compress: snappyCompress, decompress: snappyDecompress},
+		{name: "zstd", header: headerZstd, compress: zstdCompress, decompress: zstdDecompress},
+	}
+)
+
+func gzipCompress(value []byte) ([]byte, error) {
+	var ret bytes.Buffer
+	writer := gzip.NewWriter(&ret)
+	if _, err := writer.Write(value); err != nil {
+		return nil, err
+	}
+	err := writer.Close()
+	return ret.Bytes(), err
+}
+
+func gzipDecompress(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := ioutil.ReadAll(io.LimitReader(reader, MaxValueSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(ret) > MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+	return ret, nil
+}
+
+func snappyCompress(value []byte) ([]byte, error) {
+	return snappy.Encode(nil, value), nil
+}
+
+func snappyDecompress(compressed []byte) ([]byte, error) {
+	length, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	} else if length > MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+	return snappy.Decode(nil, compressed)
+}
+
+func zstdCompress(value []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(value, nil), nil
+}
+
+func zstdDecompress(compressed []byte) ([]byte, error) {
+	ret, err := zstdDecoder.DecodeAll(compressed, nil)
+	if err == zstd.ErrDecoderSizeExceeded {
+		return nil, ErrValueTooLarge
+	}
+	return ret, err
+}
+
+// CompressionCodecs returns the names of the codecs a CompressingStore may
+// compress values with.
+func CompressionCodecs() []string {
+	var ret []string
+	for _, codec := range compressionCodecs {
+		ret = append(ret, codec.name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// CompressingStore is a Store which compresses values on their way to the
+// underlying store, and decompresses them on their way back. Values smaller
+// than the threshold, or which don't get any smaller, are written as they
+// are, after a header. Values compressed with any codec are read, whichever
+// one is used for writing, so that the codec may be changed at any time.
+type CompressingStore struct {
+	Store
+
+	// Threshold is the size of the smallest value compressed.
+	Threshold int
+
+	// RequireHeader rejects values without a header, or which don't
+	// decompress, rather than reading them as they are. It's meant to be set
+	// once FrameValues has given all values a header.
+	RequireHeader bool
+
+	codec compressionCodec
+
+	// written and stored are the sizes of all values written, before and
+	// after compression, for the compression ratio.
+	written int64
+	stored  int64
+	lock    *sync.Mutex
+}
+
+// NewCompressingStore returns a CompressingStore in front of the store, which
+// compresses values with the named codec.
+func NewCompressingStore(store Store, codec string) (*CompressingStore, error) {
+	for _, candidate := range compressionCodecs {
+		if candidate.name == strings.ToLower(codec) {
+			return &CompressingStore{
+				Store:     store,
+				Threshold: DefaultCompressionThreshold,
+				codec:     candidate,
+				lock:      new(sync.Mutex),
+			}, nil
+		}
+	}
+	return nil, errors.Errorf("unknown compression codec %q, expected one of %s", codec, strings.Join(CompressionCodecs(), ", "))
+}
+
+// Get is a decompressing implementation of the Store's Get method.
+func (c *CompressingStore) Get(key string) (value string, found bool, err error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is Get which gives up once the context is done.
+func (c *CompressingStore) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	value, found, err = getContext(ctx, c.Store, key)
+	if err != nil || !found {
+		return value, found, err
+	}
+
+	value, err = c.decompress(value)
+	return value, err == nil, errors.Wrapf(err, "could not decompress value of %q", key)
+}
+
+// Set is a compressing implementation of the Store's Set method.
+func (c *CompressingStore) Set(key string, value string) error {
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	stored, err := c.compress(value)
+	if err != nil {
+		return err
+	}
+	return c.Store.Set(key, stored)
+}
+
+// Apply is a compressing implementation of the Store's Apply method.
+func (c *CompressingStore) Apply(writes []Write, conditions []Condition) error {
+	if err := checkValueSizes(writes); err != nil {
+		return err
+	}
+
+	compressed := make([]Write, len(writes))
+	for i, write := range writes {
+		compressed[i] = write
+		if write.Delete {
+			continue
+		}
+
+		stored, err := c.compress(write.Value)
+		if err != nil {
+			return err
+		}
+		compressed[i].Value = stored
+	}
+
+	return c.Store.Apply(compressed, conditions)
+}
+
+// compress returns the value as it's to be stored.
+func (c *CompressingStore) compress(value string) (string, error) {
+	stored := value
+	if len(value) >= c.Threshold {
+		compressed, err := c.codec.compress([]byte(value))
+		if err != nil {
+			return "", errors.Wrapf(err, "could not compress value with %s", c.codec.name)
+		}
+
+		if len(compressed) < len(value) {
+			stored = string(append([]byte{c.codec.header}, compressed...))
+		}
+	}
+
+	if len(stored) == len(value) {
+		stored = string([]byte{headerUncompressed}) + value
+	}
+
+	c.lock.Lock()
+	c.written += int64(len(value))
+	c.stored += int64(len(stored))
+	c.lock.Unlock()
+
+	return stored, nil
+}
+
+// decompress returns the value as it was written. Values without a header are
+// read as they are, unless a header is required.
+func (c *CompressingStore) decompress(stored string) (string, error) {
+	value, err := unframe(stored)
+	if err == ErrMalformedCompressedValue && !c.RequireHeader {
+		return stored, nil
+	}
+	return value, err
+}
+
+// unframe returns the value with a header as it was written.
+func unframe(stored string) (string, error) {
+	if stored == "" {
+		return "", ErrMalformedCompressedValue
+	}
+
+	header := stored[0]
+	if header == headerUncompressed {
+		return stored[1:], nil
+	}
+
+	for _, codec := range compressionCodecs {
+		if codec.header != header {
+			continue
+		}
+
+		value, err := codec.decompress([]byte(stored[1:]))
+		if err == ErrValueTooLarge {
+			return "", err
+		} else if err != nil {
+			return "", ErrMalformedCompressedValue
+		}
+		return string(value), nil
+	}
+
+	return "", ErrMalformedCompressedValue
+}
+
+// FrameValues gives every value of the store without a header the header of
+// an uncompressed value, returning how many it gave one, so that headers may
+// be required. It runs while the store is in use, with compression enabled on
+// every node, so that values written in the meantime have a header already.
+// Values are only given a header as long as they're not written in the
+// meantime, and batches are tried again until none of their values is. The
+// progress is written along with each batch of values, so it carries on where
+// it stopped after being interrupted, and does nothing once done.
+func FrameValues(ctx context.Context, store Store) (framed int, err error) {
+	progress, _, err := getContext(WithConsistentRead(ctx), store, compressionKey)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read progress of framing values")
+	} else if progress == framedValues {
+		return 0, nil
+	}
+
+	cursor := strings.TrimPrefix(progress, framingPrefix)
+	for {
+		keys, next, err := store.Scan(cursor, frameBatch)
+		if err != nil {
+			return framed, errors.Wrap(err, "could not scan keys")
+		}
+
+		progress := framedValues
+		if next != "" {
+			progress = framingPrefix + next
+		}
+
+		done, err := frameKeys(ctx, store, keys, progress)
+		for errors.Cause(err) == ErrConditionFailed {
+			done, err = frameKeys(ctx, store, keys, progress)
+		}
+		framed += done
+		if err != nil {
+			return framed, err
+		}
+
+		if next == "" {
+			return framed, nil
+		}
+		cursor = next
+	}
+}
+
+// frameKeys gives the values of the keys without a header one, and records
+// the progress, all at once.
+func frameKeys(ctx context.Context, store Store, keys []string, progress string) (int, error) {
+	version, err := store.Version(compressionKey)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read version of framing progress")
+	}
+
+	writes := []Write{{Key: compressionKey, Value: progress}}
+	conditions := []Condition{{Key: compressionKey, Version: version}}
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		} else if key == compressionKey {
+			continue
+		}
+
+		version, err := store.Version(key)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not read version of %q", key)
+		}
+
+		value, found, err := getContext(WithConsistentRead(ctx), store, key)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not read %q", key)
+		} else if !found {
+			continue
+		} else if _, err := unframe(value); err != ErrMalformedCompressedValue {
+			continue
+		}
+
+		writes = append(writes, Write{Key: key, Value: string([]byte{headerUncompressed}) + value})
+		conditions = append(conditions, Condition{Key: key, Version: version})
+	}
+
+	if err := store.Apply(writes, conditions); err != nil {
+		return 0, errors.Wrap(err, "could not frame values")
+	}
+	return len(writes) - 1, nil
+}
+
+func (c *CompressingStore) reportInfo(info *serverInfo) {
+	c.lock.Lock()
+	written, stored := c.written, c.stored
+	c.lock.Unlock()
+
+	ratio := 1.0
+	if stored > 0 {
+		ratio = float64(written) / float64(stored)
+	}
+
+	info.add("stats", "compression_codec", c.codec.name)
+	info.add("stats", "compression_input_bytes", written)
+	info.add("stats", "compression_output_bytes", stored)
+	info.add("stats", "compression_ratio", fmt.Sprintf("%.2f", ratio))
+
+	if reporter, ok := c.Store.(infoReporter); ok {
+		reporter.reportInfo(info)
+	}
+}
@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type compressingStoreTestSuite struct {
+	suite.Suite
+
+	store Store
+}
+
+func (c *compressingStoreTestSuite) SetupTest() {
+	c.store = NewInMemoryStore()
+}
+
+func (c *compressingStoreTestSuite) compressing(codec string) *CompressingStore {
+	ret, err := NewCompressingStore(c.store, codec)
+	c.Require().NoError(err)
+	ret.Threshold = 16
+	return ret
+}
+
+func (c *compressingStoreTestSuite) stored(key string) string {
+	value, _, err := c.store.Get(key)
+	c.Require().NoError(err)
+	return value
+}
+
+func (c *compressingStoreTestSuite) get(sut Store, key string) string {
+	value, found, err := sut.Get(key)
+	c.Require().NoError(err)
+	c.Require().True(found)
+	return value
+}
+
+func (c *compressingStoreTestSuite) TestRoundTrip() {
+	value := strings.Repeat(`{"bacon":"crispy"}`, 100)
+
+	for _, codec := range CompressionCodecs() {
+		sut := c.compressing(codec)
+		c.NoError(sut.Set("bacon", value))
+
+		c.Less(len(c.stored("bacon")), len(value)/4, codec)
+		c.Equal(value, c.get(sut, "bacon"), codec)
+	}
+}
+
+func (c *compressingStoreTestSuite) TestReadsAnyCodec() {
+	value := strings.Repeat("bacon", 100)
+	c.NoError(c.compressing("gzip").Set("bacon", value))
+
+	c.Equal(value, c.get(c.compressing("zstd"), "bacon"))
+}
+
+func (c *compressingStoreTestSuite) TestBelowThreshold() {
+	sut := c.compressing("zstd")
+	c.NoError(sut.Set("bacon", "tasty"))
+
+	c.Equal("\xf8tasty", c.stored("bacon"))
+	c.Equal("tasty", c.get(sut, "bacon"))
+}
+
+func (c *compressingStoreTestSuite) TestIncompressible() {
+	sut := c.compressing("snappy")
+	value := "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10"
+	c.NoError(sut.Set("bacon", value))
+
+	c.Equal("\xf8"+value, c.stored("bacon"))
+	c.Equal(value, c.get(sut, "bacon"))
+}
+
+func (c *compressingStoreTestSuite) TestValueStartingWithHeader() {
+	sut := c.compressing("zstd")
+	c.NoError(sut.Set("bacon", "\xf9tasty"))
+
+	c.Equal("\xf8\xf9tasty", c.stored("bacon"))
+	c.Equal("\xf9tasty", c.get(sut, "bacon"))
+}
+
+func (c *compressingStoreTestSuite) TestLegacyValues() {
+	legacy := map[string]string{
+		"bacon":   "tasty",
+		"cabbage": "\xfanot snappy",
+		"carrot":  "",
+	}
+	for key, value := range legacy {
+		c.NoError(c.store.Set(key, value))
+	}
+
+	sut := c.compressing("zstd")
+	for key, value := range legacy {
+		c.Equal(value, c.get(sut, key), key)
+	}
+
+	sut.RequireHeader = true
+	for key := range legacy {
+		_, found, err := sut.Get(key)
+		c.False(found, key)
+		c.Equal(ErrMalformedCompressedValue, errors.Cause(err), key)
+	}
+}
+
+func (c *compressingStoreTestSuite) TestFrameValues() {
+	legacy := map[string]string{
+		"bacon":   strings.Repeat("tasty", 100),
+		"cabbage": "\xfanot snappy",
+		"egg":     "",
+	}
+	for key, value := range legacy {
+		c.NoError(c.store.Set(key, value))
+	}
+
+	// Values written with compression enabled already have a header.
+	sut := c.compressing("zstd")
+	c.NoError(sut.Set("carrot", "\xf8raw"))
+
+	framed, err := FrameValues(context.Background(), c.store)
+	c.NoError(err)
+	c.Equal(3, framed)
+
+	sut.RequireHeader = true
+	for key, value := range legacy {
+		c.Equal(value, c.get(sut, key), key)
+	}
+	c.Equal("\xf8raw", c.get(sut, "carrot"))
+
+	c.NoError(sut.Set("bacon", "\xfbtasty"))
+	framed, err = FrameValues(context.Background(), c.store)
+	c.NoError(err)
+	c.Zero(framed)
+	c.Equal("\xfbtasty", c.get(sut, "bacon"))
+}
+
+func (c *compressingStoreTestSuite) TestFrameValues_Resumes() {
+	for i := 0; i < frameBatch+10; i++ {
+		c.NoError(c.store.Set(fmt.Sprintf("bacon%03d", i), "tasty"))
+	}
+
+	_, next, err := c.store.Scan("", frameBatch)
+	c.NoError(err)
+	c.NoError(c.store.Set(compressionKey, framingPrefix+next))
+
+	framed, err := FrameValues(context.Background(), c.store)
+	c.NoError(err)
+	c.Equal(10, framed)
+	c.Equal(framedValues, c.stored(compressionKey))
+
+	c.Equal("tasty", c.stored("bacon000"))
+	c.Equal("\xf8tasty", c.stored(fmt.Sprintf("bacon%03d", frameBatch+9)))
+}
+
+func (c *compressingStoreTestSuite) TestFrameValues_WrittenMeanwhile() {
+	c.NoError(c.store.Set("bacon", "tasty"))
+	c.NoError(c.store.Set("cabbage", "healthy"))
+
+	sut := c.compressing("zstd")
+	framed, err := FrameValues(context.Background(), &versionBumpingStore{Store: c.store, key: "bacon", value: "\xf8crispy"})
+	c.NoError(err)
+	c.Equal(1, framed)
+
+	sut.RequireHeader = true
+	c.Equal("crispy", c.get(sut, "bacon"))
+	c.Equal("healthy", c.get(sut, "cabbage"))
+}
+
+func (c *compressingStoreTestSuite) TestApply() {
+	sut := c.compressing("zstd")
+	c.NoError(sut.Set("cabbage", "raw"))
+
+	value := strings.Repeat("bacon", 100)
+	c.NoError(sut.Apply([]Write{{Key: "bacon", Value: value}, {Key: "cabbage", Delete: true}}, nil))
+
+	c.Equal(headerZstd, c.stored("bacon")[0])
+	c.Equal(value, c.get(sut, "bacon"))
+
+	_, found, err := sut.Get("cabbage")
+	c.False(found)
+	c.NoError(err)
+}
+
+func (c *compressingStoreTestSuite) TestUnknownCodec() {
+	_, err := NewCompressingStore(c.store, "bacon")
+	c.EqualError(err, `unknown compression codec "bacon", expected one of gzip, snappy, zstd`)
+}
+
+func (c *compressingStoreTestSuite) TestReportInfo() {
+	sut := c.compressing("zstd")
+	c.NoError(sut.Set("bacon", strings.Repeat("a", 1000)))
+	c.NoError(sut.Set("cabbage", "raw"))
+
+	info := newServerInfo()
+	sut.reportInfo(info)
+
+	stored := len(c.stored("bacon")) + 4
+	c.Equal(
+		fmt.Sprintf(
+			"# Stats\r\ncompression_codec:zstd\r\ncompression_input_bytes:1003\r\ncompression_output_bytes:%d\r\ncompression_ratio:%.2f\r\n",
+			stored, 1003/float64(stored),
+		),
+		info.render([]string{"stats"}),
+	)
+}
+
+func TestCompressingStore(t *testing.T) {
+	suite.Run(t, new(compressingStoreTestSuite))
+}
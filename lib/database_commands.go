@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+func (s *SessionHandler) validDatabase(db int) bool {
+	return db >= 0 && db < s.server.Databases
+}
+
+// parseDatabase writes the error reply itself if the argument is not a valid
+// database index.
+func (s *SessionHandler) parseDatabase(arg string) (db int, ok bool, err error) {
+	if db, err = strconv.Atoi(arg); err != nil {
+		_, err = fmt.Fprintln(s.writer, "-ERR value is not an integer or out of range")
+		return 0, false, err
+	} else if !s.validDatabase(db) {
+		_, err = fmt.Fprintln(s.writer, "-ERR DB index is out of range")
+		return 0, false, err
+	}
+	return db, true, nil
+}
+
+func (s *SessionHandler) handleSelect(args []string) error {
+	db, ok, err := s.parseDatabase(args[0])
+	if !ok {
+		return err
+	}
+
+	s.use(s.root, db)
+
+	_, err = fmt.Fprintln(s.writer, "+OK")
+	return err
+}
+
+// handleMove moves the key to another database in a single atomic batch,
+// the same way RENAME does within the selected database.
+func (s *SessionHandler) handleMove(args []string) error {
+	key := args[0]
+
+	db, ok, err := s.parseDatabase(args[1])
+	if !ok {
+		return err
+	} else if db == s.db {
+		_, err := fmt.Fprintln(s.writer, "-ERR source and destination objects are the same")
+		return err
+	}
+
+	target := &databaseStore{root: s.root, db: db}
+
+	return s.retryConditional(func() (string, error) {
+		value, found, version, err := readVersioned(s.store, key)
+		if err != nil {
+			return "", err
+		} else if !found {
+			return integer(0), nil
+		}
+
+		_, exists, targetVersion, err := readVersioned(target, key)
+		if err != nil {
+			return "", err
+		} else if exists {
+			return integer(0), nil
+		}
+
+		srcKey, err := s.store.key(key)
+		if err != nil {
+			return "", err
+		}
+
+		dstKey, err := target.key(key)
+		if err != nil {
+			return "", err
+		}
+
+		writes := []Write{{Key: srcKey, Delete: true}, {Key: dstKey, Value: value}}
+		conditions := []Condition{{Key: srcKey, Version: version}, {Key: dstKey, Version: targetVersion}}
+
+		if err := s.root.Apply(writes, conditions); err != nil {
+			return "", errors.Wrap(err, "could not apply writes to the store")
+		}
+
+		s.server.access.rename(accessKey(s.db, key), accessKey(db, key))
+		return integer(1), nil
+	})
+}
+
+// handleSwapDB swaps the namespaces of two databases, which swaps their
+// contents for all clients at once, no matter how many keys they hold.
+func (s *SessionHandler) handleSwapDB(args []string) error {
+	var dbs [2]int
+	for i, name := range []string{"first", "second"} {
+		db, err := strconv.Atoi(args[i])
+		if err != nil {
+			_, err := fmt.Fprintf(s.writer, "-ERR invalid %s DB index\n", name)
+			return err
+		} else if !s.validDatabase(db) {
+			_, err := fmt.Fprintln(s.writer, "-ERR DB index is out of range")
+			return err
+		}
+		dbs[i] = db
+	}
+
+	return s.retryConditional(func() (string, error) {
+		_, err := s.updateDatabases(func(mapping databaseMapping) error {
+			first, second := mapping.namespace(dbs[0]), mapping.namespace(dbs[1])
+			mapping[dbs[0]], mapping[dbs[1]] = second, first
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return simpleString("OK"), nil
+	})
+}
+
+func (s *SessionHandler) handleFlushDB(args []string) error {
+	return s.flush("flushdb", args, []int{s.db})
+}
+
+func (s *SessionHandler) handleFlushAll(args []string) error {
+	dbs := make([]int, 0, s.server.Databases)
+	for db := 0; db < s.server.Databases; db++ {
+		dbs = append(dbs, db)
+	}
+
+	return s.flush("flushall", args, dbs)
+}
+
+// flush gives the databases fresh namespaces, which empties them atomically,
+// and then deletes keys from their old namespaces. That takes a scan of the
+// whole store, so keys are only deleted before replying for as long as the
+// server's FlushTimeLimit, and in the background from then on. With ASYNC,
+// all of them are deleted in the background. Should the node go down before
+// it's done, remaining keys stay in the store, but they're no longer visible
+// in any database.
+func (s *SessionHandler) flush(name string, args []string, dbs []int) error {
+	var async bool
+	switch {
+	case len(args) > 1:
+		return s.badArgs(name)
+	case len(args) == 1 && strings.EqualFold(args[0], "async"):
+		async = true
+	case len(args) == 1 && !strings.EqualFold(args[0], "sync"):
+		_, err := fmt.Fprintln(s.writer, "-ERR syntax error")
+		return err
+	}
+
+	return s.retryConditional(func() (string, error) {
+		released, err := s.updateDatabases(func(mapping databaseMapping) error {
+			for _, db := range dbs {
+				namespace, err := newNamespace()
+				if err != nil {
+					return err
+				}
+				mapping[db] = namespace
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+
+		s.server.access.forgetDatabases(dbs...)
+
+		root := s.root
+		if async {
+			go s.deleteNamespaces(root, released)
+			return simpleString("OK"), nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.server.FlushTimeLimit)
+		defer cancel()
+
+		for i, namespace := range released {
+			err := deleteNamespace(ctx, root, namespace)
+			if errors.Cause(err) == context.DeadlineExceeded {
+				s.logger.Warnf("Deleting flushed keys in the background after %v", s.server.FlushTimeLimit)
+				go s.deleteNamespaces(root, released[i:])
+				break
+			} else if err != nil {
+				return "", errors.Wrap(err, "could not delete flushed keys")
+			}
+		}
+
+		return simpleString("OK"), nil
+	})
+}
+
+// deleteNamespaces deletes keys of flushed databases in the background.
+func (s *SessionHandler) deleteNamespaces(root Store, namespaces []string) {
+	for _, namespace := range namespaces {
+		if err := deleteNamespace(context.Background(), root, namespace); err != nil {
+			s.logger.Errorf("Could not delete flushed keys: %v", err)
+			return
+		}
+	}
+	s.logger.Infof("Deleted keys of %d flushed namespace(s)", len(namespaces))
+}
+
+// updateDatabases changes the database mapping, conditional on nobody else
+// changing it in the meantime. It returns the namespaces no longer used by
+// any database.
+func (s *SessionHandler) updateDatabases(update func(mapping databaseMapping) error) (released []string, err error) {
+	payload, found, version, err := readVersioned(s.root, databasesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, err := decodeDatabaseMapping(payload, found)
+	if err != nil {
+		return nil, err
+	}
+
+	before := s.namespaces(mapping)
+	if err := update(mapping); err != nil {
+		return nil, err
+	}
+	after := s.namespaces(mapping)
+
+	for namespace := range before {
+		if !after[namespace] {
+			released = append(released, namespace)
+		}
+	}
+	sort.Strings(released)
+
+	write := Write{Key: databasesKey, Value: mapping.encode()}
+	if err := s.root.Apply([]Write{write}, []Condition{{Key: databasesKey, Version: version}}); err != nil {
+		return nil, errors.Wrap(err, "could not apply writes to the store")
+	}
+
+	return released, nil
+}
+
+// namespaces returns the namespaces of all databases.
+func (s *SessionHandler) namespaces(mapping databaseMapping) map[string]bool {
+	ret := make(map[string]bool, s.server.Databases)
+	for db := 0; db < s.server.Databases; db++ {
+		ret[mapping.namespace(db)] = true
+	}
+	return ret
+}
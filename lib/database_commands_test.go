@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// withInMemoryStore replaces the mock store, since database commands are all
+// about how keys end up laid out in the store.
+func (s *sessionHandlerTestSuite) withInMemoryStore() Store {
+	store := NewInMemoryStore()
+	s.server.Store = store
+	s.sut.use(store, 0)
+	return store
+}
+
+func (s *sessionHandlerTestSuite) TestSelect() {
+	store := s.withInMemoryStore()
+
+	fmt.Fprint(s.conn, "SET bacon tasty\nSELECT 1\nGET bacon\nSET bacon crispy\nSELECT 0\nGET bacon\n")
+
+	s.handleLines(6)
+	s.responded("+OK\n+OK\n$-1\n+OK\n+OK\n$5\ntasty")
+
+	value, _, _ := store.Get("\x00db1:bacon")
+	s.Equal("crispy", value)
+}
+
+func (s *sessionHandlerTestSuite) TestSelect_Invalid() {
+	fmt.Fprint(s.conn, "SELECT one\nSELECT 16\nSELECT -1\n")
+
+	s.handleLines(3)
+	s.responded("-ERR value is not an integer or out of range\n-ERR DB index is out of range\n-ERR DB index is out of range")
+	s.Zero(s.sut.db)
+}
+
+func (s *sessionHandlerTestSuite) TestSelect_InTransaction() {
+	store := s.withInMemoryStore()
+
+	fmt.Fprint(s.conn, "MULTI\nSELECT 2\nSET bacon tasty\nEXEC\n")
+
+	s.handleLines(4)
+	s.responded("+OK\n+QUEUED\n+QUEUED\n*2\n+OK\n+OK")
+	s.Equal(2, s.sut.db)
+	s.Equal(store, s.sut.root)
+
+	_, found, _ := store.Get("\x00db2:bacon")
+	s.True(found)
+}
+
+func (s *sessionHandlerTestSuite) TestSelect_InScript() {
+	s.withInMemoryStore()
+
+	fmt.Fprint(s.conn, "EVAL \"redis.call('SELECT', 1) return redis.call('SET', 'bacon', 'tasty')\" 0\nGET bacon\nSELECT 1\nGET bacon\n")
+
+	s.handleLines(4)
+	s.responded("+OK\n$-1\n+OK\n$5\ntasty")
+}
+
+func (s *sessionHandlerTestSuite) TestMove() {
+	s.withInMemoryStore()
+
+	fmt.Fprint(s.conn, "SET bacon tasty\nMOVE bacon 1\nGET bacon\nMOVE bacon 1\nSELECT 1\nGET bacon\n")
+
+	s.handleLines(6)
+	s.responded("+OK\n:1\n$-1\n:0\n+OK\n$5\ntasty")
+}
+
+func (s *sessionHandlerTestSuite) TestMove_DestinationExists() {
+	s.withInMemoryStore()
+
+	fmt.Fprint(s.conn, "SELECT 1\nSET bacon crispy\nSELECT 0\nSET bacon tasty\nMOVE bacon 1\nGET bacon\n")
+
+	s.handleLines(6)
+	s.responded("+OK\n+OK\n+OK\n+OK\n:0\n$5\ntasty")
+}
+
+func (s *sessionHandlerTestSuite) TestMove_Invalid() {
+	fmt.Fprint(s.conn, "MOVE bacon 0\nMOVE bacon one\nMOVE bacon 16\n")
+
+	s.handleLines(3)
+	s.responded(
+		"-ERR source and destination objects are the same\n" +
+			"-ERR value is not an integer or out of range\n" +
+			"-ERR DB index is out of range",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestCopy_OtherDatabase() {
+	s.withInMemoryStore()
+
+	fmt.Fprint(s.conn, "SET bacon tasty\nCOPY bacon bacon DB 1\nSELECT 1\nGET bacon\n")
+
+	s.handleLines(4)
+	s.responded("+OK\n:1\n+OK\n$5\ntasty")
+}
+
+func (s *sessionHandlerTestSuite) TestSwapDB() {
+	store := s.withInMemoryStore()
+	other := NewSessionHandler(s.conn, logrus.NewEntry(logrus.New()), s.server)
+
+	fmt.Fprint(s.conn, "SET bacon tasty\nSELECT 1\nSET bacon crispy\nSWAPDB 0 1\nGET bacon\n")
+	s.handleLines(5)
+	s.responded("+OK\n+OK\n+OK\n+OK\n$5\ntasty")
+	s.buffer.Reset()
+
+	fmt.Fprint(s.conn, "GET bacon\n")
+	s.True(other.handleLine())
+	s.responded("$6\ncrispy")
+
+	// Keys stay where they were - only namespaces have been swapped.
+	keys, _, _ := store.Scan("", 10)
+	s.Equal([]string{"\x00db1:bacon", databasesKey, "bacon"}, keys)
+}
+
+func (s *sessionHandlerTestSuite) TestSwapDB_Invalid() {
+	fmt.Fprint(s.conn, "SWAPDB zero 1\nSWAPDB 0 one\nSWAPDB 0 16\n")
+
+	s.handleLines(3)
+	s.responded(
+		"-ERR invalid first DB index\n" +
+			"-ERR invalid second DB index\n" +
+			"-ERR DB index is out of range",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestSwapDB_AbortsWatchingTransaction() {
+	s.withInMemoryStore()
+	other := NewSessionHandler(s.conn, logrus.NewEntry(logrus.New()), s.server)
+
+	fmt.Fprint(s.conn, "WATCH bacon\n")
+	s.True(s.sut.handleLine())
+	s.buffer.Reset()
+
+	fmt.Fprint(s.conn, "SWAPDB 0 1\n")
+	s.True(other.handleLine())
+	s.buffer.Reset()
+
+	fmt.Fprint(s.conn, "MULTI\nSET bacon tasty\nEXEC\n")
+	s.handleLines(3)
+	s.responded("+OK\n+QUEUED\n*-1")
+}
+
+func (s *sessionHandlerTestSuite) TestFlushDB() {
+	store := s.withInMemoryStore()
+
+	fmt.Fprint(s.conn, "SET bacon tasty\nSELECT 1\nSET cabbage healthy\nSELECT 0\nFLUSHDB\nDBSIZE\nSELECT 1\nDBSIZE\n")
+
+	s.handleLines(8)
+	s.responded("+OK\n+OK\n+OK\n+OK\n+OK\n:0\n+OK\n:1")
+
+	_, found, _ := store.Get("bacon")
+	s.False(found)
+
+	// Access history goes along with the keys.
+	s.NotContains(s.server.access.shard("bacon").keys, "bacon")
+	s.Contains(s.server.access.shard(accessKey(1, "cabbage")).keys, accessKey(1, "cabbage"))
+}
+
+func (s *sessionHandlerTestSuite) TestFlushAll_Async() {
+	store := s.withInMemoryStore()
+
+	fmt.Fprint(s.conn, "SET bacon tasty\nSELECT 1\nSET cabbage healthy\nFLUSHALL ASYNC\nDBSIZE\nSELECT 0\nDBSIZE\n")
+
+	s.handleLines(7)
+	s.responded("+OK\n+OK\n+OK\n+OK\n:0\n+OK\n:0")
+
+	// Only the mapping remains once the old keys are deleted.
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if keys, _, _ := store.Scan("", 10); len(keys) == 1 {
+			break
+		}
+	}
+
+	keys, _, _ := store.Scan("", 10)
+	s.Equal([]string{databasesKey}, keys)
+}
+
+func (s *sessionHandlerTestSuite) TestFlushDB_TimeLimit() {
+	store := s.withInMemoryStore()
+	s.server.FlushTimeLimit = 0
+
+	fmt.Fprint(s.conn, "SET bacon tasty\nFLUSHDB SYNC\nDBSIZE\n")
+
+	s.handleLines(3)
+	s.responded("+OK\n+OK\n:0")
+
+	// Keys left once the time limit is up are deleted in the background.
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, found, _ := store.Get("bacon"); !found {
+			break
+		}
+	}
+
+	_, found, _ := store.Get("bacon")
+	s.False(found)
+}
+
+func (s *sessionHandlerTestSuite) TestFlushDB_Invalid() {
+	fmt.Fprint(s.conn, "FLUSHDB NOW\nFLUSHALL SYNC ASYNC\nMULTI\nFLUSHDB\n")
+
+	s.handleLines(4)
+	s.responded(
+		"-ERR syntax error\n" +
+			"-ERR wrong number of arguments for 'flushall' command\n" +
+			"+OK\n" +
+			"-ERR Command 'flushdb' not allowed inside a transaction",
+	)
+}
@@ -0,0 +1,264 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultDatabases is the number of databases clients can SELECT, as in
+	// Redis.
+	DefaultDatabases = 16
+
+	// DefaultFlushTimeLimit is how long FLUSHDB and FLUSHALL without ASYNC
+	// delete keys before replying.
+	DefaultFlushTimeLimit = 5 * time.Second
+
+	// databasesKey holds the namespaces of databases which have been swapped
+	// or flushed.
+	databasesKey = internalKeyPrefix + "goredis:databases"
+)
+
+// databaseMapping assigns namespaces to databases. A namespace is a prefix
+// shared by all keys of a database, so swapping databases only swaps their
+// namespaces, and flushing a database gives it a fresh one. Databases not in
+// the mapping use their default namespace.
+type databaseMapping map[int]string
+
+// defaultNamespace leaves keys of database 0 unprefixed, so that keys written
+// before goredis supported databases remain where they were. Other databases
+// are prefixed like internal keys, which keeps them out of sight of database
+// 0 clients.
+func defaultNamespace(db int) string {
+	if db == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%sdb%d:", internalKeyPrefix, db)
+}
+
+// newNamespace returns a namespace which has never been used before.
+func newNamespace() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "could not generate namespace")
+	}
+	return internalKeyPrefix + "ns" + hex.EncodeToString(id) + ":", nil
+}
+
+func (m databaseMapping) namespace(db int) string {
+	if namespace, exists := m[db]; exists {
+		return namespace
+	}
+	return defaultNamespace(db)
+}
+
+func decodeDatabaseMapping(payload string, found bool) (databaseMapping, error) {
+	ret := make(databaseMapping)
+	if !found {
+		return ret, nil
+	}
+
+	err := json.Unmarshal([]byte(payload), &ret)
+	return ret, errors.Wrap(err, "malformed database mapping")
+}
+
+func (m databaseMapping) encode() string {
+	// Maps with integer keys can always be encoded.
+	ret, _ := json.Marshal(m)
+	return string(ret)
+}
+
+// accessKey identifies a key within a database for the access tracker.
+func accessKey(db int, key string) string {
+	if db == 0 {
+		return key
+	}
+	return strconv.Itoa(db) + internalKeyPrefix + key
+}
+
+// accessKeyDatabase returns the database of a key identified by accessKey.
+func accessKeyDatabase(key string) int {
+	if i := strings.Index(key, internalKeyPrefix); i > 0 {
+		if db, err := strconv.Atoi(key[:i]); err == nil {
+			return db
+		}
+	}
+	return 0
+}
+
+// databaseStore is a view of a single database within the root store. Every
+// operation looks the namespace of the database up first, with a strongly
+// consistent read, since a mapping cached before another node swapped or
+// flushed databases would point at the wrong keys. Internal keys are shared
+// by all databases, so they're passed through as they are.
+type databaseStore struct {
+	root Store
+	db   int
+
+	// consistent makes reads of keys strongly consistent.
+	consistent bool
+}
+
+func (d *databaseStore) namespace() (string, error) {
+	payload, found, err := getContext(WithConsistentRead(context.Background()), d.root, databasesKey)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read database mapping")
+	}
+
+	mapping, err := decodeDatabaseMapping(payload, found)
+	if err != nil {
+		return "", err
+	}
+
+	return mapping.namespace(d.db), nil
+}
+
+// key returns the key as stored in the root store. Internal keys are shared
+// by all databases, and only reached by goredis itself, since commands reject
+// them as keys.
+func (d *databaseStore) key(key string) (string, error) {
+	if internalKey(key) {
+		return key, nil
+	}
+
+	namespace, err := d.namespace()
+	return namespace + key, err
+}
+
+func (d *databaseStore) Get(key string) (value string, found bool, err error) {
+	return d.GetContext(context.Background(), key)
+}
+
+// GetContext is Get passing the context on to the root store.
+func (d *databaseStore) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	if key, err = d.key(key); err != nil {
+		return
+	}
+
+	if d.consistent {
+		ctx = WithConsistentRead(ctx)
+	}
+	return getContext(ctx, d.root, key)
+}
+
+func (d *databaseStore) Set(key string, value string) error {
+	key, err := d.key(key)
+	if err != nil {
+		return err
+	}
+	return d.root.Set(key, value)
+}
+
+func (d *databaseStore) Version(key string) (uint64, error) {
+	key, err := d.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return d.root.Version(key)
+}
+
+func (d *databaseStore) Apply(writes []Write, conditions []Condition) error {
+	namespace, err := d.namespace()
+	if err != nil {
+		return err
+	}
+
+	qualify := func(key string) string {
+		if internalKey(key) {
+			return key
+		}
+		return namespace + key
+	}
+
+	mapped := make([]Write, 0, len(writes))
+	for _, write := range writes {
+		write.Key = qualify(write.Key)
+		mapped = append(mapped, write)
+	}
+
+	var mappedConditions []Condition
+	for _, condition := range conditions {
+		condition.Key = qualify(condition.Key)
+		mappedConditions = append(mappedConditions, condition)
+	}
+
+	return d.root.Apply(mapped, mappedConditions)
+}
+
+// Scan goes through the whole root store, returning only keys within the
+// namespace of the database. Pages may contain few keys, or none at all, as
+// in Redis.
+func (d *databaseStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	namespace, err := d.namespace()
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys, next, err = d.root.Scan(cursor, count)
+	return inNamespace(keys, namespace), next, err
+}
+
+// inNamespace returns the keys within the namespace, with the namespace
+// stripped. Keys of the unprefixed namespace are all keys not internal.
+func inNamespace(keys []string, namespace string) []string {
+	var ret []string
+	for _, key := range keys {
+		if namespace == "" && !internalKey(key) {
+			ret = append(ret, key)
+		} else if namespace != "" && strings.HasPrefix(key, namespace) {
+			ret = append(ret, key[len(namespace):])
+		}
+	}
+	return ret
+}
+
+// deleteNamespace deletes all keys within a namespace no longer used by any
+// database, in batches small enough for any store to apply. It scans the
+// whole store, so it stops between pages once the context is done, returning
+// the context error. Keys already deleted stay deleted, so it can be called
+// again later to delete the rest.
+func deleteNamespace(ctx context.Context, store Store, namespace string) error {
+	var cursor string
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		keys, next, err := store.Scan(cursor, keyspacePageSize)
+		if err != nil {
+			return errors.Wrap(err, "could not scan the store")
+		}
+
+		keys = inNamespace(keys, namespace)
+
+		for len(keys) > 0 {
+			batch := keys
+			if len(batch) > maxTransactionItems {
+				batch = batch[:maxTransactionItems]
+			}
+			keys = keys[len(batch):]
+
+			writes := make([]Write, 0, len(batch))
+			for _, key := range batch {
+				writes = append(writes, Write{Key: namespace + key, Delete: true})
+			}
+
+			if err := store.Apply(writes, nil); err != nil {
+				return errors.Wrap(err, "could not delete keys")
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
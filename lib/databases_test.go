@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type databaseStoreTestSuite struct {
+	suite.Suite
+
+	root Store
+	sut  *databaseStore
+}
+
+func (d *databaseStoreTestSuite) SetupTest() {
+	d.root = NewInMemoryStore()
+	d.sut = &databaseStore{root: d.root, db: 3}
+}
+
+func (d *databaseStoreTestSuite) TestNamespacedKeys() {
+	d.NoError(d.sut.Set("bacon", "tasty"))
+	d.NoError(d.sut.Apply([]Write{{Key: "cabbage", Value: "healthy"}}, []Condition{{Key: "bacon", Version: 1}}))
+
+	value, found, err := d.root.Get("\x00db3:bacon")
+	d.Equal("tasty", value)
+	d.True(found)
+	d.NoError(err)
+
+	value, found, err = d.sut.Get("cabbage")
+	d.Equal("healthy", value)
+	d.True(found)
+	d.NoError(err)
+
+	version, err := d.sut.Version("cabbage")
+	d.Equal(uint64(1), version)
+	d.NoError(err)
+
+	_, found, err = d.root.Get("bacon")
+	d.False(found)
+	d.NoError(err)
+}
+
+func (d *databaseStoreTestSuite) TestInternalKeysAreShared() {
+	d.NoError(d.sut.Set(functionsKey, "libraries"))
+
+	value, _, err := d.root.Get(functionsKey)
+	d.Equal("libraries", value)
+	d.NoError(err)
+}
+
+func (d *databaseStoreTestSuite) TestMapping() {
+	d.NoError(d.root.Set(databasesKey, databaseMapping{3: "\x00nsabc:"}.encode()))
+	d.NoError(d.sut.Set("bacon", "tasty"))
+
+	_, found, err := d.root.Get("\x00nsabc:bacon")
+	d.True(found)
+	d.NoError(err)
+}
+
+func (d *databaseStoreTestSuite) TestMalformedMapping() {
+	d.NoError(d.root.Set(databasesKey, "bacon"))
+
+	_, _, err := d.sut.Get("bacon")
+	d.Error(err)
+	d.Contains(err.Error(), "malformed database mapping")
+}
+
+func (d *databaseStoreTestSuite) TestScan() {
+	d.NoError(d.root.Set("bacon", "db0"))
+	d.NoError(d.root.Set(functionsKey, "libraries"))
+	d.NoError(d.root.Set("\x00db3:bacon", "db3"))
+	d.NoError(d.root.Set("\x00db3:cabbage", "db3"))
+	d.NoError(d.root.Set("\x00db4:eggs", "db4"))
+
+	keys, next, err := d.sut.Scan("", 10)
+	d.Equal([]string{"bacon", "cabbage"}, keys)
+	d.Empty(next)
+	d.NoError(err)
+
+	keys, _, err = (&databaseStore{root: d.root}).Scan("", 10)
+	d.Equal([]string{"bacon"}, keys)
+	d.NoError(err)
+}
+
+func (d *databaseStoreTestSuite) TestDeleteNamespace() {
+	for i := 0; i < 250; i++ {
+		d.NoError(d.sut.Set(fmt.Sprintf("key%d", i), "value"))
+	}
+	d.NoError(d.root.Set("bacon", "db0"))
+
+	d.NoError(deleteNamespace(context.Background(), d.root, "\x00db3:"))
+
+	keys, _, err := d.root.Scan("", 1000)
+	d.Equal([]string{"bacon"}, keys)
+	d.NoError(err)
+}
+
+func (d *databaseStoreTestSuite) TestDeleteNamespace_Unprefixed() {
+	d.NoError(d.root.Set("bacon", "db0"))
+	d.NoError(d.root.Set(functionsKey, "libraries"))
+	d.NoError(d.sut.Set("cabbage", "db3"))
+
+	d.NoError(deleteNamespace(context.Background(), d.root, ""))
+
+	keys, _, err := d.root.Scan("", 10)
+	d.Equal([]string{"\x00db3:cabbage", functionsKey}, keys)
+	d.NoError(err)
+}
+
+func (d *databaseStoreTestSuite) TestDeleteNamespace_Cancelled() {
+	d.NoError(d.sut.Set("bacon", "db3"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	d.Equal(context.Canceled, deleteNamespace(ctx, d.root, "\x00db3:"))
+
+	_, found, err := d.sut.Get("bacon")
+	d.True(found)
+	d.NoError(err)
+}
+
+func TestDatabaseStore(t *testing.T) {
+	suite.Run(t, new(databaseStoreTestSuite))
+}
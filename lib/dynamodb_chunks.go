@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+const (
+	chunkIDField = "chunk_id"
+	chunksField  = "chunks"
+	dataField    = "data"
+
+	// DefaultDynamoDBChunkSize is the size of the largest value stored in a
+	// single item, leaving room within the 400KB item limit of DynamoDB for
+	// the key and attribute names.
+	DefaultDynamoDBChunkSize = 350 << 10
+
+	// maxChunkedReadAttempts is the number of times a value is read again
+	// after being replaced while its chunks were being read.
+	maxChunkedReadAttempts = 3
+
+	// maxChunkGuardAttempts is the number of times a transaction is tried
+	// again after finding keys with chunks other than the expected ones.
+	maxChunkGuardAttempts = 5
+)
+
+// ErrChunkMissing is returned when the chunks of a value keep disappearing
+// while they're being read, as when it's replaced over and over.
+var ErrChunkMissing = errors.New("chunk of large value missing from DynamoDB")
+
+// dynamoDBManifest lists the chunks of a value too large for a single item.
+// Chunks are items of their own, written before the manifest which points at
+// them and never changed after that, so that replacing the manifest swaps
+// the whole value at once. A zero manifest means that the value is stored in
+// its item, if there's one.
+type dynamoDBManifest struct {
+	id     string
+	chunks int
+}
+
+// manifestOf returns the manifest held by the item, if it holds one.
+func manifestOf(item map[string]*dynamodb.AttributeValue) (dynamoDBManifest, bool) {
+	id, exists := item[chunkIDField]
+	if !exists || id.S == nil {
+		return dynamoDBManifest{}, false
+	}
+
+	var chunks int
+	if count, exists := item[chunksField]; exists && count.N != nil {
+		chunks, _ = strconv.Atoi(*count.N)
+	}
+
+	return dynamoDBManifest{id: *id.S, chunks: chunks}, true
+}
+
+// chunkKey returns the key of a single chunk. Chunk IDs are random, so chunk
+// keys don't collide with keys written by clients, and values written later
+// never overwrite the chunks of earlier ones.
+func chunkKey(key string, id string, chunk int) string {
+	return key + "\x00" + id + "\x00" + strconv.Itoa(chunk)
+}
+
+func newChunkID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "could not generate chunk ID")
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (d *DynamoDBStore) chunkSize() int {
+	if d.ChunkSize <= 0 {
+		return DefaultDynamoDBChunkSize
+	}
+	return d.ChunkSize
+}
+
+// chunked tells whether the value is too large for a single item.
+func (d *DynamoDBStore) chunked(value string) bool {
+	return len(value) > d.chunkSize()
+}
+
+// putChunks writes the chunks of the value, returning the manifest to point
+// at them. Chunks are stored as binary, so that they may split the value
+// anywhere.
+func (d *DynamoDBStore) putChunks(key string, value string) (dynamoDBManifest, error) {
+	id, err := newChunkID()
+	if err != nil {
+		return dynamoDBManifest{}, err
+	}
+
+	table := d.table(key)
+	manifest := dynamoDBManifest{id: id}
+	for start := 0; start < len(value); start += d.chunkSize() {
+		end := start + d.chunkSize()
+		if end > len(value) {
+			end = len(value)
+		}
+
+		item := table.Schema.key(chunkKey(key, id, manifest.chunks))
+		item[dataField] = &dynamodb.AttributeValue{B: []byte(value[start:end])}
+
+		err := d.write(true, func(ctx context.Context) error {
+			_, err := d.API.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+				Item:      item,
+				TableName: aws.String(table.Name),
+			})
+			return err
+		})
+		if err != nil {
+			d.dropChunks(key, manifest)
+			return dynamoDBManifest{}, apiError(err)
+		}
+		manifest.chunks++
+	}
+
+	return manifest, nil
+}
+
+// readChunks reads the chunks the manifest points at, and tells whether all
+// of them were there. They're read with strong consistency, since they may
+// have just been written.
+func (d *DynamoDBStore) readChunks(ctx context.Context, key string, manifest dynamoDBManifest) (value string, complete bool, err error) {
+	table := d.table(key)
+	var ret strings.Builder
+	for chunk := 0; chunk < manifest.chunks; chunk++ {
+		input := &dynamodb.GetItemInput{
+			ConsistentRead: aws.Bool(true),
+			Key:            table.Schema.key(chunkKey(key, manifest.id, chunk)),
+			TableName:      aws.String(table.Name),
+		}
+
+		var out *dynamodb.GetItemOutput
+		err := d.read(ctx, func(ctx context.Context) (err error) {
+			out, err = d.API.GetItemWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return "", false, err
+		}
+
+		data, exists := out.Item[dataField]
+		if !exists {
+			return "", false, nil
+		}
+		ret.Write(data.B)
+	}
+
+	return ret.String(), true, nil
+}
+
+// dropChunks deletes the chunks the manifest points at. Chunks left behind
+// take up space but are never read, so failing to delete them is no reason
+// to fail the write which replaced them.
+func (d *DynamoDBStore) dropChunks(key string, manifest dynamoDBManifest) {
+	table := d.table(key)
+	for chunk := 0; chunk < manifest.chunks; chunk++ {
+		input := &dynamodb.DeleteItemInput{
+			Key:       table.Schema.key(chunkKey(key, manifest.id, chunk)),
+			TableName: aws.String(table.Name),
+		}
+
+		d.write(true, func(ctx context.Context) error {
+			_, err := d.API.DeleteItemWithContext(ctx, input)
+			return err
+		})
+	}
+}
+
+// manifests reads the manifests of the written keys, with strong consistency,
+// leaving out the keys which hold no manifest.
+func (d *DynamoDBStore) manifests(writes []Write) (map[string]dynamoDBManifest, error) {
+	ret := make(map[string]dynamoDBManifest)
+	for _, write := range writes {
+		table := d.table(write.Key)
+		input := &dynamodb.GetItemInput{
+			ConsistentRead: aws.Bool(true),
+			ExpressionAttributeNames: map[string]*string{
+				"#chunk_id": aws.String(chunkIDField),
+				"#chunks":   aws.String(chunksField),
+			},
+			Key:                  table.Schema.key(write.Key),
+			ProjectionExpression: aws.String("#chunk_id, #chunks"),
+			TableName:            aws.String(table.Name),
+		}
+
+		var out *dynamodb.GetItemOutput
+		err := d.read(context.Background(), func(ctx context.Context) (err error) {
+			out, err = d.API.GetItemWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if manifest, chunked := manifestOf(out.Item); chunked {
+			ret[write.Key] = manifest
+		}
+	}
+	return ret, nil
+}
+
+// holdsAnyOf tells whether any key holds the manifest written for it, which
+// no other write can have pointed it at.
+func holdsAnyOf(current, written map[string]dynamoDBManifest) bool {
+	for key, manifest := range written {
+		if current[key] == manifest {
+			return true
+		}
+	}
+	return false
+}
+
+// sameManifests tells whether keys hold the same manifests in both.
+func sameManifests(a, b map[string]dynamoDBManifest) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, manifest := range a {
+		if other, exists := b[key]; !exists || other != manifest {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,516 @@
+package lib
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type fakeItem map[string]*dynamodb.AttributeValue
+
+// fakeDynamo is a set of tables in memory, which understands just enough of
+// the expressions built by DynamoDBStore to check what ends up in the tables.
+// Items are kept by table and key, as made by fakeKey.
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+
+	items map[string]fakeItem
+
+	// keys are the key attributes of tables other than the default ones.
+	keys map[string][]string
+
+	// beforeWrite, if set, runs before every write, once.
+	beforeWrite func()
+
+	// lostWrite, if set, is returned by the next update or transaction,
+	// once it's been applied, as if its response got lost.
+	lostWrite error
+
+	// tokens, if set, holds the client request tokens of the transactions
+	// applied, which are not applied again.
+	tokens map[string]bool
+
+	lock *sync.Mutex
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{items: make(map[string]fakeItem), keys: make(map[string][]string), lock: new(sync.Mutex)}
+}
+
+// fakeKey is where the item with the key is kept, which is the table followed
+// by the key attributes of the item, separated by slashes.
+func (f *fakeDynamo) fakeKey(table *string, item fakeItem) string {
+	ret := *table
+	for _, name := range f.keyAttributes(*table) {
+		ret += "/" + aws.StringValue(item[name].S)
+	}
+	return ret
+}
+
+func (f *fakeDynamo) keyAttributes(table string) []string {
+	if names, exists := f.keys[table]; exists {
+		return names
+	}
+	return []string{keyField}
+}
+
+func (f *fakeDynamo) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return &dynamodb.GetItemOutput{Item: f.items[f.fakeKey(input.TableName, input.Key)]}, nil
+}
+
+func (f *fakeDynamo) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.items[f.fakeKey(input.TableName, input.Item)] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.items, f.fakeKey(input.TableName, input.Key))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeDynamo) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	f.interfere()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := f.fakeKey(input.TableName, input.Key)
+	old := f.items[key]
+	if !f.holds(old, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "bacon", nil)
+	}
+
+	f.items[key] = f.update(input.Key, old, input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err := f.lose(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: old}, nil
+}
+
+func (f *fakeDynamo) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.interfere()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if token := aws.StringValue(input.ClientRequestToken); f.tokens[token] {
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	} else if f.tokens != nil {
+		f.tokens[token] = true
+	}
+
+	failed := false
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	for i, item := range input.TransactItems {
+		var holds bool
+		switch {
+		case item.Update != nil:
+			holds = f.holds(f.items[f.fakeKey(item.Update.TableName, item.Update.Key)], item.Update.ConditionExpression, item.Update.ExpressionAttributeNames, item.Update.ExpressionAttributeValues)
+		case item.ConditionCheck != nil:
+			holds = f.holds(f.items[f.fakeKey(item.ConditionCheck.TableName, item.ConditionCheck.Key)], item.ConditionCheck.ConditionExpression, item.ConditionCheck.ExpressionAttributeNames, item.ConditionCheck.ExpressionAttributeValues)
+		}
+
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+		if !holds {
+			failed = true
+			reasons[i].Code = aws.String("ConditionalCheckFailed")
+		}
+	}
+
+	if failed {
+		return nil, &dynamodb.TransactionCanceledException{CancellationReasons: reasons}
+	}
+
+	for _, item := range input.TransactItems {
+		switch {
+		case item.Update != nil:
+			key := f.fakeKey(item.Update.TableName, item.Update.Key)
+			f.items[key] = f.update(item.Update.Key, f.items[key], item.Update.UpdateExpression, item.Update.ExpressionAttributeNames, item.Update.ExpressionAttributeValues)
+		}
+	}
+
+	if err := f.lose(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// lose must be called with the lock held.
+func (f *fakeDynamo) lose() error {
+	err := f.lostWrite
+	f.lostWrite = nil
+	return err
+}
+
+func (f *fakeDynamo) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var keys []string
+	for key := range f.items {
+		if strings.HasPrefix(key, *input.TableName+"/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var start string
+	if input.ExclusiveStartKey != nil {
+		start = f.fakeKey(input.TableName, input.ExclusiveStartKey)
+	}
+
+	// The limit applies to the items scanned, before they're filtered.
+	out := &dynamodb.ScanOutput{}
+	var scanned int64
+	for _, key := range keys {
+		if key <= start {
+			continue
+		}
+
+		item := f.items[key]
+		if f.holds(item, input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+			out.Items = append(out.Items, item)
+		}
+
+		if scanned++; input.Limit != nil && scanned == *input.Limit {
+			out.LastEvaluatedKey = f.primaryKey(input.TableName, item)
+			break
+		}
+	}
+	return out, nil
+}
+
+// primaryKey returns the key attributes of the item.
+func (f *fakeDynamo) primaryKey(table *string, item fakeItem) fakeItem {
+	ret := make(fakeItem)
+	for _, name := range f.keyAttributes(*table) {
+		ret[name] = item[name]
+	}
+	return ret
+}
+
+// interfere runs beforeWrite, outside of the lock.
+func (f *fakeDynamo) interfere() {
+	f.lock.Lock()
+	before := f.beforeWrite
+	f.beforeWrite = nil
+	f.lock.Unlock()
+
+	if before != nil {
+		before()
+	}
+}
+
+func (f *fakeDynamo) holds(item fakeItem, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) bool {
+	if condition == nil {
+		return true
+	}
+
+	for _, term := range strings.Split(*condition, " AND ") {
+		if !f.holdsAny(item, strings.Split(term, " OR "), names, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// holdsAny tells whether the item meets any of the terms.
+func (f *fakeDynamo) holdsAny(item fakeItem, terms []string, names map[string]*string, values map[string]*dynamodb.AttributeValue) bool {
+	for _, term := range terms {
+		switch {
+		case strings.HasPrefix(term, "attribute_exists("):
+			name := *names[strings.TrimSuffix(strings.TrimPrefix(term, "attribute_exists("), ")")]
+			if _, exists := item[name]; exists {
+				return true
+			}
+		case strings.HasPrefix(term, "attribute_not_exists("):
+			name := *names[strings.TrimSuffix(strings.TrimPrefix(term, "attribute_not_exists("), ")")]
+			if _, exists := item[name]; !exists {
+				return true
+			}
+		case strings.HasPrefix(term, "attribute_type("):
+			parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(term, "attribute_type("), ")"), ", ")
+			if fakeType(item[*names[parts[0]]]) == *values[parts[1]].S {
+				return true
+			}
+		default:
+			parts := strings.Split(term, " = ")
+			actual, exists := item[*names[parts[0]]]
+			if exists && fakeType(actual) == fakeType(values[parts[1]]) && fakeString(actual) == fakeString(values[parts[1]]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func fakeType(value *dynamodb.AttributeValue) string {
+	switch {
+	case value == nil:
+		return ""
+	case value.B != nil:
+		return dynamodb.ScalarAttributeTypeB
+	case value.N != nil:
+		return dynamodb.ScalarAttributeTypeN
+	default:
+		return dynamodb.ScalarAttributeTypeS
+	}
+}
+
+func fakeString(value *dynamodb.AttributeValue) string {
+	return aws.StringValue(value.S) + aws.StringValue(value.N) + string(value.B)
+}
+
+// update applies an expression made of SET, REMOVE and ADD clauses, in that
+// order.
+func (f *fakeDynamo) update(key, old fakeItem, expression *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) fakeItem {
+	item := make(fakeItem)
+	for name, value := range key {
+		item[name] = value
+	}
+	for name, value := range old {
+		item[name] = value
+	}
+
+	rest := " " + *expression
+	if i := strings.Index(rest, " ADD "); i >= 0 {
+		parts := strings.Fields(rest[i+5:])
+		var current int
+		if value, exists := item[*names[parts[0]]]; exists {
+			current, _ = strconv.Atoi(*value.N)
+		}
+		increment, _ := strconv.Atoi(*values[parts[1]].N)
+		item[*names[parts[0]]] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(current + increment))}
+		rest = rest[:i]
+	}
+	if i := strings.Index(rest, " REMOVE "); i >= 0 {
+		for _, name := range strings.Split(rest[i+8:], ", ") {
+			delete(item, *names[name])
+		}
+		rest = rest[:i]
+	}
+	if rest == "" {
+		return item
+	}
+	for _, assignment := range strings.Split(strings.TrimPrefix(rest, " SET "), ", ") {
+		parts := strings.Split(assignment, " = ")
+		item[*names[parts[0]]] = values[parts[1]]
+	}
+
+	return item
+}
+
+// chunkItems returns the number of chunk items in the table.
+func (f *fakeDynamo) chunkItems() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var ret int
+	for _, item := range f.items {
+		if _, exists := item[dataField]; exists {
+			ret++
+		}
+	}
+	return ret
+}
+
+type dynamoDBChunksTestSuite struct {
+	suite.Suite
+
+	api *fakeDynamo
+	sut *DynamoDBStore
+}
+
+func (d *dynamoDBChunksTestSuite) SetupTest() {
+	d.api = newFakeDynamo()
+	d.sut = &DynamoDBStore{API: d.api, TableName: "table", ChunkSize: 4}
+}
+
+func (d *dynamoDBChunksTestSuite) get(key string) string {
+	value, found, err := d.sut.Get(key)
+	d.Require().NoError(err)
+	d.Require().True(found)
+	return value
+}
+
+func (d *dynamoDBChunksTestSuite) TestSet() {
+	d.NoError(d.sut.Set("bacon", "crispy\x00\xffbacon"))
+	d.Equal(4, d.api.chunkItems())
+	d.Equal("crispy\x00\xffbacon", d.get("bacon"))
+
+	version, err := d.sut.Version("bacon")
+	d.Equal(uint64(1), version)
+	d.NoError(err)
+}
+
+func (d *dynamoDBChunksTestSuite) TestSet_ReplacesChunks() {
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+	d.NoError(d.sut.Set("bacon", "chewy bacon"))
+	d.Equal(3, d.api.chunkItems())
+	d.Equal("chewy bacon", d.get("bacon"))
+
+	d.NoError(d.sut.Set("bacon", "raw"))
+	d.Zero(d.api.chunkItems())
+	d.Equal("raw", d.get("bacon"))
+}
+
+func (d *dynamoDBChunksTestSuite) TestSet_ResponseLost() {
+	d.sut.Retries = NewRetryPolicy(4)
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+
+	// The attempt made again replaces the value written by the first one,
+	// so the chunks of the value before are never known to be replaced.
+	d.api.lostWrite = awserr.New(dynamodb.ErrCodeInternalServerError, "bacon", nil)
+	d.NoError(d.sut.Set("bacon", "chewy bacon"))
+	d.Equal(6, d.api.chunkItems())
+	d.Equal("chewy bacon", d.get("bacon"))
+}
+
+func (d *dynamoDBChunksTestSuite) TestSet_ConnectionReset() {
+	d.sut.Retries = NewRetryPolicy(4)
+	d.api.lostWrite = awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("read: connection reset by peer"))
+
+	d.Equal(ErrOutcomeUnknown, errors.Cause(d.sut.Set("bacon", "crispy bacon")))
+	d.Equal("crispy bacon", d.get("bacon"))
+
+	version, err := d.sut.Version("bacon")
+	d.Equal(uint64(1), version)
+	d.NoError(err)
+}
+
+func (d *dynamoDBChunksTestSuite) TestSet_TooLarge() {
+	d.Equal(ErrValueTooLarge, d.sut.Set("bacon", strings.Repeat("x", MaxValueSize+1)))
+}
+
+func (d *dynamoDBChunksTestSuite) TestGet_ReplacedWhileReading() {
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+
+	// The item keeps pointing at chunks which are gone.
+	manifest, _ := manifestOf(d.api.items["table/bacon"])
+	d.NoError(d.sut.Set("bacon", "chewy bacon"))
+	d.api.items["table/bacon"][chunkIDField] = &dynamodb.AttributeValue{S: aws.String(manifest.id)}
+
+	_, _, err := d.sut.Get("bacon")
+	d.Equal(ErrChunkMissing, err)
+}
+
+func (d *dynamoDBChunksTestSuite) TestApply() {
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "crispy bacon"}, {Key: "eggs", Value: "ok"}}, nil))
+	d.Equal(3, d.api.chunkItems())
+	d.Equal("crispy bacon", d.get("bacon"))
+	d.Equal("ok", d.get("eggs"))
+
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Delete: true}, {Key: "eggs", Value: "scrambled"}}, nil))
+	d.Equal(3, d.api.chunkItems())
+
+	_, found, err := d.sut.Get("bacon")
+	d.False(found)
+	d.NoError(err)
+	d.Equal("scrambled", d.get("eggs"))
+
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "raw"}, {Key: "eggs", Delete: true}}, nil))
+	d.Zero(d.api.chunkItems())
+	d.Equal("raw", d.get("bacon"))
+}
+
+func (d *dynamoDBChunksTestSuite) TestApply_ConditionFailed() {
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+
+	err := d.sut.Apply([]Write{{Key: "bacon", Value: "chewy bacon"}}, []Condition{{Key: "bacon", Version: 2}})
+	d.Equal(ErrConditionFailed, err)
+	d.Equal(3, d.api.chunkItems())
+	d.Equal("crispy bacon", d.get("bacon"))
+
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "chewy bacon"}}, []Condition{{Key: "bacon", Version: 1}}))
+	d.Equal(3, d.api.chunkItems())
+	d.Equal("chewy bacon", d.get("bacon"))
+}
+
+func (d *dynamoDBChunksTestSuite) TestApply_ChunkedConcurrently() {
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+
+	d.api.beforeWrite = func() { d.NoError(d.sut.Set("bacon", "chewy bacon")) }
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "raw"}, {Key: "eggs", Value: "ok"}}, nil))
+
+	d.Zero(d.api.chunkItems())
+	d.Equal("raw", d.get("bacon"))
+}
+
+func (d *dynamoDBChunksTestSuite) TestApply_ResponseLost() {
+	d.sut.Retries = NewRetryPolicy(4)
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+
+	// The attempt made again finds the key holding its own chunks.
+	d.api.lostWrite = awserr.New(dynamodb.ErrCodeInternalServerError, "bacon", nil)
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "chewy bacon"}, {Key: "eggs", Value: "ok"}}, nil))
+	d.Equal(3, d.api.chunkItems())
+	d.Equal("chewy bacon", d.get("bacon"))
+	d.Equal("ok", d.get("eggs"))
+}
+
+func (d *dynamoDBChunksTestSuite) TestApply_ConnectionReset() {
+	d.sut.Retries = NewRetryPolicy(4)
+	d.api.tokens = make(map[string]bool)
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+
+	// Attempts at the same transaction are only applied once.
+	d.api.lostWrite = awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("read: connection reset by peer"))
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "chewy bacon"}}, []Condition{{Key: "bacon", Version: 1}}))
+	d.Equal(3, d.api.chunkItems())
+	d.Equal("chewy bacon", d.get("bacon"))
+
+	version, err := d.sut.Version("bacon")
+	d.Equal(uint64(2), version)
+	d.NoError(err)
+}
+
+func (d *dynamoDBChunksTestSuite) TestApply_DeleteLeavesTombstone() {
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Delete: true}}, []Condition{{Key: "bacon", Version: 1}}))
+	d.Zero(d.api.chunkItems())
+
+	_, found, err := d.sut.Get("bacon")
+	d.False(found)
+	d.NoError(err)
+
+	keys, _, err := d.sut.Scan("", 100)
+	d.Empty(keys)
+	d.NoError(err)
+
+	// Writing the key again carries on from the version of the tombstone.
+	d.NoError(d.sut.Set("bacon", "raw"))
+	version, err := d.sut.Version("bacon")
+	d.Equal(uint64(3), version)
+	d.NoError(err)
+}
+
+func (d *dynamoDBChunksTestSuite) TestScan_SkipsChunks() {
+	d.NoError(d.sut.Set("bacon", "crispy bacon"))
+
+	keys, _, err := d.sut.Scan("", 100)
+	d.Equal([]string{"bacon"}, keys)
+	d.NoError(err)
+}
+
+func TestDynamoDBChunks(t *testing.T) {
+	suite.Run(t, new(dynamoDBChunksTestSuite))
+}
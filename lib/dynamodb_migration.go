@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// MigrateValues rewrites values stored as strings, by versions which stored
+// them that way, as binary, returning how many it rewrote. Values are left at
+// the same version, since they don't change, and a value written while it
+// runs is left as it is. It's safe to run at any time, and to run again after
+// being interrupted.
+func (d *DynamoDBStore) MigrateValues(ctx context.Context) (migrated int, err error) {
+	for _, prefix := range d.prefixes() {
+		rewritten, err := d.migrateTable(ctx, d.tableAt(prefix))
+		migrated += rewritten
+		if err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+func (d *DynamoDBStore) migrateTable(ctx context.Context, table DynamoDBTable) (migrated int, err error) {
+	input := &dynamodb.ScanInput{
+		ConsistentRead: aws.Bool(true),
+		ExpressionAttributeNames: map[string]*string{
+			"#key":   aws.String(table.Schema.keyAttribute()),
+			"#value": aws.String(table.Schema.valueAttribute()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":string": {S: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		FilterExpression:     aws.String("attribute_type(#value, :string)"),
+		ProjectionExpression: aws.String("#key, #value"),
+		TableName:            aws.String(table.Name),
+	}
+
+	if sortKey := table.Schema.SortKeyAttribute; sortKey != "" {
+		input.ExpressionAttributeNames["#sort"] = aws.String(sortKey)
+		input.ProjectionExpression = aws.String("#key, #sort, #value")
+	}
+
+	for {
+		var out *dynamodb.ScanOutput
+		err := d.read(ctx, func(ctx context.Context) (err error) {
+			out, err = d.API.ScanWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, item := range out.Items {
+			if err := ctx.Err(); err != nil {
+				return migrated, err
+			}
+
+			rewritten, err := d.migrateValue(table, item)
+			if err != nil {
+				return migrated, err
+			} else if rewritten {
+				migrated++
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return migrated, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// migrateValue rewrites the value of a single item as binary, unless it's
+// been written since it was scanned.
+func (d *DynamoDBStore) migrateValue(table DynamoDBTable, item map[string]*dynamodb.AttributeValue) (bool, error) {
+	key, ok := table.Schema.keyOf(item)
+	value := item[table.Schema.valueAttribute()]
+	if !ok || value == nil || value.S == nil {
+		return false, nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String("#value = :old"),
+		ExpressionAttributeNames: map[string]*string{
+			"#value": aws.String(table.Schema.valueAttribute()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":old":   {S: value.S},
+			":value": {B: []byte(*value.S)},
+		},
+		Key:              table.Schema.key(key),
+		TableName:        aws.String(table.Name),
+		UpdateExpression: aws.String("SET #value = :value"),
+	}
+
+	err := d.write(true, func(ctx context.Context) error {
+		_, err := d.API.UpdateItemWithContext(ctx, input)
+		return err
+	})
+	if isConditionFailure(err) {
+		return false, nil
+	} else if err != nil {
+		return false, apiError(err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/suite"
+)
+
+type dynamoDBMigrationTestSuite struct {
+	suite.Suite
+
+	api *fakeDynamo
+	sut *DynamoDBStore
+}
+
+func (d *dynamoDBMigrationTestSuite) SetupTest() {
+	d.api = newFakeDynamo()
+	d.sut = &DynamoDBStore{API: d.api, TableName: "table", ChunkSize: 4}
+
+	// bacon was written as a string, by an earlier version.
+	d.api.items["table/bacon"] = fakeItem{
+		keyField:     {S: aws.String("bacon")},
+		valueField:   {S: aws.String("tasty")},
+		versionField: {N: aws.String("3")},
+	}
+}
+
+func (d *dynamoDBMigrationTestSuite) TestMigrateValues() {
+	d.NoError(d.sut.Set("eggs", "ok"))
+	d.NoError(d.sut.Set("ham", "crispy bacon"))
+
+	migrated, err := d.sut.MigrateValues(context.Background())
+	d.Equal(1, migrated)
+	d.NoError(err)
+
+	d.Equal([]byte("tasty"), d.api.items["table/bacon"][valueField].B)
+	d.Nil(d.api.items["table/bacon"][valueField].S)
+
+	value, found, err := d.sut.Get("bacon")
+	d.Equal("tasty", value)
+	d.True(found)
+	d.NoError(err)
+
+	version, err := d.sut.Version("bacon")
+	d.Equal(uint64(3), version)
+	d.NoError(err)
+
+	migrated, err = d.sut.MigrateValues(context.Background())
+	d.Zero(migrated)
+	d.NoError(err)
+}
+
+func (d *dynamoDBMigrationTestSuite) TestMigrateValues_WrittenMeanwhile() {
+	item := d.api.items["table/bacon"]
+	d.NoError(d.sut.Set("bacon", "chewy"))
+
+	// The item is rewritten after being scanned.
+	rewritten, err := d.sut.migrateValue(d.sut.table("bacon"), item)
+	d.False(rewritten)
+	d.NoError(err)
+
+	value, _, _ := d.sut.Get("bacon")
+	d.Equal("chewy", value)
+}
+
+func (d *dynamoDBMigrationTestSuite) TestMigrateValues_Cancelled() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := d.sut.MigrateValues(ctx)
+	d.Equal(context.Canceled, err)
+	d.Equal(dynamodb.AttributeValue{S: aws.String("tasty")}, *d.api.items["table/bacon"][valueField])
+}
+
+func TestDynamoDBMigration(t *testing.T) {
+	suite.Run(t, new(dynamoDBMigrationTestSuite))
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+const (
+	keyField     = "key"
+	valueField   = "value"
+	versionField = "version"
+)
+
+// DynamoDBSchema maps keys, values and versions onto the attributes of a
+// table, so that existing tables can be used as they are. Attributes left
+// empty have their default names, "key", "value" and "version". Chunks of
+// large values always use attributes of their own.
+type DynamoDBSchema struct {
+	KeyAttribute     string
+	ValueAttribute   string
+	VersionAttribute string
+
+	// SortKeyAttribute is the sort key of a table which has one, of type S.
+	// Keys are still held by the partition key, with SortKey telling which
+	// item of the partition holds them, which is the key itself if nil.
+	// Items of the table with other sort keys are left alone.
+	SortKeyAttribute string
+	SortKey          func(key string) string
+
+	// TTLAttribute is the attribute DynamoDB expires items of the table by,
+	// if it does. Tombstones of deleted keys are set to expire by it, while
+	// writing a value removes it, so that values never expire.
+	TTLAttribute string
+}
+
+// DynamoDBTable is a table keys are kept in, with how they're kept there.
+type DynamoDBTable struct {
+	Name   string
+	Schema DynamoDBSchema
+}
+
+// SortKeyTemplate returns a SortKey deriving the sort key of each key from
+// the template, by replacing "{key}" with the key. A template without it is a
+// fixed sort key, shared by all keys.
+func SortKeyTemplate(template string) func(key string) string {
+	return func(key string) string {
+		return strings.Replace(template, "{key}", key, -1)
+	}
+}
+
+// ParseDynamoDBTables parses tables by key prefix, separated by semicolons.
+// Each one is a prefix followed by the name of a table, all of which share
+// the schema:
+//
+//	session: sessions; user: users
+func ParseDynamoDBTables(spec string, schema DynamoDBSchema) (map[string]DynamoDBTable, error) {
+	ret := make(map[string]DynamoDBTable)
+
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("malformed table for key prefix %q, expected a prefix and a table name", entry)
+		}
+		if _, exists := ret[fields[0]]; exists {
+			return nil, errors.Errorf("more than one table for key prefix %q", fields[0])
+		}
+
+		ret[fields[0]] = DynamoDBTable{Name: fields[1], Schema: schema}
+	}
+
+	return ret, nil
+}
+
+func (s DynamoDBSchema) keyAttribute() string {
+	if s.KeyAttribute == "" {
+		return keyField
+	}
+	return s.KeyAttribute
+}
+
+func (s DynamoDBSchema) valueAttribute() string {
+	if s.ValueAttribute == "" {
+		return valueField
+	}
+	return s.ValueAttribute
+}
+
+func (s DynamoDBSchema) versionAttribute() string {
+	if s.VersionAttribute == "" {
+		return versionField
+	}
+	return s.VersionAttribute
+}
+
+func (s DynamoDBSchema) sortKey(key string) string {
+	if s.SortKey == nil {
+		return key
+	}
+	return s.SortKey(key)
+}
+
+// key returns the primary key of the item holding the key.
+func (s DynamoDBSchema) key(key string) map[string]*dynamodb.AttributeValue {
+	ret := map[string]*dynamodb.AttributeValue{s.keyAttribute(): {S: aws.String(key)}}
+	if s.SortKeyAttribute != "" {
+		ret[s.SortKeyAttribute] = &dynamodb.AttributeValue{S: aws.String(s.sortKey(key))}
+	}
+	return ret
+}
+
+// keyOf returns the key held by the item, unless the item is not one the
+// schema maps a key onto.
+func (s DynamoDBSchema) keyOf(item map[string]*dynamodb.AttributeValue) (string, bool) {
+	key, exists := item[s.keyAttribute()]
+	if !exists || key.S == nil {
+		return "", false
+	}
+	return *key.S, s.holds(*key.S, item[s.SortKeyAttribute])
+}
+
+// holds tells whether the item with the sort key holds the key, which it
+// always does in tables without sort keys.
+func (s DynamoDBSchema) holds(key string, sortKey *dynamodb.AttributeValue) bool {
+	if s.SortKeyAttribute == "" {
+		return true
+	}
+	return sortKey != nil && sortKey.S != nil && *sortKey.S == s.sortKey(key)
+}
+
+// tableFor returns the table the key is kept in, and the prefix routing it
+// there, which is empty for the default table.
+func (d *DynamoDBStore) tableFor(key string) (table DynamoDBTable, prefix string) {
+	table = d.tableAt("")
+	for candidate, other := range d.Tables {
+		if candidate != "" && strings.HasPrefix(key, candidate) && len(candidate) > len(prefix) {
+			table, prefix = other, candidate
+		}
+	}
+	return table, prefix
+}
+
+// table returns the table the key is kept in.
+func (d *DynamoDBStore) table(key string) DynamoDBTable {
+	table, _ := d.tableFor(key)
+	return table
+}
+
+// prefixes returns the prefixes of all tables, in the order they're scanned,
+// starting with the default table.
+func (d *DynamoDBStore) prefixes() []string {
+	ret := []string{""}
+	for prefix := range d.Tables {
+		if prefix != "" {
+			ret = append(ret, prefix)
+		}
+	}
+	sort.Strings(ret[1:])
+	return ret
+}
+
+// tableAt returns the table routed to by the prefix.
+func (d *DynamoDBStore) tableAt(prefix string) DynamoDBTable {
+	if prefix == "" {
+		return DynamoDBTable{Name: d.TableName, Schema: d.Schema}
+	}
+	return d.Tables[prefix]
+}
+
+// StreamSchema returns the schema of the table a stream belongs to, going by
+// the name of the table in the ARN of the stream, for a StreamSubscriber
+// following it.
+func (d *DynamoDBStore) StreamSchema(streamARN string) (DynamoDBSchema, error) {
+	// Stream ARNs end with "table/<name>/stream/<label>".
+	parts := strings.Split(streamARN, "/")
+	if len(parts) < 4 || !strings.HasSuffix(parts[len(parts)-4], ":table") || parts[len(parts)-2] != "stream" {
+		return DynamoDBSchema{}, errors.Errorf("malformed stream ARN %q", streamARN)
+	}
+
+	name := parts[len(parts)-3]
+	for _, prefix := range d.prefixes() {
+		if table := d.tableAt(prefix); table.Name == name {
+			return table.Schema, nil
+		}
+	}
+	return DynamoDBSchema{}, errors.Errorf("%s is not the stream of any table", streamARN)
+}
@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/suite"
+)
+
+type dynamoDBSchemaTestSuite struct {
+	suite.Suite
+
+	api *fakeDynamo
+	sut *DynamoDBStore
+}
+
+func (d *dynamoDBSchemaTestSuite) SetupTest() {
+	d.api = newFakeDynamo()
+	d.api.keys["table"] = []string{"pk", "sk"}
+	d.api.keys["sessions"] = []string{"id"}
+
+	d.sut = &DynamoDBStore{
+		API:       d.api,
+		TableName: "table",
+		Schema: DynamoDBSchema{
+			KeyAttribute:     "pk",
+			ValueAttribute:   "val",
+			VersionAttribute: "ver",
+			SortKeyAttribute: "sk",
+			SortKey:          SortKeyTemplate("goredis"),
+		},
+		ChunkSize: 16,
+	}
+}
+
+func (d *dynamoDBSchemaTestSuite) get(key string) string {
+	value, found, err := d.sut.Get(key)
+	d.Require().NoError(err)
+	d.Require().True(found)
+	return value
+}
+
+// scan returns all keys, sorted.
+func (d *dynamoDBSchemaTestSuite) scan() []string {
+	var ret []string
+	var cursor string
+	for {
+		keys, next, err := d.sut.Scan(cursor, 10)
+		d.Require().NoError(err)
+
+		ret = append(ret, keys...)
+		if next == "" {
+			sort.Strings(ret)
+			return ret
+		}
+		cursor = next
+	}
+}
+
+func (d *dynamoDBSchemaTestSuite) TestAttributes() {
+	d.NoError(d.sut.Set("bacon", "tasty"))
+
+	item := d.api.items["table/bacon/goredis"]
+	d.Equal([]byte("tasty"), item["val"].B)
+	d.Equal("1", *item["ver"].N)
+	d.Equal("tasty", d.get("bacon"))
+
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "crispy"}, {Key: "cabbage", Value: "raw"}}, []Condition{{Key: "bacon", Version: 1}}))
+
+	version, err := d.sut.Version("bacon")
+	d.Equal(uint64(2), version)
+	d.NoError(err)
+	d.Equal("crispy", d.get("bacon"))
+}
+
+func (d *dynamoDBSchemaTestSuite) TestSortKey_LeavesOtherItems() {
+	d.api.items["table/bacon/profile"] = fakeItem{
+		"pk":  {S: aws.String("bacon")},
+		"sk":  {S: aws.String("profile")},
+		"val": {S: aws.String("not ours")},
+	}
+
+	_, found, err := d.sut.Get("bacon")
+	d.False(found)
+	d.NoError(err)
+
+	d.NoError(d.sut.Set("bacon", "long enough to be chunked"))
+	d.NoError(d.sut.Set("cabbage", "raw"))
+
+	d.Equal("long enough to be chunked", d.get("bacon"))
+	d.Equal([]string{"bacon", "cabbage"}, d.scan())
+	d.Equal("not ours", *d.api.items["table/bacon/profile"]["val"].S)
+
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Delete: true}}, nil))
+	d.Zero(d.api.chunkItems())
+	d.Contains(d.api.items, "table/bacon/profile")
+}
+
+func (d *dynamoDBSchemaTestSuite) TestSortKey_Derived() {
+	d.sut.Schema.SortKey = SortKeyTemplate("cache#{key}")
+
+	d.NoError(d.sut.Set("bacon", "tasty"))
+	d.Contains(d.api.items, "table/bacon/cache#bacon")
+	d.Equal("tasty", d.get("bacon"))
+	d.Equal([]string{"bacon"}, d.scan())
+}
+
+func (d *dynamoDBSchemaTestSuite) TestTables() {
+	d.sut.Tables = map[string]DynamoDBTable{"session:": {Name: "sessions", Schema: DynamoDBSchema{KeyAttribute: "id"}}}
+
+	// Written before sessions got a table of their own.
+	d.api.items["table/session:stale/goredis"] = fakeItem{
+		"pk":  {S: aws.String("session:stale")},
+		"sk":  {S: aws.String("goredis")},
+		"val": {B: []byte("stale")},
+	}
+
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "tasty"}, {Key: "session:1", Value: "long enough to be chunked"}}, nil))
+
+	d.Contains(d.api.items, "table/bacon/goredis")
+	d.Contains(d.api.items, "sessions/session:1")
+	d.Equal("long enough to be chunked", d.get("session:1"))
+	d.Equal([]string{"bacon", "session:1"}, d.scan())
+
+	_, found, err := d.sut.Get("session:stale")
+	d.False(found)
+	d.NoError(err)
+}
+
+func (d *dynamoDBSchemaTestSuite) TestTables_MigrateValues() {
+	d.sut.Tables = map[string]DynamoDBTable{"session:": {Name: "sessions", Schema: DynamoDBSchema{KeyAttribute: "id"}}}
+	d.api.items["sessions/session:1"] = fakeItem{
+		"id":    {S: aws.String("session:1")},
+		"value": {S: aws.String("tasty")},
+	}
+
+	migrated, err := d.sut.MigrateValues(context.Background())
+	d.Equal(1, migrated)
+	d.NoError(err)
+	d.Equal([]byte("tasty"), d.api.items["sessions/session:1"]["value"].B)
+}
+
+func (d *dynamoDBSchemaTestSuite) TestTables_ChangedCursor() {
+	d.NoError(d.sut.Set("bacon", "tasty"))
+	d.NoError(d.sut.Set("cabbage", "raw"))
+
+	// Segments of a scan resume from both the partition and the sort key.
+	keys, cursor, err := d.sut.Scan("", 1)
+	d.Equal([]string{"bacon"}, keys)
+	d.Require().NoError(err)
+
+	d.sut.Tables = map[string]DynamoDBTable{"session:": {Name: "sessions"}}
+	_, _, err = d.sut.Scan(cursor, 1)
+	d.EqualError(err, "tables changed: malformed cursor")
+
+	d.sut.Tables = nil
+	keys, _, err = d.sut.Scan(cursor, 1)
+	d.Equal([]string{"cabbage"}, keys)
+	d.NoError(err)
+}
+
+func (d *dynamoDBSchemaTestSuite) TestStreamSchema() {
+	sessions := DynamoDBSchema{KeyAttribute: "id"}
+	d.sut.Tables = map[string]DynamoDBTable{"session:": {Name: "sessions", Schema: sessions}}
+
+	schema, err := d.sut.StreamSchema("arn:aws:dynamodb:eu-west-1:123456789012:table/sessions/stream/2019-01-01T00:00:00.000")
+	d.Equal(sessions, schema)
+	d.NoError(err)
+
+	schema, err = d.sut.StreamSchema("arn:aws:dynamodb:eu-west-1:123456789012:table/table/stream/2019-01-01T00:00:00.000")
+	d.Equal("pk", schema.KeyAttribute)
+	d.NoError(err)
+
+	_, err = d.sut.StreamSchema("arn:aws:dynamodb:eu-west-1:123456789012:table/users/stream/2019-01-01T00:00:00.000")
+	d.EqualError(err, "arn:aws:dynamodb:eu-west-1:123456789012:table/users/stream/2019-01-01T00:00:00.000 is not the stream of any table")
+
+	_, err = d.sut.StreamSchema("sessions")
+	d.EqualError(err, `malformed stream ARN "sessions"`)
+}
+
+func (d *dynamoDBSchemaTestSuite) TestParseDynamoDBTables() {
+	schema := DynamoDBSchema{KeyAttribute: "pk"}
+
+	tables, err := ParseDynamoDBTables(" session: sessions;user: users; ", schema)
+	d.Equal(map[string]DynamoDBTable{
+		"session:": {Name: "sessions", Schema: schema},
+		"user:":    {Name: "users", Schema: schema},
+	}, tables)
+	d.NoError(err)
+
+	_, err = ParseDynamoDBTables("session:", schema)
+	d.EqualError(err, `malformed table for key prefix "session:", expected a prefix and a table name`)
+
+	_, err = ParseDynamoDBTables("session: sessions; session: more", schema)
+	d.EqualError(err, `more than one table for key prefix "session:"`)
+}
+
+func (d *dynamoDBSchemaTestSuite) TestKeyOf() {
+	schema := d.sut.Schema
+
+	key, ok := schema.keyOf(schema.key("bacon"))
+	d.Equal("bacon", key)
+	d.True(ok)
+
+	_, ok = schema.keyOf(map[string]*dynamodb.AttributeValue{"pk": {S: aws.String("bacon")}})
+	d.False(ok)
+
+	key, ok = DynamoDBSchema{}.keyOf(DynamoDBSchema{}.key("bacon"))
+	d.Equal("bacon", key)
+	d.True(ok)
+}
+
+func TestDynamoDBSchema(t *testing.T) {
+	suite.Run(t, new(dynamoDBSchemaTestSuite))
+}
@@ -2,9 +2,16 @@ package lib
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/pkg/errors"
@@ -12,18 +19,42 @@ import (
 
 const (
 	apiErrorMessage = "DynamoDB API error"
-	keyField        = "key"
-	valueField      = "value"
+
+	// maxTransactionItems is the maximum number of items DynamoDB accepts in
+	// a single TransactWriteItems call.
+	maxTransactionItems = 100
+
+	// DefaultDynamoDBReadTimeout and DefaultDynamoDBWriteTimeout are how long
+	// DynamoDB is given to respond, unless configured otherwise.
+	DefaultDynamoDBReadTimeout  = time.Second
+	DefaultDynamoDBWriteTimeout = time.Second
+
+	// DefaultTombstoneTTL is how long tombstones of deleted keys are kept,
+	// unless configured otherwise.
+	DefaultTombstoneTTL = 7 * 24 * time.Hour
 )
 
 var (
 	// ErrNoValue is returned when there's no value field in the DynamoDB
-	// record retrieved by key.
+	// record retrieved by key, and it's not the tombstone of a deleted key.
 	ErrNoValue = errors.New("value field not found in DynamoDB record")
 
 	// ErrNilValue is returned when there's a value field in the DynamoDB
 	// record retrieved by key, but it
 	ErrNilValue = errors.New("value field nil in DynamoDB record")
+
+	// ErrTransactionTooLarge is returned when trying to atomically apply
+	// more writes than DynamoDB supports in a single transaction.
+	ErrTransactionTooLarge = errors.Errorf("DynamoDB transactions are limited to %d distinct keys", maxTransactionItems)
+
+	// ErrTimeout is returned when DynamoDB does not respond before the
+	// deadline, in which case writes may or may not have been applied.
+	ErrTimeout = errors.New("DynamoDB request timed out")
+
+	// ErrOutcomeUnknown is returned when a write which can't be made twice
+	// fails on the network, in which case it may or may not have been
+	// applied.
+	ErrOutcomeUnknown = errors.New("DynamoDB request failed on the network, and may or may not have been applied")
 )
 
 // DynamoDBStore is an implementation of the Store interface, backed by
@@ -31,61 +62,776 @@ var (
 type DynamoDBStore struct {
 	API       dynamodbiface.DynamoDBAPI
 	TableName string
+
+	// Schema maps keys onto the items of the table, with the zero value
+	// being the schema of tables created by EnsureTable.
+	Schema DynamoDBSchema
+
+	// Tables keeps keys with the given prefixes in tables of their own, with
+	// the longest matching prefix winning. Prefixes match keys as stored, so
+	// keys of databases other than 0 start with the namespace of their
+	// database. Keys matching no prefix are kept in the table named by
+	// TableName. Transactions may span tables.
+	Tables map[string]DynamoDBTable
+
+	// ScanSegments is the number of segments scanned in parallel when
+	// iterating over keys. Values below 2 disable parallel scans.
+	ScanSegments int
+
+	// ConsistentReads makes all reads strongly consistent, at twice the
+	// cost. Otherwise only reads made with a context from WithConsistentRead
+	// are, along with versions, which always are.
+	ConsistentReads bool
+
+	// ReadTimeout and WriteTimeout limit how long each attempt at a request
+	// may take, with zero meaning the defaults. Scans are reads.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Retries retries requests which are throttled or fail for reasons on
+	// the side of DynamoDB. Nil disables retries.
+	Retries *RetryPolicy
+
+	// ChunkSize is the size of the largest value stored in a single item,
+	// with zero meaning the default. Larger values are split into chunks
+	// stored as separate items.
+	ChunkSize int
+
+	// TombstoneTTL is how long tombstones of deleted keys are kept in tables
+	// whose schema has a TTLAttribute, with zero meaning the default. Keys
+	// go back to version zero once their tombstone expires, so it has to
+	// outlast any WATCH, or any version read to write a key conditionally,
+	// which could otherwise match again. Elsewhere tombstones are kept
+	// forever.
+	TombstoneTTL time.Duration
 }
 
 // Get is a DynamoDB implementation of the Store's Get method.
 func (d *DynamoDBStore) Get(key string) (value string, found bool, err error) {
-	// Let's make sure that requests never take more than a second. Anything
-	// longer will return an API error.
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-
-	out, err := d.API.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		Key:       dynamoDBKey(key),
-		TableName: aws.String(d.TableName),
+	return d.GetContext(context.Background(), key)
+}
+
+// GetContext is Get which gives up once the context is done. Reads made with a
+// context from WithConsistentRead are strongly consistent.
+func (d *DynamoDBStore) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	consistent := d.ConsistentReads || consistentRead(ctx)
+
+	for attempt := 1; ; attempt++ {
+		item, err := d.getItem(ctx, key, consistent)
+		if err != nil || len(item) == 0 {
+			return "", false, err
+		}
+
+		manifest, chunked := manifestOf(item)
+		if !chunked {
+			return d.table(key).Schema.itemValue(item)
+		}
+
+		value, complete, err := d.readChunks(ctx, key, manifest)
+		if err != nil || complete {
+			return value, err == nil, err
+		} else if attempt >= maxChunkedReadAttempts {
+			return "", false, ErrChunkMissing
+		}
+
+		// The value has been replaced while its chunks were being read, so
+		// the new one is read instead, making sure not to miss it.
+		consistent = true
+	}
+}
+
+func (d *DynamoDBStore) getItem(ctx context.Context, key string, consistent bool) (map[string]*dynamodb.AttributeValue, error) {
+	table := d.table(key)
+	input := &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(consistent),
+		Key:            table.Schema.key(key),
+		TableName:      aws.String(table.Name),
+	}
+
+	var out *dynamodb.GetItemOutput
+	err := d.read(ctx, func(ctx context.Context) (err error) {
+		out, err = d.API.GetItemWithContext(ctx, input)
+		return err
 	})
 	if err != nil {
-		err = errors.Wrap(err, apiErrorMessage)
-		return
+		return nil, err
 	}
 
-	if len(out.Item) == 0 {
-		return
-	}
+	return out.Item, nil
+}
 
-	valueField, exists := out.Item[valueField]
-	if !exists {
+// itemValue returns the value stored in the item itself. Values are stored as
+// binary, but items written before that hold them as strings, which are read
+// all the same until MigrateValues rewrites them. Items holding a version but
+// no value are tombstones of deleted keys.
+func (s DynamoDBSchema) itemValue(item map[string]*dynamodb.AttributeValue) (value string, found bool, err error) {
+	attribute, exists := item[s.valueAttribute()]
+	if _, versioned := item[s.versionAttribute()]; !exists && versioned {
+		return
+	} else if !exists {
 		err = ErrNoValue
 		return
 	}
 
-	if valueField.S == nil {
+	switch {
+	case attribute.B != nil:
+		value, found = string(attribute.B), true
+	case attribute.S != nil:
+		value, found = *attribute.S, true
+	default:
 		err = ErrNilValue
-		return
 	}
-
-	value, found = *valueField.S, true
 	return
 }
 
-// Set is a DynamoDB implementation of the Store's Set method.
+// Set is a DynamoDB implementation of the Store's Set method. Every write
+// increments the version attribute of the item. Values too large for a single
+// item are written in chunks first, and then swapped in along with the
+// version, so that readers see either the old value or the new one.
 func (d *DynamoDBStore) Set(key string, value string) error {
-	// Let's make sure that requests never take more than a second. Anything
-	// longer will return an API error.
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	var manifest dynamoDBManifest
+	if d.chunked(value) {
+		var err error
+		if manifest, err = d.putChunks(key, value); err != nil {
+			return err
+		}
+	}
+
+	table := d.table(key)
+	update := newDynamoDBUpdate(table.Schema, value, manifest)
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  update.names,
+		ExpressionAttributeValues: update.values,
+		Key:                       table.Schema.key(key),
+		ReturnValues:              aws.String(dynamodb.ReturnValueUpdatedOld),
+		TableName:                 aws.String(table.Name),
+		UpdateExpression:          update.expression,
+	}
+
+	// The update may have been applied by an attempt which failed, in which
+	// case the value replaced is the one being written, and the chunks of
+	// the one before are left behind.
+	var out *dynamodb.UpdateItemOutput
+	err := d.write(false, func(ctx context.Context) (err error) {
+		out, err = d.API.UpdateItemWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		d.dropUnused(key, manifest, err)
+		return apiError(err)
+	}
+
+	// The chunks of the value replaced are no longer needed.
+	if out != nil {
+		if replaced, chunked := manifestOf(out.Attributes); chunked && replaced.id != manifest.id {
+			d.dropChunks(key, replaced)
+		}
+	}
+
+	return nil
+}
+
+// Version is a DynamoDB implementation of the Store's Version method. It
+// uses a strongly consistent read, so that writes made by other nodes are
+// always taken into account.
+func (d *DynamoDBStore) Version(key string) (uint64, error) {
+	table := d.table(key)
+	input := &dynamodb.GetItemInput{
+		ConsistentRead:           aws.Bool(true),
+		ExpressionAttributeNames: map[string]*string{"#version": aws.String(table.Schema.versionAttribute())},
+		Key:                      table.Schema.key(key),
+		ProjectionExpression:     aws.String("#version"),
+		TableName:                aws.String(table.Name),
+	}
+
+	var out *dynamodb.GetItemOutput
+	err := d.read(context.Background(), func(ctx context.Context) (err error) {
+		out, err = d.API.GetItemWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	version, exists := out.Item[table.Schema.versionAttribute()]
+	if !exists || version.N == nil {
+		return 0, nil
+	}
+
+	ret, err := strconv.ParseUint(*version.N, 10, 64)
+	return ret, errors.Wrap(err, "invalid version in DynamoDB record")
+}
+
+// Apply is a DynamoDB implementation of the Store's Apply method. Multiple
+// writes, deletes or any conditions are sent as a single TransactWriteItems
+// call, so that they're atomic in the database, too. Deleting a key leaves a
+// tombstone behind, holding its version, so that a key deleted and written
+// again never goes back to a version it had before.
+//
+// Values too large for a single item are written in chunks before the
+// transaction, as in Set. Every written key is expected to hold no chunks at
+// first, and when a key turns out to hold some, the transaction is tried again
+// expecting them, so that they can be deleted once it's done. A key turning
+// out to hold the chunks just written means that the transaction was applied
+// by an attempt whose response got lost.
+func (d *DynamoDBStore) Apply(writes []Write, conditions []Condition) error {
+	writes = coalesce(writes)
+
+	switch {
+	case len(writes) == 0 && len(conditions) == 0:
+		return nil
+	case len(writes) == 1 && len(conditions) == 0 && !writes[0].Delete:
+		return d.Set(writes[0].Key, writes[0].Value)
+	}
+
+	if err := checkValueSizes(writes); err != nil {
+		return err
+	}
+
+	written := make(map[string]dynamoDBManifest)
+	for _, write := range writes {
+		if write.Delete || !d.chunked(write.Value) {
+			continue
+		}
+
+		manifest, err := d.putChunks(write.Key, write.Value)
+		if err != nil {
+			d.dropAllUnused(written, err)
+			return err
+		}
+		written[write.Key] = manifest
+	}
+
+	replaced := make(map[string]dynamoDBManifest)
+	for attempt := 1; ; attempt++ {
+		err := d.transact(writes, conditions, written, replaced)
+		if err == nil {
+			d.dropReplaced(replaced, written)
+			return nil
+		} else if err != ErrConditionFailed {
+			d.dropAllUnused(written, err)
+			return err
+		}
+
+		// Either a condition failed, or a key doesn't hold the expected
+		// chunks - which it is tells.
+		current, err := d.manifests(writes)
+		if err != nil {
+			d.dropAllUnused(written, err)
+			return err
+		} else if holdsAnyOf(current, written) {
+			d.dropReplaced(replaced, written)
+			return nil
+		}
+
+		if (len(conditions) > 0 && sameManifests(current, replaced)) || attempt >= maxChunkGuardAttempts {
+			d.dropAllUnused(written, ErrConditionFailed)
+			return ErrConditionFailed
+		}
+		replaced = current
+	}
+}
+
+// transact applies the writes in a single transaction, pointing keys at the
+// chunks written for them, if any, and requiring them to hold the chunks
+// about to be replaced.
+func (d *DynamoDBStore) transact(writes []Write, conditions []Condition, written, replaced map[string]dynamoDBManifest) error {
+	expected := make(map[string]uint64, len(conditions))
+	for _, condition := range conditions {
+		expected[condition.Key] = condition.Version
+	}
+
+	items := make([]*dynamodb.TransactWriteItem, 0, len(writes)+len(conditions))
+	for _, write := range writes {
+		var condition *uint64
+		if version, exists := expected[write.Key]; exists {
+			condition = &version
+			delete(expected, write.Key)
+		}
+
+		if write.Delete {
+			items = append(items, d.deleteItem(write.Key, condition, replaced[write.Key]))
+			continue
+		}
+
+		table := d.table(write.Key)
+		update := newDynamoDBUpdate(table.Schema, write.Value, written[write.Key])
+		if condition != nil {
+			update.requireVersion(*condition)
+		}
+		update.requireChunks(replaced[write.Key])
+
+		items = append(items, &dynamodb.TransactWriteItem{
+			Update: &dynamodb.Update{
+				ConditionExpression:       update.condition,
+				ExpressionAttributeNames:  update.names,
+				ExpressionAttributeValues: update.values,
+				Key:                       table.Schema.key(write.Key),
+				TableName:                 aws.String(table.Name),
+				UpdateExpression:          update.expression,
+			},
+		})
+	}
+
+	// Conditions on keys which are not written become separate checks.
+	for _, condition := range conditions {
+		version, exists := expected[condition.Key]
+		if !exists {
+			continue
+		}
+
+		table := d.table(condition.Key)
+		check := newDynamoDBCondition(table.Schema, version)
+
+		items = append(items, &dynamodb.TransactWriteItem{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				ConditionExpression:       check.condition,
+				ExpressionAttributeNames:  check.names,
+				ExpressionAttributeValues: check.attributeValues(),
+				Key:                       table.Schema.key(condition.Key),
+				TableName:                 aws.String(table.Name),
+			},
+		})
+		delete(expected, condition.Key)
+	}
+
+	if len(items) > maxTransactionItems {
+		return ErrTransactionTooLarge
+	}
+
+	// The token makes attempts at the same transaction idempotent, so that
+	// it's retried even when its response gets lost.
+	token, err := newClientRequestToken()
+	if err != nil {
+		return err
+	}
+
+	err = d.write(true, func(ctx context.Context) error {
+		_, err := d.API.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+			ClientRequestToken: aws.String(token),
+			TransactItems:      items,
+		})
+		return err
+	})
+
+	if isConditionFailure(err) {
+		return ErrConditionFailed
+	}
+
+	return apiError(err)
+}
+
+// deleteItem turns the item holding the key into a tombstone, which holds
+// nothing but the next version.
+func (d *DynamoDBStore) deleteItem(key string, version *uint64, replaced dynamoDBManifest) *dynamodb.TransactWriteItem {
+	table := d.table(key)
+	update := newDynamoDBDelete(table.Schema, d.tombstoneExpiry())
+	if version != nil {
+		update.requireVersion(*version)
+	}
+	update.requireChunks(replaced)
+
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			ConditionExpression:       update.condition,
+			ExpressionAttributeNames:  update.names,
+			ExpressionAttributeValues: update.values,
+			Key:                       table.Schema.key(key),
+			TableName:                 aws.String(table.Name),
+			UpdateExpression:          update.expression,
+		},
+	}
+}
+
+// tombstoneExpiry returns when tombstones written now expire.
+func (d *DynamoDBStore) tombstoneExpiry() time.Time {
+	ttl := d.TombstoneTTL
+	if ttl <= 0 {
+		ttl = DefaultTombstoneTTL
+	}
+	return time.Now().Add(ttl)
+}
+
+// dropReplaced deletes the chunks of the values a transaction replaced, other
+// than the ones it wrote, which keys may seem to have replaced when an
+// attempt at the transaction was applied without telling.
+func (d *DynamoDBStore) dropReplaced(replaced, written map[string]dynamoDBManifest) {
+	for key, manifest := range replaced {
+		if manifest.id != written[key].id {
+			d.dropChunks(key, manifest)
+		}
+	}
+}
+
+// dropUnused deletes the chunks written for a value, unless the write which
+// was to point at them may have done so before failing.
+func (d *DynamoDBStore) dropUnused(key string, manifest dynamoDBManifest, err error) {
+	switch errors.Cause(err) {
+	case ErrTimeout, ErrOutcomeUnknown:
+	default:
+		d.dropChunks(key, manifest)
+	}
+}
+
+func (d *DynamoDBStore) dropAllUnused(written map[string]dynamoDBManifest, err error) {
+	for key, manifest := range written {
+		d.dropUnused(key, manifest, err)
+	}
+}
+
+// Scan is a DynamoDB implementation of the Store's Scan method. With
+// multiple segments, each call scans all of them in parallel, and the cursor
+// holds the position in each one. With multiple tables, each has segments of
+// its own.
+func (d *DynamoDBStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	prefixes := d.prefixes()
+
+	segments := d.ScanSegments
+	if segments < 1 {
+		segments = 1
+	}
+
+	positions, err := decodeDynamoDBCursor(cursor, segments*len(prefixes))
+	if err != nil {
+		return nil, "", err
+	} else if len(positions)%len(prefixes) != 0 {
+		return nil, "", errors.WithMessage(ErrMalformedCursor, "tables changed")
+	}
+
+	var active []int
+	for segment, position := range positions {
+		if !position.Done {
+			active = append(active, segment)
+		}
+	}
+
+	limit := int64(1)
+	if count > len(active) {
+		limit = int64((count + len(active) - 1) / len(active))
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]string, len(positions))
+	errs := make([]error, len(positions))
+
+	for _, segment := range active {
+		wg.Add(1)
+		go func(segment int) {
+			defer wg.Done()
+			results[segment], errs[segment] = d.scanSegment(prefixes, positions, segment, limit)
+		}(segment)
+	}
+	wg.Wait()
+
+	for segment := range positions {
+		if errs[segment] != nil {
+			return nil, "", errs[segment]
+		}
+		keys = append(keys, results[segment]...)
+	}
+
+	next, err = encodeDynamoDBCursor(positions)
+	return keys, next, err
+}
+
+// scanSegment scans a single page of a segment, and moves its position.
+// Positions are grouped by table, in the order of the prefixes.
+func (d *DynamoDBStore) scanSegment(prefixes []string, positions []dynamoDBScanPosition, segment int, limit int64) ([]string, error) {
+	segments := len(positions) / len(prefixes)
+	prefix := prefixes[segment/segments]
+	table := d.tableAt(prefix)
+
+	// Chunks of large values are items too, but not keys, and neither are
+	// tombstones of deleted keys. Only items holding a value or pointing at
+	// chunks of one are.
+	input := &dynamodb.ScanInput{
+		ConsistentRead: aws.Bool(d.ConsistentReads),
+		ExpressionAttributeNames: map[string]*string{
+			"#chunk_id": aws.String(chunkIDField),
+			"#key":      aws.String(table.Schema.keyAttribute()),
+			"#value":    aws.String(table.Schema.valueAttribute()),
+		},
+		FilterExpression:     aws.String("attribute_exists(#value) OR attribute_exists(#chunk_id)"),
+		Limit:                aws.Int64(limit),
+		ProjectionExpression: aws.String("#key"),
+		TableName:            aws.String(table.Name),
+	}
+
+	sortKey := table.Schema.SortKeyAttribute
+	if sortKey != "" {
+		input.ExpressionAttributeNames["#sort"] = aws.String(sortKey)
+		input.ProjectionExpression = aws.String("#key, #sort")
+	}
+
+	if position := positions[segment]; position.Started {
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			table.Schema.keyAttribute(): {S: aws.String(position.After)},
+		}
+		if sortKey != "" {
+			input.ExclusiveStartKey[sortKey] = &dynamodb.AttributeValue{S: aws.String(position.AfterSortKey)}
+		}
+	}
 
-	item := dynamoDBKey(key)
-	item[valueField] = &dynamodb.AttributeValue{S: aws.String(value)}
+	if segments > 1 {
+		input.Segment = aws.Int64(int64(segment % segments))
+		input.TotalSegments = aws.Int64(int64(segments))
+	}
 
-	_, err := d.API.PutItemWithContext(ctx, &dynamodb.PutItemInput{
-		Item:      item,
-		TableName: aws.String(d.TableName),
+	var out *dynamodb.ScanOutput
+	err := d.read(context.Background(), func(ctx context.Context) (err error) {
+		out, err = d.API.ScanWithContext(ctx, input)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Tables may hold items other than the ones holding keys, as well as
+	// keys routed to other tables since they were written.
+	keys := make([]string, 0, len(out.Items))
+	for _, item := range out.Items {
+		if key, ok := table.Schema.keyOf(item); ok {
+			if _, routed := d.tableFor(key); routed == prefix {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	positions[segment] = dynamoDBScanPosition{Done: true}
+	if last, exists := out.LastEvaluatedKey[table.Schema.keyAttribute()]; exists && last.S != nil {
+		positions[segment] = dynamoDBScanPosition{After: *last.S, Started: true}
+		if sortKey != "" {
+			positions[segment].AfterSortKey = aws.StringValue(out.LastEvaluatedKey[sortKey].S)
+		}
+	}
+
+	return keys, nil
+}
+
+// read makes a read request, retrying it as configured. Each attempt may take
+// up to the read timeout.
+func (d *DynamoDBStore) read(ctx context.Context, request func(ctx context.Context) error) error {
+	timeout := d.ReadTimeout
+	if timeout <= 0 {
+		timeout = DefaultDynamoDBReadTimeout
+	}
+	return apiError(d.Retries.do(ctx, timeout, true, request))
+}
 
+// write makes a write request, retrying it as configured. Each attempt may
+// take up to the write timeout. Writes which aren't idempotent aren't retried
+// when they fail on the network. Errors are returned as they are, so that
+// failed conditions can be told apart.
+func (d *DynamoDBStore) write(idempotent bool, request func(ctx context.Context) error) error {
+	timeout := d.WriteTimeout
+	if timeout <= 0 {
+		timeout = DefaultDynamoDBWriteTimeout
+	}
+	return d.Retries.do(context.Background(), timeout, idempotent, request)
+}
+
+// newClientRequestToken returns a token identifying a transaction, which is
+// the same for all attempts at it.
+func newClientRequestToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", errors.Wrap(err, "could not generate client request token")
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// apiError wraps errors of the API, leaving the ones which tell that DynamoDB
+// is slow or overloaded as they are.
+func apiError(err error) error {
+	switch errors.Cause(err) {
+	case ErrTimeout, ErrOutcomeUnknown, ErrThrottled, ErrRetryBudgetExhausted:
+		return err
+	}
 	return errors.Wrap(err, apiErrorMessage)
 }
 
-func dynamoDBKey(key string) map[string]*dynamodb.AttributeValue {
-	return map[string]*dynamodb.AttributeValue{keyField: {S: aws.String(key)}}
+// dynamoDBScanPosition is where the scan of a single segment stands. After
+// and AfterSortKey are the key from LastEvaluatedKey, to be used as
+// ExclusiveStartKey.
+type dynamoDBScanPosition struct {
+	After        string `json:"a,omitempty"`
+	AfterSortKey string `json:"k,omitempty"`
+	Done         bool   `json:"d,omitempty"`
+	Started      bool   `json:"s,omitempty"`
+}
+
+func decodeDynamoDBCursor(cursor string, segments int) ([]dynamoDBScanPosition, error) {
+	if cursor == "" {
+		if segments < 1 {
+			segments = 1
+		}
+		return make([]dynamoDBScanPosition, segments), nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.WithMessage(ErrMalformedCursor, err.Error())
+	}
+
+	var ret []dynamoDBScanPosition
+	if err := json.Unmarshal(raw, &ret); err != nil {
+		return nil, errors.WithMessage(ErrMalformedCursor, err.Error())
+	} else if len(ret) == 0 {
+		return nil, errors.WithMessage(ErrMalformedCursor, "no segments")
+	}
+
+	return ret, nil
+}
+
+// encodeDynamoDBCursor returns an empty cursor once all segments are done.
+func encodeDynamoDBCursor(positions []dynamoDBScanPosition) (string, error) {
+	done := true
+	for _, position := range positions {
+		done = done && position.Done
+	}
+
+	if done {
+		return "", nil
+	}
+
+	raw, err := json.Marshal(positions)
+	return base64.RawURLEncoding.EncodeToString(raw), errors.Wrap(err, "could not encode cursor")
+}
+
+// dynamoDBExpression holds the parts of a DynamoDB expression.
+type dynamoDBExpression struct {
+	condition  *string
+	expression *string
+	names      map[string]*string
+	values     map[string]*dynamodb.AttributeValue
+	schema     DynamoDBSchema
+}
+
+func newDynamoDBExpression(schema DynamoDBSchema) *dynamoDBExpression {
+	return &dynamoDBExpression{
+		names:  make(map[string]*string),
+		values: make(map[string]*dynamodb.AttributeValue),
+		schema: schema,
+	}
+}
+
+// newDynamoDBCondition builds a condition requiring an item to be at the
+// given version.
+func newDynamoDBCondition(schema DynamoDBSchema, version uint64) *dynamoDBExpression {
+	ret := newDynamoDBExpression(schema)
+	ret.requireVersion(version)
+	return ret
+}
+
+// newDynamoDBUpdate builds an update setting the value and incrementing the
+// version of an item. With a manifest, the item points at the chunks of the
+// value instead of holding it. Either way, what the item held before goes.
+func newDynamoDBUpdate(schema DynamoDBSchema, value string, manifest dynamoDBManifest) *dynamoDBExpression {
+	ret := newDynamoDBExpression(schema)
+	ret.names["#chunk_id"] = aws.String(chunkIDField)
+	ret.names["#chunks"] = aws.String(chunksField)
+	ret.names["#value"] = aws.String(schema.valueAttribute())
+	ret.names["#version"] = aws.String(schema.versionAttribute())
+	ret.values[":one"] = &dynamodb.AttributeValue{N: aws.String("1")}
+
+	// Items which were tombstones must not expire once they hold a value.
+	var expiry string
+	if schema.TTLAttribute != "" {
+		ret.names["#expires"] = aws.String(schema.TTLAttribute)
+		expiry = ", #expires"
+	}
+
+	if manifest.id == "" {
+		ret.expression = aws.String("SET #value = :value REMOVE #chunk_id, #chunks" + expiry + " ADD #version :one")
+		ret.values[":value"] = &dynamodb.AttributeValue{B: []byte(value)}
+		return ret
+	}
+
+	ret.expression = aws.String("SET #chunk_id = :chunk_id, #chunks = :chunks REMOVE #value" + expiry + " ADD #version :one")
+	ret.values[":chunk_id"] = &dynamodb.AttributeValue{S: aws.String(manifest.id)}
+	ret.values[":chunks"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(manifest.chunks))}
+	return ret
+}
+
+// newDynamoDBDelete builds an update deleting the value of an item, whether
+// held by the item or in chunks, while incrementing its version. With a TTL
+// attribute, the tombstone left behind expires at the given time.
+func newDynamoDBDelete(schema DynamoDBSchema, expires time.Time) *dynamoDBExpression {
+	ret := newDynamoDBExpression(schema)
+	ret.expression = aws.String("REMOVE #value, #chunk_id, #chunks ADD #version :one")
+	ret.names["#chunk_id"] = aws.String(chunkIDField)
+	ret.names["#chunks"] = aws.String(chunksField)
+	ret.names["#value"] = aws.String(schema.valueAttribute())
+	ret.names["#version"] = aws.String(schema.versionAttribute())
+	ret.values[":one"] = &dynamodb.AttributeValue{N: aws.String("1")}
+
+	if schema.TTLAttribute != "" {
+		ret.expression = aws.String("SET #expires = :expires " + *ret.expression)
+		ret.names["#expires"] = aws.String(schema.TTLAttribute)
+		ret.values[":expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expires.Unix(), 10))}
+	}
+	return ret
+}
+
+// require adds a condition to the ones already there.
+func (e *dynamoDBExpression) require(condition string) {
+	if e.condition != nil {
+		condition = *e.condition + " AND " + condition
+	}
+	e.condition = aws.String(condition)
+}
+
+// requireVersion requires an item to be at the given version. Version zero
+// means that the item has never been written.
+func (e *dynamoDBExpression) requireVersion(version uint64) {
+	e.names["#version"] = aws.String(e.schema.versionAttribute())
+
+	if version == 0 {
+		e.require("attribute_not_exists(#version)")
+		return
+	}
+
+	e.require("#version = :version")
+	e.values[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatUint(version, 10))}
+}
+
+// requireChunks requires an item to point at the chunks in the manifest, or
+// at no chunks at all if it's zero.
+func (e *dynamoDBExpression) requireChunks(manifest dynamoDBManifest) {
+	e.names["#chunk_id"] = aws.String(chunkIDField)
+
+	if manifest.id == "" {
+		e.require("attribute_not_exists(#chunk_id)")
+		return
+	}
+
+	e.require("#chunk_id = :expected_chunk_id")
+	e.values[":expected_chunk_id"] = &dynamodb.AttributeValue{S: aws.String(manifest.id)}
+}
+
+// attributeValues returns nil rather than no values, which DynamoDB rejects.
+func (e *dynamoDBExpression) attributeValues() map[string]*dynamodb.AttributeValue {
+	if len(e.values) == 0 {
+		return nil
+	}
+	return e.values
+}
+
+func isConditionFailure(err error) bool {
+	if canceled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		for _, reason := range canceled.CancellationReasons {
+			if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+		return false
+	}
+
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
 }
@@ -1,9 +1,14 @@
 package lib
 
 import (
+	"context"
+	"fmt"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/pkg/errors"
@@ -40,6 +45,7 @@ func (d *dynamoDBStoreTestSuite) TestGet_OK() {
 			d.Len(input.Key, 1)
 			d.Equal(key, *input.Key["key"].S)
 			d.Equal("table", *input.TableName)
+			d.False(*input.ConsistentRead)
 
 			return true
 		}),
@@ -55,6 +61,73 @@ func (d *dynamoDBStoreTestSuite) TestGet_OK() {
 	d.NoError(err)
 }
 
+func (d *dynamoDBStoreTestSuite) TestGet_Binary() {
+	const value = "\xff\x00bacon\r\n"
+
+	d.api.On(
+		"GetItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.GetItemInput"),
+		[]request.Option(nil),
+	).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{"value": {B: []byte(value)}},
+	}, nil)
+
+	ret, found, err := d.sut.Get("key")
+
+	d.Equal(value, ret)
+	d.True(found)
+	d.NoError(err)
+}
+
+// expectConsistentGet expects a single strongly consistent read.
+func (d *dynamoDBStoreTestSuite) expectConsistentGet() {
+	d.api.On(
+		"GetItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(input *dynamodb.GetItemInput) bool { return *input.ConsistentRead }),
+		[]request.Option(nil),
+	).Return(&dynamodb.GetItemOutput{}, nil).Once()
+}
+
+func (d *dynamoDBStoreTestSuite) TestGet_ConsistentReads() {
+	d.sut.ConsistentReads = true
+	d.expectConsistentGet()
+
+	_, _, err := d.sut.Get("key")
+	d.NoError(err)
+	d.api.AssertExpectations(d.T())
+}
+
+func (d *dynamoDBStoreTestSuite) TestGetContext_ConsistentRead() {
+	d.expectConsistentGet()
+
+	_, _, err := d.sut.GetContext(WithConsistentRead(context.Background()), "key")
+	d.NoError(err)
+	d.api.AssertExpectations(d.T())
+}
+
+func (d *dynamoDBStoreTestSuite) TestGet_Timeout() {
+	d.sut.ReadTimeout = time.Millisecond
+
+	d.api.On(
+		"GetItemWithContext",
+		mock.MatchedBy(func(ctx context.Context) bool {
+			deadline, ok := ctx.Deadline()
+			return ok && time.Until(deadline) <= time.Millisecond
+		}),
+		mock.AnythingOfType("*dynamodb.GetItemInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.GetItemOutput)(nil), errors.New("RequestCanceled")).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	})
+
+	_, found, err := d.sut.Get("key")
+
+	d.False(found)
+	d.Equal(ErrTimeout, err)
+}
+
 func (d *dynamoDBStoreTestSuite) TestGet_APIError() {
 	const key = "key"
 
@@ -72,6 +145,23 @@ func (d *dynamoDBStoreTestSuite) TestGet_APIError() {
 	d.EqualError(err, "DynamoDB API error: bacon")
 }
 
+func (d *dynamoDBStoreTestSuite) TestGetContext_Cancelled() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	d.api.On(
+		"GetItemWithContext",
+		mock.MatchedBy(func(ctx context.Context) bool { return ctx.Err() == context.Canceled }),
+		mock.AnythingOfType("*dynamodb.GetItemInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.GetItemOutput)(nil), context.Canceled)
+
+	_, found, err := d.sut.GetContext(ctx, "key")
+
+	d.False(found)
+	d.EqualError(err, "DynamoDB API error: context canceled")
+}
+
 func (d *dynamoDBStoreTestSuite) TestGet_NotFound() {
 	const key = "key"
 
@@ -108,6 +198,23 @@ func (d *dynamoDBStoreTestSuite) TestGet_NoValueField() {
 	d.EqualError(err, "value field not found in DynamoDB record")
 }
 
+func (d *dynamoDBStoreTestSuite) TestGet_Tombstone() {
+	d.api.On(
+		"GetItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.GetItemInput"),
+		[]request.Option(nil),
+	).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{"key": {S: aws.String("key")}, "version": {N: aws.String("2")}},
+	}, nil)
+
+	ret, found, err := d.sut.Get("key")
+
+	d.Empty(ret)
+	d.False(found)
+	d.NoError(err)
+}
+
 func (d *dynamoDBStoreTestSuite) TestGet_NilValueField() {
 	const key = "key"
 
@@ -132,24 +239,30 @@ func (d *dynamoDBStoreTestSuite) TestSet_OK() {
 	const value = "value"
 
 	d.api.On(
-		"PutItemWithContext",
+		"UpdateItemWithContext",
 		mock.AnythingOfType("*context.timerCtx"),
 		mock.MatchedBy(func(in interface{}) bool {
-			input, ok := in.(*dynamodb.PutItemInput)
+			input, ok := in.(*dynamodb.UpdateItemInput)
 			if !ok {
 				return false
 			}
 
-			d.Len(input.Item, 2)
-			d.Equal(key, *input.Item["key"].S)
-			d.Equal(value, *input.Item["value"].S)
+			d.Len(input.Key, 1)
+			d.Equal(key, *input.Key["key"].S)
+			d.Equal("SET #value = :value REMOVE #chunk_id, #chunks ADD #version :one", *input.UpdateExpression)
+			d.Equal("value", *input.ExpressionAttributeNames["#value"])
+			d.Equal("version", *input.ExpressionAttributeNames["#version"])
+			d.Equal([]byte(value), input.ExpressionAttributeValues[":value"].B)
+			d.Equal("1", *input.ExpressionAttributeValues[":one"].N)
+			d.Nil(input.ConditionExpression)
+			d.Equal("UPDATED_OLD", *input.ReturnValues)
 
 			d.Equal("table", *input.TableName)
 
 			return true
 		}),
 		[]request.Option(nil),
-	).Return((*dynamodb.PutItemOutput)(nil), nil)
+	).Return((*dynamodb.UpdateItemOutput)(nil), nil)
 
 	d.NoError(d.sut.Set(key, value))
 }
@@ -159,15 +272,457 @@ func (d *dynamoDBStoreTestSuite) TestSet_APIError() {
 	const value = "value"
 
 	d.api.On(
-		"PutItemWithContext",
+		"UpdateItemWithContext",
 		mock.AnythingOfType("*context.timerCtx"),
-		mock.AnythingOfType("*dynamodb.PutItemInput"),
+		mock.AnythingOfType("*dynamodb.UpdateItemInput"),
 		[]request.Option(nil),
-	).Return((*dynamodb.PutItemOutput)(nil), errors.New("bacon"))
+	).Return((*dynamodb.UpdateItemOutput)(nil), errors.New("bacon"))
 
 	d.EqualError(d.sut.Set(key, value), "DynamoDB API error: bacon")
 }
 
+func (d *dynamoDBStoreTestSuite) TestSet_Retries() {
+	d.sut.Retries = NewRetryPolicy(2)
+	d.sut.Retries.BaseDelay = time.Microsecond
+
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+
+	d.api.On(
+		"UpdateItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.UpdateItemInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.UpdateItemOutput)(nil), throttled).Once()
+
+	d.api.On(
+		"UpdateItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.UpdateItemInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.UpdateItemOutput)(nil), nil).Once()
+
+	d.NoError(d.sut.Set("key", "value"))
+	d.api.AssertNumberOfCalls(d.T(), "UpdateItemWithContext", 2)
+}
+
+func (d *dynamoDBStoreTestSuite) TestSet_Throttled() {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+
+	d.api.On(
+		"UpdateItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.UpdateItemInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.UpdateItemOutput)(nil), throttled)
+
+	d.Equal(ErrThrottled, errors.Cause(d.sut.Set("key", "value")))
+}
+
+func (d *dynamoDBStoreTestSuite) TestSet_Timeout() {
+	d.sut.ReadTimeout = time.Hour
+	d.sut.WriteTimeout = time.Millisecond
+
+	d.api.On(
+		"UpdateItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.UpdateItemInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.UpdateItemOutput)(nil), errors.New("RequestCanceled")).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	})
+
+	d.Equal(ErrTimeout, d.sut.Set("key", "value"))
+}
+
+func (d *dynamoDBStoreTestSuite) TestVersion_OK() {
+	const key = "key"
+
+	d.api.On(
+		"GetItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(in interface{}) bool {
+			input, ok := in.(*dynamodb.GetItemInput)
+			if !ok {
+				return false
+			}
+
+			d.Equal(key, *input.Key["key"].S)
+			d.True(*input.ConsistentRead)
+			d.Equal("#version", *input.ProjectionExpression)
+
+			return true
+		}),
+		[]request.Option(nil),
+	).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{"version": {N: aws.String("42")}},
+	}, nil)
+
+	version, err := d.sut.Version(key)
+
+	d.Equal(uint64(42), version)
+	d.NoError(err)
+}
+
+func (d *dynamoDBStoreTestSuite) TestVersion_NotFound() {
+	d.api.On(
+		"GetItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.GetItemInput"),
+		[]request.Option(nil),
+	).Return(&dynamodb.GetItemOutput{}, nil)
+
+	version, err := d.sut.Version("key")
+
+	d.Zero(version)
+	d.NoError(err)
+}
+
+func (d *dynamoDBStoreTestSuite) TestVersion_APIError() {
+	d.api.On(
+		"GetItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.GetItemInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.GetItemOutput)(nil), errors.New("bacon"))
+
+	_, err := d.sut.Version("key")
+
+	d.EqualError(err, "DynamoDB API error: bacon")
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_Transaction() {
+	d.api.On(
+		"TransactWriteItemsWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(in interface{}) bool {
+			input, ok := in.(*dynamodb.TransactWriteItemsInput)
+			if !ok {
+				return false
+			}
+
+			d.Len(input.TransactItems, 2)
+			d.Equal("bacon", *input.TransactItems[0].Update.Key["key"].S)
+			d.Equal([]byte("crispy"), input.TransactItems[0].Update.ExpressionAttributeValues[":value"].B)
+			d.Equal("attribute_not_exists(#chunk_id)", *input.TransactItems[0].Update.ConditionExpression)
+			d.Equal("cabbage", *input.TransactItems[1].Update.Key["key"].S)
+			d.Equal("table", *input.TransactItems[1].Update.TableName)
+
+			return true
+		}),
+		[]request.Option(nil),
+	).Return((*dynamodb.TransactWriteItemsOutput)(nil), nil)
+
+	d.NoError(d.sut.Apply([]Write{
+		{Key: "bacon", Value: "tasty"},
+		{Key: "cabbage", Value: "healthy"},
+		{Key: "bacon", Value: "crispy"},
+	}, nil))
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_Conditions() {
+	d.api.On(
+		"TransactWriteItemsWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(in interface{}) bool {
+			input, ok := in.(*dynamodb.TransactWriteItemsInput)
+			if !ok {
+				return false
+			}
+
+			d.Len(input.TransactItems, 2)
+
+			update := input.TransactItems[0].Update
+			d.Equal("bacon", *update.Key["key"].S)
+			d.Equal("#version = :version AND attribute_not_exists(#chunk_id)", *update.ConditionExpression)
+			d.Equal("3", *update.ExpressionAttributeValues[":version"].N)
+
+			check := input.TransactItems[1].ConditionCheck
+			d.Equal("cabbage", *check.Key["key"].S)
+			d.Equal("attribute_not_exists(#version)", *check.ConditionExpression)
+			d.Equal("version", *check.ExpressionAttributeNames["#version"])
+
+			return true
+		}),
+		[]request.Option(nil),
+	).Return((*dynamodb.TransactWriteItemsOutput)(nil), nil)
+
+	d.NoError(d.sut.Apply(
+		[]Write{{Key: "bacon", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 3}, {Key: "cabbage", Version: 0}},
+	))
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_Delete() {
+	d.api.On(
+		"TransactWriteItemsWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(in interface{}) bool {
+			input, ok := in.(*dynamodb.TransactWriteItemsInput)
+			if !ok {
+				return false
+			}
+
+			d.Len(input.TransactItems, 2)
+
+			del := input.TransactItems[0].Update
+			d.Equal("bacon", *del.Key["key"].S)
+			d.Equal("table", *del.TableName)
+			d.Equal("REMOVE #value, #chunk_id, #chunks ADD #version :one", *del.UpdateExpression)
+			d.Equal("#version = :version AND attribute_not_exists(#chunk_id)", *del.ConditionExpression)
+			d.Equal("2", *del.ExpressionAttributeValues[":version"].N)
+
+			update := input.TransactItems[1].Update
+			d.Equal("cabbage", *update.Key["key"].S)
+			d.Equal([]byte("tasty"), update.ExpressionAttributeValues[":value"].B)
+
+			return true
+		}),
+		[]request.Option(nil),
+	).Return((*dynamodb.TransactWriteItemsOutput)(nil), nil)
+
+	d.NoError(d.sut.Apply(
+		[]Write{{Key: "bacon", Delete: true}, {Key: "cabbage", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 2}},
+	))
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_TombstoneExpires() {
+	d.sut.Schema.TTLAttribute = "expires"
+	d.sut.TombstoneTTL = time.Hour
+	now := time.Now()
+
+	d.api.On(
+		"TransactWriteItemsWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(in interface{}) bool {
+			input, ok := in.(*dynamodb.TransactWriteItemsInput)
+			if !ok {
+				return false
+			}
+
+			del := input.TransactItems[0].Update
+			d.Equal("SET #expires = :expires REMOVE #value, #chunk_id, #chunks ADD #version :one", *del.UpdateExpression)
+			d.Equal("expires", *del.ExpressionAttributeNames["#expires"])
+
+			expires, err := strconv.ParseInt(*del.ExpressionAttributeValues[":expires"].N, 10, 64)
+			d.NoError(err)
+			d.InDelta(now.Add(time.Hour).Unix(), expires, 5)
+
+			// Keys written again must not expire along with their tombstone.
+			update := input.TransactItems[1].Update
+			d.Equal("SET #value = :value REMOVE #chunk_id, #chunks, #expires ADD #version :one", *update.UpdateExpression)
+			d.Equal("expires", *update.ExpressionAttributeNames["#expires"])
+
+			return true
+		}),
+		[]request.Option(nil),
+	).Return((*dynamodb.TransactWriteItemsOutput)(nil), nil)
+
+	d.NoError(d.sut.Apply(
+		[]Write{{Key: "bacon", Delete: true}, {Key: "cabbage", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 2}},
+	))
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_SingleDelete() {
+	d.api.On(
+		"TransactWriteItemsWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(in interface{}) bool {
+			input, ok := in.(*dynamodb.TransactWriteItemsInput)
+			if !ok {
+				return false
+			}
+
+			d.Len(input.TransactItems, 1)
+			del := input.TransactItems[0].Update
+			d.Equal("bacon", *del.Key["key"].S)
+			d.Equal("attribute_not_exists(#chunk_id)", *del.ConditionExpression)
+			d.Equal(map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}}, del.ExpressionAttributeValues)
+
+			return true
+		}),
+		[]request.Option(nil),
+	).Return((*dynamodb.TransactWriteItemsOutput)(nil), nil)
+
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Delete: true}}, nil))
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_ConditionFailed() {
+	d.api.On(
+		"TransactWriteItemsWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.TransactWriteItemsInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.TransactWriteItemsOutput)(nil), &dynamodb.TransactionCanceledException{
+		CancellationReasons: []*dynamodb.CancellationReason{
+			{Code: aws.String("None")},
+			{Code: aws.String("ConditionalCheckFailed")},
+		},
+	})
+
+	// No chunks are in the way, so it's the condition which failed.
+	d.api.On(
+		"GetItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(input *dynamodb.GetItemInput) bool { return *input.Key["key"].S == "bacon" }),
+		[]request.Option(nil),
+	).Return(&dynamodb.GetItemOutput{}, nil).Once()
+
+	d.Equal(ErrConditionFailed, d.sut.Apply(
+		[]Write{{Key: "bacon", Value: "tasty"}},
+		[]Condition{{Key: "cabbage", Version: 1}},
+	))
+	d.api.AssertExpectations(d.T())
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_SingleWrite() {
+	d.api.On(
+		"UpdateItemWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.UpdateItemInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.UpdateItemOutput)(nil), nil)
+
+	d.NoError(d.sut.Apply([]Write{{Key: "bacon", Value: "tasty"}}, nil))
+	d.api.AssertNotCalled(d.T(), "TransactWriteItemsWithContext", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_NoWrites() {
+	d.NoError(d.sut.Apply(nil, nil))
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_TooLarge() {
+	writes := make([]Write, maxTransactionItems+1)
+	for i := range writes {
+		writes[i].Key = fmt.Sprintf("key%d", i)
+	}
+
+	d.Equal(ErrTransactionTooLarge, d.sut.Apply(writes, nil))
+}
+
+func (d *dynamoDBStoreTestSuite) TestApply_APIError() {
+	d.api.On(
+		"TransactWriteItemsWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.TransactWriteItemsInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.TransactWriteItemsOutput)(nil), errors.New("bacon"))
+
+	d.EqualError(d.sut.Apply([]Write{
+		{Key: "bacon", Value: "tasty"},
+		{Key: "cabbage", Value: "healthy"},
+	}, nil), "DynamoDB API error: bacon")
+}
+
+func (d *dynamoDBStoreTestSuite) TestScan_SingleSegment() {
+	d.api.On(
+		"ScanWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(input *dynamodb.ScanInput) bool {
+			return input.ExclusiveStartKey == nil
+		}),
+		[]request.Option(nil),
+	).Return(&dynamodb.ScanOutput{
+		Items:            []map[string]*dynamodb.AttributeValue{DynamoDBSchema{}.key("bacon"), DynamoDBSchema{}.key("cabbage")},
+		LastEvaluatedKey: DynamoDBSchema{}.key("cabbage"),
+	}, nil).Once()
+
+	keys, cursor, err := d.sut.Scan("", 2)
+
+	d.Equal([]string{"bacon", "cabbage"}, keys)
+	d.NotEmpty(cursor)
+	d.NoError(err)
+
+	d.api.On(
+		"ScanWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(input *dynamodb.ScanInput) bool {
+			d.Equal("cabbage", *input.ExclusiveStartKey["key"].S)
+			d.Equal(int64(2), *input.Limit)
+			d.Equal("#key", *input.ProjectionExpression)
+			d.Equal("key", *input.ExpressionAttributeNames["#key"])
+			d.Equal("attribute_exists(#value) OR attribute_exists(#chunk_id)", *input.FilterExpression)
+			d.Equal("table", *input.TableName)
+			d.Nil(input.Segment)
+			d.Nil(input.TotalSegments)
+			return true
+		}),
+		[]request.Option(nil),
+	).Return(&dynamodb.ScanOutput{
+		Items: []map[string]*dynamodb.AttributeValue{DynamoDBSchema{}.key("eggs")},
+	}, nil).Once()
+
+	keys, cursor, err = d.sut.Scan(cursor, 2)
+
+	d.Equal([]string{"eggs"}, keys)
+	d.Empty(cursor)
+	d.NoError(err)
+}
+
+func (d *dynamoDBStoreTestSuite) TestScan_ParallelSegments() {
+	d.sut.ScanSegments = 2
+
+	for segment, key := range []string{"bacon", "cabbage"} {
+		segment, key := int64(segment), key
+
+		output := &dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{DynamoDBSchema{}.key(key)}}
+		if segment == 0 {
+			output.LastEvaluatedKey = DynamoDBSchema{}.key(key)
+		}
+
+		d.api.On(
+			"ScanWithContext",
+			mock.AnythingOfType("*context.timerCtx"),
+			mock.MatchedBy(func(input *dynamodb.ScanInput) bool {
+				return *input.Segment == segment && *input.TotalSegments == 2 && *input.Limit == 5
+			}),
+			[]request.Option(nil),
+		).Return(output, nil).Once()
+	}
+
+	keys, cursor, err := d.sut.Scan("", 10)
+
+	d.Equal([]string{"bacon", "cabbage"}, keys)
+	d.NoError(err)
+
+	// Only the first segment is left, so it gets the whole count.
+	d.api.On(
+		"ScanWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.MatchedBy(func(input *dynamodb.ScanInput) bool {
+			return *input.Segment == 0 && *input.Limit == 10 && *input.ExclusiveStartKey["key"].S == "bacon"
+		}),
+		[]request.Option(nil),
+	).Return(&dynamodb.ScanOutput{}, nil).Once()
+
+	keys, cursor, err = d.sut.Scan(cursor, 10)
+
+	d.Empty(keys)
+	d.Empty(cursor)
+	d.NoError(err)
+	d.api.AssertExpectations(d.T())
+}
+
+func (d *dynamoDBStoreTestSuite) TestScan_APIError() {
+	d.api.On(
+		"ScanWithContext",
+		mock.AnythingOfType("*context.timerCtx"),
+		mock.AnythingOfType("*dynamodb.ScanInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.ScanOutput)(nil), errors.New("bacon"))
+
+	_, _, err := d.sut.Scan("", 10)
+
+	d.EqualError(err, "DynamoDB API error: bacon")
+}
+
+func (d *dynamoDBStoreTestSuite) TestScan_MalformedCursor() {
+	_, _, err := d.sut.Scan("bacon", 10)
+
+	d.Equal(ErrMalformedCursor, errors.Cause(err))
+}
+
 func TestDynamoDBStore(t *testing.T) {
 	suite.Run(t, new(dynamoDBStoreTestSuite))
 }
@@ -0,0 +1,328 @@
+package lib
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultStreamPollInterval is how often each shard of the stream is
+	// polled for new records. DynamoDB allows up to five GetRecords calls per
+	// shard per second.
+	DefaultStreamPollInterval = 250 * time.Millisecond
+
+	// DefaultStreamDiscoveryInterval is how often the stream is described to
+	// discover new shards, which DynamoDB creates every few hours.
+	DefaultStreamDiscoveryInterval = time.Minute
+
+	// streamRecordsLimit is the maximum number of records DynamoDB returns in
+	// a single GetRecords call.
+	streamRecordsLimit = 1000
+)
+
+// streamShard tracks how far a single shard of the stream has been consumed.
+type streamShard struct {
+	id     string
+	parent string
+
+	// start is where to read the shard from when there's no checkpoint.
+	start string
+
+	// iterator is where the next GetRecords call continues from. Iterators
+	// expire after 15 minutes, in which case a new one is requested from the
+	// checkpoint.
+	iterator string
+
+	// checkpoint is the sequence number of the last record applied.
+	checkpoint string
+
+	// finished is set once all records of a closed shard have been applied.
+	finished bool
+}
+
+// StreamSubscriber keeps a CachingStore coherent with writes made through other
+// nodes sharing the same DynamoDB table, by following the table's stream and
+// invalidating the keys it reports as written. It works with any stream view
+// type, since it only needs the keys.
+//
+// Keys are invalidated rather than updated in place, since records may arrive
+// after the key has been written again through this node. Writes made
+// through this node are invalidated as well when their records arrive, which
+// costs one more authority read for each of them.
+//
+// Checkpoints are only kept in memory, which is enough since the cache itself
+// is: a node starting afresh has nothing to invalidate, so it only follows the
+// shards open at the time from their latest records.
+type StreamSubscriber struct {
+	API       dynamodbstreamsiface.DynamoDBStreamsAPI
+	StreamARN string
+	Store     *CachingStore
+
+	// Schema is the schema of the table the stream belongs to.
+	Schema DynamoDBSchema
+
+	PollInterval      time.Duration
+	DiscoveryInterval time.Duration
+
+	logger     logrus.FieldLogger
+	shards     map[string]*streamShard
+	discovered bool
+	rediscover bool
+}
+
+// NewStreamSubscriber returns a StreamSubscriber with the default intervals.
+func NewStreamSubscriber(api dynamodbstreamsiface.DynamoDBStreamsAPI, streamARN string, store *CachingStore, logger logrus.FieldLogger) *StreamSubscriber {
+	return &StreamSubscriber{
+		API:               api,
+		StreamARN:         streamARN,
+		Store:             store,
+		PollInterval:      DefaultStreamPollInterval,
+		DiscoveryInterval: DefaultStreamDiscoveryInterval,
+		logger:            logger,
+		shards:            make(map[string]*streamShard),
+	}
+}
+
+// Run follows the stream until the context is done. Errors are logged and
+// retried on the next poll, since the cache may only become stale while the
+// stream can't be read.
+func (s *StreamSubscriber) Run(ctx context.Context) error {
+	poll := time.NewTicker(s.PollInterval)
+	defer poll.Stop()
+
+	var lastDiscovery time.Time
+	for {
+		if !s.discovered || s.rediscover || time.Since(lastDiscovery) >= s.DiscoveryInterval {
+			if err := s.discover(ctx); err != nil {
+				s.logger.Errorf("Could not discover stream shards: %v", err)
+			} else {
+				lastDiscovery = time.Now()
+			}
+		}
+
+		if s.discovered {
+			if err := s.poll(ctx); err != nil {
+				s.logger.Errorf("Could not read stream records: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll.C:
+		}
+	}
+}
+
+// discover describes the stream, starting to follow shards not seen before,
+// and forgetting finished shards DynamoDB has trimmed.
+func (s *StreamSubscriber) discover(ctx context.Context) error {
+	var shards []*dynamodbstreams.Shard
+
+	input := &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(s.StreamARN)}
+	for {
+		out, err := s.API.DescribeStreamWithContext(ctx, input)
+		if err != nil {
+			return errors.Wrap(err, apiErrorMessage)
+		}
+
+		shards = append(shards, out.StreamDescription.Shards...)
+
+		if out.StreamDescription.LastEvaluatedShardId == nil {
+			break
+		}
+		input.ExclusiveStartShardId = out.StreamDescription.LastEvaluatedShardId
+	}
+
+	described := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		id := aws.StringValue(shard.ShardId)
+		described[id] = true
+
+		if _, known := s.shards[id]; known {
+			continue
+		}
+
+		closed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+		tracked := &streamShard{id: id, parent: aws.StringValue(shard.ParentShardId), start: dynamodbstreams.ShardIteratorTypeTrimHorizon}
+
+		// Records in shards which existed before this node started were
+		// written before it had anything cached.
+		if !s.discovered {
+			tracked.start = dynamodbstreams.ShardIteratorTypeLatest
+			tracked.finished = closed
+		}
+
+		s.shards[id] = tracked
+	}
+
+	for id, shard := range s.shards {
+		if described[id] {
+			continue
+		} else if !shard.finished {
+			if err := s.lost(shard); err != nil {
+				return err
+			}
+		}
+		delete(s.shards, id)
+	}
+
+	s.discovered, s.rediscover = true, false
+	return nil
+}
+
+// poll reads the next batch of records from each shard ready to be read. A
+// shard is ready once its parent is finished, so that records for the same
+// key are applied in order across resharding.
+func (s *StreamSubscriber) poll(ctx context.Context) error {
+	ids := make([]string, 0, len(s.shards))
+	for id := range s.shards {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		shard := s.shards[id]
+		if shard.finished || !s.ready(shard) {
+			continue
+		}
+
+		if err := s.pollShard(ctx, shard); err != nil {
+			return errors.Wrapf(err, "could not read shard %s", id)
+		}
+	}
+	return nil
+}
+
+func (s *StreamSubscriber) ready(shard *streamShard) bool {
+	parent, tracked := s.shards[shard.parent]
+	return !tracked || parent.finished
+}
+
+func (s *StreamSubscriber) pollShard(ctx context.Context, shard *streamShard) error {
+	if shard.iterator == "" {
+		if err := s.resetIterator(ctx, shard); err != nil || shard.iterator == "" {
+			return err
+		}
+	}
+
+	out, err := s.API.GetRecordsWithContext(ctx, &dynamodbstreams.GetRecordsInput{
+		Limit:         aws.Int64(streamRecordsLimit),
+		ShardIterator: aws.String(shard.iterator),
+	})
+
+	if err != nil {
+		switch awsErrorCode(err) {
+		case dynamodbstreams.ErrCodeExpiredIteratorException:
+			shard.iterator = ""
+			return nil
+		case dynamodbstreams.ErrCodeTrimmedDataAccessException:
+			return s.restart(shard)
+		}
+		return errors.Wrap(err, apiErrorMessage)
+	}
+
+	for _, record := range out.Records {
+		if err := s.apply(record); err != nil {
+			return err
+		}
+		if record.Dynamodb != nil {
+			shard.checkpoint = aws.StringValue(record.Dynamodb.SequenceNumber)
+		}
+	}
+
+	if out.NextShardIterator == nil {
+		shard.finished, s.rediscover = true, true
+		return nil
+	}
+	shard.iterator = *out.NextShardIterator
+	return nil
+}
+
+// resetIterator requests an iterator continuing after the checkpoint, or from
+// where the shard is to be read from if there's none yet.
+func (s *StreamSubscriber) resetIterator(ctx context.Context, shard *streamShard) error {
+	input := &dynamodbstreams.GetShardIteratorInput{
+		ShardId:           aws.String(shard.id),
+		ShardIteratorType: aws.String(shard.start),
+		StreamArn:         aws.String(s.StreamARN),
+	}
+	if shard.checkpoint != "" {
+		input.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeAfterSequenceNumber)
+		input.SequenceNumber = aws.String(shard.checkpoint)
+	}
+
+	out, err := s.API.GetShardIteratorWithContext(ctx, input)
+	if err != nil {
+		switch awsErrorCode(err) {
+		case dynamodbstreams.ErrCodeTrimmedDataAccessException:
+			return s.restart(shard)
+		case dynamodbstreams.ErrCodeResourceNotFoundException:
+			return s.lost(shard)
+		}
+		return errors.Wrap(err, apiErrorMessage)
+	}
+
+	shard.iterator = aws.StringValue(out.ShardIterator)
+	return nil
+}
+
+// restart handles records having been trimmed from the shard before they
+// were read. Any key may have been written by them, so the whole cache is
+// invalidated, and the shard is read again from its oldest record.
+func (s *StreamSubscriber) restart(shard *streamShard) error {
+	s.logger.Warnf("Records of stream shard %s were trimmed before they were read, invalidating the cache", shard.id)
+
+	shard.iterator, shard.checkpoint, shard.start = "", "", dynamodbstreams.ShardIteratorTypeTrimHorizon
+	return errors.Wrap(s.Store.InvalidateAll(), "could not invalidate the cache")
+}
+
+// lost handles a shard which is gone before all its records were read, so
+// the whole cache is invalidated, and its children are read next.
+func (s *StreamSubscriber) lost(shard *streamShard) error {
+	s.logger.Warnf("Stream shard %s is gone before it was read, invalidating the cache", shard.id)
+
+	shard.iterator, shard.finished, s.rediscover = "", true, true
+	return errors.Wrap(s.Store.InvalidateAll(), "could not invalidate the cache")
+}
+
+// apply invalidates the key written by the record, whatever the operation.
+// Records of items which hold no key are logged and skipped, since reading
+// them again would not change that.
+func (s *StreamSubscriber) apply(record *dynamodbstreams.Record) error {
+	var keys map[string]*dynamodb.AttributeValue
+	if record.Dynamodb != nil {
+		keys = record.Dynamodb.Keys
+	}
+
+	name := s.Schema.keyAttribute()
+	key := keys[name]
+	if key == nil || key.S == nil {
+		s.logger.Warnf("Skipping stream record %s, which has no %s field", aws.StringValue(record.EventID), name)
+		return nil
+	}
+
+	if !s.Schema.holds(*key.S, keys[s.Schema.SortKeyAttribute]) {
+		return nil
+	}
+
+	return errors.Wrap(s.Store.Invalidate(*key.S), "could not invalidate key")
+}
+
+// awsErrorCode returns the code of an AWS error, or an empty string for any
+// other error.
+func awsErrorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return ""
+}
@@ -0,0 +1,479 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeStreamShard is a shard of a fakeStream. Records before trimmed are gone.
+type fakeStreamShard struct {
+	id      string
+	parent  string
+	records []*dynamodbstreams.Record
+	trimmed int
+	closed  bool
+}
+
+// fakeStream is an in-memory DynamoDB stream, describing shards in pages of
+// two. Iterators are of the form shard/position/serial, where the serial
+// number tells whether the iterator has expired.
+type fakeStream struct {
+	dynamodbstreamsiface.DynamoDBStreamsAPI
+
+	shards   []*fakeStreamShard
+	sequence int
+	serial   int
+	expired  int
+
+	iteratorRequests []string
+	lock             *sync.Mutex
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{lock: new(sync.Mutex)}
+}
+
+func (f *fakeStream) addShard(id, parent string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.shards = append(f.shards, &fakeStreamShard{id: id, parent: parent})
+}
+
+func (f *fakeStream) shard(id string) *fakeStreamShard {
+	for _, shard := range f.shards {
+		if shard.id == id {
+			return shard
+		}
+	}
+	return nil
+}
+
+func (f *fakeStream) write(shardID, eventName, key string) {
+	f.writeKeys(shardID, eventName, map[string]*dynamodb.AttributeValue{keyField: {S: aws.String(key)}})
+}
+
+// writeKeys adds a record of the item with the key attributes.
+func (f *fakeStream) writeKeys(shardID, eventName string, keys map[string]*dynamodb.AttributeValue) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.sequence++
+	shard := f.shard(shardID)
+	shard.records = append(shard.records, &dynamodbstreams.Record{
+		EventID:   aws.String(strconv.Itoa(f.sequence)),
+		EventName: aws.String(eventName),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			Keys:           keys,
+			SequenceNumber: aws.String(fmt.Sprintf("%05d", f.sequence)),
+		},
+	})
+}
+
+func (f *fakeStream) close(shardID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.shard(shardID).closed = true
+}
+
+func (f *fakeStream) trim(shardID string, records int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.shard(shardID).trimmed = records
+}
+
+func (f *fakeStream) remove(shardID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i, shard := range f.shards {
+		if shard.id == shardID {
+			f.shards = append(f.shards[:i], f.shards[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *fakeStream) expireIterators() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.expired = f.serial
+}
+
+// iterator must be called with the lock held.
+func (f *fakeStream) iterator(shardID string, position int) *string {
+	f.serial++
+	return aws.String(fmt.Sprintf("%s/%d/%d", shardID, position, f.serial))
+}
+
+func (f *fakeStream) DescribeStreamWithContext(ctx aws.Context, input *dynamodbstreams.DescribeStreamInput, opts ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	start := 0
+	if input.ExclusiveStartShardId != nil {
+		for i, shard := range f.shards {
+			if shard.id == *input.ExclusiveStartShardId {
+				start = i + 1
+			}
+		}
+	}
+
+	description := &dynamodbstreams.StreamDescription{StreamArn: input.StreamArn}
+	for i := start; i < len(f.shards) && i < start+2; i++ {
+		shard := f.shards[i]
+
+		described := &dynamodbstreams.Shard{
+			ShardId:             aws.String(shard.id),
+			SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{StartingSequenceNumber: aws.String("00000")},
+		}
+		if shard.parent != "" {
+			described.ParentShardId = aws.String(shard.parent)
+		}
+		if shard.closed {
+			described.SequenceNumberRange.EndingSequenceNumber = aws.String("99999")
+		}
+		description.Shards = append(description.Shards, described)
+	}
+
+	if start+2 < len(f.shards) {
+		description.LastEvaluatedShardId = description.Shards[1].ShardId
+	}
+
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: description}, nil
+}
+
+func (f *fakeStream) GetShardIteratorWithContext(ctx aws.Context, input *dynamodbstreams.GetShardIteratorInput, opts ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	request := fmt.Sprintf("%s %s", *input.ShardId, *input.ShardIteratorType)
+	if input.SequenceNumber != nil {
+		request += " " + *input.SequenceNumber
+	}
+	f.iteratorRequests = append(f.iteratorRequests, request)
+
+	shard := f.shard(*input.ShardId)
+	if shard == nil {
+		return nil, awserr.New(dynamodbstreams.ErrCodeResourceNotFoundException, "no such shard", nil)
+	}
+
+	var position int
+	switch *input.ShardIteratorType {
+	case dynamodbstreams.ShardIteratorTypeTrimHorizon:
+		position = shard.trimmed
+	case dynamodbstreams.ShardIteratorTypeLatest:
+		position = len(shard.records)
+	case dynamodbstreams.ShardIteratorTypeAfterSequenceNumber:
+		for i, record := range shard.records {
+			if *record.Dynamodb.SequenceNumber == *input.SequenceNumber {
+				position = i + 1
+			}
+		}
+		if position < shard.trimmed {
+			return nil, awserr.New(dynamodbstreams.ErrCodeTrimmedDataAccessException, "trimmed", nil)
+		}
+	}
+
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: f.iterator(shard.id, position)}, nil
+}
+
+func (f *fakeStream) GetRecordsWithContext(ctx aws.Context, input *dynamodbstreams.GetRecordsInput, opts ...request.Option) (*dynamodbstreams.GetRecordsOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.Split(*input.ShardIterator, "/")
+	shard := f.shard(parts[0])
+	position, _ := strconv.Atoi(parts[1])
+
+	if serial, _ := strconv.Atoi(parts[2]); serial <= f.expired {
+		return nil, awserr.New(dynamodbstreams.ErrCodeExpiredIteratorException, "expired", nil)
+	}
+
+	if position < shard.trimmed {
+		return nil, awserr.New(dynamodbstreams.ErrCodeTrimmedDataAccessException, "trimmed", nil)
+	}
+
+	out := &dynamodbstreams.GetRecordsOutput{Records: shard.records[position:]}
+	if !shard.closed {
+		out.NextShardIterator = f.iterator(shard.id, len(shard.records))
+	}
+	return out, nil
+}
+
+type streamSubscriberTestSuite struct {
+	suite.Suite
+
+	authority Store
+	logOutput *bytes.Buffer
+	store     *CachingStore
+	stream    *fakeStream
+
+	sut *StreamSubscriber
+}
+
+func (s *streamSubscriberTestSuite) SetupTest() {
+	s.authority = NewInMemoryStore()
+	s.store = NewCachingStore(s.authority, NewInMemoryStore())
+	s.stream = newFakeStream()
+	s.logOutput = bytes.NewBuffer(nil)
+
+	logger := logrus.New()
+	logger.SetOutput(s.logOutput)
+
+	s.sut = NewStreamSubscriber(s.stream, "arn:stream", s.store, logger)
+}
+
+// cached reads the key from the authority through the store, so that it
+// ends up in the cache.
+func (s *streamSubscriberTestSuite) cached(key, value string) {
+	s.Require().NoError(s.authority.Set(key, value))
+
+	_, found, err := s.store.Get(key)
+	s.Require().True(found)
+	s.Require().NoError(err)
+}
+
+// remoteWrite writes the key as another node would.
+func (s *streamSubscriberTestSuite) remoteWrite(shardID, key, value string) {
+	s.Require().NoError(s.authority.Set(key, value))
+	s.stream.write(shardID, dynamodbstreams.OperationTypeModify, key)
+}
+
+func (s *streamSubscriberTestSuite) inCache(key string) bool {
+	_, found, err := s.store.Cache.Get(key)
+	s.Require().NoError(err)
+	return found
+}
+
+func (s *streamSubscriberTestSuite) discoverAndPoll() {
+	s.Require().NoError(s.sut.discover(context.Background()))
+	s.Require().NoError(s.sut.poll(context.Background()))
+}
+
+func (s *streamSubscriberTestSuite) TestInvalidatesWrittenKeys() {
+	s.stream.addShard("shard-1", "")
+	s.discoverAndPoll()
+
+	s.cached("bacon", "stale")
+	s.cached("cabbage", "healthy")
+	s.remoteWrite("shard-1", "bacon", "fresh")
+
+	s.NoError(s.sut.poll(context.Background()))
+
+	s.False(s.inCache("bacon"))
+	s.True(s.inCache("cabbage"))
+
+	value, _, err := s.store.Get("bacon")
+	s.Equal("fresh", value)
+	s.NoError(err)
+}
+
+func (s *streamSubscriberTestSuite) TestForgetsKnownMissing() {
+	s.stream.addShard("shard-1", "")
+	s.discoverAndPoll()
+
+	_, found, err := s.store.Get("bacon")
+	s.Require().False(found)
+	s.Require().NoError(err)
+
+	s.remoteWrite("shard-1", "bacon", "tasty")
+	s.NoError(s.sut.poll(context.Background()))
+
+	s.False(s.store.KnownMissing.Contains("bacon"))
+}
+
+func (s *streamSubscriberTestSuite) TestStartsFromLatest() {
+	s.stream.addShard("shard-1", "")
+	s.stream.write("shard-1", dynamodbstreams.OperationTypeInsert, "bacon")
+	s.stream.addShard("shard-0", "")
+	s.stream.close("shard-0")
+
+	s.discoverAndPoll()
+
+	s.Equal([]string{"shard-1 LATEST"}, s.stream.iteratorRequests)
+	s.True(s.sut.shards["shard-0"].finished)
+}
+
+func (s *streamSubscriberTestSuite) TestDiscoversAllPages() {
+	for i := 0; i < 5; i++ {
+		s.stream.addShard(fmt.Sprintf("shard-%d", i), "")
+	}
+
+	s.NoError(s.sut.discover(context.Background()))
+
+	s.Len(s.sut.shards, 5)
+}
+
+func (s *streamSubscriberTestSuite) TestResharding() {
+	s.stream.addShard("parent", "")
+	s.discoverAndPoll()
+
+	s.cached("bacon", "stale")
+	s.cached("cabbage", "stale")
+
+	s.remoteWrite("parent", "bacon", "fresh")
+	s.stream.close("parent")
+	s.stream.addShard("child", "parent")
+	s.remoteWrite("child", "cabbage", "fresh")
+
+	// The child is discovered before its parent is finished, so it's not
+	// read until the parent is.
+	s.NoError(s.sut.discover(context.Background()))
+	s.Equal(dynamodbstreams.ShardIteratorTypeTrimHorizon, s.sut.shards["child"].start)
+	s.False(s.sut.ready(s.sut.shards["child"]))
+
+	s.NoError(s.sut.poll(context.Background()))
+	s.True(s.sut.shards["parent"].finished)
+	s.True(s.sut.rediscover)
+	s.False(s.inCache("bacon"))
+	s.True(s.inCache("cabbage"))
+
+	s.discoverAndPoll()
+	s.False(s.inCache("cabbage"))
+
+	// Once trimmed, the finished parent is forgotten.
+	s.stream.remove("parent")
+	s.NoError(s.sut.discover(context.Background()))
+	s.NotContains(s.sut.shards, "parent")
+}
+
+func (s *streamSubscriberTestSuite) TestExpiredIterator() {
+	s.stream.addShard("shard-1", "")
+	s.discoverAndPoll()
+
+	s.remoteWrite("shard-1", "bacon", "tasty")
+	s.NoError(s.sut.poll(context.Background()))
+
+	s.stream.expireIterators()
+	s.NoError(s.sut.poll(context.Background()))
+	s.Empty(s.sut.shards["shard-1"].iterator)
+
+	s.cached("bacon", "tasty")
+	s.remoteWrite("shard-1", "cabbage", "healthy")
+	s.NoError(s.sut.poll(context.Background()))
+
+	s.Equal([]string{"shard-1 LATEST", "shard-1 AFTER_SEQUENCE_NUMBER 00001"}, s.stream.iteratorRequests)
+	s.True(s.inCache("bacon"), "records already applied are not applied again")
+}
+
+func (s *streamSubscriberTestSuite) TestTrimmedBeforeRead() {
+	s.stream.addShard("shard-1", "")
+	s.discoverAndPoll()
+
+	s.remoteWrite("shard-1", "bacon", "tasty")
+	s.NoError(s.sut.poll(context.Background()))
+
+	s.cached("cabbage", "healthy")
+	s.remoteWrite("shard-1", "carrot", "crunchy")
+	s.remoteWrite("shard-1", "potato", "starchy")
+	s.stream.trim("shard-1", 2)
+	s.stream.expireIterators()
+
+	// The first poll finds the iterator expired, the second that records
+	// after the checkpoint are gone, and the third starts over.
+	for i := 0; i < 3; i++ {
+		s.NoError(s.sut.poll(context.Background()))
+	}
+
+	s.False(s.inCache("cabbage"))
+	s.Contains(s.logOutput.String(), "were trimmed before they were read")
+	s.Equal("shard-1 TRIM_HORIZON", s.stream.iteratorRequests[len(s.stream.iteratorRequests)-1])
+	s.Equal("00003", s.sut.shards["shard-1"].checkpoint)
+}
+
+func (s *streamSubscriberTestSuite) TestShardGoneBeforeRead() {
+	s.stream.addShard("shard-1", "")
+	s.discoverAndPoll()
+
+	s.cached("bacon", "tasty")
+	s.stream.remove("shard-1")
+
+	s.NoError(s.sut.discover(context.Background()))
+
+	s.False(s.inCache("bacon"))
+	s.Empty(s.sut.shards)
+	s.Contains(s.logOutput.String(), "is gone before it was read")
+}
+
+func (s *streamSubscriberTestSuite) TestMalformedRecord() {
+	s.stream.addShard("shard-1", "")
+	s.discoverAndPoll()
+
+	s.cached("bacon", "stale")
+	s.stream.write("shard-1", dynamodbstreams.OperationTypeInsert, "bacon")
+	s.stream.shards[0].records[0].Dynamodb.Keys = nil
+	s.NoError(s.sut.poll(context.Background()))
+	s.Contains(s.logOutput.String(), "Skipping stream record 1, which has no key field")
+
+	// The shard is read on past the record.
+	s.remoteWrite("shard-1", "bacon", "fresh")
+	s.NoError(s.sut.poll(context.Background()))
+	s.False(s.inCache("bacon"))
+}
+
+func (s *streamSubscriberTestSuite) TestSchema() {
+	s.sut.Schema = DynamoDBSchema{KeyAttribute: "pk", SortKeyAttribute: "sk", SortKey: SortKeyTemplate("goredis")}
+	s.stream.addShard("shard-1", "")
+	s.discoverAndPoll()
+
+	s.cached("bacon", "stale")
+	s.cached("cabbage", "healthy")
+
+	// Only the item holding the key tells that it was written.
+	for key, sortKey := range map[string]string{"bacon": "goredis", "cabbage": "profile"} {
+		s.stream.writeKeys("shard-1", dynamodbstreams.OperationTypeModify, map[string]*dynamodb.AttributeValue{
+			"pk": {S: aws.String(key)},
+			"sk": {S: aws.String(sortKey)},
+		})
+	}
+
+	s.NoError(s.sut.poll(context.Background()))
+
+	s.False(s.inCache("bacon"))
+	s.True(s.inCache("cabbage"))
+}
+
+func (s *streamSubscriberTestSuite) TestRun() {
+	s.sut.PollInterval = time.Millisecond
+	s.stream.addShard("shard-1", "")
+	s.cached("bacon", "stale")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.sut.Run(ctx) }()
+
+	// Writes made before the subscriber is following the stream may go
+	// unnoticed, so keep writing until one is applied.
+	deadline := time.Now().Add(5 * time.Second)
+	for s.inCache("bacon") && time.Now().Before(deadline) {
+		s.remoteWrite("shard-1", "bacon", "fresh")
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	s.Equal(context.Canceled, <-done)
+	s.False(s.inCache("bacon"))
+}
+
+func TestStreamSubscriber(t *testing.T) {
+	suite.Run(t, new(streamSubscriberTestSuite))
+}
@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+// DynamoDBTableSpec is what a DynamoDBStore needs of its tables, beyond the
+// keys their schemas call for, and how to create them if asked to.
+type DynamoDBTableSpec struct {
+	// Create creates the table if it doesn't exist, rather than failing.
+	Create bool
+
+	// ReadCapacity and WriteCapacity are the provisioned capacity of a
+	// created table, which is on-demand if both are zero.
+	ReadCapacity  int64
+	WriteCapacity int64
+
+	// Stream requires the table to stream its writes, as other nodes follow
+	// them to keep their caches coherent.
+	Stream bool
+
+	// TTLAttribute, if set, requires DynamoDB to expire items by it.
+	TTLAttribute string
+}
+
+// EnsureTable checks that the tables are there, and are what the store
+// needs, creating them first if they're missing and the spec says so. It
+// returns the ARNs of the streams of the tables which have one, starting with
+// the default table.
+func (d *DynamoDBStore) EnsureTable(ctx context.Context, spec DynamoDBTableSpec) (streamARNs []string, err error) {
+	checked := make(map[string]bool)
+	for _, prefix := range d.prefixes() {
+		table := d.tableAt(prefix)
+		if checked[table.Name] {
+			continue
+		}
+		checked[table.Name] = true
+
+		streamARN, err := d.ensureTable(ctx, table, spec)
+		if err != nil {
+			return nil, err
+		} else if streamARN != "" {
+			streamARNs = append(streamARNs, streamARN)
+		}
+	}
+	return streamARNs, nil
+}
+
+func (d *DynamoDBStore) ensureTable(ctx context.Context, table DynamoDBTable, spec DynamoDBTableSpec) (streamARN string, err error) {
+	description, err := d.describeTable(ctx, table)
+	if isResourceNotFound(err) {
+		if !spec.Create {
+			return "", errors.Errorf("table %q does not exist", table.Name)
+		}
+		if description, err = d.createTable(ctx, table, spec); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	if aws.StringValue(description.TableStatus) == dynamodb.TableStatusCreating {
+		if description, err = d.waitForTable(ctx, table); err != nil {
+			return "", err
+		}
+	}
+
+	problems := tableProblems(description, table.Schema, spec)
+	if spec.TTLAttribute != "" {
+		problem, err := d.ttlProblem(ctx, table, spec.TTLAttribute)
+		if err != nil {
+			return "", err
+		} else if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	if len(problems) > 0 {
+		return "", errors.Errorf("table %q is misconfigured: %s", table.Name, strings.Join(problems, "; "))
+	}
+
+	return aws.StringValue(description.LatestStreamArn), nil
+}
+
+func (d *DynamoDBStore) describeTable(ctx context.Context, table DynamoDBTable) (*dynamodb.TableDescription, error) {
+	out, err := d.API.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(table.Name),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not describe table %q", table.Name)
+	}
+	return out.Table, nil
+}
+
+// createTable creates the table as specified, waiting for it to become
+// active. Another node creating it at the same time is just as good.
+func (d *DynamoDBStore) createTable(ctx context.Context, table DynamoDBTable, spec DynamoDBTableSpec) (*dynamodb.TableDescription, error) {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{{
+			AttributeName: aws.String(table.Schema.keyAttribute()),
+			AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+		}},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		KeySchema: []*dynamodb.KeySchemaElement{{
+			AttributeName: aws.String(table.Schema.keyAttribute()),
+			KeyType:       aws.String(dynamodb.KeyTypeHash),
+		}},
+		TableName: aws.String(table.Name),
+	}
+
+	if sortKey := table.Schema.SortKeyAttribute; sortKey != "" {
+		input.AttributeDefinitions = append(input.AttributeDefinitions, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(sortKey),
+			AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+		})
+		input.KeySchema = append(input.KeySchema, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String(sortKey),
+			KeyType:       aws.String(dynamodb.KeyTypeRange),
+		})
+	}
+
+	if spec.ReadCapacity > 0 || spec.WriteCapacity > 0 {
+		input.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(spec.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(spec.WriteCapacity),
+		}
+	}
+
+	// Followers of the stream only look at the keys.
+	if spec.Stream {
+		input.StreamSpecification = &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(dynamodb.StreamViewTypeKeysOnly),
+		}
+	}
+
+	_, err := d.API.CreateTableWithContext(ctx, input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeResourceInUseException {
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create table %q", table.Name)
+	}
+
+	description, err := d.waitForTable(ctx, table)
+	if err != nil || spec.TTLAttribute == "" {
+		return description, err
+	}
+
+	_, err = d.API.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table.Name),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(spec.TTLAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return description, errors.Wrapf(err, "could not enable TTL on table %q", table.Name)
+}
+
+func (d *DynamoDBStore) waitForTable(ctx context.Context, table DynamoDBTable) (*dynamodb.TableDescription, error) {
+	err := d.API.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(table.Name),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "table %q did not become active", table.Name)
+	}
+	return d.describeTable(ctx, table)
+}
+
+// tableProblems lists the ways in which the table is not what the store
+// needs.
+func tableProblems(table *dynamodb.TableDescription, schema DynamoDBSchema, spec DynamoDBTableSpec) []string {
+	var problems []string
+
+	types := make(map[string]string)
+	for _, attribute := range table.AttributeDefinitions {
+		types[aws.StringValue(attribute.AttributeName)] = aws.StringValue(attribute.AttributeType)
+	}
+
+	var hasSortKey bool
+	for _, key := range table.KeySchema {
+		name, kind := aws.StringValue(key.AttributeName), aws.StringValue(key.KeyType)
+
+		expected, role := schema.keyAttribute(), "hash"
+		if kind == dynamodb.KeyTypeRange {
+			expected, role, hasSortKey = schema.SortKeyAttribute, "range", true
+		}
+
+		switch {
+		case expected == "":
+			problems = append(problems, fmt.Sprintf("has a %s key %q, expected none", role, name))
+		case name != expected:
+			problems = append(problems, fmt.Sprintf("has a %s key %q, expected %q", role, name, expected))
+		case types[name] != dynamodb.ScalarAttributeTypeS:
+			problems = append(problems, fmt.Sprintf("has a %s key of type %s, expected %s", role, types[name], dynamodb.ScalarAttributeTypeS))
+		}
+	}
+
+	if schema.SortKeyAttribute != "" && !hasSortKey {
+		problems = append(problems, fmt.Sprintf("has no range key, expected %q", schema.SortKeyAttribute))
+	}
+
+	if spec.Stream && (table.StreamSpecification == nil || !aws.BoolValue(table.StreamSpecification.StreamEnabled)) {
+		problems = append(problems, "has no stream, needed for cache coherence")
+	}
+
+	return problems
+}
+
+// ttlProblem tells how TTL is misconfigured on the table, if it is.
+func (d *DynamoDBStore) ttlProblem(ctx context.Context, table DynamoDBTable, attribute string) (string, error) {
+	out, err := d.API.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(table.Name),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "could not describe TTL of table %q", table.Name)
+	}
+
+	ttl := out.TimeToLiveDescription
+	if ttl == nil {
+		ttl = &dynamodb.TimeToLiveDescription{}
+	}
+
+	switch aws.StringValue(ttl.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+		if name := aws.StringValue(ttl.AttributeName); name != attribute {
+			return fmt.Sprintf("expires items by %q, expected %q", name, attribute), nil
+		}
+		return "", nil
+	}
+	return fmt.Sprintf("does not expire items, expected TTL on %q", attribute), nil
+}
+
+func isResourceNotFound(err error) bool {
+	awsErr, ok := errors.Cause(err).(awserr.Error)
+	return ok && awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException
+}
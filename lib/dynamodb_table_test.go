@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type dynamoDBTableTestSuite struct {
+	suite.Suite
+
+	api *mockDynamo
+	sut *DynamoDBStore
+}
+
+func (d *dynamoDBTableTestSuite) SetupTest() {
+	d.api = new(mockDynamo)
+	d.sut = &DynamoDBStore{API: d.api, TableName: "table"}
+}
+
+// validTable is a table as created by EnsureTable, with a stream.
+func validTable() *dynamodb.TableDescription {
+	return &dynamodb.TableDescription{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{{
+			AttributeName: aws.String("key"),
+			AttributeType: aws.String("S"),
+		}},
+		KeySchema: []*dynamodb.KeySchemaElement{{
+			AttributeName: aws.String("key"),
+			KeyType:       aws.String("HASH"),
+		}},
+		LatestStreamArn:     aws.String("arn:stream"),
+		StreamSpecification: &dynamodb.StreamSpecification{StreamEnabled: aws.Bool(true)},
+		TableStatus:         aws.String("ACTIVE"),
+	}
+}
+
+func (d *dynamoDBTableTestSuite) describes(table *dynamodb.TableDescription, err error) {
+	d.api.On(
+		"DescribeTableWithContext",
+		mock.Anything,
+		&dynamodb.DescribeTableInput{TableName: aws.String("table")},
+		[]request.Option(nil),
+	).Return(&dynamodb.DescribeTableOutput{Table: table}, err).Once()
+}
+
+func (d *dynamoDBTableTestSuite) describesTTL(attribute, status string) {
+	d.api.On(
+		"DescribeTimeToLiveWithContext",
+		mock.Anything,
+		&dynamodb.DescribeTimeToLiveInput{TableName: aws.String("table")},
+		[]request.Option(nil),
+	).Return(&dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &dynamodb.TimeToLiveDescription{
+		AttributeName:    aws.String(attribute),
+		TimeToLiveStatus: aws.String(status),
+	}}, nil)
+}
+
+func (d *dynamoDBTableTestSuite) waits() {
+	d.api.On(
+		"WaitUntilTableExistsWithContext",
+		mock.Anything,
+		&dynamodb.DescribeTableInput{TableName: aws.String("table")},
+		[]request.WaiterOption(nil),
+	).Return(nil).Once()
+}
+
+func (d *dynamoDBTableTestSuite) TestValid() {
+	d.describes(validTable(), nil)
+	d.describesTTL("expires", "ENABLED")
+
+	streamARNs, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{Stream: true, TTLAttribute: "expires"})
+	d.Equal([]string{"arn:stream"}, streamARNs)
+	d.NoError(err)
+}
+
+func (d *dynamoDBTableTestSuite) TestMisconfigured() {
+	table := validTable()
+	table.AttributeDefinitions = append(table.AttributeDefinitions, &dynamodb.AttributeDefinition{
+		AttributeName: aws.String("sort"),
+		AttributeType: aws.String("N"),
+	})
+	table.AttributeDefinitions[0].AttributeType = aws.String("N")
+	table.KeySchema = append(table.KeySchema, &dynamodb.KeySchemaElement{
+		AttributeName: aws.String("sort"),
+		KeyType:       aws.String("RANGE"),
+	})
+	table.StreamSpecification = nil
+
+	d.describes(table, nil)
+	d.describesTTL("ttl", "ENABLED")
+
+	_, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{Stream: true, TTLAttribute: "expires"})
+	d.EqualError(err, `table "table" is misconfigured: `+
+		`has a hash key of type N, expected S; `+
+		`has a range key "sort", expected none; `+
+		`has no stream, needed for cache coherence; `+
+		`expires items by "ttl", expected "expires"`)
+}
+
+func (d *dynamoDBTableTestSuite) TestWrongHashKey() {
+	table := validTable()
+	table.KeySchema[0].AttributeName = aws.String("id")
+
+	d.describes(table, nil)
+	d.describesTTL("", "DISABLED")
+
+	_, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{TTLAttribute: "expires"})
+	d.EqualError(err, `table "table" is misconfigured: has a hash key "id", expected "key"; does not expire items, expected TTL on "expires"`)
+}
+
+func (d *dynamoDBTableTestSuite) TestSortKey() {
+	d.sut.Schema = DynamoDBSchema{KeyAttribute: "pk", SortKeyAttribute: "sk"}
+
+	table := validTable()
+	table.AttributeDefinitions[0].AttributeName = aws.String("pk")
+	table.KeySchema[0].AttributeName = aws.String("pk")
+	d.describes(table, nil)
+
+	_, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{})
+	d.EqualError(err, `table "table" is misconfigured: has no range key, expected "sk"`)
+
+	table.AttributeDefinitions = append(table.AttributeDefinitions, &dynamodb.AttributeDefinition{
+		AttributeName: aws.String("sk"),
+		AttributeType: aws.String("S"),
+	})
+	table.KeySchema = append(table.KeySchema, &dynamodb.KeySchemaElement{
+		AttributeName: aws.String("sk"),
+		KeyType:       aws.String("RANGE"),
+	})
+	d.describes(table, nil)
+
+	_, err = d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{})
+	d.NoError(err)
+}
+
+func (d *dynamoDBTableTestSuite) TestTables() {
+	d.sut.Tables = map[string]DynamoDBTable{
+		"session:": {Name: "sessions"},
+		"user:":    {Name: "table"},
+	}
+
+	sessions := validTable()
+	sessions.LatestStreamArn = aws.String("arn:sessions")
+
+	d.describes(validTable(), nil)
+	d.api.On(
+		"DescribeTableWithContext",
+		mock.Anything,
+		&dynamodb.DescribeTableInput{TableName: aws.String("sessions")},
+		[]request.Option(nil),
+	).Return(&dynamodb.DescribeTableOutput{Table: sessions}, nil).Once()
+
+	streamARNs, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{Stream: true})
+	d.Equal([]string{"arn:stream", "arn:sessions"}, streamARNs)
+	d.NoError(err)
+	d.api.AssertExpectations(d.T())
+}
+
+func (d *dynamoDBTableTestSuite) TestMissing() {
+	d.describes(nil, awserr.New("ResourceNotFoundException", "bacon", nil))
+
+	_, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{})
+	d.EqualError(err, `table "table" does not exist`)
+}
+
+func (d *dynamoDBTableTestSuite) TestCreate_OnDemand() {
+	d.describes(nil, awserr.New("ResourceNotFoundException", "bacon", nil))
+	d.api.On(
+		"CreateTableWithContext",
+		mock.Anything,
+		mock.MatchedBy(func(input *dynamodb.CreateTableInput) bool {
+			d.Equal("table", *input.TableName)
+			d.Equal("PAY_PER_REQUEST", *input.BillingMode)
+			d.Nil(input.ProvisionedThroughput)
+			d.Equal("key", *input.KeySchema[0].AttributeName)
+			d.Equal("HASH", *input.KeySchema[0].KeyType)
+			d.Equal("S", *input.AttributeDefinitions[0].AttributeType)
+			d.True(*input.StreamSpecification.StreamEnabled)
+			d.Equal("KEYS_ONLY", *input.StreamSpecification.StreamViewType)
+			return true
+		}),
+		[]request.Option(nil),
+	).Return(&dynamodb.CreateTableOutput{}, nil)
+	d.waits()
+	d.describes(validTable(), nil)
+
+	streamARNs, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{Create: true, Stream: true})
+	d.Equal([]string{"arn:stream"}, streamARNs)
+	d.NoError(err)
+	d.api.AssertExpectations(d.T())
+}
+
+func (d *dynamoDBTableTestSuite) TestCreate_Provisioned() {
+	d.describes(nil, awserr.New("ResourceNotFoundException", "bacon", nil))
+	d.api.On(
+		"CreateTableWithContext",
+		mock.Anything,
+		mock.MatchedBy(func(input *dynamodb.CreateTableInput) bool {
+			d.Equal("PROVISIONED", *input.BillingMode)
+			d.Equal(int64(5), *input.ProvisionedThroughput.ReadCapacityUnits)
+			d.Equal(int64(10), *input.ProvisionedThroughput.WriteCapacityUnits)
+			d.Nil(input.StreamSpecification)
+			return true
+		}),
+		[]request.Option(nil),
+	).Return(&dynamodb.CreateTableOutput{}, nil)
+	d.waits()
+	d.describes(validTable(), nil)
+	d.api.On(
+		"UpdateTimeToLiveWithContext",
+		mock.Anything,
+		&dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String("table"),
+			TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+				AttributeName: aws.String("expires"),
+				Enabled:       aws.Bool(true),
+			},
+		},
+		[]request.Option(nil),
+	).Return(&dynamodb.UpdateTimeToLiveOutput{}, nil)
+	d.describesTTL("expires", "ENABLING")
+
+	_, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{
+		Create:        true,
+		ReadCapacity:  5,
+		WriteCapacity: 10,
+		TTLAttribute:  "expires",
+	})
+	d.NoError(err)
+	d.api.AssertExpectations(d.T())
+}
+
+func (d *dynamoDBTableTestSuite) TestCreate_SortKey() {
+	d.sut.Schema = DynamoDBSchema{KeyAttribute: "pk", SortKeyAttribute: "sk"}
+
+	d.describes(nil, awserr.New("ResourceNotFoundException", "bacon", nil))
+	d.api.On(
+		"CreateTableWithContext",
+		mock.Anything,
+		mock.MatchedBy(func(input *dynamodb.CreateTableInput) bool {
+			d.Equal([]*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("pk"), KeyType: aws.String("HASH")},
+				{AttributeName: aws.String("sk"), KeyType: aws.String("RANGE")},
+			}, input.KeySchema)
+			d.Equal([]*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("pk"), AttributeType: aws.String("S")},
+				{AttributeName: aws.String("sk"), AttributeType: aws.String("S")},
+			}, input.AttributeDefinitions)
+			return true
+		}),
+		[]request.Option(nil),
+	).Return(&dynamodb.CreateTableOutput{}, nil)
+	d.waits()
+	d.describes(&dynamodb.TableDescription{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("pk"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("sk"), AttributeType: aws.String("S")},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("pk"), KeyType: aws.String("HASH")},
+			{AttributeName: aws.String("sk"), KeyType: aws.String("RANGE")},
+		},
+		TableStatus: aws.String("ACTIVE"),
+	}, nil)
+
+	streamARNs, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{Create: true})
+	d.Empty(streamARNs)
+	d.NoError(err)
+	d.api.AssertExpectations(d.T())
+}
+
+func (d *dynamoDBTableTestSuite) TestCreate_Concurrently() {
+	d.describes(nil, awserr.New("ResourceNotFoundException", "bacon", nil))
+	d.api.On(
+		"CreateTableWithContext",
+		mock.Anything,
+		mock.AnythingOfType("*dynamodb.CreateTableInput"),
+		[]request.Option(nil),
+	).Return((*dynamodb.CreateTableOutput)(nil), awserr.New("ResourceInUseException", "bacon", nil))
+	d.waits()
+	d.describes(validTable(), nil)
+
+	_, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{Create: true})
+	d.NoError(err)
+}
+
+func (d *dynamoDBTableTestSuite) TestCreating() {
+	table := validTable()
+	table.TableStatus = aws.String("CREATING")
+
+	d.describes(table, nil)
+	d.waits()
+	d.describes(validTable(), nil)
+
+	_, err := d.sut.EnsureTable(context.Background(), DynamoDBTableSpec{})
+	d.NoError(err)
+	d.api.AssertExpectations(d.T())
+}
+
+func TestDynamoDBTable(t *testing.T) {
+	suite.Run(t, new(dynamoDBTableTestSuite))
+}
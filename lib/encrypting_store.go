@@ -0,0 +1,447 @@
+package lib
+
+import (
+	"context"
+	"crypto/cipher"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// headerEncrypted starts values encrypted by an EncryptingStore, after
+	// the headers of compressed values.
+	headerEncrypted byte = 0xfc
+
+	// DefaultDataKeyTTL is how long a data key encrypts values before a new
+	// one is generated.
+	DefaultDataKeyTTL = 5 * time.Minute
+
+	// maxDataKeyUses is the number of values a single data key encrypts at
+	// most, well within the limits of random nonces for AES-GCM.
+	maxDataKeyUses = 1 << 24
+
+	// maxDecryptedDataKeys is the number of decrypted data keys kept around,
+	// so that reading values doesn't take a call to the key provider each.
+	maxDecryptedDataKeys = 1024
+
+	// reencryptBatch is the number of keys scanned at a time when encrypting
+	// values anew.
+	reencryptBatch = 100
+)
+
+var (
+	// ErrMalformedEnvelope is returned when reading an encrypted value which
+	// is cut short.
+	ErrMalformedEnvelope = errors.New("malformed encrypted value")
+
+	// ErrNotEncrypted is returned when reading a value which isn't encrypted
+	// while encryption is required.
+	ErrNotEncrypted = errors.New("value is not encrypted")
+)
+
+// dataKeyInUse is the data key values are being encrypted with.
+type dataKeyInUse struct {
+	DataKey
+
+	aead    cipher.AEAD
+	created time.Time
+	uses    int
+}
+
+// dataKeyGeneration is a data key being generated, which everyone needing one
+// meanwhile waits for.
+type dataKeyGeneration struct {
+	done chan struct{}
+	key  *dataKeyInUse
+	err  error
+}
+
+// EncryptingStore is a Store which encrypts values on their way to the
+// underlying store, and decrypts them on their way back. Values are encrypted
+// with AES-GCM, with data keys which are stored next to them, encrypted with a
+// master key of the key provider. Keys are authenticated along with the
+// values, so that values can't be swapped between keys.
+//
+// Values are stored as:
+//
+//	header | master key ID | encrypted data key | nonce | ciphertext
+//
+// with the ID and the data key prefixed by their lengths, as uvarints. Values
+// stored before encryption was enabled are read as they are, until Reencrypt
+// encrypts them, unless encryption is required.
+type EncryptingStore struct {
+	Store
+
+	Keys KeyProvider
+
+	// DataKeyTTL is how long a data key encrypts values before a new one is
+	// generated.
+	DataKeyTTL time.Duration
+
+	// RequireEncrypted rejects values which aren't encrypted, rather than
+	// reading them as they are, so that nothing written to the underlying
+	// store by anyone without the keys is trusted. It's meant to be set
+	// once Reencrypt has encrypted all values.
+	RequireEncrypted bool
+
+	current     *dataKeyInUse
+	generating  *dataKeyGeneration
+	decrypted   map[string]cipher.AEAD
+	reencrypted int
+	now         func() time.Time
+	lock        *sync.Mutex
+}
+
+// NewEncryptingStore returns an EncryptingStore in front of the store, with
+// data keys from the key provider.
+func NewEncryptingStore(store Store, keys KeyProvider) *EncryptingStore {
+	return &EncryptingStore{
+		Store:      store,
+		Keys:       keys,
+		DataKeyTTL: DefaultDataKeyTTL,
+		decrypted:  make(map[string]cipher.AEAD),
+		now:        time.Now,
+		lock:       new(sync.Mutex),
+	}
+}
+
+// Get is a decrypting implementation of the Store's Get method.
+func (e *EncryptingStore) Get(key string) (value string, found bool, err error) {
+	return e.GetContext(context.Background(), key)
+}
+
+// GetContext is Get which gives up once the context is done.
+func (e *EncryptingStore) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	value, found, err = getContext(ctx, e.Store, key)
+	if err != nil || !found {
+		return value, found, err
+	}
+
+	value, _, err = e.decrypt(key, value)
+	return value, err == nil, errors.Wrapf(err, "could not decrypt value of %q", key)
+}
+
+// Set is an encrypting implementation of the Store's Set method.
+func (e *EncryptingStore) Set(key string, value string) error {
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	sealed, err := e.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	return e.Store.Set(key, sealed)
+}
+
+// Apply is an encrypting implementation of the Store's Apply method.
+func (e *EncryptingStore) Apply(writes []Write, conditions []Condition) error {
+	if err := checkValueSizes(writes); err != nil {
+		return err
+	}
+
+	encrypted := make([]Write, len(writes))
+	for i, write := range writes {
+		encrypted[i] = write
+		if write.Delete {
+			continue
+		}
+
+		sealed, err := e.encrypt(write.Key, write.Value)
+		if err != nil {
+			return err
+		}
+		encrypted[i].Value = sealed
+	}
+
+	return e.Store.Apply(encrypted, conditions)
+}
+
+// Reencrypt encrypts values stored in plaintext, or with data keys encrypted
+// with a master key other than the current one, returning how many it
+// encrypted. Values written while it runs are left as they are, having just
+// been encrypted anyway. It's safe to run at any time, and to run again after
+// being interrupted.
+func (e *EncryptingStore) Reencrypt(ctx context.Context) (reencrypted int, err error) {
+	var cursor string
+	for {
+		keys, next, err := e.Store.Scan(cursor, reencryptBatch)
+		if err != nil {
+			return reencrypted, errors.Wrap(err, "could not scan keys")
+		}
+
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return reencrypted, err
+			}
+
+			done, err := e.reencrypt(ctx, key)
+			if err != nil {
+				return reencrypted, err
+			} else if done {
+				reencrypted++
+			}
+		}
+
+		if next == "" {
+			return reencrypted, nil
+		}
+		cursor = next
+	}
+}
+
+// reencrypt encrypts a single value anew, if it needs to be, as long as it's
+// not written in the meantime.
+func (e *EncryptingStore) reencrypt(ctx context.Context, key string) (bool, error) {
+	version, err := e.Store.Version(key)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not read version of %q", key)
+	}
+
+	stored, found, err := getContext(WithConsistentRead(ctx), e.Store, key)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not read %q", key)
+	} else if !found {
+		return false, nil
+	}
+
+	current, err := e.currentKeyID()
+	if err != nil {
+		return false, err
+	}
+
+	value, keyID, err := e.decrypt(key, stored)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not decrypt value of %q", key)
+	} else if keyID == current {
+		return false, nil
+	}
+
+	sealed, err := e.encrypt(key, value)
+	if err != nil {
+		return false, err
+	}
+
+	err = e.Store.Apply([]Write{{Key: key, Value: sealed}}, []Condition{{Key: key, Version: version}})
+	if errors.Cause(err) == ErrConditionFailed {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "could not write %q", key)
+	}
+
+	e.lock.Lock()
+	e.reencrypted++
+	e.lock.Unlock()
+
+	return true, nil
+}
+
+// encrypt returns the value as it's to be stored.
+func (e *EncryptingStore) encrypt(key string, value string) (string, error) {
+	current, err := e.dataKey()
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := randomBytes(current.aead.NonceSize())
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate nonce")
+	}
+
+	ret := []byte{headerEncrypted}
+	ret = append(appendUvarint(ret, uint64(len(current.KeyID))), current.KeyID...)
+	ret = append(appendUvarint(ret, uint64(len(current.Encrypted))), current.Encrypted...)
+	ret = current.aead.Seal(append(ret, nonce...), nonce, []byte(value), []byte(key))
+
+	return string(ret), nil
+}
+
+// decrypt returns the value as it was written, along with the ID of the
+// master key its data key is encrypted with, if it's encrypted.
+func (e *EncryptingStore) decrypt(key string, stored string) (value string, keyID string, err error) {
+	keyID, encryptedKey, sealed, err := parseEnvelope(stored)
+	if err != nil {
+		return e.plaintext(stored, err)
+	}
+
+	aead, err := e.decryptedDataKey(keyID, encryptedKey)
+	if err != nil {
+		return "", "", err
+	} else if len(sealed) < aead.NonceSize() {
+		return e.plaintext(stored, ErrMalformedEnvelope)
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	opened, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not authenticate value")
+	}
+
+	return string(opened), keyID, nil
+}
+
+// plaintext returns a value which isn't encrypted as it is, having been
+// written before encryption was enabled, unless encryption is required. Such
+// values may start with the header too, being binary, as long as what follows
+// isn't an envelope.
+func (e *EncryptingStore) plaintext(stored string, reason error) (value string, keyID string, err error) {
+	if e.RequireEncrypted {
+		return "", "", reason
+	}
+	return stored, "", nil
+}
+
+// currentKeyID returns the ID of the master key values are encrypted with,
+// without using up the current data key, unless there's none yet.
+func (e *EncryptingStore) currentKeyID() (string, error) {
+	e.lock.Lock()
+	current := e.current
+	e.lock.Unlock()
+
+	if current == nil {
+		var err error
+		if current, err = e.dataKey(); err != nil {
+			return "", err
+		}
+	}
+	return current.KeyID, nil
+}
+
+// dataKey returns the data key to encrypt a value with, generating a new one
+// once the current one is too old or has been used too many times. Only one
+// data key is generated at a time, without holding the lock, since it may
+// take a call to KMS.
+func (e *EncryptingStore) dataKey() (*dataKeyInUse, error) {
+	for {
+		e.lock.Lock()
+		if current := e.current; current != nil && current.uses < maxDataKeyUses && e.now().Sub(current.created) < e.DataKeyTTL {
+			current.uses++
+			e.lock.Unlock()
+			return current, nil
+		}
+
+		generation := e.generating
+		if generation == nil {
+			generation = &dataKeyGeneration{done: make(chan struct{})}
+			e.generating = generation
+			e.lock.Unlock()
+			e.generate(generation)
+		} else {
+			e.lock.Unlock()
+			<-generation.done
+		}
+
+		if generation.err != nil {
+			return nil, generation.err
+		}
+
+		// The new data key may have been used up by everyone else waiting
+		// for it, in which case another one is needed.
+		e.lock.Lock()
+		if key := generation.key; key.uses < maxDataKeyUses {
+			key.uses++
+			e.lock.Unlock()
+			return key, nil
+		}
+		e.lock.Unlock()
+	}
+}
+
+// generate generates a data key, which becomes the current one.
+func (e *EncryptingStore) generate(generation *dataKeyGeneration) {
+	defer close(generation.done)
+
+	key, err := e.Keys.GenerateDataKey()
+	var aead cipher.AEAD
+	if err == nil {
+		aead, err = newAEAD(key.Plaintext)
+		err = errors.Wrap(err, "invalid data key")
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.generating = nil
+	if err != nil {
+		generation.err = err
+		return
+	}
+
+	generation.key = &dataKeyInUse{DataKey: key, aead: aead, created: e.now()}
+	e.current = generation.key
+	e.rememberDataKey(key.KeyID, key.Encrypted, aead)
+}
+
+// decryptedDataKey returns the data key for a value, decrypting it unless it
+// has been decrypted before.
+func (e *EncryptingStore) decryptedDataKey(keyID string, encrypted []byte) (cipher.AEAD, error) {
+	e.lock.Lock()
+	aead, known := e.decrypted[keyID+"\x00"+string(encrypted)]
+	e.lock.Unlock()
+
+	if known {
+		return aead, nil
+	}
+
+	plaintext, err := e.Keys.DecryptDataKey(keyID, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	if aead, err = newAEAD(plaintext); err != nil {
+		return nil, errors.Wrap(err, "invalid data key")
+	}
+
+	e.lock.Lock()
+	e.rememberDataKey(keyID, encrypted, aead)
+	e.lock.Unlock()
+
+	return aead, nil
+}
+
+// rememberDataKey must be called with the lock held. Once there are too many
+// data keys, they're all forgotten, which only costs a few more calls to the
+// key provider.
+func (e *EncryptingStore) rememberDataKey(keyID string, encrypted []byte, aead cipher.AEAD) {
+	if len(e.decrypted) >= maxDecryptedDataKeys {
+		e.decrypted = make(map[string]cipher.AEAD)
+	}
+	e.decrypted[keyID+"\x00"+string(encrypted)] = aead
+}
+
+func (e *EncryptingStore) reportInfo(info *serverInfo) {
+	e.lock.Lock()
+	var keyID string
+	if e.current != nil {
+		keyID = e.current.KeyID
+	}
+	info.add("stats", "encryption_master_key", keyID)
+	info.add("stats", "encryption_reencrypted_values", e.reencrypted)
+	e.lock.Unlock()
+
+	if reporter, ok := e.Store.(infoReporter); ok {
+		reporter.reportInfo(info)
+	}
+}
+
+// parseEnvelope splits an encrypted value into its parts, the last of which
+// is the nonce followed by the ciphertext.
+func parseEnvelope(stored string) (keyID string, encryptedKey []byte, sealed []byte, err error) {
+	if stored == "" || stored[0] != headerEncrypted {
+		return "", nil, nil, ErrNotEncrypted
+	}
+
+	keyID, rest, ok := readWALString([]byte(stored[1:]))
+	if !ok {
+		return "", nil, nil, ErrMalformedEnvelope
+	}
+
+	rawKey, rest, ok := readWALString(rest)
+	if !ok {
+		return "", nil, nil, ErrMalformedEnvelope
+	}
+
+	return keyID, []byte(rawKey), rest, nil
+}
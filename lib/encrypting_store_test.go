@@ -0,0 +1,280 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type encryptingStoreTestSuite struct {
+	suite.Suite
+
+	now   time.Time
+	store Store
+
+	sut *EncryptingStore
+}
+
+func (e *encryptingStoreTestSuite) SetupTest() {
+	e.now = time.Unix(1500000000, 0)
+	e.store = NewInMemoryStore()
+	e.sut = e.encrypting("1", "1")
+}
+
+// encrypting returns an EncryptingStore whose keyring holds the given master
+// keys, the first of which is the current one.
+func (e *encryptingStoreTestSuite) encrypting(current string, ids ...string) *EncryptingStore {
+	keys := make(map[string][]byte)
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id), 32)
+	}
+
+	keyring, err := NewKeyring(current, keys)
+	e.Require().NoError(err)
+
+	ret := NewEncryptingStore(e.store, keyring)
+	ret.now = func() time.Time { return e.now }
+	return ret
+}
+
+func (e *encryptingStoreTestSuite) stored(key string) string {
+	value, _, err := e.store.Get(key)
+	e.Require().NoError(err)
+	return value
+}
+
+func (e *encryptingStoreTestSuite) get(sut Store, key string) string {
+	value, found, err := sut.Get(key)
+	e.Require().NoError(err)
+	e.Require().True(found)
+	return value
+}
+
+func (e *encryptingStoreTestSuite) TestRoundTrip() {
+	e.NoError(e.sut.Set("bacon", "tasty\x00\xff"))
+
+	e.Equal(headerEncrypted, e.stored("bacon")[0])
+	e.NotContains(e.stored("bacon"), "tasty")
+	e.Equal("tasty\x00\xff", e.get(e.sut, "bacon"))
+}
+
+func (e *encryptingStoreTestSuite) TestApply() {
+	e.NoError(e.sut.Set("cabbage", "raw"))
+	e.NoError(e.sut.Apply([]Write{{Key: "bacon", Value: "tasty"}, {Key: "cabbage", Delete: true}}, nil))
+
+	e.Equal("tasty", e.get(e.sut, "bacon"))
+
+	_, found, err := e.sut.Get("cabbage")
+	e.False(found)
+	e.NoError(err)
+}
+
+func (e *encryptingStoreTestSuite) TestSwappedBetweenKeys() {
+	e.NoError(e.sut.Set("bacon", "tasty"))
+	e.NoError(e.store.Set("cabbage", e.stored("bacon")))
+
+	_, found, err := e.sut.Get("cabbage")
+	e.False(found)
+	e.EqualError(err, `could not decrypt value of "cabbage": could not authenticate value: cipher: message authentication failed`)
+}
+
+func (e *encryptingStoreTestSuite) TestMalformed() {
+	e.NoError(e.store.Set("bacon", "\xfc\x05bacon"))
+	e.sut.RequireEncrypted = true
+
+	_, found, err := e.sut.Get("bacon")
+	e.False(found)
+	e.Equal(ErrMalformedEnvelope, errors.Cause(err))
+}
+
+func (e *encryptingStoreTestSuite) TestPlaintext() {
+	e.NoError(e.store.Set("bacon", "tasty"))
+	e.NoError(e.store.Set("cabbage", "\xfc\x05bacon"))
+
+	e.Equal("tasty", e.get(e.sut, "bacon"))
+	e.Equal("\xfc\x05bacon", e.get(e.sut, "cabbage"))
+}
+
+func (e *encryptingStoreTestSuite) TestPlaintext_Required() {
+	e.NoError(e.store.Set("bacon", "tasty"))
+	e.NoError(e.store.Set("cabbage", ""))
+	e.sut.RequireEncrypted = true
+
+	for _, key := range []string{"bacon", "cabbage"} {
+		_, found, err := e.sut.Get(key)
+		e.False(found, key)
+		e.Equal(ErrNotEncrypted, errors.Cause(err), key)
+	}
+}
+
+func (e *encryptingStoreTestSuite) TestDataKeys() {
+	e.NoError(e.sut.Set("bacon", "tasty"))
+	e.NoError(e.sut.Set("cabbage", "tasty"))
+
+	keyID, baconKey, _, _ := parseEnvelope(e.stored("bacon"))
+	_, cabbageKey, _, _ := parseEnvelope(e.stored("cabbage"))
+	e.Equal("1", keyID)
+	e.Equal(baconKey, cabbageKey)
+
+	e.now = e.now.Add(e.sut.DataKeyTTL)
+	e.NoError(e.sut.Set("cabbage", "tasty"))
+	_, cabbageKey, _, _ = parseEnvelope(e.stored("cabbage"))
+	e.NotEqual(baconKey, cabbageKey)
+
+	e.Equal("tasty", e.get(e.sut, "bacon"))
+	e.Equal("tasty", e.get(e.sut, "cabbage"))
+}
+
+func (e *encryptingStoreTestSuite) TestDataKeys_GeneratedOnce() {
+	e.NoError(e.sut.Set("cabbage", "tasty"))
+	e.now = e.now.Add(e.sut.DataKeyTTL)
+
+	keys := &blockingKeyProvider{KeyProvider: e.sut.Keys, started: make(chan struct{}, 10), release: make(chan struct{})}
+	e.sut.Keys = keys
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e.NoError(e.sut.Set(fmt.Sprintf("bacon%d", i), "tasty"))
+		}(i)
+	}
+
+	// Values are still decrypted while a data key is being generated.
+	<-keys.started
+	e.Equal("tasty", e.get(e.sut, "cabbage"))
+
+	close(keys.release)
+	wg.Wait()
+
+	e.Equal(int32(1), atomic.LoadInt32(&keys.generated))
+	e.Equal(10, e.sut.current.uses)
+}
+
+func (e *encryptingStoreTestSuite) TestRotation() {
+	e.NoError(e.sut.Set("bacon", "tasty"))
+	e.NoError(e.store.Set("cabbage", "plain"))
+
+	rotated := e.encrypting("2", "1", "2")
+	e.NoError(rotated.Set("ham", "smoked"))
+	e.Equal("tasty", e.get(rotated, "bacon"))
+
+	reencrypted, err := rotated.Reencrypt(context.Background())
+	e.Equal(2, reencrypted)
+	e.NoError(err)
+
+	for key, value := range map[string]string{"bacon": "tasty", "cabbage": "plain", "ham": "smoked"} {
+		keyID, _, _, err := parseEnvelope(e.stored(key))
+		e.NoError(err)
+		e.Equal("2", keyID, key)
+		e.Equal(value, e.get(rotated, key))
+	}
+
+	// The old master key is no longer needed.
+	e.Equal("tasty", e.get(e.encrypting("2", "2"), "bacon"))
+
+	reencrypted, err = rotated.Reencrypt(context.Background())
+	e.Zero(reencrypted)
+	e.NoError(err)
+}
+
+func (e *encryptingStoreTestSuite) TestReencrypt_KeepsDataKey() {
+	e.NoError(e.sut.Set("bacon", "tasty"))
+	e.NoError(e.sut.Set("cabbage", "tasty"))
+	e.NoError(e.store.Set("ham", "\xfc\x05bacon"))
+
+	reencrypted, err := e.sut.Reencrypt(context.Background())
+	e.Equal(1, reencrypted)
+	e.NoError(err)
+
+	e.Equal(3, e.sut.current.uses)
+	e.Equal("\xfc\x05bacon", e.get(e.sut, "ham"))
+
+	e.sut.RequireEncrypted = true
+	e.Equal("\xfc\x05bacon", e.get(e.sut, "ham"))
+}
+
+func (e *encryptingStoreTestSuite) TestReencrypt_WrittenMeanwhile() {
+	e.NoError(e.sut.Set("bacon", "tasty"))
+
+	rotated := e.encrypting("2", "1", "2")
+	e.store = &versionBumpingStore{Store: e.store, key: "bacon", value: e.stored("bacon")}
+	rotated.Store = e.store
+
+	reencrypted, err := rotated.Reencrypt(context.Background())
+	e.Zero(reencrypted)
+	e.NoError(err)
+
+	keyID, _, _, _ := parseEnvelope(e.stored("bacon"))
+	e.Equal("1", keyID)
+}
+
+func (e *encryptingStoreTestSuite) TestReencrypt_Cancelled() {
+	e.NoError(e.store.Set("bacon", "tasty"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := e.sut.Reencrypt(ctx)
+	e.Equal(context.Canceled, err)
+	e.Equal("tasty", e.stored("bacon"))
+}
+
+func (e *encryptingStoreTestSuite) TestReportInfo() {
+	e.NoError(e.store.Set("bacon", strings.Repeat("tasty", 10)))
+	_, err := e.sut.Reencrypt(context.Background())
+	e.NoError(err)
+
+	info := newServerInfo()
+	e.sut.reportInfo(info)
+	e.Equal("# Stats\r\nencryption_master_key:1\r\nencryption_reencrypted_values:1\r\n", info.render([]string{"stats"}))
+}
+
+// versionBumpingStore writes the value of the key again right after its
+// version is first read, as another client would.
+type versionBumpingStore struct {
+	Store
+
+	key    string
+	value  string
+	bumped bool
+}
+
+func (v *versionBumpingStore) Version(key string) (uint64, error) {
+	version, err := v.Store.Version(key)
+	if key == v.key && !v.bumped {
+		v.Store.Set(v.key, v.value)
+		v.bumped = true
+	}
+	return version, err
+}
+
+// blockingKeyProvider generates data keys once released, as KMS would after a
+// while, counting how many it generated.
+type blockingKeyProvider struct {
+	KeyProvider
+
+	started   chan struct{}
+	release   chan struct{}
+	generated int32
+}
+
+func (b *blockingKeyProvider) GenerateDataKey() (DataKey, error) {
+	b.started <- struct{}{}
+	<-b.release
+	atomic.AddInt32(&b.generated, 1)
+	return b.KeyProvider.GenerateDataKey()
+}
+
+func TestEncryptingStore(t *testing.T) {
+	suite.Run(t, new(encryptingStoreTestSuite))
+}
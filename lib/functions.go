@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// functionsKey is where function libraries are persisted, so that all nodes
+// sharing the store see the same libraries.
+const functionsKey = internalKeyPrefix + "goredis:functions"
+
+const (
+	// functionChunkName is what errors refer to library code as.
+	functionChunkName = "user_function"
+
+	// functionLoadTimeout limits how long running library code to register
+	// its functions can take, as it does in Redis.
+	functionLoadTimeout = 500 * time.Millisecond
+)
+
+var functionNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// functionFlags are the flags functions can be registered with. Of these,
+// only no-writes has any effect in goredis.
+var functionFlags = map[string]bool{
+	"allow-cross-slot-keys": true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"no-writes":             true,
+}
+
+// functionLibrary is a library of functions loaded with FUNCTION LOAD.
+type functionLibrary struct {
+	name      string
+	code      string
+	proto     *lua.FunctionProto
+	functions map[string]*libraryFunction
+}
+
+// libraryFunction describes a function registered by a library. The Lua
+// function itself is registered anew in every state running the library.
+type libraryFunction struct {
+	name        string
+	description string
+	flags       []string
+}
+
+func (f *libraryFunction) readOnly() bool {
+	for _, flag := range f.flags {
+		if flag == "no-writes" {
+			return true
+		}
+	}
+	return false
+}
+
+// compileLibrary compiles the library code and runs it to find out which
+// functions it registers. Errors are meant to be shown to the client.
+func compileLibrary(code string, logger *logrus.Entry) (*functionLibrary, error) {
+	name, body, err := parseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+
+	proto, err := compileLua(body, functionChunkName)
+	if err != nil {
+		return nil, errors.Errorf("Error compiling function: %v", err)
+	}
+
+	ret := &functionLibrary{
+		name:      name,
+		code:      code,
+		proto:     proto,
+		functions: make(map[string]*libraryFunction),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+
+	state := newLuaState(ctx)
+	defer state.Close()
+
+	redis := newRedisTable(state, logger)
+	state.SetField(redis, "register_function", state.NewFunction(registerFunction(
+		func(L *lua.LState, function *libraryFunction, _ *lua.LFunction) {
+			if _, exists := ret.functions[function.name]; exists {
+				L.RaiseError("Function already exists in the library")
+			}
+			ret.functions[function.name] = function
+		},
+	)))
+	state.SetGlobal("redis", redis)
+
+	state.Push(state.NewFunctionFromProto(proto))
+	if err := state.PCall(0, 0, nil); err != nil {
+		return nil, errors.Errorf("Error registering functions: %s", luaErrorMessage(err))
+	}
+
+	if len(ret.functions) == 0 {
+		return nil, errors.New("No functions registered")
+	}
+
+	return ret, nil
+}
+
+// parseLibraryMetadata reads the library name from the shebang line, like
+// "#!lua name=mylib", and returns the rest of the code with the shebang
+// blanked out, so that line numbers in errors stay correct.
+func parseLibraryMetadata(code string) (name, body string, err error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", errors.New("Missing library metadata")
+	}
+
+	shebang := code
+	if newline := strings.IndexByte(code, '\n'); newline >= 0 {
+		shebang, body = code[:newline], code[newline:]
+	}
+
+	parts := strings.Fields(shebang[2:])
+	if len(parts) == 0 || parts[0] != "lua" {
+		engine := ""
+		if len(parts) > 0 {
+			engine = parts[0]
+		}
+		return "", "", errors.Errorf("Engine '%s' not found", engine)
+	}
+
+	for _, part := range parts[1:] {
+		if !strings.HasPrefix(part, "name=") {
+			return "", "", errors.Errorf("Invalid metadata value given: %s", part)
+		}
+		name = strings.TrimPrefix(part, "name=")
+	}
+
+	if name == "" {
+		return "", "", errors.New("Library name was not given")
+	} else if !functionNamePattern.MatchString(name) {
+		return "", "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	return name, body, nil
+}
+
+// registerFunction implements redis.register_function, accepting either a
+// name and a callback, or a table with named arguments.
+func registerFunction(register func(L *lua.LState, function *libraryFunction, callback *lua.LFunction)) lua.LGFunction {
+	return func(L *lua.LState) int {
+		function := new(libraryFunction)
+		var callback lua.LValue
+
+		switch L.GetTop() {
+		case 2:
+			function.name = L.Get(1).String()
+			callback = L.Get(2)
+		case 1:
+			L.CheckTable(1).ForEach(func(key, value lua.LValue) {
+				switch key.String() {
+				case "function_name":
+					function.name = value.String()
+				case "callback":
+					callback = value
+				case "description":
+					function.description = value.String()
+				case "flags":
+					function.flags = readFunctionFlags(L, value)
+				default:
+					L.RaiseError("unknown argument given to redis.register_function")
+				}
+			})
+		default:
+			L.RaiseError("wrong number of arguments to redis.register_function")
+		}
+
+		if !functionNamePattern.MatchString(function.name) {
+			L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+		}
+
+		fn, ok := callback.(*lua.LFunction)
+		if !ok {
+			L.RaiseError("callback argument given to redis.register_function must be a function")
+		}
+
+		register(L, function, fn)
+		return 0
+	}
+}
+
+func readFunctionFlags(L *lua.LState, value lua.LValue) (flags []string) {
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		L.RaiseError("flags argument to redis.register_function must be a table representing function flags")
+	}
+
+	table.ForEach(func(_, flag lua.LValue) {
+		if !functionFlags[flag.String()] {
+			L.RaiseError("unknown flag given")
+		}
+		flags = append(flags, flag.String())
+	})
+
+	return flags
+}
+
+// luaErrorMessage returns the message of a Lua error without the stack trace.
+func luaErrorMessage(err error) string {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		return apiErr.Object.String()
+	}
+	return err.Error()
+}
+
+// addLibrary adds the library unless it, or any of its functions, would
+// clash with the libraries already there.
+func addLibrary(libraries map[string]*functionLibrary, library *functionLibrary, replace bool) error {
+	if _, exists := libraries[library.name]; exists && !replace {
+		return errors.Errorf("Library '%s' already exists", library.name)
+	}
+
+	for _, other := range libraries {
+		if other.name == library.name {
+			continue
+		}
+
+		for name := range library.functions {
+			if _, taken := other.functions[name]; taken {
+				return errors.Errorf("Function %s already exists", name)
+			}
+		}
+	}
+
+	libraries[library.name] = library
+	return nil
+}
+
+func findFunction(libraries map[string]*functionLibrary, name string) (*functionLibrary, *libraryFunction) {
+	for _, library := range libraries {
+		if function, found := library.functions[name]; found {
+			return library, function
+		}
+	}
+	return nil, nil
+}
+
+// dumpLibraries serializes libraries the way FUNCTION DUMP does in Redis.
+func dumpLibraries(libraries map[string]*functionLibrary) string {
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body []byte
+	for _, name := range names {
+		body = appendRDBString(append(body, rdbOpcodeFunction2), libraries[name].code)
+	}
+
+	return string(sealRDBPayload(body))
+}
+
+// restoreLibraries reads libraries serialized by dumpLibraries, or by
+// FUNCTION DUMP in Redis. Errors are meant to be shown to the client.
+func restoreLibraries(payload string, logger *logrus.Entry) (map[string]*functionLibrary, error) {
+	body, ok := openRDBPayload([]byte(payload))
+	if !ok {
+		return nil, errors.New("payload version or checksum are wrong")
+	}
+
+	ret := make(map[string]*functionLibrary)
+	reader := &rdbReader{data: body}
+
+	for !reader.done() {
+		if opcode, _ := reader.readByte(); opcode != rdbOpcodeFunction2 {
+			return nil, errors.New("given type is not a function")
+		}
+
+		code, err := reader.readString()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read library code")
+		}
+
+		library, err := compileLibrary(code, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := addLibrary(ret, library, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// functionRegistry remembers the libraries decoded from the most recently
+// seen payload, so that libraries are not compiled on every FCALL.
+type functionRegistry struct {
+	libraries map[string]*functionLibrary
+	payload   string
+	lock      *sync.Mutex
+}
+
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{lock: new(sync.Mutex)}
+}
+
+// decode returns the libraries serialized in the payload, in a map which the
+// caller is free to modify.
+func (r *functionRegistry) decode(payload string, logger *logrus.Entry) (map[string]*functionLibrary, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.libraries == nil || r.payload != payload {
+		libraries, err := restoreLibraries(payload, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		r.libraries, r.payload = libraries, payload
+	}
+
+	ret := make(map[string]*functionLibrary, len(r.libraries))
+	for name, library := range r.libraries {
+		ret[name] = library
+	}
+
+	return ret, nil
+}
+
+// encode serializes the libraries, and remembers them as the most recent.
+func (r *functionRegistry) encode(libraries map[string]*functionLibrary) string {
+	payload := dumpLibraries(libraries)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.libraries, r.payload = libraries, payload
+	return payload
+}
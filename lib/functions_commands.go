@@ -0,0 +1,333 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func (s *SessionHandler) handleFCall(args []string) error {
+	return s.fcall(args, false)
+}
+
+func (s *SessionHandler) handleFCallRO(args []string) error {
+	return s.fcall(args, true)
+}
+
+// fcall runs a library function. Functions registered with the no-writes
+// flag are not allowed to call write commands, and only they can be called
+// with FCALL_RO.
+func (s *SessionHandler) fcall(args []string, readOnly bool) error {
+	libraries, err := s.loadLibraries()
+	if err != nil {
+		return err
+	}
+
+	library, function := findFunction(libraries, args[0])
+	if function == nil {
+		_, err := fmt.Fprintln(s.writer, "-ERR Function not found")
+		return err
+	} else if readOnly && !function.readOnly() {
+		_, err := fmt.Fprintln(s.writer, "-ERR Can not execute a script with write flag using *_ro command.")
+		return err
+	}
+
+	keys, argv, ok, err := s.splitKeys(args[1:])
+	if !ok {
+		return err
+	}
+
+	return s.runScript(function.name, function.readOnly(), func(state *lua.LState) (int, error) {
+		var callback *lua.LFunction
+
+		redis := state.GetGlobal("redis").(*lua.LTable)
+		state.SetField(redis, "register_function", state.NewFunction(registerFunction(
+			func(_ *lua.LState, registered *libraryFunction, fn *lua.LFunction) {
+				if registered.name == function.name {
+					callback = fn
+				}
+			},
+		)))
+
+		state.Push(state.NewFunctionFromProto(library.proto))
+		if err := state.PCall(0, 0, nil); err != nil {
+			return 0, err
+		}
+
+		if callback == nil {
+			return 0, errors.Errorf("library %s did not register function %s", library.name, function.name)
+		}
+
+		state.Push(callback)
+		state.Push(stringsTable(state, keys))
+		state.Push(stringsTable(state, argv))
+		return 2, nil
+	})
+}
+
+func (s *SessionHandler) loadLibraries() (map[string]*functionLibrary, error) {
+	payload, found, err := s.store.Get(functionsKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read function libraries from the store")
+	} else if !found {
+		return make(map[string]*functionLibrary), nil
+	}
+
+	libraries, err := s.server.functions.decode(payload, s.logger)
+	return libraries, errors.Wrap(err, "could not decode function libraries")
+}
+
+func (s *SessionHandler) saveLibraries(libraries map[string]*functionLibrary) error {
+	if err := s.store.Set(functionsKey, s.server.functions.encode(libraries)); err != nil {
+		return errors.Wrap(err, "could not write function libraries to the store")
+	}
+	return nil
+}
+
+// functionError replies with an error meant to be shown to the client.
+func (s *SessionHandler) functionError(err error) error {
+	_, err = io.WriteString(s.writer, errorString("ERR "+err.Error()))
+	return err
+}
+
+func (s *SessionHandler) handleFunction(args []string) error {
+	switch strings.ToLower(args[0]) {
+	case "load":
+		return s.handleFunctionLoad(args[1:])
+	case "delete":
+		return s.handleFunctionDelete(args[1:])
+	case "list":
+		return s.handleFunctionList(args[1:])
+	case "dump":
+		return s.handleFunctionDump(args[1:])
+	case "restore":
+		return s.handleFunctionRestore(args[1:])
+	case "flush":
+		return s.handleFunctionFlush(args[1:])
+	default:
+		_, err := fmt.Fprintf(s.writer, "-ERR unknown subcommand '%s'\n", args[0])
+		return err
+	}
+}
+
+func (s *SessionHandler) handleFunctionLoad(args []string) error {
+	var replace bool
+	if len(args) == 2 {
+		if !strings.EqualFold(args[0], "replace") {
+			_, err := fmt.Fprintf(s.writer, "-ERR Unknown option given: %s\n", args[0])
+			return err
+		}
+		replace, args = true, args[1:]
+	}
+
+	if len(args) != 1 {
+		return s.badArgs("function|load")
+	}
+
+	library, err := compileLibrary(args[0], s.logger)
+	if err != nil {
+		return s.functionError(err)
+	}
+
+	libraries, err := s.loadLibraries()
+	if err != nil {
+		return err
+	}
+
+	if err := addLibrary(libraries, library, replace); err != nil {
+		return s.functionError(err)
+	}
+
+	if err := s.saveLibraries(libraries); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(s.writer, bulkString(library.name))
+	return err
+}
+
+func (s *SessionHandler) handleFunctionDelete(args []string) error {
+	if len(args) != 1 {
+		return s.badArgs("function|delete")
+	}
+
+	libraries, err := s.loadLibraries()
+	if err != nil {
+		return err
+	}
+
+	if _, exists := libraries[args[0]]; !exists {
+		_, err := fmt.Fprintln(s.writer, "-ERR Library not found")
+		return err
+	}
+
+	delete(libraries, args[0])
+
+	if err := s.saveLibraries(libraries); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(s.writer, "+OK")
+	return err
+}
+
+func (s *SessionHandler) handleFunctionList(args []string) error {
+	var withCode bool
+	var pattern string
+
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "withcode"):
+			withCode = true
+		case strings.EqualFold(args[i], "libraryname") && i+1 < len(args):
+			i++
+			pattern = args[i]
+		default:
+			_, err := fmt.Fprintf(s.writer, "-ERR Unknown argument %s\n", args[i])
+			return err
+		}
+	}
+
+	libraries, err := s.loadLibraries()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range libraries {
+		if pattern == "" || globMatch(pattern, name, true) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	reply := arrayHeader(len(names))
+	for _, name := range names {
+		reply += describeLibrary(libraries[name], withCode)
+	}
+
+	_, err = io.WriteString(s.writer, reply)
+	return err
+}
+
+func describeLibrary(library *functionLibrary, withCode bool) string {
+	var names []string
+	for name := range library.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	functions := arrayHeader(len(names))
+	for _, name := range names {
+		function := library.functions[name]
+
+		description := nullBulkString
+		if function.description != "" {
+			description = bulkString(function.description)
+		}
+
+		flags := arrayHeader(len(function.flags))
+		for _, flag := range function.flags {
+			flags += bulkString(flag)
+		}
+
+		functions += arrayHeader(6) +
+			bulkString("name") + bulkString(name) +
+			bulkString("description") + description +
+			bulkString("flags") + flags
+	}
+
+	fields := 6
+	if withCode {
+		fields += 2
+	}
+
+	ret := arrayHeader(fields) +
+		bulkString("library_name") + bulkString(library.name) +
+		bulkString("engine") + bulkString("LUA") +
+		bulkString("functions") + functions
+
+	if withCode {
+		ret += bulkString("library_code") + bulkString(library.code)
+	}
+
+	return ret
+}
+
+func (s *SessionHandler) handleFunctionDump(args []string) error {
+	if len(args) != 0 {
+		return s.badArgs("function|dump")
+	}
+
+	libraries, err := s.loadLibraries()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(s.writer, bulkString(dumpLibraries(libraries)))
+	return err
+}
+
+// handleFunctionRestore restores libraries from a FUNCTION DUMP payload. By
+// default (APPEND) it fails if any of them already exists, REPLACE replaces
+// existing libraries and FLUSH removes all existing libraries first.
+func (s *SessionHandler) handleFunctionRestore(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return s.badArgs("function|restore")
+	}
+
+	policy := "append"
+	if len(args) == 2 {
+		policy = strings.ToLower(args[1])
+	}
+
+	if policy != "append" && policy != "replace" && policy != "flush" {
+		_, err := fmt.Fprintln(s.writer, "-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+		return err
+	}
+
+	restored, err := restoreLibraries(args[0], s.logger)
+	if err != nil {
+		return s.functionError(err)
+	}
+
+	libraries := restored
+	if policy != "flush" {
+		if libraries, err = s.loadLibraries(); err != nil {
+			return err
+		}
+
+		for _, library := range restored {
+			if err := addLibrary(libraries, library, policy == "replace"); err != nil {
+				return s.functionError(err)
+			}
+		}
+	}
+
+	if err := s.saveLibraries(libraries); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(s.writer, "+OK")
+	return err
+}
+
+func (s *SessionHandler) handleFunctionFlush(args []string) error {
+	if len(args) > 1 {
+		return s.badArgs("function|flush")
+	} else if len(args) == 1 && !strings.EqualFold(args[0], "sync") && !strings.EqualFold(args[0], "async") {
+		_, err := fmt.Fprintln(s.writer, "-ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+		return err
+	}
+
+	if err := s.saveLibraries(make(map[string]*functionLibrary)); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintln(s.writer, "+OK")
+	return err
+}
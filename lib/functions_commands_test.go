@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// Library code spans multiple lines, which the inline protocol can't carry,
+// so these tests dispatch commands directly.
+
+func (s *sessionHandlerTestSuite) TestFunctionLoad() {
+	s.store.On("Get", functionsKey).Return("", false, nil)
+	s.store.On("Set", functionsKey, mock.MatchedBy(func(payload string) bool {
+		libraries, err := restoreLibraries(payload, s.sut.logger)
+		return err == nil && libraries["bacon"].code == testLibrary
+	})).Return(nil)
+
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "LOAD", testLibrary}))
+	s.responded("$5\nbacon")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionLoad_AlreadyExists() {
+	s.withLibraries(testLibrary)
+
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "LOAD", testLibrary}))
+	s.responded("-ERR Library 'bacon' already exists")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionLoad_Replace() {
+	s.withLibraries(testLibrary)
+	s.store.On("Set", functionsKey, mock.AnythingOfType("string")).Return(nil)
+
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "LOAD", "REPLACE", testLibrary}))
+	s.responded("$5\nbacon")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionLoad_Invalid() {
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "LOAD", "return 1"}))
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "LOAD", "FORCE", testLibrary}))
+	s.responded("-ERR Missing library metadata\n-ERR Unknown option given: FORCE")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionLoad_StoreError() {
+	s.store.On("Get", functionsKey).Return("", false, errors.New("store error"))
+
+	s.EqualError(
+		s.sut.dispatch([]string{"FUNCTION", "LOAD", testLibrary}),
+		"could not read function libraries from the store: store error",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestFCall() {
+	s.withLibraries(testLibrary)
+	s.store.On("Apply", []Write{{Key: "bacon", Value: "crispy"}}, []Condition(nil)).Return(nil)
+
+	fmt.Fprintln(s.conn, "FCALL fry 1 bacon crispy")
+
+	s.True(s.sut.handleLine())
+	s.responded("+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestFCallRO() {
+	s.withLibraries(testLibrary)
+	s.store.On("Get", "bacon").Return("crispy", true, nil)
+
+	fmt.Fprint(s.conn, "FCALL_RO smell 1 bacon\nFCALL_RO fry 1 bacon crispy\n")
+
+	s.handleLines(2)
+	s.responded("$6\ncrispy\n-ERR Can not execute a script with write flag using *_ro command.")
+}
+
+func (s *sessionHandlerTestSuite) TestFCall_ReadOnlyFunctionWrites() {
+	s.withLibraries("#!lua name=bacon\nredis.register_function{function_name='sneaky', callback=function() return redis.call('SET', 'bacon', 'raw') end, flags={'no-writes'}}")
+
+	fmt.Fprintln(s.conn, "FCALL sneaky 0")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR Write commands are not allowed from read-only scripts.")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestFCall_NotFound() {
+	s.withLibraries(testLibrary)
+
+	fmt.Fprintln(s.conn, "FCALL boil 0")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR Function not found")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionDelete() {
+	s.withLibraries(testLibrary)
+	s.store.On("Set", functionsKey, dumpLibraries(map[string]*functionLibrary{})).Return(nil)
+
+	fmt.Fprint(s.conn, "FUNCTION DELETE cabbage\nFUNCTION DELETE bacon\n")
+
+	s.handleLines(2)
+	s.responded("-ERR Library not found\n+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionList() {
+	s.withLibraries("#!lua name=bacon\nredis.register_function{function_name='fry', callback=print, flags={'no-writes'}}")
+
+	fmt.Fprint(s.conn, "FUNCTION LIST LIBRARYNAME cab*\nFUNCTION LIST\nFUNCTION LIST WITHCODE LIBRARYNAME BA*\n")
+
+	s.handleLines(3)
+	s.responded("*0\n" +
+		"*1\n*6\n$12\nlibrary_name\n$5\nbacon\n$6\nengine\n$3\nLUA\n$9\nfunctions\n" +
+		"*1\n*6\n$4\nname\n$3\nfry\n$11\ndescription\n$-1\n$5\nflags\n*1\n$9\nno-writes\n" +
+		"*1\n*8\n$12\nlibrary_name\n$5\nbacon\n$6\nengine\n$3\nLUA\n$9\nfunctions\n" +
+		"*1\n*6\n$4\nname\n$3\nfry\n$11\ndescription\n$-1\n$5\nflags\n*1\n$9\nno-writes\n" +
+		"$12\nlibrary_code\n$98\n#!lua name=bacon\nredis.register_function{function_name='fry', callback=print, flags={'no-writes'}}")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionDump() {
+	payload := s.withLibraries(testLibrary)
+
+	fmt.Fprintln(s.conn, "FUNCTION DUMP")
+
+	s.True(s.sut.handleLine())
+	s.responded(fmt.Sprintf("$%d\n%s", len(payload), payload))
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionRestore() {
+	payload := s.withLibraries(testLibrary)
+	s.store.On("Set", functionsKey, payload).Return(nil)
+
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "RESTORE", payload}))
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "RESTORE", payload, "REPLACE"}))
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "RESTORE", payload, "FLUSH"}))
+	s.responded("-ERR Library 'bacon' already exists\n+OK\n+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionRestore_Invalid() {
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "RESTORE", "bacon"}))
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "RESTORE", "bacon", "MERGE"}))
+	s.responded(
+		"-ERR payload version or checksum are wrong\n" +
+			"-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionRestore_HugeLZFLength() {
+	// An LZF string claiming to decompress to 2^63-1 bytes.
+	payload := string(sealRDBPayload([]byte{
+		rdbOpcodeFunction2, 0xc3, 0x01, 0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00,
+	}))
+
+	s.NoError(s.sut.dispatch([]string{"FUNCTION", "RESTORE", payload}))
+	s.responded("-ERR could not read library code: invalid LZF decompressed length 9223372036854775807")
+}
+
+func (s *sessionHandlerTestSuite) TestFunctionFlush() {
+	s.store.On("Set", functionsKey, dumpLibraries(map[string]*functionLibrary{})).Return(nil)
+
+	fmt.Fprintln(s.conn, "FUNCTION FLUSH")
+
+	s.True(s.sut.handleLine())
+	s.responded("+OK")
+}
+
+func (s *sessionHandlerTestSuite) withLibraries(code ...string) (payload string) {
+	libraries := make(map[string]*functionLibrary)
+	for _, code := range code {
+		library, err := compileLibrary(code, s.sut.logger)
+		s.Require().NoError(err)
+		libraries[library.name] = library
+	}
+
+	payload = dumpLibraries(libraries)
+	s.store.On("Get", functionsKey).Return(payload, true, nil)
+
+	return payload
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+const testLibrary = "#!lua name=bacon\n" +
+	"redis.register_function('fry', function(keys, args) return redis.call('SET', keys[1], args[1]) end)\n" +
+	"redis.register_function{function_name='smell', callback=function(keys) return redis.call('GET', keys[1]) end, flags={'no-writes'}, description='Smells bacon'}\n"
+
+type functionsTestSuite struct {
+	suite.Suite
+
+	logger *logrus.Entry
+}
+
+func (f *functionsTestSuite) SetupTest() {
+	f.logger = logrus.NewEntry(logrus.New())
+}
+
+func (f *functionsTestSuite) TestCompileLibrary() {
+	library, err := compileLibrary(testLibrary, f.logger)
+
+	f.Require().NoError(err)
+	f.Equal("bacon", library.name)
+	f.Len(library.functions, 2)
+	f.False(library.functions["fry"].readOnly())
+	f.True(library.functions["smell"].readOnly())
+	f.Equal("Smells bacon", library.functions["smell"].description)
+}
+
+func (f *functionsTestSuite) TestCompileLibrary_Errors() {
+	for _, testCase := range []struct {
+		code     string
+		expected string
+	}{
+		{"return 1", "Missing library metadata"},
+		{"#!python name=bacon\n", "Engine 'python' not found"},
+		{"#!lua\n", "Library name was not given"},
+		{"#!lua name=bacon flavour=smoky\n", "Invalid metadata value given: flavour=smoky"},
+		{"#!lua name=ba-con\n", "Library names can only contain letters, numbers, or underscores(_) and must be at least one character long"},
+		{"#!lua name=bacon\n", "No functions registered"},
+		{"#!lua name=bacon\nreturn (", "Error compiling function: user_function at EOF:   syntax error\n"},
+		{"#!lua name=bacon\nredis.register_function('f', 1)", "Error registering functions: user_function:2: callback argument given to redis.register_function must be a function"},
+		{"#!lua name=bacon\nredis.register_function('f-g', print)", "Error registering functions: user_function:2: Function names can only contain letters, numbers, or underscores(_) and must be at least one character long"},
+		{"#!lua name=bacon\nredis.register_function{function_name='f', callback=print, flags={'sizzling'}}", "Error registering functions: user_function:2: unknown flag given"},
+		{"#!lua name=bacon\nredis.register_function('f', print)\nredis.register_function('f', print)", "Error registering functions: user_function:3: Function already exists in the library"},
+		{"#!lua name=bacon\nredis.register_function('f', print)\nredis.call('GET', 'bacon')", "Error registering functions: user_function:3: attempt to call a non-function object"},
+	} {
+		_, err := compileLibrary(testCase.code, f.logger)
+		f.EqualError(err, testCase.expected, testCase.code)
+	}
+}
+
+func (f *functionsTestSuite) TestCompileLibrary_Timeout() {
+	_, err := compileLibrary("#!lua name=bacon\nwhile true do end", f.logger)
+
+	f.EqualError(err, "Error registering functions: user_function:2: context deadline exceeded")
+}
+
+func (f *functionsTestSuite) TestAddLibrary() {
+	library, _ := compileLibrary(testLibrary, f.logger)
+	clashing, _ := compileLibrary("#!lua name=cabbage\nredis.register_function('fry', print)", f.logger)
+	libraries := make(map[string]*functionLibrary)
+
+	f.NoError(addLibrary(libraries, library, false))
+	f.EqualError(addLibrary(libraries, library, false), "Library 'bacon' already exists")
+	f.NoError(addLibrary(libraries, library, true))
+	f.EqualError(addLibrary(libraries, clashing, true), "Function fry already exists")
+}
+
+func (f *functionsTestSuite) TestDumpAndRestore() {
+	library, _ := compileLibrary(testLibrary, f.logger)
+
+	restored, err := restoreLibraries(dumpLibraries(map[string]*functionLibrary{"bacon": library}), f.logger)
+
+	f.NoError(err)
+	f.Len(restored, 1)
+	f.Equal(testLibrary, restored["bacon"].code)
+}
+
+func (f *functionsTestSuite) TestRestore_Invalid() {
+	_, err := restoreLibraries("bacon", f.logger)
+	f.EqualError(err, "payload version or checksum are wrong")
+
+	_, err = restoreLibraries(string(sealRDBPayload([]byte{0x00})), f.logger)
+	f.EqualError(err, "given type is not a function")
+}
+
+func (f *functionsTestSuite) TestRegistry() {
+	library, _ := compileLibrary(testLibrary, f.logger)
+	sut := newFunctionRegistry()
+
+	payload := sut.encode(map[string]*functionLibrary{"bacon": library})
+	libraries, err := sut.decode(payload, f.logger)
+
+	f.NoError(err)
+	f.Equal(library, libraries["bacon"], "should not be compiled again")
+
+	delete(libraries, "bacon")
+	libraries, _ = sut.decode(payload, f.logger)
+	f.Len(libraries, 1, "should not be affected by changes made by callers")
+}
+
+func TestFunctions(t *testing.T) {
+	suite.Run(t, new(functionsTestSuite))
+}
@@ -0,0 +1,125 @@
+package lib
+
+// maxGlobNesting protects against abusive patterns with many consecutive
+// wildcards, exactly like Redis does.
+const maxGlobNesting = 1000
+
+// globMatch reports whether str matches the glob-style pattern. It is a port
+// of Redis's stringmatchlen, supporting *, ?, [...] (with ^ negation and
+// ranges) and backslash escapes, so that pattern subscriptions and key
+// matching behave identically to a real Redis.
+func globMatch(pattern, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return globMatchImpl(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+func globMatchImpl(pattern, str string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	if nesting > maxGlobNesting {
+		return false
+	}
+
+	p, s := 0, 0
+
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for s < len(str) {
+				if globMatchImpl(pattern[p+1:], str[s:], nocase, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				s++
+			}
+			// There was no match for the rest of the pattern starting from
+			// anywhere in the rest of the string, so no longer match for any
+			// earlier '*' can succeed either.
+			*skipLongerMatches = true
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p+1 < len(pattern) && pattern[p] == '\\' {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if p < len(pattern) && pattern[p] == ']' {
+					break
+				} else if p >= len(pattern) {
+					p--
+					break
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if bytesEqual(pattern[p], str[s], nocase) {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if !bytesEqual(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+		if s == len(str) {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			break
+		}
+	}
+
+	return p == len(pattern) && s == len(str)
+}
+
+func bytesEqual(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
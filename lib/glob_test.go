@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type globTestSuite struct {
+	suite.Suite
+}
+
+func (g *globTestSuite) TestMatches() {
+	for _, testCase := range []struct {
+		pattern string
+		str     string
+	}{
+		{"*", "bacon"},
+		{"bacon", "bacon"},
+		{"ba*", "bacon"},
+		{"*con", "bacon"},
+		{"b*c*n", "bacon"},
+		{"b?con", "bacon"},
+		{"b[ae]con", "becon"},
+		{"b[^e]con", "bacon"},
+		{"b[a-c]con", "bbcon"},
+		{"b[c-a]con", "bbcon"},
+		{`b\*con`, "b*con"},
+		{`b[\]]con`, "b]con"},
+		{"news.*", "news.tech"},
+		{"h*llo**", "hello"},
+	} {
+		g.True(globMatch(testCase.pattern, testCase.str, false), "%q should match %q", testCase.pattern, testCase.str)
+	}
+}
+
+func (g *globTestSuite) TestDoesNotMatch() {
+	for _, testCase := range []struct {
+		pattern string
+		str     string
+	}{
+		{"", "bacon"},
+		{"bacon", "baco"},
+		{"bacon", "Bacon"},
+		{"b?con", "bcon"},
+		{"b[ae]con", "bicon"},
+		{"b[^a]con", "bacon"},
+		{"b[a-c]con", "bdcon"},
+		{`b\*con`, "bacon"},
+		{"news.*", "news"},
+	} {
+		g.False(globMatch(testCase.pattern, testCase.str, false), "%q should not match %q", testCase.pattern, testCase.str)
+	}
+}
+
+func (g *globTestSuite) TestNoCase() {
+	g.True(globMatch("BA*", "bacon", true))
+	g.True(globMatch("b[A-C]con", "bbcon", true))
+	g.False(globMatch("BA*", "bacon", false))
+}
+
+func (g *globTestSuite) TestUnterminatedBracket() {
+	g.True(globMatch("b[ac", "ba", false))
+	g.False(globMatch("b[ac", "bd", false))
+}
+
+func (g *globTestSuite) TestAbusivePattern() {
+	pattern := strings.Repeat("a*", 50) + "b"
+	str := strings.Repeat("a", 100)
+
+	g.False(globMatch(pattern, str, false))
+}
+
+func TestGlob(t *testing.T) {
+	suite.Run(t, new(globTestSuite))
+}
@@ -1,17 +1,22 @@
 package lib
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 type inMemoryStore struct {
-	data map[string]string
-	lock *sync.RWMutex
+	data     map[string]string
+	versions map[string]uint64
+	lock     *sync.RWMutex
 }
 
 // NewInMemoryStore returns an in-memory implementation of Store.
 func NewInMemoryStore() Store {
 	return &inMemoryStore{
-		data: make(map[string]string),
-		lock: new(sync.RWMutex),
+		data:     make(map[string]string),
+		versions: make(map[string]uint64),
+		lock:     new(sync.RWMutex),
 	}
 }
 
@@ -27,6 +32,71 @@ func (s *inMemoryStore) Set(key string, value string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.data[key] = value
+	s.write(Write{Key: key, Value: value})
 	return nil
 }
+
+func (s *inMemoryStore) Version(key string) (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.versions[key], nil
+}
+
+func (s *inMemoryStore) Apply(writes []Write, conditions []Condition) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, condition := range conditions {
+		if s.versions[condition.Key] != condition.Version {
+			return ErrConditionFailed
+		}
+	}
+
+	for _, write := range writes {
+		s.write(write)
+	}
+	return nil
+}
+
+// Scan iterates over keys in lexicographical order, which keeps cursors valid
+// no matter how the keyspace changes between calls. The cursor is the last
+// key returned, prefixed so that it's never empty.
+func (s *inMemoryStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var after string
+	if cursor != "" {
+		after = cursor[1:]
+	}
+
+	for key := range s.data {
+		if cursor == "" || key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if count < 1 {
+		count = 1
+	}
+
+	if len(keys) > count {
+		keys = keys[:count]
+		next = ">" + keys[count-1]
+	}
+
+	return keys, next, nil
+}
+
+// write must be called with the lock held. Versions are kept forever, even
+// for deleted keys, so that a version number is never reused for the same key.
+func (s *inMemoryStore) write(write Write) {
+	if write.Delete {
+		delete(s.data, write.Key)
+	} else {
+		s.data[write.Key] = write.Value
+	}
+	s.versions[write.Key]++
+}
@@ -37,6 +37,94 @@ func (i *inMemoryStoreTestSuite) TestFailedGet() {
 	i.NoError(err)
 }
 
+func (i *inMemoryStoreTestSuite) TestApply() {
+	i.NoError(i.sut.Apply([]Write{
+		{Key: "bacon", Value: "tasty"},
+		{Key: "cabbage", Value: "healthy"},
+	}, nil))
+
+	ret, found, err := i.sut.Get("cabbage")
+	i.Equal("healthy", ret)
+	i.True(found)
+	i.NoError(err)
+}
+
+func (i *inMemoryStoreTestSuite) TestVersion() {
+	version, err := i.sut.Version("bacon")
+	i.Zero(version)
+	i.NoError(err)
+
+	i.NoError(i.sut.Set("bacon", "tasty"))
+	i.NoError(i.sut.Set("bacon", "crispy"))
+
+	version, err = i.sut.Version("bacon")
+	i.Equal(uint64(2), version)
+	i.NoError(err)
+}
+
+func (i *inMemoryStoreTestSuite) TestApply_Conditions() {
+	i.NoError(i.sut.Set("bacon", "tasty"))
+
+	i.NoError(i.sut.Apply(
+		[]Write{{Key: "bacon", Value: "crispy"}},
+		[]Condition{{Key: "bacon", Version: 1}, {Key: "cabbage", Version: 0}},
+	))
+
+	i.Equal(ErrConditionFailed, i.sut.Apply(
+		[]Write{{Key: "bacon", Value: "burnt"}},
+		[]Condition{{Key: "bacon", Version: 1}},
+	))
+
+	ret, _, _ := i.sut.Get("bacon")
+	i.Equal("crispy", ret)
+}
+
+func (i *inMemoryStoreTestSuite) TestApply_Delete() {
+	i.NoError(i.sut.Set("bacon", "tasty"))
+
+	i.NoError(i.sut.Apply([]Write{
+		{Key: "bacon", Delete: true},
+		{Key: "cabbage", Value: "tasty"},
+	}, nil))
+
+	_, found, err := i.sut.Get("bacon")
+	i.False(found)
+	i.NoError(err)
+
+	// Versions of deleted keys are kept, so they're never reused.
+	version, err := i.sut.Version("bacon")
+	i.Equal(uint64(2), version)
+	i.NoError(err)
+
+	keys, _, err := i.sut.Scan("", 10)
+	i.Equal([]string{"cabbage"}, keys)
+	i.NoError(err)
+}
+
+func (i *inMemoryStoreTestSuite) TestScan() {
+	for _, key := range []string{"cabbage", "", "bacon", "eggs", "dill"} {
+		i.NoError(i.sut.Set(key, "value"))
+	}
+
+	keys, cursor, err := i.sut.Scan("", 2)
+	i.Equal([]string{"", "bacon"}, keys)
+	i.NotEmpty(cursor)
+	i.NoError(err)
+
+	// Keys sorting before the cursor are not returned again.
+	i.NoError(i.sut.Set("apples", "value"))
+
+	keys, cursor, err = i.sut.Scan(cursor, 2)
+	i.Equal([]string{"cabbage", "dill"}, keys)
+	i.NotEmpty(cursor)
+	i.NoError(err)
+
+	keys, cursor, err = i.sut.Scan(cursor, 2)
+	i.Equal([]string{"eggs"}, keys)
+	i.Empty(cursor)
+	i.NoError(err)
+}
+
 func TestInMemoryStore(t *testing.T) {
 	suite.Run(t, new(inMemoryStoreTestSuite))
 }
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// redisVersion is the version of Redis whose commands goredis mirrors. Some
+// clients look at it in INFO to tell which commands they can use.
+const redisVersion = "7.0.0"
+
+// infoSections are the sections of INFO, in the order they're reported.
+var infoSections = []string{"server", "memory", "persistence", "stats"}
+
+// infoReporter is implemented by stores which have something to report in
+// INFO, like the memory usage of a cache.
+type infoReporter interface {
+	reportInfo(info *serverInfo)
+}
+
+type infoField struct {
+	name  string
+	value interface{}
+}
+
+// serverInfo collects the fields of INFO by section.
+type serverInfo struct {
+	sections map[string][]infoField
+}
+
+func newServerInfo() *serverInfo {
+	return &serverInfo{sections: make(map[string][]infoField)}
+}
+
+func (i *serverInfo) add(section, name string, value interface{}) {
+	i.sections[section] = append(i.sections[section], infoField{name: name, value: value})
+}
+
+// render formats the sections the way Redis does, skipping the ones which are
+// empty. Lines end with CRLF, since that's what clients parsing INFO expect.
+func (i *serverInfo) render(sections []string) string {
+	var out []string
+	for _, section := range sections {
+		fields := i.sections[section]
+		if len(fields) == 0 {
+			continue
+		}
+
+		lines := []string{"# " + strings.Title(section)}
+		for _, field := range fields {
+			lines = append(lines, fmt.Sprintf("%s:%v", field.name, field.value))
+		}
+		out = append(out, strings.Join(lines, "\r\n")+"\r\n")
+	}
+	return strings.Join(out, "\r\n")
+}
+
+// handleInfo reports the default sections unless asked for specific ones.
+// Sections goredis knows nothing about are silently left out, as in Redis.
+func (s *SessionHandler) handleInfo(args []string) error {
+	info := newServerInfo()
+	info.add("server", "redis_version", redisVersion)
+	info.add("server", "redis_mode", "standalone")
+	if reporter, ok := s.server.Store.(infoReporter); ok {
+		reporter.reportInfo(info)
+	}
+
+	sections := infoSections
+	if len(args) > 0 {
+		sections = nil
+		for _, arg := range args {
+			switch arg = strings.ToLower(arg); arg {
+			case "all", "default", "everything":
+				sections = append(sections, infoSections...)
+			default:
+				sections = append(sections, arg)
+			}
+		}
+	}
+
+	_, err := io.WriteString(s.writer, bulkString(info.render(dedupe(sections))))
+	return err
+}
+
+func dedupe(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var ret []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			ret = append(ret, value)
+		}
+	}
+	return ret
+}
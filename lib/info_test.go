@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+func (s *sessionHandlerTestSuite) TestInfo_Default() {
+	fmt.Fprintln(s.conn, "INFO")
+
+	s.True(s.sut.handleLine())
+	s.responded("$54\n# Server\r\nredis_version:7.0.0\r\nredis_mode:standalone\r\n")
+}
+
+func (s *sessionHandlerTestSuite) TestInfo_BoundedCache() {
+	cache := NewBoundedStore(1024, AllKeysLFU)
+	s.server.Store = NewCachingStore(NewInMemoryStore(), cache)
+	s.NoError(cache.Set("bacon", "tasty"))
+
+	fmt.Fprintln(s.conn, "INFO memory STATS memory")
+
+	s.True(s.sut.handleLine())
+	s.responded("$99\n" +
+		"# Memory\r\n" +
+		"used_memory:74\r\n" +
+		"maxmemory:1024\r\n" +
+		"maxmemory_policy:allkeys-lfu\r\n" +
+		"\r\n" +
+		"# Stats\r\n" +
+		"evicted_keys:0\r\n")
+}
+
+func (s *sessionHandlerTestSuite) TestInfo_WriteBehind() {
+	dir, err := ioutil.TempDir("", "write-behind")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	writeBehind, err := OpenWriteBehind(dir, logrus.New())
+	s.Require().NoError(err)
+	defer writeBehind.log.close()
+
+	store := NewCachingStore(NewInMemoryStore(), NewInMemoryStore())
+	store.WriteBehind = writeBehind
+	s.server.Store = store
+	s.NoError(store.Set("bacon", "tasty"))
+
+	fmt.Fprintln(s.conn, "INFO persistence")
+
+	s.True(s.sut.handleLine())
+	s.responded("$79\n# Persistence\r\nwrite_behind_pending_writes:1\r\nwrite_behind_set_aside_writes:0\r\n")
+}
+
+func (s *sessionHandlerTestSuite) TestInfo_UnknownSection() {
+	fmt.Fprintln(s.conn, "INFO cabbage")
+
+	s.True(s.sut.handleLine())
+	s.responded("$0\n")
+}
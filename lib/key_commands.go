@@ -0,0 +1,385 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// conditionalRetries is how many times commands which read keys before
+	// writing them start over when the keys are modified in between, which
+	// can only happen when other nodes share the store.
+	conditionalRetries = 5
+
+	// embstrSizeLimit is the length up to which Redis stores strings in a
+	// single allocation along with the object header.
+	embstrSizeLimit = 44
+)
+
+// retryConditional writes the reply of the attempt, running it again when
+// its writes fail because of a condition.
+func (s *SessionHandler) retryConditional(attempt func() (reply string, err error)) error {
+	for retries := 0; ; retries++ {
+		reply, err := attempt()
+		if errors.Cause(err) == ErrConditionFailed && retries < conditionalRetries {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(s.writer, reply)
+		return err
+	}
+}
+
+// readVersioned returns the value of a key along with its version. The
+// version is read first, so that a write made in between fails conditions
+// on it rather than going unnoticed. The value is read with strong
+// consistency, since a cached one may be older than the version, when
+// written through another node.
+func readVersioned(store Store, key string) (value string, found bool, version uint64, err error) {
+	if version, err = store.Version(key); err != nil {
+		err = errors.Wrap(err, "could not read version from the store")
+		return
+	}
+
+	value, found, err = getContext(WithConsistentRead(context.Background()), store, key)
+	err = errors.Wrap(err, "could not read from the store")
+	return
+}
+
+func (s *SessionHandler) handleRename(args []string) error {
+	return s.rename(args[0], args[1], false)
+}
+
+func (s *SessionHandler) handleRenameNX(args []string) error {
+	return s.rename(args[0], args[1], true)
+}
+
+// rename deletes the source and writes the destination in a single atomic
+// batch, so that the value is never lost nor duplicated.
+func (s *SessionHandler) rename(src, dst string, nx bool) error {
+	return s.retryConditional(func() (string, error) {
+		value, found, version, err := readVersioned(s.store, src)
+		if err != nil {
+			return "", err
+		} else if !found {
+			return errorString("ERR no such key"), nil
+		}
+
+		if src == dst {
+			if nx {
+				return integer(0), nil
+			}
+			return simpleString("OK"), nil
+		}
+
+		conditions := []Condition{{Key: src, Version: version}}
+
+		if nx {
+			_, exists, dstVersion, err := readVersioned(s.store, dst)
+			if err != nil {
+				return "", err
+			} else if exists {
+				return integer(0), nil
+			}
+
+			conditions = append(conditions, Condition{Key: dst, Version: dstVersion})
+		}
+
+		writes := []Write{{Key: src, Delete: true}, {Key: dst, Value: value}}
+		if err := s.store.Apply(writes, conditions); err != nil {
+			return "", errors.Wrap(err, "could not apply writes to the store")
+		}
+
+		s.server.access.rename(accessKey(s.db, src), accessKey(s.db, dst))
+
+		if nx {
+			return integer(1), nil
+		}
+		return simpleString("OK"), nil
+	})
+}
+
+// handleCopy copies keys within the selected database, or to another one.
+// Either way, the copy is written to the root store in terms of the keys
+// in it, since databases are only views of the root store.
+func (s *SessionHandler) handleCopy(args []string) error {
+	src, dst := args[0], args[1]
+
+	db, replace := s.db, false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "replace":
+			replace = true
+		case "db":
+			if i++; i >= len(args) {
+				_, err := fmt.Fprintln(s.writer, "-ERR syntax error")
+				return err
+			}
+
+			var err error
+			if db, err = strconv.Atoi(args[i]); err != nil {
+				_, err := fmt.Fprintln(s.writer, "-ERR value is not an integer or out of range")
+				return err
+			} else if !s.validDatabase(db) {
+				_, err := fmt.Fprintln(s.writer, "-ERR DB index is out of range")
+				return err
+			}
+		default:
+			_, err := fmt.Fprintln(s.writer, "-ERR syntax error")
+			return err
+		}
+	}
+
+	if src == dst && db == s.db {
+		_, err := fmt.Fprintln(s.writer, "-ERR source and destination objects are the same")
+		return err
+	}
+
+	target := &databaseStore{root: s.root, db: db}
+
+	return s.retryConditional(func() (string, error) {
+		value, found, version, err := readVersioned(s.store, src)
+		if err != nil {
+			return "", err
+		} else if !found {
+			return integer(0), nil
+		}
+
+		srcKey, err := s.store.key(src)
+		if err != nil {
+			return "", err
+		}
+
+		dstKey, err := target.key(dst)
+		if err != nil {
+			return "", err
+		}
+
+		conditions := []Condition{{Key: srcKey, Version: version}}
+
+		if !replace {
+			_, exists, dstVersion, err := readVersioned(target, dst)
+			if err != nil {
+				return "", err
+			} else if exists {
+				return integer(0), nil
+			}
+
+			conditions = append(conditions, Condition{Key: dstKey, Version: dstVersion})
+		}
+
+		if err := s.root.Apply([]Write{{Key: dstKey, Value: value}}, conditions); err != nil {
+			return "", errors.Wrap(err, "could not apply writes to the store")
+		}
+
+		s.server.access.touch(accessKey(s.db, src), accessKey(db, dst))
+		return integer(1), nil
+	})
+}
+
+// handleType does not count as an access to the key, as in Redis.
+func (s *SessionHandler) handleType(args []string) error {
+	_, found, err := s.store.Get(args[0])
+	if err != nil {
+		return errors.Wrap(err, "could not read from the store")
+	}
+
+	keyType := "none"
+	if found {
+		keyType = "string"
+	}
+
+	_, err = io.WriteString(s.writer, simpleString(keyType))
+	return err
+}
+
+func (s *SessionHandler) handleTouch(args []string) error {
+	var touched []string
+	for _, key := range args {
+		_, found, err := s.store.Get(key)
+		if err != nil {
+			return errors.Wrap(err, "could not read from the store")
+		}
+
+		if found {
+			touched = append(touched, key)
+		}
+	}
+
+	for i, key := range touched {
+		touched[i] = accessKey(s.db, key)
+	}
+	s.server.access.touch(touched...)
+
+	_, err := io.WriteString(s.writer, integer(len(touched)))
+	return err
+}
+
+// handleObject inspects keys without counting as an access to them. Idle
+// time and access frequency only reflect accesses made through this node.
+func (s *SessionHandler) handleObject(args []string) error {
+	subcommand := strings.ToLower(args[0])
+
+	switch subcommand {
+	case "encoding", "freq", "idletime", "refcount":
+	default:
+		_, err := fmt.Fprintf(s.writer, "-ERR unknown subcommand '%s'\n", args[0])
+		return err
+	}
+
+	if len(args) != 2 {
+		return s.badArgs("object|" + subcommand)
+	}
+
+	value, found, err := s.store.Get(args[1])
+	if err != nil {
+		return errors.Wrap(err, "could not read from the store")
+	} else if !found {
+		_, err := io.WriteString(s.writer, nullBulkString)
+		return err
+	}
+
+	var reply string
+	switch idle, frequency := s.server.access.lookup(accessKey(s.db, args[1])); subcommand {
+	case "encoding":
+		reply = bulkString(objectEncoding(value))
+	case "freq":
+		reply = integer(int(frequency))
+	case "idletime":
+		reply = integer(int(idle / time.Second))
+	case "refcount":
+		reply = integer(1)
+	}
+
+	_, err = io.WriteString(s.writer, reply)
+	return err
+}
+
+// objectEncoding returns the encoding Redis would use for the value.
+func objectEncoding(value string) string {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(n, 10) == value {
+		return "int"
+	} else if len(value) <= embstrSizeLimit {
+		return "embstr"
+	}
+	return "raw"
+}
+
+func (s *SessionHandler) handleDump(args []string) error {
+	value, found, err := s.store.Get(args[0])
+	if err != nil {
+		return errors.Wrap(err, "could not read from the store")
+	} else if !found {
+		_, err := io.WriteString(s.writer, nullBulkString)
+		return err
+	}
+
+	_, err = io.WriteString(s.writer, bulkString(dumpString(value)))
+	return err
+}
+
+// handleRestore creates a key from a DUMP payload. goredis does not support
+// key expiration, so the only TTL accepted other than zero is an absolute
+// one which has already passed, in which case the key is not created. Any
+// other TTL is rejected, rather than creating a key which never expires.
+// IDLETIME and FREQ are always honoured, since they only seed the access
+// statistics kept for OBJECT.
+func (s *SessionHandler) handleRestore(args []string) error {
+	key, payload := args[0], args[2]
+
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		_, err := fmt.Fprintln(s.writer, "-ERR value is not an integer or out of range")
+		return err
+	} else if ttl < 0 {
+		_, err := fmt.Fprintln(s.writer, "-ERR Invalid TTL value, must be >= 0")
+		return err
+	}
+
+	var replace, absTTL bool
+	idle, frequency := int64(-1), int64(-1)
+
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); option {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		case "idletime", "freq":
+			if i++; i >= len(args) {
+				_, err := fmt.Fprintln(s.writer, "-ERR syntax error")
+				return err
+			}
+
+			value, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				_, err := fmt.Fprintln(s.writer, "-ERR value is not an integer or out of range")
+				return err
+			}
+
+			if option == "idletime" {
+				if idle = value; idle < 0 {
+					_, err := fmt.Fprintln(s.writer, "-ERR Invalid IDLETIME value, must be >= 0")
+					return err
+				}
+			} else if frequency = value; frequency < 0 || frequency > 255 {
+				_, err := fmt.Fprintln(s.writer, "-ERR Invalid FREQ value, must be >= 0 and <= 255")
+				return err
+			}
+		default:
+			_, err := fmt.Fprintln(s.writer, "-ERR syntax error")
+			return err
+		}
+	}
+
+	value, err := restoreString(payload)
+	if err != nil {
+		_, err := io.WriteString(s.writer, errorString("ERR "+err.Error()))
+		return err
+	}
+
+	expired := absTTL && ttl != 0 && ttl <= time.Now().UnixNano()/int64(time.Millisecond)
+	if ttl != 0 && !expired {
+		_, err := fmt.Fprintln(s.writer, "-ERR key expiration is not supported, TTL must be 0 or an ABSTTL which has passed")
+		return err
+	}
+
+	return s.retryConditional(func() (string, error) {
+		var conditions []Condition
+
+		if !replace {
+			_, exists, version, err := readVersioned(s.store, key)
+			if err != nil {
+				return "", err
+			} else if exists {
+				return errorString("BUSYKEY Target key name already exists."), nil
+			}
+
+			conditions = append(conditions, Condition{Key: key, Version: version})
+		}
+
+		if expired && !replace {
+			return simpleString("OK"), nil
+		}
+
+		// An expired key replaces the existing one by deleting it.
+		write := Write{Key: key, Value: value, Delete: expired}
+		if err := s.store.Apply([]Write{write}, conditions); err != nil {
+			return "", errors.Wrap(err, "could not apply writes to the store")
+		}
+
+		if !expired {
+			s.server.access.restore(accessKey(s.db, key), time.Duration(idle)*time.Second, int(frequency))
+		}
+
+		return simpleString("OK"), nil
+	})
+}
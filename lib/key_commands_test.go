@@ -0,0 +1,336 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func (s *sessionHandlerTestSuite) TestRename() {
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On(
+		"Apply",
+		[]Write{{Key: "bacon", Delete: true}, {Key: "cabbage", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 3}},
+	).Return(nil)
+
+	fmt.Fprintln(s.conn, "RENAME bacon cabbage")
+
+	s.True(s.sut.handleLine())
+	s.responded("+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestRename_NoSuchKey() {
+	s.store.On("Version", "bacon").Return(uint64(0), nil)
+	s.store.On("Get", "bacon").Return("", false, nil)
+
+	fmt.Fprintln(s.conn, "RENAME bacon cabbage")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR no such key")
+}
+
+func (s *sessionHandlerTestSuite) TestRename_SameKey() {
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+
+	fmt.Fprint(s.conn, "RENAME bacon bacon\nRENAMENX bacon bacon\n")
+
+	s.handleLines(2)
+	s.responded("+OK\n:0")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestRename_RetriesConcurrentModification() {
+	s.store.On("Version", "bacon").Return(uint64(3), nil).Once()
+	s.store.On("Get", "bacon").Return("tasty", true, nil).Once()
+	s.store.On(
+		"Apply",
+		[]Write{{Key: "bacon", Delete: true}, {Key: "cabbage", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 3}},
+	).Return(ErrConditionFailed)
+
+	s.store.On("Version", "bacon").Return(uint64(4), nil).Once()
+	s.store.On("Get", "bacon").Return("crispy", true, nil).Once()
+	s.store.On(
+		"Apply",
+		[]Write{{Key: "bacon", Delete: true}, {Key: "cabbage", Value: "crispy"}},
+		[]Condition{{Key: "bacon", Version: 4}},
+	).Return(nil)
+
+	fmt.Fprintln(s.conn, "RENAME bacon cabbage")
+
+	s.True(s.sut.handleLine())
+	s.responded("+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestRename_StoreError() {
+	s.store.On("Version", "bacon").Return(uint64(0), errors.New("store error"))
+
+	fmt.Fprintln(s.conn, "RENAME bacon cabbage")
+
+	s.False(s.sut.handleLine())
+	s.loggedError("Could not handle command RENAME bacon cabbage: could not read version from the store: store error")
+}
+
+func (s *sessionHandlerTestSuite) TestRenameNX() {
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On("Version", "cabbage").Return(uint64(2), nil)
+	s.store.On("Get", "cabbage").Return("", false, nil)
+	s.store.On(
+		"Apply",
+		[]Write{{Key: "bacon", Delete: true}, {Key: "cabbage", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 3}, {Key: "cabbage", Version: 2}},
+	).Return(nil)
+
+	fmt.Fprintln(s.conn, "RENAMENX bacon cabbage")
+
+	s.True(s.sut.handleLine())
+	s.responded(":1")
+}
+
+func (s *sessionHandlerTestSuite) TestRenameNX_DestinationExists() {
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On("Version", "cabbage").Return(uint64(1), nil)
+	s.store.On("Get", "cabbage").Return("healthy", true, nil)
+
+	fmt.Fprintln(s.conn, "RENAMENX bacon cabbage")
+
+	s.True(s.sut.handleLine())
+	s.responded(":0")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestCopy() {
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On("Version", "cabbage").Return(uint64(0), nil)
+	s.store.On("Get", "cabbage").Return("", false, nil)
+	s.store.On(
+		"Apply",
+		[]Write{{Key: "cabbage", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 3}, {Key: "cabbage", Version: 0}},
+	).Return(nil)
+
+	fmt.Fprintln(s.conn, "COPY bacon cabbage DB 0")
+
+	s.True(s.sut.handleLine())
+	s.responded(":1")
+}
+
+func (s *sessionHandlerTestSuite) TestCopy_Replace() {
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On(
+		"Apply",
+		[]Write{{Key: "cabbage", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 3}},
+	).Return(nil)
+
+	fmt.Fprintln(s.conn, "COPY bacon cabbage REPLACE")
+
+	s.True(s.sut.handleLine())
+	s.responded(":1")
+	s.store.AssertNotCalled(s.T(), "Get", "cabbage")
+}
+
+func (s *sessionHandlerTestSuite) TestCopy_NotCopied() {
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On("Version", "cabbage").Return(uint64(1), nil)
+	s.store.On("Get", "cabbage").Return("healthy", true, nil)
+	s.store.On("Version", "eggs").Return(uint64(0), nil)
+	s.store.On("Get", "eggs").Return("", false, nil)
+
+	fmt.Fprint(s.conn, "COPY bacon cabbage\nCOPY eggs cabbage\n")
+
+	s.handleLines(2)
+	s.responded(":0\n:0")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestCopy_Invalid() {
+	fmt.Fprint(s.conn, "COPY bacon bacon\nCOPY bacon cabbage DB\nCOPY bacon cabbage DB one\nCOPY bacon cabbage DB 16\nCOPY bacon cabbage NOW\n")
+
+	s.handleLines(5)
+	s.responded(
+		"-ERR source and destination objects are the same\n" +
+			"-ERR syntax error\n" +
+			"-ERR value is not an integer or out of range\n" +
+			"-ERR DB index is out of range\n" +
+			"-ERR syntax error",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestType() {
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On("Get", "cabbage").Return("", false, nil)
+
+	fmt.Fprint(s.conn, "TYPE bacon\nTYPE cabbage\n")
+
+	s.handleLines(2)
+	s.responded("+string\n+none")
+}
+
+func (s *sessionHandlerTestSuite) TestTouch() {
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On("Get", "cabbage").Return("", false, nil)
+
+	fmt.Fprintln(s.conn, "TOUCH bacon cabbage bacon")
+
+	s.True(s.sut.handleLine())
+	s.responded(":2")
+	s.Contains(s.server.access.shard("bacon").keys, "bacon")
+	s.NotContains(s.server.access.shard("cabbage").keys, "cabbage")
+}
+
+func (s *sessionHandlerTestSuite) TestObject() {
+	now := time.Now()
+	s.server.access.now = func() time.Time { return now }
+
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On("Get", "number").Return("-42", true, nil)
+	s.store.On("Get", "padded").Return("042", true, nil)
+	s.store.On("Get", "long").Return(strings.Repeat("x", 45), true, nil)
+	s.store.On("Get", "cabbage").Return("", false, nil)
+
+	fmt.Fprint(s.conn, "GET bacon\n")
+	s.True(s.sut.handleLine())
+	s.buffer.Reset()
+
+	now = now.Add(90 * time.Second)
+
+	fmt.Fprint(s.conn, strings.Join([]string{
+		"OBJECT ENCODING bacon",
+		"OBJECT ENCODING number",
+		"OBJECT ENCODING padded",
+		"OBJECT ENCODING long",
+		"OBJECT IDLETIME bacon",
+		"OBJECT FREQ bacon",
+		"OBJECT REFCOUNT bacon",
+		"OBJECT IDLETIME cabbage",
+		"",
+	}, "\n"))
+
+	s.handleLines(8)
+	s.responded("$6\nembstr\n$3\nint\n$6\nembstr\n$3\nraw\n:90\n:5\n:1\n$-1")
+}
+
+func (s *sessionHandlerTestSuite) TestObject_Invalid() {
+	fmt.Fprint(s.conn, "OBJECT SIZE bacon\nOBJECT FREQ\n")
+
+	s.handleLines(2)
+	s.responded("-ERR unknown subcommand 'SIZE'\n-ERR wrong number of arguments for 'object|freq' command")
+}
+
+func (s *sessionHandlerTestSuite) TestDump() {
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On("Get", "cabbage").Return("", false, nil)
+
+	fmt.Fprint(s.conn, "DUMP bacon\nDUMP cabbage\n")
+
+	s.handleLines(2)
+	s.responded(bulkString(dumpString("tasty")) + "$-1")
+}
+
+func (s *sessionHandlerTestSuite) TestRestore() {
+	now := time.Now()
+	s.server.access.now = func() time.Time { return now }
+
+	s.store.On("Version", "bacon").Return(uint64(2), nil)
+	s.store.On("Get", "bacon").Return("", false, nil)
+	s.store.On("Apply", []Write{{Key: "bacon", Value: "tasty"}}, []Condition{{Key: "bacon", Version: 2}}).Return(nil)
+
+	s.Require().NoError(s.sut.dispatch([]string{"RESTORE", "bacon", "0", dumpString("tasty"), "IDLETIME", "60"}))
+	s.responded("+OK")
+
+	idle, _ := s.server.access.lookup("bacon")
+	s.Equal(time.Minute, idle)
+}
+
+func (s *sessionHandlerTestSuite) TestRestore_Replace() {
+	s.store.On("Apply", []Write{{Key: "bacon", Value: "tasty"}}, []Condition(nil)).Return(nil)
+
+	s.Require().NoError(s.sut.dispatch([]string{"RESTORE", "bacon", "0", dumpString("tasty"), "REPLACE", "FREQ", "42"}))
+	s.responded("+OK")
+
+	_, frequency := s.server.access.lookup("bacon")
+	s.Equal(uint8(42), frequency)
+}
+
+func (s *sessionHandlerTestSuite) TestRestore_BusyKey() {
+	s.store.On("Version", "bacon").Return(uint64(2), nil)
+	s.store.On("Get", "bacon").Return("crispy", true, nil)
+
+	s.Require().NoError(s.sut.dispatch([]string{"RESTORE", "bacon", "0", dumpString("tasty")}))
+	s.responded("-BUSYKEY Target key name already exists.")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestRestore_Expired() {
+	s.store.On("Apply", []Write{{Key: "bacon", Value: "tasty", Delete: true}}, []Condition(nil)).Return(nil)
+
+	s.Require().NoError(s.sut.dispatch([]string{"RESTORE", "bacon", "1000", dumpString("tasty"), "ABSTTL", "REPLACE"}))
+	s.responded("+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestRestore_FutureTTL() {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond), 10)
+
+	for _, args := range [][]string{
+		{"RESTORE", "bacon", "1000", dumpString("tasty"), "IDLETIME", "60"},
+		{"RESTORE", "bacon", future, dumpString("tasty"), "ABSTTL", "REPLACE"},
+	} {
+		s.Require().NoError(s.sut.dispatch(args))
+	}
+
+	message := "-ERR key expiration is not supported, TTL must be 0 or an ABSTTL which has passed"
+	s.responded(message + "\n" + message)
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestRestore_HugeLZFLength() {
+	// An LZF string claiming to decompress to 2^63-1 bytes.
+	payload := string(sealRDBPayload([]byte{
+		0xc3, 0x01, 0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00,
+	}))
+
+	s.Require().NoError(s.sut.dispatch([]string{"RESTORE", "bacon", "0", payload}))
+	s.responded("-ERR Bad data format")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestRestore_Invalid() {
+	payload := dumpString("tasty")
+
+	for _, args := range [][]string{
+		{"RESTORE", "bacon", "soon", payload},
+		{"RESTORE", "bacon", "-1", payload},
+		{"RESTORE", "bacon", "1000", payload},
+		{"RESTORE", "bacon", "0", payload, "IDLETIME"},
+		{"RESTORE", "bacon", "0", payload, "IDLETIME", "-1"},
+		{"RESTORE", "bacon", "0", payload, "FREQ", "256"},
+		{"RESTORE", "bacon", "0", payload, "NOW"},
+		{"RESTORE", "bacon", "0", "garbage"},
+	} {
+		s.Require().NoError(s.sut.dispatch(args))
+	}
+
+	s.responded(
+		"-ERR value is not an integer or out of range\n" +
+			"-ERR Invalid TTL value, must be >= 0\n" +
+			"-ERR key expiration is not supported, TTL must be 0 or an ABSTTL which has passed\n" +
+			"-ERR syntax error\n" +
+			"-ERR Invalid IDLETIME value, must be >= 0\n" +
+			"-ERR Invalid FREQ value, must be >= 0 and <= 255\n" +
+			"-ERR syntax error\n" +
+			"-ERR DUMP payload version or checksum are wrong",
+	)
+}
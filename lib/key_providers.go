@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/pkg/errors"
+)
+
+// dataKeySize is the size of data keys, for AES-256.
+const dataKeySize = 32
+
+// DefaultKMSTimeout is how long KMS is given to respond, unless configured
+// otherwise.
+const DefaultKMSTimeout = time.Second
+
+// DataKey is a key values are encrypted with, along with the same key
+// encrypted with a master key, which is what's stored next to the values.
+type DataKey struct {
+	// KeyID identifies the master key the data key is encrypted with.
+	KeyID     string
+	Plaintext []byte
+	Encrypted []byte
+}
+
+// KeyProvider generates data keys, encrypted with the current master key, and
+// decrypts the data keys it has generated, with whichever master key they
+// were encrypted with, so that master keys can be rotated.
+type KeyProvider interface {
+	GenerateDataKey() (DataKey, error)
+	DecryptDataKey(keyID string, encrypted []byte) ([]byte, error)
+}
+
+// Keyring is a KeyProvider holding the master keys itself, meant for
+// development and testing.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// keyringFile is the format of keyring files, with base64 encoded keys.
+type keyringFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// NewKeyring returns a Keyring encrypting data keys with the current master
+// key, and decrypting them with any of them. Master keys are AES keys of 16,
+// 24 or 32 bytes.
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	if _, exists := keys[current]; !exists {
+		return nil, errors.Errorf("current master key %q not in keyring", current)
+	}
+
+	ret := &Keyring{current: current, keys: make(map[string]cipher.AEAD)}
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid master key %q", id)
+		}
+		ret.keys[id] = aead
+	}
+	return ret, nil
+}
+
+// LoadKeyring reads a keyring file, a JSON object naming the current master
+// key and holding all of them, base64 encoded:
+//
+//	{"current": "2", "keys": {"1": "...", "2": "..."}}
+func LoadKeyring(path string) (*Keyring, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read keyring")
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, errors.Wrap(err, "malformed keyring")
+	}
+
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		if keys[id], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, errors.Wrapf(err, "malformed master key %q", id)
+		}
+	}
+
+	return NewKeyring(file.Current, keys)
+}
+
+// GenerateDataKey is a Keyring implementation of the KeyProvider's
+// GenerateDataKey method.
+func (k *Keyring) GenerateDataKey() (DataKey, error) {
+	plaintext, err := randomBytes(dataKeySize)
+	if err != nil {
+		return DataKey{}, errors.Wrap(err, "could not generate data key")
+	}
+
+	nonce, err := randomBytes(k.keys[k.current].NonceSize())
+	if err != nil {
+		return DataKey{}, errors.Wrap(err, "could not generate data key")
+	}
+
+	return DataKey{
+		KeyID:     k.current,
+		Plaintext: plaintext,
+		Encrypted: k.keys[k.current].Seal(nonce, nonce, plaintext, []byte(k.current)),
+	}, nil
+}
+
+// DecryptDataKey is a Keyring implementation of the KeyProvider's
+// DecryptDataKey method.
+func (k *Keyring) DecryptDataKey(keyID string, encrypted []byte) ([]byte, error) {
+	aead, exists := k.keys[keyID]
+	if !exists {
+		return nil, errors.Errorf("master key %q not in keyring", keyID)
+	} else if len(encrypted) < aead.NonceSize() {
+		return nil, errors.New("malformed data key")
+	}
+
+	nonce, sealed := encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():]
+	ret, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	return ret, errors.Wrap(err, "could not decrypt data key")
+}
+
+// KMSKeyProvider is a KeyProvider backed by AWS KMS, which keeps the master
+// key to itself, and rotates it as configured there.
+type KMSKeyProvider struct {
+	API kmsiface.KMSAPI
+
+	// KeyID is the master key new data keys are encrypted with, as a key ID,
+	// an ARN or an alias.
+	KeyID string
+
+	// Timeout limits how long each request may take, with zero meaning the
+	// default.
+	Timeout time.Duration
+}
+
+// GenerateDataKey is a KMS implementation of the KeyProvider's
+// GenerateDataKey method.
+func (k *KMSKeyProvider) GenerateDataKey() (DataKey, error) {
+	ctx, cancel := k.context()
+	defer cancel()
+
+	out, err := k.API.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.KeyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return DataKey{}, errors.Wrap(err, "could not generate data key")
+	}
+
+	// The key is identified by its ARN, so that it's decrypted with the same
+	// key even once an alias points at another one.
+	return DataKey{
+		KeyID:     aws.StringValue(out.KeyId),
+		Plaintext: out.Plaintext,
+		Encrypted: out.CiphertextBlob,
+	}, nil
+}
+
+// DecryptDataKey is a KMS implementation of the KeyProvider's DecryptDataKey
+// method.
+func (k *KMSKeyProvider) DecryptDataKey(keyID string, encrypted []byte) ([]byte, error) {
+	ctx, cancel := k.context()
+	defer cancel()
+
+	out, err := k.API.DecryptWithContext(ctx, &kms.DecryptInput{
+		CiphertextBlob: encrypted,
+		KeyId:          aws.String(keyID),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt data key")
+	}
+	return out.Plaintext, nil
+}
+
+func (k *KMSKeyProvider) context() (context.Context, context.CancelFunc) {
+	timeout := k.Timeout
+	if timeout <= 0 {
+		timeout = DefaultKMSTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(size int) ([]byte, error) {
+	ret := make([]byte, size)
+	_, err := rand.Read(ret)
+	return ret, err
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeKMS "encrypts" data keys by prefixing them with the key ID.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+
+	err error
+}
+
+func (f *fakeKMS) GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	plaintext := bytes.Repeat([]byte("k"), 32)
+	return &kms.GenerateDataKeyOutput{
+		CiphertextBlob: append([]byte(*input.KeyId+":"), plaintext...),
+		KeyId:          aws.String("arn:" + *input.KeyId),
+		Plaintext:      plaintext,
+	}, nil
+}
+
+func (f *fakeKMS) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	prefix := []byte((*input.KeyId)[len("arn:"):] + ":")
+	if !bytes.HasPrefix(input.CiphertextBlob, prefix) {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return &kms.DecryptOutput{KeyId: input.KeyId, Plaintext: input.CiphertextBlob[len(prefix):]}, nil
+}
+
+type keyProvidersTestSuite struct {
+	suite.Suite
+
+	dir string
+}
+
+func (k *keyProvidersTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "keyring")
+	k.Require().NoError(err)
+	k.dir = dir
+}
+
+func (k *keyProvidersTestSuite) TearDownTest() {
+	os.RemoveAll(k.dir)
+}
+
+func (k *keyProvidersTestSuite) TestKeyring() {
+	keyring, err := NewKeyring("2", map[string][]byte{
+		"1": bytes.Repeat([]byte("1"), 32),
+		"2": bytes.Repeat([]byte("2"), 16),
+	})
+	k.Require().NoError(err)
+
+	key, err := keyring.GenerateDataKey()
+	k.Require().NoError(err)
+	k.Equal("2", key.KeyID)
+	k.Len(key.Plaintext, 32)
+	k.NotContains(string(key.Encrypted), string(key.Plaintext))
+
+	plaintext, err := keyring.DecryptDataKey("2", key.Encrypted)
+	k.Equal(key.Plaintext, plaintext)
+	k.NoError(err)
+
+	_, err = keyring.DecryptDataKey("1", key.Encrypted)
+	k.EqualError(err, "could not decrypt data key: cipher: message authentication failed")
+
+	_, err = keyring.DecryptDataKey("3", key.Encrypted)
+	k.EqualError(err, `master key "3" not in keyring`)
+}
+
+func (k *keyProvidersTestSuite) TestNewKeyring_Invalid() {
+	_, err := NewKeyring("2", map[string][]byte{"1": bytes.Repeat([]byte("1"), 32)})
+	k.EqualError(err, `current master key "2" not in keyring`)
+
+	_, err = NewKeyring("1", map[string][]byte{"1": []byte("bacon")})
+	k.EqualError(err, `invalid master key "1": crypto/aes: invalid key size 5`)
+}
+
+func (k *keyProvidersTestSuite) TestLoadKeyring() {
+	path := filepath.Join(k.dir, "keyring.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("1"), 32))
+	k.Require().NoError(ioutil.WriteFile(path, []byte(`{"current": "1", "keys": {"1": "`+key+`"}}`), 0600))
+
+	keyring, err := LoadKeyring(path)
+	k.Require().NoError(err)
+
+	dataKey, err := keyring.GenerateDataKey()
+	k.Require().NoError(err)
+	k.Equal("1", dataKey.KeyID)
+}
+
+func (k *keyProvidersTestSuite) TestLoadKeyring_Malformed() {
+	path := filepath.Join(k.dir, "keyring.json")
+	k.Require().NoError(ioutil.WriteFile(path, []byte(`{"current": "1", "keys": {"1": "!"}}`), 0600))
+
+	_, err := LoadKeyring(path)
+	k.EqualError(err, `malformed master key "1": illegal base64 data at input byte 0`)
+}
+
+func (k *keyProvidersTestSuite) TestKMS() {
+	provider := &KMSKeyProvider{API: new(fakeKMS), KeyID: "alias/bacon"}
+
+	key, err := provider.GenerateDataKey()
+	k.Require().NoError(err)
+	k.Equal("arn:alias/bacon", key.KeyID)
+
+	plaintext, err := provider.DecryptDataKey(key.KeyID, key.Encrypted)
+	k.Equal(key.Plaintext, plaintext)
+	k.NoError(err)
+}
+
+func (k *keyProvidersTestSuite) TestKMS_Error() {
+	provider := &KMSKeyProvider{API: &fakeKMS{err: errors.New("AccessDeniedException")}, KeyID: "alias/bacon"}
+
+	_, err := provider.GenerateDataKey()
+	k.EqualError(err, "could not generate data key: AccessDeniedException")
+
+	_, err = provider.DecryptDataKey("arn:alias/bacon", []byte("bacon"))
+	k.EqualError(err, "could not decrypt data key: AccessDeniedException")
+}
+
+func TestKeyProviders(t *testing.T) {
+	suite.Run(t, new(keyProvidersTestSuite))
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultScanCount is the number of keys SCAN asks for unless told
+	// otherwise, as in Redis.
+	defaultScanCount = 10
+
+	// keyspacePageSize is the number of keys requested at a time when
+	// iterating over the whole keyspace.
+	keyspacePageSize = 1000
+)
+
+// keyTypes are the types SCAN can filter keys by. All values in goredis are
+// strings, so filtering by any other type returns no keys.
+var keyTypes = map[string]bool{
+	"hash":   true,
+	"list":   true,
+	"set":    true,
+	"stream": true,
+	"string": true,
+	"zset":   true,
+}
+
+func internalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix)
+}
+
+// forEachKey calls the function for every key visible to clients.
+func (s *SessionHandler) forEachKey(fn func(key string)) error {
+	var cursor string
+	for {
+		keys, next, err := s.store.Scan(cursor, keyspacePageSize)
+		if err != nil {
+			return errors.Wrap(err, "could not scan the store")
+		}
+
+		for _, key := range keys {
+			if !internalKey(key) {
+				fn(key)
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// handleScan returns a single page of keys. As in Redis, MATCH and TYPE are
+// applied after retrieving the page, so fewer keys than COUNT, or none at
+// all, may be returned before the iteration is complete.
+func (s *SessionHandler) handleScan(args []string) error {
+	cursor, valid := decodeScanCursor(args[0])
+	if !valid {
+		_, err := fmt.Fprintln(s.writer, "-ERR invalid cursor")
+		return err
+	}
+
+	count, pattern, keyType := defaultScanCount, "", ""
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			_, err := fmt.Fprintln(s.writer, "-ERR syntax error")
+			return err
+		}
+
+		switch value := args[i+1]; strings.ToLower(args[i]) {
+		case "match":
+			pattern = value
+		case "count":
+			var err error
+			if count, err = strconv.Atoi(value); err != nil {
+				_, err := fmt.Fprintln(s.writer, "-ERR value is not an integer or out of range")
+				return err
+			} else if count < 1 {
+				_, err := fmt.Fprintln(s.writer, "-ERR syntax error")
+				return err
+			}
+		case "type":
+			if keyType = strings.ToLower(value); !keyTypes[keyType] {
+				_, err := fmt.Fprintf(s.writer, "-ERR unknown type name '%s'\n", value)
+				return err
+			}
+		default:
+			_, err := fmt.Fprintln(s.writer, "-ERR syntax error")
+			return err
+		}
+	}
+
+	keys, next, err := s.store.Scan(cursor, count)
+	if errors.Cause(err) == ErrMalformedCursor {
+		_, err := fmt.Fprintln(s.writer, "-ERR invalid cursor")
+		return err
+	} else if err != nil {
+		return errors.Wrap(err, "could not scan the store")
+	}
+
+	var matching []string
+	for _, key := range keys {
+		if internalKey(key) || (keyType != "" && keyType != "string") {
+			continue
+		}
+
+		if pattern == "" || globMatch(pattern, key, false) {
+			matching = append(matching, key)
+		}
+	}
+
+	reply := arrayHeader(2) + bulkString(encodeScanCursor(next)) + arrayHeader(len(matching))
+	for _, key := range matching {
+		reply += bulkString(key)
+	}
+
+	_, err = io.WriteString(s.writer, reply)
+	return err
+}
+
+func (s *SessionHandler) handleKeys(args []string) error {
+	var keys []string
+	err := s.forEachKey(func(key string) {
+		if globMatch(args[0], key, false) {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	reply := arrayHeader(len(keys))
+	for _, key := range keys {
+		reply += bulkString(key)
+	}
+
+	_, err = io.WriteString(s.writer, reply)
+	return err
+}
+
+func (s *SessionHandler) handleDBSize(args []string) error {
+	var size int
+	if err := s.forEachKey(func(string) { size++ }); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(s.writer, integer(size))
+	return err
+}
+
+// handleRandomKey picks a key using reservoir sampling. Unlike in Redis this
+// takes a walk over the whole keyspace, since stores can't seek to a random
+// position.
+func (s *SessionHandler) handleRandomKey(args []string) error {
+	var chosen string
+	var seen int
+
+	err := s.forEachKey(func(key string) {
+		if seen++; rand.Intn(seen) == 0 {
+			chosen = key
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if seen == 0 {
+		_, err := io.WriteString(s.writer, nullBulkString)
+		return err
+	}
+
+	_, err = io.WriteString(s.writer, bulkString(chosen))
+	return err
+}
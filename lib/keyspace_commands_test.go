@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+func (s *sessionHandlerTestSuite) TestScan() {
+	s.store.On("Scan", "", 10).Return([]string{"bacon", functionsKey, "cabbage"}, "next", nil)
+	s.store.On("Scan", "next", 10).Return([]string{"eggs"}, "", nil)
+
+	fmt.Fprint(s.conn, "SCAN 0\nSCAN bmV4dA\n")
+
+	s.handleLines(2)
+	s.responded("*2\n$6\nbmV4dA\n*2\n$5\nbacon\n$7\ncabbage\n*2\n$1\n0\n*1\n$4\neggs")
+}
+
+func (s *sessionHandlerTestSuite) TestScan_Options() {
+	s.store.On("Scan", "", 3).Return([]string{"bacon", "cabbage", "beans"}, "", nil)
+
+	fmt.Fprint(s.conn, "SCAN 0 MATCH b* COUNT 3\nSCAN 0 COUNT 3 TYPE hash\nSCAN 0 TYPE STRING COUNT 3 MATCH *e*\n")
+
+	s.handleLines(3)
+	s.responded(
+		"*2\n$1\n0\n*2\n$5\nbacon\n$5\nbeans\n" +
+			"*2\n$1\n0\n*0\n" +
+			"*2\n$1\n0\n*2\n$7\ncabbage\n$5\nbeans",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestScan_AcrossSessions() {
+	store := s.withInMemoryStore()
+	for i := 0; i < 200; i++ {
+		s.Require().NoError(store.Set(fmt.Sprintf("key:%d", i), "x"))
+	}
+
+	// Every page is scanned in a session of its own, as when clients take
+	// connections from a pool, or are balanced across nodes.
+	scanned := make(map[string]bool)
+	for cursor := "0"; ; {
+		buffer := bytes.NewBuffer(nil)
+		session := NewSessionHandler(&mockReadWriteCloser{ReadWriter: buffer}, logrus.NewEntry(logrus.New()), s.server)
+		s.Require().NoError(session.dispatch([]string{"SCAN", cursor, "COUNT", "7"}))
+
+		reply, err := readReply(bufio.NewReader(buffer))
+		s.Require().NoError(err)
+		s.Require().IsType([]interface{}{}, reply, "%v", reply)
+
+		for _, key := range reply.([]interface{})[1].([]interface{}) {
+			scanned[key.(string)] = true
+		}
+		if cursor = reply.([]interface{})[0].(string); cursor == "0" {
+			break
+		}
+	}
+	s.Len(scanned, 200)
+}
+
+func (s *sessionHandlerTestSuite) TestScan_Invalid() {
+	fmt.Fprint(s.conn, "SCAN bacon!\nSCAN 0 COUNT\nSCAN 0 COUNT 0\nSCAN 0 COUNT many\nSCAN 0 TYPE bacon\nSCAN 0 ORDER asc\n")
+
+	s.handleLines(6)
+	s.responded(
+		"-ERR invalid cursor\n" +
+			"-ERR syntax error\n" +
+			"-ERR syntax error\n" +
+			"-ERR value is not an integer or out of range\n" +
+			"-ERR unknown type name 'bacon'\n" +
+			"-ERR syntax error",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestScan_MalformedCursor() {
+	s.store.On("Scan", "bacon", 10).Return([]string(nil), "", ErrMalformedCursor)
+
+	fmt.Fprintln(s.conn, "SCAN YmFjb24")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR invalid cursor")
+}
+
+func (s *sessionHandlerTestSuite) TestScan_StoreError() {
+	s.store.On("Scan", "", 10).Return([]string(nil), "", errors.New("store error"))
+
+	fmt.Fprintln(s.conn, "SCAN 0")
+
+	s.False(s.sut.handleLine())
+	s.loggedError("Could not handle command SCAN 0: could not scan the store: store error")
+}
+
+func (s *sessionHandlerTestSuite) TestKeys() {
+	s.withKeys("bacon", functionsKey, "cabbage", "beans")
+
+	fmt.Fprintln(s.conn, "KEYS b*")
+
+	s.True(s.sut.handleLine())
+	s.responded("*2\n$5\nbacon\n$5\nbeans")
+}
+
+func (s *sessionHandlerTestSuite) TestDBSize() {
+	s.withKeys("bacon", functionsKey, "cabbage", "beans")
+
+	fmt.Fprintln(s.conn, "DBSIZE")
+
+	s.True(s.sut.handleLine())
+	s.responded(":3")
+}
+
+func (s *sessionHandlerTestSuite) TestRandomKey() {
+	s.withKeys(functionsKey, "bacon")
+
+	fmt.Fprintln(s.conn, "RANDOMKEY")
+
+	s.True(s.sut.handleLine())
+	s.responded("$5\nbacon")
+}
+
+func (s *sessionHandlerTestSuite) TestRandomKey_Empty() {
+	s.withKeys(functionsKey)
+
+	fmt.Fprintln(s.conn, "RANDOMKEY")
+
+	s.True(s.sut.handleLine())
+	s.responded("$-1")
+}
+
+// withKeys makes the store return the keys one page at a time.
+func (s *sessionHandlerTestSuite) withKeys(keys ...string) {
+	cursor := ""
+	for i, key := range keys {
+		next := fmt.Sprintf("after-%d", i)
+		if i == len(keys)-1 {
+			next = ""
+		}
+
+		s.store.On("Scan", cursor, keyspacePageSize).Return([]string{key}, next, nil)
+		cursor = next
+	}
+}
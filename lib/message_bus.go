@@ -0,0 +1,79 @@
+package lib
+
+import "sync"
+
+// MessageBus fans pub/sub messages out between goredis nodes, so that a
+// PUBLISH on one node reaches subscribers connected to any other node.
+type MessageBus interface {
+	// Broadcast sends a message published locally to all other nodes.
+	Broadcast(channel, message string) error
+
+	// Listen registers a function to be called for every message published
+	// on another node. It is called once, before any messages are broadcast.
+	Listen(deliver func(channel, message string))
+
+	// Close disconnects from the bus.
+	Close() error
+}
+
+// InProcessBus connects nodes living in the same process, which is mostly
+// useful for testing multi-node setups.
+type InProcessBus struct {
+	nodes []*inProcessNode
+	lock  *sync.RWMutex
+}
+
+// NewInProcessBus returns an InProcessBus with no nodes.
+func NewInProcessBus() *InProcessBus {
+	return &InProcessBus{lock: new(sync.RWMutex)}
+}
+
+// Node returns a new MessageBus endpoint connected to all other endpoints
+// of this bus.
+func (b *InProcessBus) Node() MessageBus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	node := &inProcessNode{bus: b}
+	b.nodes = append(b.nodes, node)
+	return node
+}
+
+type inProcessNode struct {
+	bus     *InProcessBus
+	deliver func(channel, message string)
+}
+
+func (n *inProcessNode) Broadcast(channel, message string) error {
+	n.bus.lock.RLock()
+	defer n.bus.lock.RUnlock()
+
+	for _, node := range n.bus.nodes {
+		if node != n && node.deliver != nil {
+			node.deliver(channel, message)
+		}
+	}
+
+	return nil
+}
+
+func (n *inProcessNode) Listen(deliver func(channel, message string)) {
+	n.bus.lock.Lock()
+	defer n.bus.lock.Unlock()
+
+	n.deliver = deliver
+}
+
+func (n *inProcessNode) Close() error {
+	n.bus.lock.Lock()
+	defer n.bus.lock.Unlock()
+
+	for i, node := range n.bus.nodes {
+		if node == n {
+			n.bus.nodes = append(n.bus.nodes[:i], n.bus.nodes[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
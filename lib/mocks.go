@@ -25,6 +25,66 @@ func (m *mockDynamo) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItem
 	return args.Get(0).(*dynamodb.PutItemOutput), args.Error(1)
 }
 
+func (m *mockDynamo) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	args := m.Called(ctx, input, opts)
+	return args.Get(0).(*dynamodb.DeleteItemOutput), args.Error(1)
+}
+
+func (m *mockDynamo) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(ctx, input, opts)
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func (m *mockDynamo) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	args := m.Called(ctx, input, opts)
+	return args.Get(0).(*dynamodb.TransactWriteItemsOutput), args.Error(1)
+}
+
+func (m *mockDynamo) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	args := m.Called(ctx, input, opts)
+	return args.Get(0).(*dynamodb.ScanOutput), args.Error(1)
+}
+
+func (m *mockDynamo) DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	args := m.Called(ctx, input, opts)
+	return args.Get(0).(*dynamodb.DescribeTableOutput), args.Error(1)
+}
+
+func (m *mockDynamo) CreateTableWithContext(ctx aws.Context, input *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	args := m.Called(ctx, input, opts)
+	return args.Get(0).(*dynamodb.CreateTableOutput), args.Error(1)
+}
+
+func (m *mockDynamo) DescribeTimeToLiveWithContext(ctx aws.Context, input *dynamodb.DescribeTimeToLiveInput, opts ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	args := m.Called(ctx, input, opts)
+	return args.Get(0).(*dynamodb.DescribeTimeToLiveOutput), args.Error(1)
+}
+
+func (m *mockDynamo) UpdateTimeToLiveWithContext(ctx aws.Context, input *dynamodb.UpdateTimeToLiveInput, opts ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	args := m.Called(ctx, input, opts)
+	return args.Get(0).(*dynamodb.UpdateTimeToLiveOutput), args.Error(1)
+}
+
+func (m *mockDynamo) WaitUntilTableExistsWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.WaiterOption) error {
+	return m.Called(ctx, input, opts).Error(0)
+}
+
+type mockMessageBus struct {
+	mock.Mock
+}
+
+func (m *mockMessageBus) Broadcast(channel, message string) error {
+	return m.Called(channel, message).Error(0)
+}
+
+func (m *mockMessageBus) Listen(deliver func(channel, message string)) {
+	m.Called(deliver)
+}
+
+func (m *mockMessageBus) Close() error {
+	return m.Called().Error(0)
+}
+
 type mockReadWriteCloser struct {
 	io.ReadWriter
 	mock.Mock
@@ -46,3 +106,17 @@ func (m *mockStore) Get(key string) (value string, found bool, err error) {
 func (m *mockStore) Set(key string, value string) error {
 	return m.Called(key, value).Error(0)
 }
+
+func (m *mockStore) Version(key string) (uint64, error) {
+	args := m.Called(key)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *mockStore) Apply(writes []Write, conditions []Condition) error {
+	return m.Called(writes, conditions).Error(0)
+}
+
+func (m *mockStore) Scan(cursor string, count int) (keys []string, next string, err error) {
+	args := m.Called(cursor, count)
+	return args.Get(0).([]string), args.String(1), args.Error(2)
+}
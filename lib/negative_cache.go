@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultNegativeCacheSize is how many missing keys a CachingStore
+	// remembers by default.
+	DefaultNegativeCacheSize = 100000
+
+	// DefaultNegativeCacheTTL is how long a CachingStore remembers a key as
+	// missing by default. It bounds how long a key written through another
+	// node sharing the authority can appear to be missing.
+	DefaultNegativeCacheTTL = 30 * time.Second
+
+	// negativeCacheBuckets is the number of buckets keys are hashed into,
+	// each counting removals of its own keys, so that writes of other keys
+	// rarely keep one from being added.
+	negativeCacheBuckets = 1024
+)
+
+type negativeEntry struct {
+	key     string
+	expires time.Time
+}
+
+// NegativeCache remembers keys known to be missing from the authority, so
+// that looking them up again does not have to reach it. It's safe for
+// concurrent use. Keys are forgotten once they expire, or when room is needed
+// for newer ones, oldest first.
+type NegativeCache struct {
+	maxKeys int
+	ttl     time.Duration
+
+	// Keys are ordered by expiration time, which is the same as the order
+	// they were added in, since they all live for the same time.
+	order *list.List
+	keys  map[string]*list.Element
+
+	// generations count removals of the keys in each bucket, so that a
+	// lookup which started before a key was written can tell not to mark it
+	// missing afterwards.
+	generations [negativeCacheBuckets]uint64
+
+	now  func() time.Time
+	lock *sync.Mutex
+}
+
+// NewNegativeCache returns a NegativeCache holding up to maxKeys keys, each
+// for up to ttl.
+func NewNegativeCache(maxKeys int, ttl time.Duration) *NegativeCache {
+	return &NegativeCache{
+		maxKeys: maxKeys,
+		ttl:     ttl,
+		order:   list.New(),
+		keys:    make(map[string]*list.Element),
+		now:     time.Now,
+		lock:    new(sync.Mutex),
+	}
+}
+
+// Contains reports whether the key is known to be missing.
+func (n *NegativeCache) Contains(key string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.expire()
+	_, exists := n.keys[key]
+	return exists
+}
+
+// Generation returns the current generation of the key, to be passed to Add
+// once the key is found to be missing.
+func (n *NegativeCache) Generation(key string) uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.generations[negativeCacheBucket(key)]
+}
+
+// Add marks the key as missing, unless it, or another key in the same bucket,
+// was removed since the given generation, in which case the key may have been
+// written in the meantime. It reports whether the key was added.
+func (n *NegativeCache) Add(key string, generation uint64) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if generation != n.generations[negativeCacheBucket(key)] || n.maxKeys < 1 || n.ttl <= 0 {
+		return false
+	}
+
+	n.forget(key)
+
+	n.keys[key] = n.order.PushBack(&negativeEntry{key: key, expires: n.now().Add(n.ttl)})
+	for n.order.Len() > n.maxKeys {
+		n.forget(n.order.Front().Value.(*negativeEntry).key)
+	}
+	n.expire()
+	return true
+}
+
+// Remove forgets the key, as it's about to be written.
+func (n *NegativeCache) Remove(key string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.generations[negativeCacheBucket(key)]++
+	n.forget(key)
+}
+
+// Clear forgets all keys.
+func (n *NegativeCache) Clear() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for bucket := range n.generations {
+		n.generations[bucket]++
+	}
+	n.order.Init()
+	n.keys = make(map[string]*list.Element)
+}
+
+// Len returns the number of keys known to be missing.
+func (n *NegativeCache) Len() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.expire()
+	return n.order.Len()
+}
+
+// expire must be called with the lock held.
+func (n *NegativeCache) expire() {
+	now := n.now()
+	for front := n.order.Front(); front != nil; front = n.order.Front() {
+		entry := front.Value.(*negativeEntry)
+		if now.Before(entry.expires) {
+			return
+		}
+		n.forget(entry.key)
+	}
+}
+
+// forget must be called with the lock held.
+func (n *NegativeCache) forget(key string) {
+	if element, exists := n.keys[key]; exists {
+		n.order.Remove(element)
+		delete(n.keys, key)
+	}
+}
+
+func negativeCacheBucket(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32() % negativeCacheBuckets
+}
@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type negativeCacheTestSuite struct {
+	suite.Suite
+
+	now  time.Time
+	lock *sync.Mutex
+
+	sut *NegativeCache
+}
+
+func (n *negativeCacheTestSuite) SetupTest() {
+	n.now = time.Unix(1500000000, 0)
+	n.lock = new(sync.Mutex)
+
+	n.sut = NewNegativeCache(3, time.Minute)
+	n.sut.now = func() time.Time {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		return n.now
+	}
+}
+
+func (n *negativeCacheTestSuite) add(keys ...string) {
+	for _, key := range keys {
+		n.Require().True(n.sut.Add(key, n.sut.Generation(key)))
+	}
+}
+
+func (n *negativeCacheTestSuite) advance(by time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.now = n.now.Add(by)
+}
+
+func (n *negativeCacheTestSuite) TestAdd() {
+	n.add("bacon")
+
+	n.True(n.sut.Contains("bacon"))
+	n.False(n.sut.Contains("cabbage"))
+	n.Equal(1, n.sut.Len())
+}
+
+func (n *negativeCacheTestSuite) TestRemove() {
+	n.add("bacon", "cabbage")
+
+	n.sut.Remove("bacon")
+
+	n.False(n.sut.Contains("bacon"))
+	n.True(n.sut.Contains("cabbage"))
+}
+
+func (n *negativeCacheTestSuite) TestAdd_RemovedSince() {
+	generation := n.sut.Generation("bacon")
+	n.sut.Remove("bacon")
+
+	n.False(n.sut.Add("bacon", generation))
+	n.False(n.sut.Contains("bacon"))
+}
+
+func (n *negativeCacheTestSuite) TestAdd_OthersRemovedSince() {
+	generation := n.sut.Generation("bacon")
+	for i := 0; i < 100; i++ {
+		if key := fmt.Sprintf("cabbage%d", i); negativeCacheBucket(key) != negativeCacheBucket("bacon") {
+			n.sut.Remove(key)
+		}
+	}
+
+	n.True(n.sut.Add("bacon", generation))
+	n.True(n.sut.Contains("bacon"))
+}
+
+func (n *negativeCacheTestSuite) TestAdd_ClearedSince() {
+	generation := n.sut.Generation("bacon")
+	n.sut.Clear()
+
+	n.False(n.sut.Add("bacon", generation))
+}
+
+func (n *negativeCacheTestSuite) TestExpires() {
+	n.add("bacon")
+	n.advance(30 * time.Second)
+	n.add("cabbage")
+	n.advance(30 * time.Second)
+
+	n.False(n.sut.Contains("bacon"))
+	n.True(n.sut.Contains("cabbage"))
+	n.Equal(1, n.sut.Len())
+}
+
+func (n *negativeCacheTestSuite) TestReAddExtends() {
+	n.add("bacon")
+	n.advance(30 * time.Second)
+	n.add("bacon")
+	n.advance(45 * time.Second)
+
+	n.True(n.sut.Contains("bacon"))
+}
+
+func (n *negativeCacheTestSuite) TestBounded() {
+	n.add("bacon", "cabbage", "carrot", "potato")
+
+	n.False(n.sut.Contains("bacon"))
+	n.True(n.sut.Contains("potato"))
+	n.Equal(3, n.sut.Len())
+}
+
+func (n *negativeCacheTestSuite) TestDisabled() {
+	n.sut = NewNegativeCache(0, time.Minute)
+
+	n.False(n.sut.Add("bacon", n.sut.Generation("bacon")))
+	n.False(n.sut.Contains("bacon"))
+}
+
+func (n *negativeCacheTestSuite) TestConcurrentUse() {
+	n.sut = NewNegativeCache(50, time.Minute)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("key%d", (worker*i)%100)
+				switch i % 4 {
+				case 0:
+					n.sut.Add(key, n.sut.Generation(key))
+				case 1:
+					n.sut.Remove(key)
+				case 2:
+					n.sut.Contains(key)
+				case 3:
+					n.sut.Len()
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	n.True(n.sut.Len() <= 50)
+}
+
+// TestConcurrentCachingStore has sessions writing and reading the same keys
+// through a CachingStore, and checks that a key is never reported missing
+// once it's been written.
+func (n *negativeCacheTestSuite) TestConcurrentCachingStore() {
+	store := NewCachingStore(NewInMemoryStore(), NewInMemoryStore())
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%d", i%20)
+				if worker%2 == 0 {
+					n.NoError(store.Set(key, "tasty"))
+				} else {
+					_, _, err := store.Get(key)
+					n.NoError(err)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		_, found, err := store.Get(fmt.Sprintf("key%d", i))
+		n.True(found)
+		n.NoError(err)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	suite.Run(t, new(negativeCacheTestSuite))
+}
@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PubSub keeps track of channel and pattern subscriptions of all client
+// sessions, and delivers published messages to them. Once joined to a
+// MessageBus, it also exchanges messages with PubSubs on other nodes.
+type PubSub struct {
+	bus      MessageBus
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+	lock     *sync.RWMutex
+}
+
+// NewPubSub returns an empty PubSub.
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+		lock:     new(sync.RWMutex),
+	}
+}
+
+// subscriber is the pub/sub state of a single client session. Its channel and
+// pattern sets are only ever accessed from the session's own goroutine.
+type subscriber struct {
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	output   *clientOutput
+}
+
+func newSubscriber(output *clientOutput) *subscriber {
+	return &subscriber{
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		output:   output,
+	}
+}
+
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// Join connects the PubSub to other nodes through the MessageBus. It must be
+// called before any clients connect.
+func (p *PubSub) Join(bus MessageBus) {
+	p.bus = bus
+	bus.Listen(func(channel, message string) { p.deliver(channel, message) })
+}
+
+// Publish delivers the message to local subscribers and broadcasts it to
+// other nodes, if any. Like Redis Cluster, it only counts local receivers.
+func (p *PubSub) Publish(channel, message string) (receivers int, err error) {
+	receivers = p.deliver(channel, message)
+
+	if p.bus != nil {
+		err = errors.Wrap(p.bus.Broadcast(channel, message), "could not broadcast message")
+	}
+
+	return
+}
+
+// deliver sends the message to all subscribers of the channel and all
+// subscribers of patterns matching the channel, returning the number of
+// clients which received it.
+func (p *PubSub) deliver(channel, message string) (receivers int) {
+	type delivery struct {
+		subscriber *subscriber
+		payload    []byte
+	}
+
+	var deliveries []delivery
+
+	p.lock.RLock()
+	if subscribers, exists := p.channels[channel]; exists {
+		payload := []byte(arrayHeader(3) + bulkString("message") + bulkString(channel) + bulkString(message))
+		for sub := range subscribers {
+			deliveries = append(deliveries, delivery{sub, payload})
+		}
+	}
+	for pattern, subscribers := range p.patterns {
+		if !globMatch(pattern, channel, false) {
+			continue
+		}
+		payload := []byte(arrayHeader(4) + bulkString("pmessage") + bulkString(pattern) + bulkString(channel) + bulkString(message))
+		for sub := range subscribers {
+			deliveries = append(deliveries, delivery{sub, payload})
+		}
+	}
+	p.lock.RUnlock()
+
+	// Pushing happens outside of the lock, so that a subscriber being
+	// disconnected for overcoming its output buffer limits can unsubscribe.
+	for _, d := range deliveries {
+		d.subscriber.output.push(d.payload)
+	}
+
+	return len(deliveries)
+}
+
+// Channels returns active channels, optionally limited to the ones matching a
+// glob-style pattern.
+func (p *PubSub) Channels(pattern string) []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	ret := make([]string, 0, len(p.channels))
+	for channel := range p.channels {
+		if pattern == "" || globMatch(pattern, channel, false) {
+			ret = append(ret, channel)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// NumSub returns the number of subscribers of a channel, not counting
+// clients subscribed to patterns.
+func (p *PubSub) NumSub(channel string) int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return len(p.channels[channel])
+}
+
+// NumPat returns the number of unique patterns subscribed to by all clients.
+func (p *PubSub) NumPat() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return len(p.patterns)
+}
+
+func (p *PubSub) subscribe(sub *subscriber, channel string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	addSubscriber(p.channels, channel, sub)
+	sub.channels[channel] = struct{}{}
+}
+
+func (p *PubSub) unsubscribe(sub *subscriber, channel string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	removeSubscriber(p.channels, channel, sub)
+	delete(sub.channels, channel)
+}
+
+func (p *PubSub) psubscribe(sub *subscriber, pattern string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	addSubscriber(p.patterns, pattern, sub)
+	sub.patterns[pattern] = struct{}{}
+}
+
+func (p *PubSub) punsubscribe(sub *subscriber, pattern string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	removeSubscriber(p.patterns, pattern, sub)
+	delete(sub.patterns, pattern)
+}
+
+func (p *PubSub) unsubscribeAll(sub *subscriber) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for channel := range sub.channels {
+		removeSubscriber(p.channels, channel, sub)
+	}
+	for pattern := range sub.patterns {
+		removeSubscriber(p.patterns, pattern, sub)
+	}
+
+	sub.channels = make(map[string]struct{})
+	sub.patterns = make(map[string]struct{})
+}
+
+func addSubscriber(index map[string]map[*subscriber]struct{}, name string, sub *subscriber) {
+	subscribers, exists := index[name]
+	if !exists {
+		subscribers = make(map[*subscriber]struct{})
+		index[name] = subscribers
+	}
+	subscribers[sub] = struct{}{}
+}
+
+func removeSubscriber(index map[string]map[*subscriber]struct{}, name string, sub *subscriber) {
+	subscribers, exists := index[name]
+	if !exists {
+		return
+	}
+
+	delete(subscribers, sub)
+	if len(subscribers) == 0 {
+		delete(index, name)
+	}
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+func (s *SessionHandler) subscribed() bool {
+	return s.subscriber != nil && s.subscriber.count() > 0
+}
+
+func (s *SessionHandler) ensureSubscriber() *subscriber {
+	if s.subscriber == nil {
+		s.subscriber = newSubscriber(s.output)
+	}
+	return s.subscriber
+}
+
+func (s *SessionHandler) unsubscribeAll() {
+	if s.subscriber != nil {
+		s.server.PubSub.unsubscribeAll(s.subscriber)
+	}
+}
+
+func (s *SessionHandler) handleSubscribe(args []string) error {
+	if len(args) == 0 {
+		return s.badArgs("subscribe")
+	}
+
+	sub := s.ensureSubscriber()
+	for _, channel := range args {
+		channel := channel
+		subscribe := func() { s.server.PubSub.subscribe(sub, channel) }
+		if err := s.confirm(subscribe, "subscribe", channel); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SessionHandler) handlePSubscribe(args []string) error {
+	if len(args) == 0 {
+		return s.badArgs("psubscribe")
+	}
+
+	sub := s.ensureSubscriber()
+	for _, pattern := range args {
+		pattern := pattern
+		psubscribe := func() { s.server.PubSub.psubscribe(sub, pattern) }
+		if err := s.confirm(psubscribe, "psubscribe", pattern); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SessionHandler) handleUnsubscribe(args []string) error {
+	sub := s.ensureSubscriber()
+
+	if len(args) == 0 {
+		for channel := range sub.channels {
+			args = append(args, channel)
+		}
+		if len(args) == 0 {
+			return s.confirmEmpty("unsubscribe")
+		}
+	}
+
+	for _, channel := range args {
+		channel := channel
+		unsubscribe := func() { s.server.PubSub.unsubscribe(sub, channel) }
+		if err := s.confirm(unsubscribe, "unsubscribe", channel); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SessionHandler) handlePUnsubscribe(args []string) error {
+	sub := s.ensureSubscriber()
+
+	if len(args) == 0 {
+		for pattern := range sub.patterns {
+			args = append(args, pattern)
+		}
+		if len(args) == 0 {
+			return s.confirmEmpty("punsubscribe")
+		}
+	}
+
+	for _, pattern := range args {
+		pattern := pattern
+		punsubscribe := func() { s.server.PubSub.punsubscribe(sub, pattern) }
+		if err := s.confirm(punsubscribe, "punsubscribe", pattern); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// confirm performs a subscription change and replies with its confirmation,
+// atomically with respect to messages pushed to this client.
+func (s *SessionHandler) confirm(change func(), kind, name string) error {
+	_, err := s.output.writeWith(func() []byte {
+		change()
+		return []byte(arrayHeader(3) + bulkString(kind) + bulkString(name) + integer(s.subscriber.count()))
+	})
+	return err
+}
+
+func (s *SessionHandler) confirmEmpty(kind string) error {
+	_, err := io.WriteString(s.writer, arrayHeader(3)+bulkString(kind)+nullBulkString+integer(0))
+	return err
+}
+
+func (s *SessionHandler) handlePublish(args []string) error {
+	if len(args) != 2 {
+		return s.badArgs("publish")
+	}
+
+	receivers, err := s.server.PubSub.Publish(args[0], args[1])
+	if err != nil {
+		// Local subscribers got the message, so this is not worth failing
+		// the command over.
+		s.logger.Warnf("Could not publish to other nodes: %v", err)
+	}
+
+	_, err = io.WriteString(s.writer, integer(receivers))
+	return err
+}
+
+func (s *SessionHandler) handlePubSub(args []string) error {
+	if len(args) == 0 {
+		return s.badArgs("pubsub")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "channels":
+		if len(args) > 2 {
+			return s.badArgs("pubsub|channels")
+		}
+
+		var pattern string
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+
+		channels := s.server.PubSub.Channels(pattern)
+
+		reply := arrayHeader(len(channels))
+		for _, channel := range channels {
+			reply += bulkString(channel)
+		}
+
+		_, err := io.WriteString(s.writer, reply)
+		return err
+	case "numsub":
+		reply := arrayHeader(2 * (len(args) - 1))
+		for _, channel := range args[1:] {
+			reply += bulkString(channel) + integer(s.server.PubSub.NumSub(channel))
+		}
+
+		_, err := io.WriteString(s.writer, reply)
+		return err
+	case "numpat":
+		if len(args) != 1 {
+			return s.badArgs("pubsub|numpat")
+		}
+
+		_, err := io.WriteString(s.writer, integer(s.server.PubSub.NumPat()))
+		return err
+	default:
+		_, err := fmt.Fprintf(s.writer, "-ERR unknown subcommand '%s'\n", args[0])
+		return err
+	}
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+func (s *sessionHandlerTestSuite) TestSubscribe() {
+	fmt.Fprintln(s.conn, "SUBSCRIBE news weather")
+
+	s.True(s.sut.handleLine())
+	s.responded("*3\n$9\nsubscribe\n$4\nnews\n:1\n*3\n$9\nsubscribe\n$7\nweather\n:2")
+	s.Equal(1, s.server.PubSub.NumSub("news"))
+}
+
+func (s *sessionHandlerTestSuite) TestSubscribe_InvalidArgs() {
+	fmt.Fprintln(s.conn, "SUBSCRIBE")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR wrong number of arguments for 'subscribe' command")
+}
+
+func (s *sessionHandlerTestSuite) TestPSubscribe() {
+	fmt.Fprintln(s.conn, "PSUBSCRIBE news.*")
+
+	s.True(s.sut.handleLine())
+	s.responded("*3\n$10\npsubscribe\n$6\nnews.*\n:1")
+	s.Equal(1, s.server.PubSub.NumPat())
+}
+
+func (s *sessionHandlerTestSuite) TestSubscribedMode_RejectsCommands() {
+	s.server.PubSub.subscribe(s.sut.ensureSubscriber(), "news")
+	fmt.Fprintln(s.conn, "GET bacon")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+}
+
+func (s *sessionHandlerTestSuite) TestSubscribedMode_Ping() {
+	s.server.PubSub.subscribe(s.sut.ensureSubscriber(), "news")
+	fmt.Fprintln(s.conn, "PING")
+
+	s.True(s.sut.handleLine())
+	s.responded("*2\n$4\npong\n$0\n")
+}
+
+func (s *sessionHandlerTestSuite) TestUnsubscribe_All() {
+	sub := s.sut.ensureSubscriber()
+	s.server.PubSub.subscribe(sub, "news")
+	fmt.Fprintln(s.conn, "UNSUBSCRIBE")
+
+	s.True(s.sut.handleLine())
+	s.responded("*3\n$11\nunsubscribe\n$4\nnews\n:0")
+	s.False(s.sut.subscribed())
+	s.Equal(0, s.server.PubSub.NumSub("news"))
+}
+
+func (s *sessionHandlerTestSuite) TestUnsubscribe_NotSubscribed() {
+	fmt.Fprintln(s.conn, "UNSUBSCRIBE")
+
+	s.True(s.sut.handleLine())
+	s.responded("*3\n$11\nunsubscribe\n$-1\n:0")
+}
+
+func (s *sessionHandlerTestSuite) TestPUnsubscribe() {
+	s.server.PubSub.psubscribe(s.sut.ensureSubscriber(), "news.*")
+	fmt.Fprintln(s.conn, "PUNSUBSCRIBE news.*")
+
+	s.True(s.sut.handleLine())
+	s.responded("*3\n$12\npunsubscribe\n$6\nnews.*\n:0")
+	s.Equal(0, s.server.PubSub.NumPat())
+}
+
+func (s *sessionHandlerTestSuite) TestPublish() {
+	subscriberOutput := bytes.NewBuffer(nil)
+	subscriber := NewSessionHandler(
+		&mockReadWriteCloser{ReadWriter: subscriberOutput},
+		logrus.New().WithField("test", true),
+		s.server,
+	)
+	s.server.PubSub.subscribe(subscriber.ensureSubscriber(), "news")
+
+	fmt.Fprintln(s.conn, "PUBLISH news hello")
+
+	s.True(s.sut.handleLine())
+	s.responded(":1")
+
+	subscriber.output.wait()
+	s.Equal("*3\n$7\nmessage\n$4\nnews\n$5\nhello\n", subscriberOutput.String())
+}
+
+func (s *sessionHandlerTestSuite) TestPublish_InvalidArgs() {
+	fmt.Fprintln(s.conn, "PUBLISH news")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR wrong number of arguments for 'publish' command")
+}
+
+func (s *sessionHandlerTestSuite) TestPubSub_Channels() {
+	s.server.PubSub.subscribe(s.sut.ensureSubscriber(), "news")
+	s.server.PubSub.subscribe(s.sut.ensureSubscriber(), "weather")
+	s.sut.unsubscribeAll()
+	s.server.PubSub.subscribe(newSubscriber(s.sut.output), "news")
+
+	fmt.Fprintln(s.conn, "PUBSUB CHANNELS n*")
+
+	s.True(s.sut.handleLine())
+	s.responded("*1\n$4\nnews")
+}
+
+func (s *sessionHandlerTestSuite) TestPubSub_NumSub() {
+	s.server.PubSub.subscribe(newSubscriber(s.sut.output), "news")
+
+	fmt.Fprintln(s.conn, "PUBSUB NUMSUB news weather")
+
+	s.True(s.sut.handleLine())
+	s.responded("*4\n$4\nnews\n:1\n$7\nweather\n:0")
+}
+
+func (s *sessionHandlerTestSuite) TestPubSub_NumPat() {
+	s.server.PubSub.psubscribe(newSubscriber(s.sut.output), "n*")
+
+	fmt.Fprintln(s.conn, "PUBSUB NUMPAT")
+
+	s.True(s.sut.handleLine())
+	s.responded(":1")
+}
+
+func (s *sessionHandlerTestSuite) TestPubSub_UnknownSubcommand() {
+	fmt.Fprintln(s.conn, "PUBSUB BACON")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR unknown subcommand 'BACON'")
+}
+
+func (s *sessionHandlerTestSuite) TestQuit() {
+	fmt.Fprintln(s.conn, "QUIT")
+
+	s.False(s.sut.handleLine())
+	s.responded("+OK")
+	s.NotContains(s.logOutput.String(), "level=error")
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type pubSubTestSuite struct {
+	suite.Suite
+
+	buffer *bytes.Buffer
+	sub    *subscriber
+
+	sut *PubSub
+}
+
+func (p *pubSubTestSuite) SetupTest() {
+	p.buffer = bytes.NewBuffer(nil)
+	p.sub = newSubscriber(newClientOutput(p.buffer, OutputBufferLimits{}, nil))
+	p.sut = NewPubSub()
+}
+
+func (p *pubSubTestSuite) TestPublish_Channel() {
+	p.sut.subscribe(p.sub, "news")
+
+	p.publish(1, "news", "hello")
+	p.sub.output.wait()
+
+	p.Equal("*3\n$7\nmessage\n$4\nnews\n$5\nhello\n", p.buffer.String())
+}
+
+func (p *pubSubTestSuite) TestPublish_Pattern() {
+	p.sut.psubscribe(p.sub, "n*s")
+
+	p.publish(1, "news", "hello")
+	p.sub.output.wait()
+
+	p.Equal("*4\n$8\npmessage\n$3\nn*s\n$4\nnews\n$5\nhello\n", p.buffer.String())
+}
+
+func (p *pubSubTestSuite) TestPublish_ChannelAndPattern() {
+	p.sut.subscribe(p.sub, "news")
+	p.sut.psubscribe(p.sub, "*")
+
+	p.publish(2, "news", "hello")
+}
+
+func (p *pubSubTestSuite) TestPublish_NoSubscribers() {
+	p.sut.subscribe(p.sub, "news")
+	p.sut.psubscribe(p.sub, "sport.*")
+
+	p.publish(0, "weather", "sunny")
+}
+
+func (p *pubSubTestSuite) TestUnsubscribe() {
+	p.sut.subscribe(p.sub, "news")
+	p.sut.unsubscribe(p.sub, "news")
+
+	p.Empty(p.sub.channels)
+	p.Empty(p.sut.Channels(""))
+	p.publish(0, "news", "hello")
+}
+
+func (p *pubSubTestSuite) TestUnsubscribeAll() {
+	p.sut.subscribe(p.sub, "news")
+	p.sut.psubscribe(p.sub, "sport.*")
+	p.sut.unsubscribeAll(p.sub)
+
+	p.Equal(0, p.sub.count())
+	p.Empty(p.sut.Channels(""))
+	p.Equal(0, p.sut.NumPat())
+}
+
+func (p *pubSubTestSuite) TestChannels() {
+	p.sut.subscribe(p.sub, "news.tech")
+	p.sut.subscribe(p.sub, "news.sport")
+	p.sut.subscribe(p.sub, "weather")
+
+	p.Equal([]string{"news.sport", "news.tech", "weather"}, p.sut.Channels(""))
+	p.Equal([]string{"news.sport", "news.tech"}, p.sut.Channels("news.*"))
+}
+
+func (p *pubSubTestSuite) TestNumSubAndNumPat() {
+	other := newSubscriber(newClientOutput(bytes.NewBuffer(nil), OutputBufferLimits{}, nil))
+
+	p.sut.subscribe(p.sub, "news")
+	p.sut.subscribe(other, "news")
+	p.sut.psubscribe(p.sub, "n*")
+	p.sut.psubscribe(other, "n*")
+	p.sut.psubscribe(other, "w*")
+
+	p.Equal(2, p.sut.NumSub("news"))
+	p.Equal(0, p.sut.NumSub("weather"))
+	p.Equal(2, p.sut.NumPat())
+}
+
+func (p *pubSubTestSuite) TestJoin() {
+	bus := NewInProcessBus()
+	other := NewPubSub()
+
+	p.sut.Join(bus.Node())
+	other.Join(bus.Node())
+	other.subscribe(p.sub, "news")
+
+	p.publish(0, "news", "hello")
+	p.sub.output.wait()
+
+	p.Equal("*3\n$7\nmessage\n$4\nnews\n$5\nhello\n", p.buffer.String())
+}
+
+func (p *pubSubTestSuite) TestJoin_BroadcastError() {
+	bus := new(mockMessageBus)
+	bus.On("Listen", mock.Anything).Return()
+	bus.On("Broadcast", "news", "hello").Return(errors.New("bacon"))
+
+	p.sut.Join(bus)
+	p.sut.subscribe(p.sub, "news")
+
+	receivers, err := p.sut.Publish("news", "hello")
+	p.Equal(1, receivers)
+	p.EqualError(err, "could not broadcast message: bacon")
+}
+
+func (p *pubSubTestSuite) publish(expectedReceivers int, channel, message string) {
+	receivers, err := p.sut.Publish(channel, message)
+
+	p.Equal(expectedReceivers, receivers)
+	p.NoError(err)
+}
+
+func TestPubSub(t *testing.T) {
+	suite.Run(t, new(pubSubTestSuite))
+}
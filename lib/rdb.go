@@ -0,0 +1,314 @@
+package lib
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// rdbVersion is the version of the RDB format written to DUMP payloads,
+	// which is the one used by Redis 7.0. Payloads are accepted up to
+	// rdbMaxVersion, since nothing goredis reads has changed since.
+	rdbVersion    = 10
+	rdbMaxVersion = 12
+
+	rdbTypeString      = 0
+	rdbOpcodeFunction2 = 245
+
+	rdbEncodingInt8  = 0
+	rdbEncodingInt16 = 1
+	rdbEncodingInt32 = 2
+	rdbEncodingLZF   = 3
+
+	// lzfMaxExpansion is how many bytes LZF data may decompress to for each
+	// byte of it, with the longest back reference taking three bytes to
+	// stand for 264.
+	lzfMaxExpansion = 88
+)
+
+// errRDBTruncated is returned when reading past the end of the RDB data.
+var errRDBTruncated = errors.New("unexpected end of RDB data")
+
+// crc64Table implements the Jones polynomial used by Redis, in its reflected
+// form.
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Jones computes the checksum the way Redis does, which unlike
+// crc64.Update neither inverts the initial value nor the result.
+func crc64Jones(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// sealRDBPayload appends the RDB version and checksum footer expected at the
+// end of DUMP payloads.
+func sealRDBPayload(body []byte) []byte {
+	var footer [10]byte
+	binary.LittleEndian.PutUint16(footer[:2], rdbVersion)
+
+	payload := append(body, footer[:2]...)
+	binary.LittleEndian.PutUint64(footer[2:], crc64Jones(0, payload))
+
+	return append(payload, footer[2:]...)
+}
+
+// openRDBPayload verifies the footer of a DUMP payload and returns its body.
+func openRDBPayload(payload []byte) (body []byte, ok bool) {
+	if len(payload) < 10 {
+		return nil, false
+	}
+
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer[:2]) > rdbMaxVersion {
+		return nil, false
+	}
+
+	checksum := binary.LittleEndian.Uint64(footer[2:])
+	if checksum != crc64Jones(0, payload[:len(payload)-8]) {
+		return nil, false
+	}
+
+	return payload[:len(payload)-10], true
+}
+
+// dumpString serializes a string value the way DUMP does in Redis.
+func dumpString(value string) string {
+	return string(sealRDBPayload(appendRDBString([]byte{rdbTypeString}, value)))
+}
+
+// restoreString reads a value serialized by dumpString, or by DUMP in Redis.
+// Strings are the only type goredis supports. Errors are meant to be shown
+// to the client.
+func restoreString(payload string) (string, error) {
+	body, ok := openRDBPayload([]byte(payload))
+	if !ok {
+		return "", errors.New("DUMP payload version or checksum are wrong")
+	}
+
+	reader := &rdbReader{data: body}
+	if valueType, err := reader.readByte(); err != nil || valueType != rdbTypeString {
+		return "", errors.New("Bad data format")
+	}
+
+	value, err := reader.readString()
+	if err != nil || !reader.done() {
+		return "", errors.New("Bad data format")
+	}
+
+	return value, nil
+}
+
+func appendRDBLength(buf []byte, length uint64) []byte {
+	switch {
+	case length < 1<<6:
+		return append(buf, byte(length))
+	case length < 1<<14:
+		return append(buf, byte(length>>8)|0x40, byte(length))
+	case length <= 1<<32-1:
+		var encoded [4]byte
+		binary.BigEndian.PutUint32(encoded[:], uint32(length))
+		return append(append(buf, 0x80), encoded[:]...)
+	default:
+		var encoded [8]byte
+		binary.BigEndian.PutUint64(encoded[:], length)
+		return append(append(buf, 0x81), encoded[:]...)
+	}
+}
+
+func appendRDBString(buf []byte, value string) []byte {
+	return append(appendRDBLength(buf, uint64(len(value))), value...)
+}
+
+// rdbReader reads values encoded the way Redis encodes them in RDB files and
+// DUMP payloads, including the integer and LZF string encodings which
+// goredis never writes itself.
+type rdbReader struct {
+	data []byte
+}
+
+func (r *rdbReader) done() bool {
+	return len(r.data) == 0
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	if len(r.data) == 0 {
+		return 0, errRDBTruncated
+	}
+
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b, nil
+}
+
+func (r *rdbReader) readBytes(count uint64) ([]byte, error) {
+	if uint64(len(r.data)) < count {
+		return nil, errRDBTruncated
+	}
+
+	ret := r.data[:count]
+	r.data = r.data[count:]
+	return ret, nil
+}
+
+// readLength reads a length, or the special encoding of the string which
+// follows if encoded is true.
+func (r *rdbReader) readLength() (length uint64, encoded bool, err error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3f), false, nil
+	case 1:
+		second, err := r.readByte()
+		return uint64(first&0x3f)<<8 | uint64(second), false, err
+	case 3:
+		return uint64(first & 0x3f), true, nil
+	}
+
+	switch first {
+	case 0x80:
+		raw, err := r.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(raw)), false, nil
+	case 0x81:
+		raw, err := r.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(raw), false, nil
+	default:
+		return 0, false, errors.Errorf("unknown length encoding %#x", first)
+	}
+}
+
+func (r *rdbReader) readString() (string, error) {
+	length, encoded, err := r.readLength()
+	if err != nil {
+		return "", err
+	}
+
+	if !encoded {
+		raw, err := r.readBytes(length)
+		return string(raw), err
+	}
+
+	switch length {
+	case rdbEncodingInt8:
+		raw, err := r.readBytes(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int8(raw[0])), 10), nil
+	case rdbEncodingInt16:
+		raw, err := r.readBytes(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(raw))), 10), nil
+	case rdbEncodingInt32:
+		raw, err := r.readBytes(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(raw))), 10), nil
+	case rdbEncodingLZF:
+		return r.readLZFString()
+	default:
+		return "", errors.Errorf("unknown string encoding %d", length)
+	}
+}
+
+func (r *rdbReader) readLZFString() (string, error) {
+	compressedLength, _, err := r.readLength()
+	if err != nil {
+		return "", err
+	}
+
+	length, _, err := r.readLength()
+	if err != nil {
+		return "", err
+	}
+
+	compressed, err := r.readBytes(compressedLength)
+	if err != nil {
+		return "", err
+	}
+
+	ret, err := lzfDecompress(compressed, length)
+	return string(ret), err
+}
+
+// lzfDecompress decompresses data compressed with LZF, which Redis uses for
+// long strings. The length comes from the payload, so it's checked against
+// what the data could possibly decompress to before anything is allocated.
+func lzfDecompress(in []byte, length uint64) ([]byte, error) {
+	if length > MaxValueSize || length > uint64(len(in))*lzfMaxExpansion {
+		return nil, errors.Errorf("invalid LZF decompressed length %d", length)
+	}
+
+	out := make([]byte, 0, length)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 1<<5 {
+			// A literal run of ctrl+1 bytes.
+			end := i + ctrl + 1
+			if end > len(in) {
+				return nil, errors.New("truncated LZF literal")
+			}
+
+			out = append(out, in[i:end]...)
+			i = end
+			continue
+		}
+
+		// A back reference.
+		size := ctrl >> 5
+		if size == 7 {
+			if i >= len(in) {
+				return nil, errors.New("truncated LZF back reference")
+			}
+			size += int(in[i])
+			i++
+		}
+
+		if i >= len(in) {
+			return nil, errors.New("truncated LZF back reference")
+		}
+
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+
+		if ref < 0 {
+			return nil, errors.New("invalid LZF back reference")
+		}
+
+		if uint64(len(out)+size+2) > length {
+			return nil, errors.Errorf("LZF data decompresses to more than %d bytes", length)
+		}
+
+		// The reference may overlap with what is being written, so it
+		// has to be copied byte by byte.
+		for j := 0; j < size+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if uint64(len(out)) != length {
+		return nil, errors.Errorf("LZF data decompressed to %d bytes instead of %d", len(out), length)
+	}
+
+	return out, nil
+}
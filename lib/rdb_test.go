@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type rdbTestSuite struct {
+	suite.Suite
+}
+
+func (r *rdbTestSuite) TestCRC64() {
+	// The check value from the Redis source.
+	r.Equal(uint64(0xe9c6d914c4b8d9ca), crc64Jones(0, []byte("123456789")))
+}
+
+func (r *rdbTestSuite) TestPayload() {
+	payload := sealRDBPayload([]byte("bacon"))
+
+	body, ok := openRDBPayload(payload)
+	r.True(ok)
+	r.Equal("bacon", string(body))
+
+	payload[0] = 'B'
+	_, ok = openRDBPayload(payload)
+	r.False(ok)
+}
+
+func (r *rdbTestSuite) TestPayload_ZeroChecksum() {
+	_, ok := openRDBPayload([]byte("bacon\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+
+	r.False(ok)
+}
+
+func (r *rdbTestSuite) TestPayload_FutureVersion() {
+	_, ok := openRDBPayload([]byte("bacon\xff\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+
+	r.False(ok)
+}
+
+func (r *rdbTestSuite) TestStrings() {
+	values := []string{"", "bacon", strings.Repeat("a", 1<<6), strings.Repeat("b", 1<<14)}
+
+	var data []byte
+	for _, value := range values {
+		data = appendRDBString(data, value)
+	}
+
+	reader := &rdbReader{data: data}
+	for _, value := range values {
+		read, err := reader.readString()
+		r.NoError(err)
+		r.Equal(value, read)
+	}
+	r.True(reader.done())
+}
+
+func (r *rdbTestSuite) TestEncodedStrings() {
+	reader := &rdbReader{data: []byte{
+		0xc0, 0xfe, // int8
+		0xc1, 0x39, 0x30, // int16
+		0xc2, 0x15, 0xcd, 0x5b, 0x07, // int32
+		0xc3, 0x05, 0x0a, 0x00, 'a', 0xe0, 0x00, 0x00, // LZF
+	}}
+
+	for _, expected := range []string{"-2", "12345", "123456789", "aaaaaaaaaa"} {
+		read, err := reader.readString()
+		r.NoError(err)
+		r.Equal(expected, read)
+	}
+}
+
+func (r *rdbTestSuite) TestTruncated() {
+	for _, data := range [][]byte{{}, {0x05, 'a'}, {0x40}, {0x80, 0x00}, {0xc2, 0x00}} {
+		_, err := (&rdbReader{data: data}).readString()
+		r.Error(err, "%q", data)
+	}
+}
+
+func (r *rdbTestSuite) TestLZF() {
+	out, err := lzfDecompress([]byte{0x02, 'a', 'b', 'c', 0x20, 0x02}, 6)
+	r.NoError(err)
+	r.Equal("abcabc", string(out))
+
+	_, err = lzfDecompress([]byte{0x20, 0x05}, 3)
+	r.EqualError(err, "invalid LZF back reference")
+
+	_, err = lzfDecompress([]byte{0x02, 'a', 'b', 'c'}, 6)
+	r.EqualError(err, "LZF data decompressed to 3 bytes instead of 6")
+
+	_, err = lzfDecompress([]byte{0x02, 'a', 'b', 'c', 0xe0, 0xff, 0x02}, 100)
+	r.EqualError(err, "LZF data decompresses to more than 100 bytes")
+
+	_, err = lzfDecompress([]byte{0x00}, 89)
+	r.EqualError(err, "invalid LZF decompressed length 89")
+
+	_, err = lzfDecompress(make([]byte, 1<<24), MaxValueSize+1)
+	r.EqualError(err, "invalid LZF decompressed length 536870913")
+}
+
+func (r *rdbTestSuite) TestLZF_HugeLength() {
+	reader := &rdbReader{data: []byte{0xc3, 0x01, 0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}}
+
+	_, err := reader.readString()
+	r.EqualError(err, "invalid LZF decompressed length 9223372036854775807")
+}
+
+func (r *rdbTestSuite) TestDumpString() {
+	value, err := restoreString(dumpString("bacon"))
+	r.Equal("bacon", value)
+	r.NoError(err)
+}
+
+func (r *rdbTestSuite) TestRestoreString_FromRedis() {
+	// DUMP of the value 10 in Redis 7.0, which uses the integer encoding.
+	value, err := restoreString("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb")
+	r.Equal("10", value)
+	r.NoError(err)
+}
+
+func (r *rdbTestSuite) TestRestoreString_Invalid() {
+	_, err := restoreString("bacon")
+	r.EqualError(err, "DUMP payload version or checksum are wrong")
+
+	// A list, which goredis does not support.
+	_, err = restoreString(string(sealRDBPayload([]byte{1, 0})))
+	r.EqualError(err, "Bad data format")
+
+	_, err = restoreString(string(sealRDBPayload(append(appendRDBString([]byte{rdbTypeString}, "bacon"), 0))))
+	r.EqualError(err, "Bad data format")
+}
+
+func TestRDB(t *testing.T) {
+	suite.Run(t, new(rdbTestSuite))
+}
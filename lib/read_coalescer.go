@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"sync"
+)
+
+// readResult is the outcome of a read shared by all of its waiters.
+type readResult struct {
+	value string
+	found bool
+	err   error
+}
+
+// inflightRead is a read shared by all callers asking for the same key while
+// it's in progress.
+type inflightRead struct {
+	done   chan struct{}
+	result readResult
+
+	// waiters is the number of callers still waiting for the result. The
+	// read is cancelled once it drops to zero, unless it's a background
+	// read, which nobody was waiting for in the first place.
+	waiters    int
+	background bool
+	cancel     context.CancelFunc
+}
+
+// readCoalescer deduplicates concurrent reads of the same key, so that only
+// one of them reaches the store and all callers get its result. A read of a
+// key which gets invalidated while in progress is detached: callers already
+// waiting still get its result, but new callers start over, and the result
+// is not kept.
+type readCoalescer struct {
+	reads map[string]*inflightRead
+	lock  *sync.Mutex
+}
+
+func newReadCoalescer() *readCoalescer {
+	return &readCoalescer{
+		reads: make(map[string]*inflightRead),
+		lock:  new(sync.Mutex),
+	}
+}
+
+// read returns the result of fetching the key, joining a read already in
+// progress if there is one. The fetch runs with a context of its own, which
+// is cancelled only when all callers waiting for it have given up. Unless the
+// read is detached by then, keep is called with its result, with the lock
+// held, so that nothing can invalidate the key in the meantime. Whatever keep
+// returns is what callers get.
+func (c *readCoalescer) read(ctx context.Context, key string, fetch func(ctx context.Context) readResult, keep func(readResult) readResult) readResult {
+	c.lock.Lock()
+	read, exists := c.reads[key]
+	if !exists {
+		read = c.start(key, fetch, keep)
+	}
+	read.waiters++
+	c.lock.Unlock()
+
+	select {
+	case <-read.done:
+		return read.result
+	case <-ctx.Done():
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if read.waiters--; read.waiters == 0 && !read.background {
+		read.cancel()
+		c.detach(key, read)
+	}
+	return readResult{err: ctx.Err()}
+}
+
+// refresh starts reading the key in the background, unless a read of it is
+// already in progress.
+func (c *readCoalescer) refresh(key string, fetch func(ctx context.Context) readResult, keep func(readResult) readResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, exists := c.reads[key]; !exists {
+		c.start(key, fetch, keep).background = true
+	}
+}
+
+// invalidate detaches the read of the key in progress, if any.
+func (c *readCoalescer) invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.reads, key)
+}
+
+// invalidateAll detaches all reads in progress.
+func (c *readCoalescer) invalidateAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reads = make(map[string]*inflightRead)
+}
+
+// start must be called with the lock held.
+func (c *readCoalescer) start(key string, fetch func(ctx context.Context) readResult, keep func(readResult) readResult) *inflightRead {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	read := &inflightRead{done: make(chan struct{}), cancel: cancel}
+	c.reads[key] = read
+
+	go func() {
+		defer cancel()
+
+		result := fetch(ctx)
+
+		c.lock.Lock()
+		if c.reads[key] == read {
+			result = keep(result)
+			c.detach(key, read)
+		}
+		read.result = result
+		c.lock.Unlock()
+
+		close(read.done)
+	}()
+
+	return read
+}
+
+// detach must be called with the lock held. A newer read of the same key may
+// have taken the place of this one, in which case it's left alone.
+func (c *readCoalescer) detach(key string, read *inflightRead) {
+	if c.reads[key] == read {
+		delete(c.reads, key)
+	}
+}
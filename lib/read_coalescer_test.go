@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type readCoalescerTestSuite struct {
+	suite.Suite
+
+	fetches int
+	kept    []readResult
+	release chan struct{}
+	lock    *sync.Mutex
+
+	sut *readCoalescer
+}
+
+func (r *readCoalescerTestSuite) SetupTest() {
+	r.fetches = 0
+	r.kept = nil
+	r.release = make(chan struct{})
+	r.lock = new(sync.Mutex)
+
+	r.sut = newReadCoalescer()
+}
+
+// fetch blocks until released or cancelled.
+func (r *readCoalescerTestSuite) fetch(result readResult) func(ctx context.Context) readResult {
+	return func(ctx context.Context) readResult {
+		r.lock.Lock()
+		r.fetches++
+		r.lock.Unlock()
+
+		select {
+		case <-r.release:
+			return result
+		case <-ctx.Done():
+			return readResult{err: ctx.Err()}
+		}
+	}
+}
+
+// keep records the results kept.
+func (r *readCoalescerTestSuite) keep(result readResult) readResult {
+	r.kept = append(r.kept, result)
+	return result
+}
+
+func (r *readCoalescerTestSuite) fetchCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.fetches
+}
+
+// waitForWaiters waits until the read of the key in progress has the given
+// number of callers waiting for it, or until there's no read of the key in
+// progress if waiters is negative.
+func (r *readCoalescerTestSuite) waitForWaiters(key string, waiters int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.sut.lock.Lock()
+		read, exists := r.sut.reads[key]
+		current := -1
+		if exists {
+			current = read.waiters
+		}
+		r.sut.lock.Unlock()
+
+		if current == waiters {
+			return
+		}
+	}
+	r.FailNow("timed out waiting for waiters")
+}
+
+// readConcurrently starts the reads, returning a channel with their results.
+func (r *readCoalescerTestSuite) readConcurrently(contexts []context.Context, result readResult) <-chan readResult {
+	results := make(chan readResult, len(contexts))
+	for _, ctx := range contexts {
+		go func(ctx context.Context) {
+			results <- r.sut.read(ctx, "bacon", r.fetch(result), r.keep)
+		}(ctx)
+	}
+	return results
+}
+
+func (r *readCoalescerTestSuite) backgrounds(count int) []context.Context {
+	ret := make([]context.Context, count)
+	for i := range ret {
+		ret[i] = context.Background()
+	}
+	return ret
+}
+
+func (r *readCoalescerTestSuite) TestSharesRead() {
+	results := r.readConcurrently(r.backgrounds(10), readResult{value: "tasty", found: true})
+	r.waitForWaiters("bacon", 10)
+	close(r.release)
+
+	for i := 0; i < 10; i++ {
+		r.Equal(readResult{value: "tasty", found: true}, <-results)
+	}
+	r.Equal(1, r.fetchCount())
+	r.Equal([]readResult{{value: "tasty", found: true}}, r.kept)
+	r.Empty(r.sut.reads)
+}
+
+func (r *readCoalescerTestSuite) TestSharesError() {
+	results := r.readConcurrently(r.backgrounds(3), readResult{err: errors.New("bacon")})
+	r.waitForWaiters("bacon", 3)
+	close(r.release)
+
+	for i := 0; i < 3; i++ {
+		r.EqualError((<-results).err, "bacon")
+	}
+	r.Equal(1, r.fetchCount())
+}
+
+func (r *readCoalescerTestSuite) TestInvalidate() {
+	stale := r.readConcurrently(r.backgrounds(1), readResult{})
+	r.waitForWaiters("bacon", 1)
+
+	r.sut.invalidate("bacon")
+
+	fresh := r.readConcurrently(r.backgrounds(1), readResult{value: "tasty", found: true})
+	r.waitForWaiters("bacon", 1)
+	close(r.release)
+
+	r.Equal(readResult{}, <-stale)
+	r.Equal(readResult{value: "tasty", found: true}, <-fresh)
+	r.Equal(2, r.fetchCount())
+	r.Equal([]readResult{{value: "tasty", found: true}}, r.kept)
+	r.Empty(r.sut.reads)
+}
+
+func (r *readCoalescerTestSuite) TestInvalidateAll() {
+	results := r.readConcurrently(r.backgrounds(1), readResult{found: true})
+	r.waitForWaiters("bacon", 1)
+
+	r.sut.invalidateAll()
+	close(r.release)
+
+	r.Equal(readResult{found: true}, <-results)
+	r.Empty(r.kept)
+}
+
+func (r *readCoalescerTestSuite) TestSomeWaitersGiveUp() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	impatient := r.readConcurrently([]context.Context{ctx}, readResult{})
+	r.waitForWaiters("bacon", 1)
+	patient := r.readConcurrently(r.backgrounds(1), readResult{})
+	r.waitForWaiters("bacon", 2)
+
+	cancel()
+	r.Equal(context.Canceled, (<-impatient).err)
+	r.waitForWaiters("bacon", 1)
+
+	close(r.release)
+	r.NoError((<-patient).err)
+	r.Equal(1, r.fetchCount())
+}
+
+func (r *readCoalescerTestSuite) TestAllWaitersGiveUp() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancelled := make(chan struct{})
+	go func() {
+		r.sut.read(ctx, "bacon", func(ctx context.Context) readResult {
+			<-ctx.Done()
+			close(cancelled)
+			return readResult{err: ctx.Err()}
+		}, r.keep)
+	}()
+	r.waitForWaiters("bacon", 1)
+
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		r.FailNow("the read was not cancelled")
+	}
+	r.waitForWaiters("bacon", -1)
+}
+
+func (r *readCoalescerTestSuite) TestReadsAgainWhenDone() {
+	close(r.release)
+
+	r.Equal(readResult{found: true}, r.sut.read(context.Background(), "bacon", r.fetch(readResult{found: true}), r.keep))
+	r.Equal(readResult{}, r.sut.read(context.Background(), "bacon", r.fetch(readResult{}), r.keep))
+	r.Equal(2, r.fetchCount())
+}
+
+func (r *readCoalescerTestSuite) TestRefresh() {
+	r.sut.refresh("bacon", r.fetch(readResult{value: "tasty", found: true}), r.keep)
+	r.sut.refresh("bacon", r.fetch(readResult{}), r.keep)
+	r.waitForWaiters("bacon", 0)
+
+	close(r.release)
+	r.waitForWaiters("bacon", -1)
+
+	r.Equal(1, r.fetchCount())
+	r.Equal([]readResult{{value: "tasty", found: true}}, r.kept)
+}
+
+func (r *readCoalescerTestSuite) TestRefresh_WaitersGiveUp() {
+	r.sut.refresh("bacon", r.fetch(readResult{found: true}), r.keep)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	impatient := r.readConcurrently([]context.Context{ctx}, readResult{})
+	r.waitForWaiters("bacon", 1)
+
+	cancel()
+	r.Equal(context.Canceled, (<-impatient).err)
+	r.waitForWaiters("bacon", 0)
+
+	close(r.release)
+	r.waitForWaiters("bacon", -1)
+
+	r.Equal(1, r.fetchCount())
+	r.Equal([]readResult{{found: true}}, r.kept)
+}
+
+func TestReadCoalescer(t *testing.T) {
+	suite.Run(t, new(readCoalescerTestSuite))
+}
@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nullBulkString is the RESP representation of a missing value.
+const nullBulkString = "$-1\n"
+
+// statusReply and errorReply are what readReply returns for simple strings
+// and errors respectively, so that they can be told apart from bulk strings.
+type (
+	statusReply string
+	errorReply  string
+)
+
+func arrayHeader(length int) string {
+	return fmt.Sprintf("*%d\n", length)
+}
+
+func bulkString(value string) string {
+	return fmt.Sprintf("$%d\n%s\n", len(value), value)
+}
+
+func integer(value int) string {
+	return fmt.Sprintf(":%d\n", value)
+}
+
+func simpleString(value string) string {
+	return "+" + singleLine(value) + "\n"
+}
+
+func errorString(value string) string {
+	return "-" + singleLine(value) + "\n"
+}
+
+// singleLine makes sure that a simple string or error does not break the
+// protocol by spanning multiple lines.
+func singleLine(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// readReply parses a single reply as written by command handlers. Integers
+// are returned as int64, bulk strings as string and arrays as []interface{},
+// while null bulk strings and null arrays are both returned as nil.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return statusReply(line[1:]), nil
+	case '-':
+		return errorReply(line[1:]), nil
+	case ':':
+		value, err := strconv.ParseInt(line[1:], 10, 64)
+		return value, errors.Wrap(err, "malformed integer reply")
+	case '"':
+		// PING replies with a quoted string.
+		value, err := strconv.Unquote(line)
+		return statusReply(value), errors.Wrap(err, "malformed quoted reply")
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed bulk string length")
+		} else if length < 0 {
+			return nil, nil
+		}
+
+		// The value is followed by a line terminator.
+		value := make([]byte, length+1)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, errors.Wrap(err, "truncated bulk string")
+		}
+
+		return string(value[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed array length")
+		} else if length < 0 {
+			return nil, nil
+		}
+
+		elements := make([]interface{}, length)
+		for i := range elements {
+			if elements[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return elements, nil
+	default:
+		return nil, errors.Errorf("unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type repliesTestSuite struct {
+	suite.Suite
+}
+
+func (r *repliesTestSuite) TestReadReply() {
+	for _, testCase := range []struct {
+		input    string
+		expected interface{}
+	}{
+		{"+OK\n", statusReply("OK")},
+		{"-ERR bacon\n", errorReply("ERR bacon")},
+		{":42\n", int64(42)},
+		{"\"PONG\"\n", statusReply("PONG")},
+		{"$5\ntasty\n", "tasty"},
+		{"$6\nta\nsty\n", "ta\nsty"},
+		{"$-1\n", nil},
+		{"*-1\n", nil},
+		{"*2\n:1\n*1\n$5\ntasty\n", []interface{}{int64(1), []interface{}{"tasty"}}},
+	} {
+		reply, err := readReply(bufio.NewReader(strings.NewReader(testCase.input)))
+
+		r.NoError(err, "%q", testCase.input)
+		r.Equal(testCase.expected, reply, "%q", testCase.input)
+	}
+}
+
+func (r *repliesTestSuite) TestReadReply_Malformed() {
+	for _, input := range []string{"", "\n", "?\n", ":bacon\n", "$5\ntas", "*2\n:1\n"} {
+		_, err := readReply(bufio.NewReader(strings.NewReader(input)))
+
+		r.Error(err, "%q", input)
+	}
+}
+
+func (r *repliesTestSuite) TestErrorString_SingleLine() {
+	r.Equal("-ERR bacon is tasty\n", errorString("ERR bacon\nis\rtasty"))
+}
+
+func TestReplies(t *testing.T) {
+	suite.Run(t, new(repliesTestSuite))
+}
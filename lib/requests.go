@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/shlex"
+	"github.com/pkg/errors"
+)
+
+// maxMultiBulkLength is the largest number of arguments a command may have,
+// as in Redis.
+const maxMultiBulkLength = 1024 * 1024
+
+// protocolError means that a request could not be parsed, so that nothing
+// the client sends after it can be made sense of either.
+type protocolError string
+
+func (p protocolError) Error() string {
+	return "Protocol error: " + string(p)
+}
+
+// malformedLine means that an inline command could not be split into
+// arguments. The line has been read whole, so the client may carry on.
+type malformedLine struct {
+	err error
+}
+
+func (m malformedLine) Error() string {
+	return "malformed line: " + m.err.Error()
+}
+
+// readCommand reads the arguments of the next command, along with the command
+// as it's logged. Commands sent as RESP arrays of bulk strings may hold any
+// bytes, while inline commands are split as in a shell, which is handy when
+// typing them but can't carry line breaks.
+func (s *SessionHandler) readCommand() (args []string, command string, err error) {
+	first, err := s.buffer.R.Peek(1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if first[0] != '*' {
+		command, err := s.buffer.ReadLine()
+		if err != nil {
+			return nil, "", err
+		}
+
+		args, err := shlex.Split(command)
+		if err != nil {
+			return nil, command, malformedLine{err}
+		}
+		return args, command, nil
+	}
+
+	count, err := s.readLength('*', maxMultiBulkLength)
+	if err != nil {
+		return nil, "", err
+	} else if count <= 0 {
+		return nil, "", nil
+	}
+
+	args = make([]string, count)
+	for i := range args {
+		if args[i], err = s.readBulkString(); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return args, strings.Join(args, " "), nil
+}
+
+// readLength reads a line holding a length after the given prefix, which may
+// be negative but no larger than max.
+func (s *SessionHandler) readLength(prefix byte, max int) (int, error) {
+	line, err := s.buffer.ReadLine()
+	if err != nil {
+		return 0, err
+	}
+
+	kind := "multibulk"
+	if prefix == '$' {
+		kind = "bulk"
+	}
+
+	if line == "" || line[0] != prefix {
+		got := "EOL"
+		if line != "" {
+			got = line[:1]
+		}
+		return 0, protocolError("expected '" + string(prefix) + "', got '" + got + "'")
+	}
+
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length > max {
+		return 0, protocolError("invalid " + kind + " length")
+	}
+
+	return length, nil
+}
+
+// readBulkString reads a single argument of a RESP command. The buffer grows
+// as the value comes in, rather than trusting the length up front.
+func (s *SessionHandler) readBulkString() (string, error) {
+	length, err := s.readLength('$', MaxValueSize)
+	if err != nil {
+		return "", err
+	} else if length < 0 {
+		return "", protocolError("invalid bulk length")
+	}
+
+	var value bytes.Buffer
+	if _, err := io.CopyN(&value, s.buffer.R, int64(length)); err != nil {
+		return "", errors.Wrap(err, "truncated bulk string")
+	}
+
+	terminator := make([]byte, 2)
+	if _, err := io.ReadFull(s.buffer.R, terminator); err != nil {
+		return "", errors.Wrap(err, "truncated bulk string")
+	} else if string(terminator) != "\r\n" {
+		return "", protocolError("bulk string not terminated by CRLF")
+	}
+
+	return value.String(), nil
+}
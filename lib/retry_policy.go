@@ -0,0 +1,296 @@
+package lib
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultRetryAttempts is the number of attempts made at each request,
+	// including the first one.
+	DefaultRetryAttempts = 4
+
+	// DefaultRetryBaseDelay and DefaultRetryMaxDelay bound the backoff
+	// between attempts, which doubles with every retry.
+	DefaultRetryBaseDelay = 25 * time.Millisecond
+	DefaultRetryMaxDelay  = time.Second
+
+	// DefaultRetryBudget and DefaultRetryBudgetRatio size the retry budget,
+	// as in gRPC retry throttling.
+	DefaultRetryBudget      = 100
+	DefaultRetryBudgetRatio = 0.1
+)
+
+var (
+	// ErrThrottled is returned once DynamoDB kept throttling a request for
+	// all attempts at it.
+	ErrThrottled = errors.New("DynamoDB kept throttling requests")
+
+	// ErrRetryBudgetExhausted is returned when a request could have been
+	// retried, but so many requests are failing that retries would only
+	// make matters worse.
+	ErrRetryBudgetExhausted = errors.New("too many DynamoDB requests are failing to retry them")
+)
+
+// throttlingErrorCodes are errors telling that a request was rejected for
+// exceeding capacity or rate limits.
+var throttlingErrorCodes = map[string]bool{
+	dynamodb.ErrCodeProvisionedThroughputExceededException: true,
+	dynamodb.ErrCodeRequestLimitExceeded:                   true,
+	"ThrottlingException":                                  true,
+	"ThrottlingError":                                      true,
+	"ProvisionedThroughputExceeded":                        true,
+}
+
+// transientErrorCodes are errors which are not the fault of the request, so
+// that it may well succeed if made again.
+var transientErrorCodes = map[string]bool{
+	dynamodb.ErrCodeInternalServerError:            true,
+	dynamodb.ErrCodeTransactionConflictException:   true,
+	dynamodb.ErrCodeTransactionInProgressException: true,
+	"ServiceUnavailable":                           true,
+	"TransactionConflict":                          true,
+}
+
+// networkErrorCodes are errors the SDK reports when a request, or its
+// response, is lost on the way, as when the connection is reset or times out.
+// Since the SDK isn't left to retry requests itself, idempotent ones are
+// retried here.
+var networkErrorCodes = map[string]bool{
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+	"RequestTimeout":               true,
+	"RequestTimeoutException":      true,
+}
+
+// rejectedErrorCodes are errors telling that a request is invalid, so that it
+// fails the same way however often it's made. ValidationError and
+// ItemCollectionSizeLimitExceeded are the codes of transaction cancellation
+// reasons.
+var rejectedErrorCodes = map[string]bool{
+	dynamodb.ErrCodeItemCollectionSizeLimitExceededException: true,
+	"ItemCollectionSizeLimitExceeded":                        true,
+	"SerializationException":                                 true,
+	"ValidationError":                                        true,
+	"ValidationException":                                    true,
+}
+
+// RetryPolicy retries requests which failed in a way worth retrying, backing
+// off exponentially with full jitter between attempts.
+//
+// Retries are limited by a budget shared by all requests: failed attempts
+// take a token from it, while successful requests put a fraction of a token
+// back, and requests are only retried while more than half of the tokens
+// are left. That way retries don't pile up when DynamoDB is failing anyway.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	budget      float64
+	budgetLimit float64
+	budgetRatio float64
+	random      *rand.Rand
+	lock        *sync.Mutex
+}
+
+// NewRetryPolicy returns a RetryPolicy with the default backoff and budget.
+func NewRetryPolicy(maxAttempts int) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: maxAttempts,
+		BaseDelay:   DefaultRetryBaseDelay,
+		MaxDelay:    DefaultRetryMaxDelay,
+		budget:      DefaultRetryBudget,
+		budgetLimit: DefaultRetryBudget,
+		budgetRatio: DefaultRetryBudgetRatio,
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		lock:        new(sync.Mutex),
+	}
+}
+
+// SetBudget sets the number of tokens in the retry budget, and the fraction
+// of a token put back by every successful request.
+func (r *RetryPolicy) SetBudget(tokens int, ratio float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.budget, r.budgetLimit, r.budgetRatio = float64(tokens), float64(tokens), ratio
+}
+
+// do makes attempts at the request until it succeeds, fails in a way not
+// worth retrying, or runs out of attempts or budget. Each attempt gets its
+// own timeout, while backing off stops early once the context is done.
+// Errors are returned as they are, except for timeouts, which are
+// ErrTimeout, and throttling outlasting all attempts.
+//
+// Requests which fail on the network may have been applied all the same, so
+// they're only retried if making them twice does no harm. Otherwise the
+// error is ErrOutcomeUnknown.
+func (r *RetryPolicy) do(ctx context.Context, timeout time.Duration, idempotent bool, request func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := attemptRequest(ctx, timeout, request)
+		if err == nil {
+			r.succeeded()
+			return nil
+		}
+
+		throttled := isThrottling(err)
+		if !idempotent && isNetworkFailure(err) {
+			return errors.WithMessage(ErrOutcomeUnknown, err.Error())
+		} else if !throttled && !isTransient(err) {
+			return err
+		}
+
+		switch {
+		case r == nil:
+			return errorAfterRetries(err, throttled)
+		case !r.failed():
+			return errors.WithMessage(ErrRetryBudgetExhausted, err.Error())
+		case attempt >= r.MaxAttempts:
+			return errorAfterRetries(err, throttled)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.backoff(attempt)):
+		}
+	}
+}
+
+// attemptRequest gives the request its own timeout.
+func attemptRequest(ctx context.Context, timeout time.Duration, request func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := request(ctx); err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return ErrTimeout
+}
+
+func errorAfterRetries(err error, throttled bool) error {
+	if throttled {
+		return errors.WithMessage(ErrThrottled, err.Error())
+	}
+	return err
+}
+
+// backoff returns how long to wait before the given retry.
+func (r *RetryPolicy) backoff(retry int) time.Duration {
+	ceiling := r.MaxDelay
+	if shift := uint(retry - 1); shift < 32 && r.BaseDelay<<shift < ceiling {
+		ceiling = r.BaseDelay << shift
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return time.Duration(r.random.Int63n(int64(ceiling) + 1))
+}
+
+// succeeded puts a fraction of a token back into the budget.
+func (r *RetryPolicy) succeeded() {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.budget += r.budgetRatio; r.budget > r.budgetLimit {
+		r.budget = r.budgetLimit
+	}
+}
+
+// failed takes a token from the budget, and tells whether there's enough
+// left to retry.
+func (r *RetryPolicy) failed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.budget--; r.budget < 0 {
+		r.budget = 0
+	}
+	return r.budget > r.budgetLimit/2
+}
+
+// isRejected tells whether a write failed for what it is, rather than for
+// anything going on with the store, so that making it again is pointless.
+func isRejected(err error) bool {
+	switch cause := errors.Cause(err); cause {
+	case ErrValueTooLarge, ErrTransactionTooLarge:
+		return true
+	default:
+		return rejectedErrorCodes[awsErrorCode(cause)] || cancellationReasonIn(cause, rejectedErrorCodes)
+	}
+}
+
+// isUnavailability tells whether a request failed because of how the store
+// is doing, rather than because of what the request is: it timed out, was
+// throttled or failed in a transient way, whether it was retried or not.
+func isUnavailability(err error) bool {
+	switch cause := errors.Cause(err); cause {
+	case ErrTimeout, ErrOutcomeUnknown, ErrThrottled, ErrRetryBudgetExhausted, context.DeadlineExceeded:
+		return true
+	default:
+		return isThrottling(cause) || isTransient(cause)
+	}
+}
+
+func isThrottling(err error) bool {
+	return throttlingErrorCodes[awsErrorCode(err)] || cancellationReasonIn(err, throttlingErrorCodes)
+}
+
+func isTransient(err error) bool {
+	return transientErrorCodes[awsErrorCode(err)] || cancellationReasonIn(err, transientErrorCodes) || isNetworkFailure(err)
+}
+
+// isNetworkFailure tells whether a request failed on its way to DynamoDB or
+// back, in which case it may or may not have been applied. Responses cut
+// short are reported as failing to read or deserialize them, wrapping the
+// error of the connection. Requests which time out as a whole, rather than on
+// the network, are ErrTimeout instead.
+func isNetworkFailure(err error) bool {
+	switch code := awsErrorCode(err); {
+	case networkErrorCodes[code]:
+		return request.IsErrorRetryable(err) || isNetworkFailure(err.(awserr.Error).OrigErr())
+	case code == request.ErrCodeRead, code == request.ErrCodeSerialization:
+		return isNetworkFailure(err.(awserr.Error).OrigErr())
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return err != nil && (strings.Contains(err.Error(), "connection reset") || strings.Contains(err.Error(), "broken pipe"))
+}
+
+// cancellationReasonIn tells whether a transaction was cancelled for any of
+// the reasons, and for no other reason than that.
+func cancellationReasonIn(err error, codes map[string]bool) bool {
+	canceled, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		return false
+	}
+
+	var found bool
+	for _, reason := range canceled.CancellationReasons {
+		switch code := aws.StringValue(reason.Code); {
+		case codes[code]:
+			found = true
+		case code != "None":
+			return false
+		}
+	}
+	return found
+}
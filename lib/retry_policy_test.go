@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type retryPolicyTestSuite struct {
+	suite.Suite
+
+	attempts int
+
+	sut *RetryPolicy
+}
+
+func (r *retryPolicyTestSuite) SetupTest() {
+	r.attempts = 0
+
+	r.sut = NewRetryPolicy(3)
+	r.sut.BaseDelay = time.Microsecond
+	r.sut.MaxDelay = time.Millisecond
+}
+
+// failing returns a request failing with the errors in turn, and succeeding
+// once it runs out of them.
+func (r *retryPolicyTestSuite) failing(errs ...error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		r.attempts++
+		if r.attempts > len(errs) {
+			return nil
+		}
+		return errs[r.attempts-1]
+	}
+}
+
+func (r *retryPolicyTestSuite) do(request func(ctx context.Context) error) error {
+	return r.sut.do(context.Background(), time.Second, true, request)
+}
+
+func throttling() error {
+	return awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+}
+
+func (r *retryPolicyTestSuite) TestSucceeds() {
+	r.NoError(r.do(r.failing()))
+	r.Equal(1, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestRetriesThrottling() {
+	r.NoError(r.do(r.failing(throttling(), throttling())))
+	r.Equal(3, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestRetriesTransient() {
+	r.NoError(r.do(r.failing(awserr.New(dynamodb.ErrCodeInternalServerError, "oops", nil))))
+	r.Equal(2, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestThrottledThroughout() {
+	err := r.do(r.failing(throttling(), throttling(), throttling()))
+
+	r.Equal(ErrThrottled, errors.Cause(err))
+	r.EqualError(err, "ProvisionedThroughputExceededException: slow down: DynamoDB kept throttling requests")
+	r.Equal(3, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestTransientThroughout() {
+	transient := awserr.New("ServiceUnavailable", "oops", nil)
+
+	r.Equal(transient, r.do(r.failing(transient, transient, transient)))
+	r.Equal(3, r.attempts)
+}
+
+func networkFailures() []error {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("read: connection reset by peer")}
+
+	return []error{
+		awserr.New(request.ErrCodeRequestError, "send request failed", &url.Error{Op: "Post", URL: "https://dynamodb", Err: reset}),
+		awserr.New(request.ErrCodeResponseTimeout, "read on body has reached the timeout limit", nil),
+		awserr.New(request.ErrCodeSerialization, "failed decoding JSON RPC response", reset),
+		&net.DNSError{Err: "i/o timeout", Name: "dynamodb", IsTimeout: true},
+		reset,
+	}
+}
+
+func (r *retryPolicyTestSuite) TestRetriesNetworkFailures() {
+	for _, failure := range networkFailures() {
+		r.attempts = 0
+		r.NoError(r.do(r.failing(failure)), failure.Error())
+		r.Equal(2, r.attempts, failure.Error())
+	}
+}
+
+func (r *retryPolicyTestSuite) TestNetworkFailuresOfWrites() {
+	for _, failure := range networkFailures() {
+		r.attempts = 0
+		err := r.sut.do(context.Background(), time.Second, false, r.failing(failure))
+		r.Equal(ErrOutcomeUnknown, errors.Cause(err), failure.Error())
+		r.Equal(1, r.attempts, failure.Error())
+	}
+
+	// Failures which tell that the request wasn't applied are retried.
+	r.attempts = 0
+	r.NoError(r.sut.do(context.Background(), time.Second, false, r.failing(throttling())))
+	r.Equal(2, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestDoesNotRetryMalformedResponses() {
+	malformed := awserr.New(request.ErrCodeSerialization, "failed decoding JSON RPC response", errors.New("unexpected end of JSON input"))
+
+	r.Equal(malformed, r.do(r.failing(malformed)))
+	r.Equal(1, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestFatal() {
+	fatal := awserr.New("ValidationException", "bacon", nil)
+
+	r.Equal(fatal, r.do(r.failing(fatal)))
+	r.Equal(1, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestTimeout() {
+	err := r.sut.do(context.Background(), time.Millisecond, true, func(ctx context.Context) error {
+		r.attempts++
+		<-ctx.Done()
+		return errors.New("RequestCanceled")
+	})
+
+	r.Equal(ErrTimeout, err)
+	r.Equal(1, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestContextDone() {
+	r.sut.BaseDelay, r.sut.MaxDelay = time.Hour, time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	r.Equal(context.DeadlineExceeded, r.sut.do(ctx, time.Second, true, r.failing(throttling())))
+	r.Equal(1, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestNoPolicy() {
+	r.sut = nil
+
+	r.Equal(ErrThrottled, errors.Cause(r.do(r.failing(throttling()))))
+	r.Equal(1, r.attempts)
+}
+
+func (r *retryPolicyTestSuite) TestBudget() {
+	r.sut.SetBudget(3, 0.5)
+
+	// The first failure leaves two tokens, which is enough to retry.
+	r.NoError(r.do(r.failing(throttling())))
+	r.Equal(2.5, r.sut.budget)
+
+	// The second one leaves only half of them.
+	r.attempts = 0
+	r.Equal(ErrRetryBudgetExhausted, errors.Cause(r.do(r.failing(throttling()))))
+	r.Equal(1, r.attempts)
+
+	// Successful requests put tokens back, up to the limit.
+	for i := 0; i < 10; i++ {
+		r.attempts = 0
+		r.NoError(r.do(r.failing()))
+	}
+	r.Equal(3.0, r.sut.budget)
+}
+
+func (r *retryPolicyTestSuite) TestBackoff() {
+	r.sut.BaseDelay, r.sut.MaxDelay = 10*time.Millisecond, 25*time.Millisecond
+
+	for i := 0; i < 100; i++ {
+		r.True(r.sut.backoff(1) <= 10*time.Millisecond)
+		r.True(r.sut.backoff(2) <= 20*time.Millisecond)
+		r.True(r.sut.backoff(3) <= 25*time.Millisecond)
+		r.True(r.sut.backoff(100) <= 25*time.Millisecond)
+	}
+}
+
+func (r *retryPolicyTestSuite) TestCancellationReasons() {
+	cancelled := func(codes ...string) error {
+		ret := &dynamodb.TransactionCanceledException{}
+		for _, code := range codes {
+			ret.CancellationReasons = append(ret.CancellationReasons, &dynamodb.CancellationReason{Code: aws.String(code)})
+		}
+		return ret
+	}
+
+	r.True(isThrottling(cancelled("None", "ThrottlingError")))
+	r.True(isTransient(cancelled("TransactionConflict", "None")))
+	r.False(isThrottling(cancelled("ThrottlingError", "ConditionalCheckFailed")))
+	r.False(isTransient(cancelled("None")))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	suite.Run(t, new(retryPolicyTestSuite))
+}
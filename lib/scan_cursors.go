@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"encoding/base64"
+)
+
+// encodeScanCursor returns the cursor SCAN hands out to clients for a store
+// cursor. Store cursors are carried in the client cursor itself, so that any
+// session on any node sharing the store can continue an iteration. The end of
+// the iteration is always cursor "0", as in Redis.
+func encodeScanCursor(cursor string) string {
+	if cursor == "" {
+		return "0"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+// decodeScanCursor returns the store cursor for a client cursor, with "0"
+// starting a new iteration. Cursors which decode fine may still be rejected
+// by the store with ErrMalformedCursor.
+func decodeScanCursor(cursor string) (string, bool) {
+	if cursor == "0" {
+		return "", true
+	}
+
+	ret, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(ret) == 0 {
+		return "", false
+	}
+	return string(ret), true
+}
@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type scanCursorsTestSuite struct {
+	suite.Suite
+}
+
+func (s *scanCursorsTestSuite) TestRoundTrip() {
+	for _, cursor := range []string{"bacon", ">\x00db1:cabbage", "0"} {
+		encoded := encodeScanCursor(cursor)
+		s.NotEqual("0", encoded)
+
+		ret, valid := decodeScanCursor(encoded)
+		s.Equal(cursor, ret)
+		s.True(valid)
+	}
+}
+
+func (s *scanCursorsTestSuite) TestStartAndEnd() {
+	s.Equal("0", encodeScanCursor(""))
+
+	ret, valid := decodeScanCursor("0")
+	s.Empty(ret)
+	s.True(valid)
+}
+
+func (s *scanCursorsTestSuite) TestInvalid() {
+	for _, cursor := range []string{"", "-", "bacon!", "a"} {
+		_, valid := decodeScanCursor(cursor)
+		s.False(valid, cursor)
+	}
+}
+
+func TestScanCursors(t *testing.T) {
+	suite.Run(t, new(scanCursorsTestSuite))
+}
@@ -0,0 +1,468 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// DefaultScriptTimeLimit mirrors the default Redis lua-time-limit. Scripts
+// are not interrupted when they reach it, but can be killed from then on.
+const DefaultScriptTimeLimit = 5 * time.Second
+
+// scriptChunkName is what compilation and runtime errors refer to scripts as.
+const scriptChunkName = "user_script"
+
+// scriptLibs are the Lua standard libraries available to scripts.
+var scriptLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// scripting holds scripts compiled by EVAL or SCRIPT LOAD, keyed by the SHA1
+// digest of their source, and keeps track of the script being executed.
+type scripting struct {
+	protos  map[string]*lua.FunctionProto
+	running *runningScript
+	lock    *sync.Mutex
+}
+
+type runningScript struct {
+	cancel  context.CancelFunc
+	killed  bool
+	started time.Time
+}
+
+func newScripting() *scripting {
+	return &scripting{
+		protos: make(map[string]*lua.FunctionProto),
+		lock:   new(sync.Mutex),
+	}
+}
+
+// load compiles the script unless it is already cached, and returns it along
+// with its digest.
+func (sc *scripting) load(source string) (sha string, proto *lua.FunctionProto, err error) {
+	sha = sha1hex(source)
+	if proto = sc.lookup(sha); proto != nil {
+		return sha, proto, nil
+	}
+
+	if proto, err = compileLua(source, scriptChunkName); err != nil {
+		return "", nil, err
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	sc.protos[sha] = proto
+	return sha, proto, nil
+}
+
+func (sc *scripting) lookup(sha string) *lua.FunctionProto {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	return sc.protos[strings.ToLower(sha)]
+}
+
+func (sc *scripting) flush() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	sc.protos = make(map[string]*lua.FunctionProto)
+}
+
+// start registers a script as running. The returned context is cancelled if
+// the script gets killed, and the returned function must be called when the
+// script is done, to tell whether that happened.
+func (sc *scripting) start() (ctx context.Context, finish func() (killed bool)) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	running := &runningScript{cancel: cancel, started: time.Now()}
+	sc.running = running
+
+	return ctx, func() bool {
+		cancel()
+
+		sc.lock.Lock()
+		defer sc.lock.Unlock()
+
+		sc.running = nil
+		return running.killed
+	}
+}
+
+// busy tells whether a script has been running for longer than the limit.
+func (sc *scripting) busy(limit time.Duration) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	return sc.busyLocked(limit)
+}
+
+func (sc *scripting) busyLocked(limit time.Duration) bool {
+	return sc.running != nil && time.Since(sc.running.started) >= limit
+}
+
+// kill stops the running script if it's been running for longer than the
+// limit, and reports whether it did.
+func (sc *scripting) kill(limit time.Duration) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if !sc.busyLocked(limit) {
+		return false
+	}
+
+	sc.running.killed = true
+	sc.running.cancel()
+
+	return true
+}
+
+func compileLua(source, chunkName string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), chunkName)
+	if err != nil {
+		return nil, err
+	}
+
+	return lua.Compile(chunk, chunkName)
+}
+
+func sha1hex(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// runScript executes a script in a fresh Lua state. The setup function
+// pushes the Lua function to call followed by its arguments, and returns the
+// number of arguments. Writes made by the script are buffered and applied to
+// the store in a single batch once it finishes, so that a killed script never
+// leaves partial results behind.
+func (s *SessionHandler) runScript(name string, readOnly bool, setup func(state *lua.LState) (nargs int, err error)) error {
+	store := newTransactionStore(s.root, nil)
+
+	ctx, finish := s.server.scripts.start()
+	run := &scriptRun{readOnly: readOnly, replies: bytes.NewBuffer(nil), session: s}
+
+	state := run.newState(ctx)
+	defer state.Close()
+
+	// Scripts can SELECT other databases without affecting the caller.
+	originalRoot, originalDB, originalWriter := s.root, s.db, s.writer
+	s.use(store, s.db)
+	s.writer = run.replies
+
+	nargs, err := setup(state)
+	if err == nil {
+		err = state.PCall(nargs, 1, nil)
+	}
+
+	s.use(originalRoot, originalDB)
+	s.writer = originalWriter
+
+	killed := finish()
+
+	if run.fatal != nil {
+		return run.fatal
+	} else if killed {
+		_, err := io.WriteString(s.writer, errorString("ERR Script killed by user with SCRIPT KILL..."))
+		return err
+	}
+
+	// Commands like RENAME make their writes conditional on the keys they
+	// read, which other nodes may have modified while the script was running.
+	if commitErr := store.commit(nil); errors.Cause(commitErr) == ErrConditionFailed {
+		_, err := io.WriteString(s.writer, errorString("ERR Script writes were discarded, since keys they depend on were modified concurrently"))
+		return err
+	} else if commitErr != nil {
+		return errors.Wrap(commitErr, "could not commit script writes")
+	}
+
+	if err != nil {
+		_, err := io.WriteString(s.writer, scriptError(name, err))
+		return err
+	}
+
+	_, err = io.WriteString(s.writer, luaToReply(state.Get(-1)))
+	return err
+}
+
+// scriptError formats an error raised by the script the way Redis does.
+// Errors returned by redis.call, or created with redis.error_reply, are
+// passed to the client as they are.
+func scriptError(name string, err error) string {
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok {
+		return errorString(fmt.Sprintf("ERR Error running script (call to %s): %v", name, err))
+	}
+
+	if table, ok := apiErr.Object.(*lua.LTable); ok {
+		if message, ok := table.RawGetString("err").(lua.LString); ok {
+			return errorString(string(message))
+		}
+	}
+
+	return errorString(fmt.Sprintf("ERR Error running script (call to %s): @%s", name, apiErr.Object.String()))
+}
+
+// scriptRun is the state of a single script execution, used to dispatch
+// redis.call back into the session executing the script.
+type scriptRun struct {
+	cancel   context.CancelFunc
+	fatal    error
+	readOnly bool
+	replies  *bytes.Buffer
+	session  *SessionHandler
+}
+
+func (r *scriptRun) newState(ctx context.Context) *lua.LState {
+	ctx, r.cancel = context.WithCancel(ctx)
+	state := newLuaState(ctx)
+
+	table := newRedisTable(state, r.session.logger)
+	state.SetFuncs(table, map[string]lua.LGFunction{
+		"call":  func(L *lua.LState) int { return r.call(L, true) },
+		"pcall": func(L *lua.LState) int { return r.call(L, false) },
+	})
+	state.SetGlobal("redis", table)
+
+	return state
+}
+
+// newLuaState returns a sandboxed Lua state, which stops executing as soon
+// as the context is done.
+func newLuaState(ctx context.Context) *lua.LState {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for _, lib := range scriptLibs {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+
+	// Scripts have no business touching the file system.
+	state.SetGlobal("dofile", lua.LNil)
+	state.SetGlobal("loadfile", lua.LNil)
+
+	state.SetContext(ctx)
+	return state
+}
+
+// newRedisTable returns the parts of the redis Lua API which do not depend
+// on the script being executed.
+func newRedisTable(state *lua.LState, logger *logrus.Entry) *lua.LTable {
+	table := state.NewTable()
+
+	state.SetFuncs(table, map[string]lua.LGFunction{
+		"error_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1hex(L.CheckString(1))))
+			return 1
+		},
+		"log": func(L *lua.LState) int { return luaLog(L, logger) },
+	})
+
+	for name, level := range map[string]int{
+		"LOG_DEBUG":   0,
+		"LOG_VERBOSE": 1,
+		"LOG_NOTICE":  2,
+		"LOG_WARNING": 3,
+	} {
+		table.RawSetString(name, lua.LNumber(level))
+	}
+
+	return table
+}
+
+// call implements redis.call and redis.pcall, which only differ in whether
+// error replies are raised as Lua errors or returned.
+func (r *scriptRun) call(L *lua.LState, raise bool) int {
+	reply := r.execute(L)
+
+	if r.fatal != nil {
+		r.cancel()
+		L.RaiseError("%v", r.fatal)
+		return 0
+	}
+
+	if message, isError := reply.(errorReply); isError && raise {
+		L.Error(replyTable(L, "err", string(message)), 1)
+		return 0
+	}
+
+	L.Push(replyToLua(L, reply))
+	return 1
+}
+
+func (r *scriptRun) execute(L *lua.LState) interface{} {
+	args := make([]string, L.GetTop())
+	for i := range args {
+		switch arg := L.Get(i + 1).(type) {
+		case lua.LString, lua.LNumber:
+			args[i] = arg.String()
+		default:
+			return errorReply("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	if len(args) == 0 {
+		return errorReply("ERR Please specify at least one argument for this redis lib call")
+	}
+
+	cmd, known := commands[strings.ToLower(args[0])]
+	if !known {
+		return errorReply("ERR Unknown Redis command called from script")
+	} else if cmd.is(flagNoScript) {
+		return errorReply("ERR This Redis command is not allowed from script")
+	} else if r.readOnly && cmd.is(flagWrite) {
+		return errorReply("ERR Write commands are not allowed from read-only scripts.")
+	} else if !cmd.validArity(len(args)) {
+		return errorReply("ERR Wrong number of args calling Redis command from script")
+	} else if key, reserved := cmd.reservedKey(args); reserved {
+		return errorReply(reservedKeyError(key))
+	}
+
+	r.replies.Reset()
+
+	if err := cmd.handler(r.session, args[1:]); err != nil {
+		r.fatal = err
+		return nil
+	}
+
+	reply, err := readReply(bufio.NewReader(r.replies))
+	if err != nil {
+		r.fatal = errors.Wrapf(err, "could not read reply to %s", args[0])
+	}
+
+	return reply
+}
+
+func luaLog(L *lua.LState, logger *logrus.Entry) int {
+	if L.GetTop() < 2 {
+		L.RaiseError("redis.log() requires two arguments or more.")
+		return 0
+	}
+
+	parts := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+	}
+	message := strings.Join(parts, " ")
+
+	switch level := L.CheckInt(1); level {
+	case 0, 1:
+		logger.Debug(message)
+	case 2:
+		logger.Info(message)
+	case 3:
+		logger.Warn(message)
+	default:
+		L.RaiseError("Invalid debug level.")
+	}
+
+	return 0
+}
+
+func stringsTable(L *lua.LState, values []string) *lua.LTable {
+	table := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		table.Append(lua.LString(value))
+	}
+	return table
+}
+
+func replyTable(L *lua.LState, field, message string) *lua.LTable {
+	table := L.CreateTable(0, 1)
+	table.RawSetString(field, lua.LString(message))
+	return table
+}
+
+// replyToLua converts a command reply to a Lua value following the Redis
+// conversion rules.
+func replyToLua(L *lua.LState, reply interface{}) lua.LValue {
+	switch value := reply.(type) {
+	case int64:
+		return lua.LNumber(value)
+	case string:
+		return lua.LString(value)
+	case statusReply:
+		return replyTable(L, "ok", string(value))
+	case errorReply:
+		return replyTable(L, "err", string(value))
+	case []interface{}:
+		table := L.CreateTable(len(value), 0)
+		for _, element := range value {
+			table.Append(replyToLua(L, element))
+		}
+		return table
+	default:
+		return lua.LFalse
+	}
+}
+
+// luaToReply converts a value returned by a script to a reply following the
+// Redis conversion rules. Numbers are truncated to integers and arrays end
+// at the first nil.
+func luaToReply(value lua.LValue) string {
+	switch value := value.(type) {
+	case lua.LNumber:
+		return integer(int(value))
+	case lua.LString:
+		return bulkString(string(value))
+	case lua.LBool:
+		if value {
+			return integer(1)
+		}
+		return nullBulkString
+	case *lua.LTable:
+		if message, ok := value.RawGetString("err").(lua.LString); ok {
+			return errorString(string(message))
+		}
+
+		if message, ok := value.RawGetString("ok").(lua.LString); ok {
+			return simpleString(string(message))
+		}
+
+		var elements []string
+		for i := 1; ; i++ {
+			element := value.RawGetInt(i)
+			if element == lua.LNil {
+				break
+			}
+			elements = append(elements, luaToReply(element))
+		}
+
+		return arrayHeader(len(elements)) + strings.Join(elements, "")
+	default:
+		return nullBulkString
+	}
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func (s *SessionHandler) handleEval(args []string) error {
+	sha, proto, err := s.server.scripts.load(args[0])
+	if err != nil {
+		return s.compileError(err)
+	}
+
+	return s.evalScript(proto, sha, args[1:])
+}
+
+func (s *SessionHandler) handleEvalSHA(args []string) error {
+	proto := s.server.scripts.lookup(args[0])
+	if proto == nil {
+		_, err := fmt.Fprintln(s.writer, "-NOSCRIPT No matching script. Please use EVAL.")
+		return err
+	}
+
+	return s.evalScript(proto, strings.ToLower(args[0]), args[1:])
+}
+
+func (s *SessionHandler) evalScript(proto *lua.FunctionProto, sha string, args []string) error {
+	keys, argv, ok, err := s.splitKeys(args)
+	if !ok {
+		return err
+	}
+
+	return s.runScript("f_"+sha, false, func(state *lua.LState) (int, error) {
+		state.SetGlobal("KEYS", stringsTable(state, keys))
+		state.SetGlobal("ARGV", stringsTable(state, argv))
+		state.Push(state.NewFunctionFromProto(proto))
+		return 0, nil
+	})
+}
+
+// splitKeys splits the arguments following a script or function name into
+// key names and other arguments, based on the number of keys given first.
+// If that number is invalid, it replies with an error and returns !ok.
+func (s *SessionHandler) splitKeys(args []string) (keys, argv []string, ok bool, err error) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		_, err := fmt.Fprintln(s.writer, "-ERR value is not an integer or out of range")
+		return nil, nil, false, err
+	} else if numKeys > len(args)-1 {
+		_, err := fmt.Fprintln(s.writer, "-ERR Number of keys can't be greater than number of args")
+		return nil, nil, false, err
+	} else if numKeys < 0 {
+		_, err := fmt.Fprintln(s.writer, "-ERR Number of keys can't be negative")
+		return nil, nil, false, err
+	}
+
+	return args[1 : 1+numKeys], args[1+numKeys:], true, nil
+}
+
+func (s *SessionHandler) compileError(err error) error {
+	_, err = io.WriteString(s.writer, errorString(fmt.Sprintf("ERR Error compiling script (new function): %v", err)))
+	return err
+}
+
+func (s *SessionHandler) handleScript(args []string) error {
+	switch strings.ToLower(args[0]) {
+	case "load":
+		if len(args) != 2 {
+			return s.badArgs("script|load")
+		}
+
+		sha, _, err := s.server.scripts.load(args[1])
+		if err != nil {
+			return s.compileError(err)
+		}
+
+		_, err = io.WriteString(s.writer, bulkString(sha))
+		return err
+	case "exists":
+		if len(args) < 2 {
+			return s.badArgs("script|exists")
+		}
+
+		reply := arrayHeader(len(args) - 1)
+		for _, sha := range args[1:] {
+			if s.server.scripts.lookup(sha) != nil {
+				reply += integer(1)
+			} else {
+				reply += integer(0)
+			}
+		}
+
+		_, err := io.WriteString(s.writer, reply)
+		return err
+	case "flush":
+		if len(args) > 2 {
+			return s.badArgs("script|flush")
+		} else if len(args) == 2 && !strings.EqualFold(args[1], "sync") && !strings.EqualFold(args[1], "async") {
+			_, err := fmt.Fprintln(s.writer, "-ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+			return err
+		}
+
+		s.server.scripts.flush()
+
+		_, err := fmt.Fprintln(s.writer, "+OK")
+		return err
+	case "kill":
+		if len(args) != 1 {
+			return s.badArgs("script|kill")
+		}
+
+		if !s.server.scripts.kill(s.server.ScriptTimeLimit) {
+			_, err := fmt.Fprintln(s.writer, "-NOTBUSY No scripts in execution right now.")
+			return err
+		}
+
+		_, err := fmt.Fprintln(s.writer, "+OK")
+		return err
+	default:
+		_, err := fmt.Fprintf(s.writer, "-ERR unknown subcommand '%s'\n", args[0])
+		return err
+	}
+}
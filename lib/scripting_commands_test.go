@@ -0,0 +1,209 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/mock"
+)
+
+func (s *sessionHandlerTestSuite) TestEval_Conversions() {
+	fmt.Fprintln(s.conn, `EVAL "return {1, 'two', {3}, false, true, nil, 7}" 0`)
+
+	s.True(s.sut.handleLine())
+	s.responded("*5\n:1\n$3\ntwo\n*1\n:3\n$-1\n:1")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_KeysAndArgv() {
+	fmt.Fprintln(s.conn, `EVAL "return {KEYS[1], ARGV[1], ARGV[2]}" 1 bacon tasty crispy`)
+
+	s.True(s.sut.handleLine())
+	s.responded("*3\n$5\nbacon\n$5\ntasty\n$6\ncrispy")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_Call() {
+	fmt.Fprintln(s.conn, `EVAL "return redis.call('get', KEYS[1])" 1 bacon`)
+
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+
+	s.True(s.sut.handleLine())
+	s.responded("$5\ntasty")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_CallNotFound() {
+	fmt.Fprintln(s.conn, `EVAL "return redis.call('GET', KEYS[1]) == false" 1 bacon`)
+
+	s.store.On("Get", "bacon").Return("", false, nil)
+
+	s.True(s.sut.handleLine())
+	s.responded(":1")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_WritesAppliedAtOnce() {
+	fmt.Fprintln(s.conn, `EVAL "redis.call('SET', KEYS[1], ARGV[1]); redis.call('SET', KEYS[2], ARGV[1]); return redis.call('GET', KEYS[1])" 2 bacon cabbage tasty`)
+
+	s.store.On("Apply", []Write{
+		{Key: "bacon", Value: "tasty"},
+		{Key: "cabbage", Value: "tasty"},
+	}, []Condition(nil)).Return(nil)
+
+	s.True(s.sut.handleLine())
+	s.responded("$5\ntasty")
+	s.store.AssertNotCalled(s.T(), "Get", "bacon")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_StatusReply() {
+	fmt.Fprintln(s.conn, `EVAL "return redis.call('PING')" 0`)
+
+	s.True(s.sut.handleLine())
+	s.responded("+PONG")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_ErrorReply() {
+	fmt.Fprintln(s.conn, `EVAL "return redis.error_reply('MY bacon')" 0`)
+
+	s.True(s.sut.handleLine())
+	s.responded("-MY bacon")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_CallRaisesErrors() {
+	fmt.Fprintln(s.conn, `EVAL "redis.call('SET', 'bacon'); return 1" 0`)
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR Wrong number of args calling Redis command from script")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_PCallReturnsErrors() {
+	fmt.Fprint(s.conn, `EVAL "return redis.pcall('BACON')['err']" 0`+"\n"+`EVAL "return redis.pcall('MULTI')" 0`+"\n")
+
+	s.handleLines(2)
+	s.responded("$44\nERR Unknown Redis command called from script\n-ERR This Redis command is not allowed from script")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_CallReservedKey() {
+	s.Require().NoError(s.sut.dispatch([]string{"EVAL", "return redis.pcall('SET', KEYS[1], 'x')['err']", "1", functionsKey}))
+	s.responded("$55\nERR key \"\\x00goredis:functions\" is reserved for goredis")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestEval_RuntimeError() {
+	fmt.Fprintln(s.conn, `EVAL "error('bacon')" 0`)
+
+	s.True(s.sut.handleLine())
+	s.responded(fmt.Sprintf("-ERR Error running script (call to f_%s): @user_script:1: bacon", sha1hex("error('bacon')")))
+}
+
+func (s *sessionHandlerTestSuite) TestEval_CompileError() {
+	fmt.Fprintln(s.conn, `EVAL "return (" 0`)
+
+	s.True(s.sut.handleLine())
+	s.Contains(s.buffer.String(), "-ERR Error compiling script (new function): user_script")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_NoFileSystemAccess() {
+	fmt.Fprintln(s.conn, `EVAL "return {type(dofile), type(loadfile), type(io), type(os)}" 0`)
+
+	s.True(s.sut.handleLine())
+	s.responded("*4\n$3\nnil\n$3\nnil\n$3\nnil\n$3\nnil")
+}
+
+func (s *sessionHandlerTestSuite) TestEval_InvalidNumKeys() {
+	fmt.Fprint(s.conn, "EVAL \"return 1\" bacon\nEVAL \"return 1\" 2 bacon\nEVAL \"return 1\" -1\n")
+
+	s.handleLines(3)
+	s.responded(
+		"-ERR value is not an integer or out of range\n" +
+			"-ERR Number of keys can't be greater than number of args\n" +
+			"-ERR Number of keys can't be negative",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestEval_StoreError() {
+	fmt.Fprintln(s.conn, `EVAL "return redis.pcall('GET', 'bacon')" 0`)
+
+	s.store.On("Get", "bacon").Return("", false, errors.New("store error"))
+
+	s.False(s.sut.handleLine())
+	s.loggedError(`Could not handle command EVAL \"return redis.pcall('GET', 'bacon')\" 0: could not read from the store: store error`)
+}
+
+func (s *sessionHandlerTestSuite) TestEval_InsideMulti() {
+	fmt.Fprint(s.conn, "MULTI\nEVAL \"return redis.call('SET', 'bacon', 'tasty')\" 0\nSET cabbage healthy\nEXEC\n")
+
+	s.store.On("Apply", []Write{
+		{Key: "bacon", Value: "tasty"},
+		{Key: "cabbage", Value: "healthy"},
+	}, []Condition{}).Return(nil)
+
+	s.handleLines(4)
+	s.responded("+OK\n+QUEUED\n+QUEUED\n*2\n+OK\n+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestEvalSHA() {
+	sha := sha1hex("return ARGV[1]")
+	fmt.Fprintf(s.conn, "SCRIPT LOAD \"return ARGV[1]\"\nEVALSHA %s 0 bacon\n", sha)
+
+	s.handleLines(2)
+	s.responded(fmt.Sprintf("$40\n%s\n$5\nbacon", sha))
+}
+
+func (s *sessionHandlerTestSuite) TestEvalSHA_NoScript() {
+	fmt.Fprintln(s.conn, "EVALSHA e0e1f9fabfc9d4800c877a703b823ac0578ff8db 0")
+
+	s.True(s.sut.handleLine())
+	s.responded("-NOSCRIPT No matching script. Please use EVAL.")
+}
+
+func (s *sessionHandlerTestSuite) TestScript_ExistsAndFlush() {
+	sha := sha1hex("return 1")
+	fmt.Fprintf(s.conn, "EVAL \"return 1\" 0\nSCRIPT EXISTS %s bacon\nSCRIPT FLUSH\nSCRIPT EXISTS %s\n", sha, sha)
+
+	s.handleLines(4)
+	s.responded(":1\n*2\n:1\n:0\n+OK\n*1\n:0")
+}
+
+func (s *sessionHandlerTestSuite) TestScript_Invalid() {
+	fmt.Fprint(s.conn, "SCRIPT FLUSH LATER\nSCRIPT BACON\nSCRIPT LOAD\n")
+
+	s.handleLines(3)
+	s.responded(
+		"-ERR SCRIPT FLUSH only support SYNC|ASYNC option\n" +
+			"-ERR unknown subcommand 'BACON'\n" +
+			"-ERR wrong number of arguments for 'script|load' command",
+	)
+}
+
+func (s *sessionHandlerTestSuite) TestScript_KillNotBusy() {
+	fmt.Fprintln(s.conn, "SCRIPT KILL")
+
+	s.True(s.sut.handleLine())
+	s.responded("-NOTBUSY No scripts in execution right now.")
+}
+
+func (s *sessionHandlerTestSuite) TestScript_Kill() {
+	s.server.ScriptTimeLimit = time.Millisecond
+
+	// The script writes first, to make sure the write never makes it to
+	// the store.
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintln(buffer, `EVAL "redis.call('SET', 'bacon', 'tasty') while true do end" 0`)
+	busy := NewSessionHandler(&mockReadWriteCloser{ReadWriter: buffer}, logrus.NewEntry(logrus.New()), s.server)
+
+	done := make(chan bool)
+	go func() { done <- busy.handleLine() }()
+
+	for !s.server.scripts.busy(s.server.ScriptTimeLimit) {
+		time.Sleep(time.Millisecond)
+	}
+
+	fmt.Fprint(s.conn, "GET bacon\nSCRIPT KILL\n")
+	s.handleLines(2)
+
+	s.True(<-done)
+	s.responded("-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\n+OK")
+	s.Equal("-ERR Script killed by user with SCRIPT KILL...\n", buffer.String())
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
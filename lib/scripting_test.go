@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type scriptingTestSuite struct {
+	suite.Suite
+
+	sut *scripting
+}
+
+func (s *scriptingTestSuite) SetupTest() {
+	s.sut = newScripting()
+}
+
+func (s *scriptingTestSuite) TestLoad() {
+	sha, proto, err := s.sut.load("return 1")
+
+	s.NoError(err)
+	s.Equal("e0e1f9fabfc9d4800c877a703b823ac0578ff8db", sha)
+	s.Equal(proto, s.sut.lookup("E0E1F9FABFC9D4800C877A703B823AC0578FF8DB"))
+
+	s.sut.flush()
+	s.Nil(s.sut.lookup(sha))
+}
+
+func (s *scriptingTestSuite) TestLoad_CompileError() {
+	_, _, err := s.sut.load("return (")
+
+	s.Error(err)
+	s.Contains(err.Error(), "user_script")
+}
+
+func (s *scriptingTestSuite) TestKill() {
+	s.False(s.sut.kill(0))
+
+	ctx, finish := s.sut.start()
+
+	s.False(s.sut.busy(time.Hour))
+	s.False(s.sut.kill(time.Hour))
+	s.NoError(ctx.Err())
+
+	s.True(s.sut.busy(0))
+	s.True(s.sut.kill(0))
+	s.Error(ctx.Err())
+
+	s.True(finish())
+	s.False(s.sut.busy(0))
+}
+
+func (s *scriptingTestSuite) TestLuaToReply() {
+	state := lua.NewState()
+	defer state.Close()
+
+	table := state.NewTable()
+	table.Append(lua.LNumber(1.9))
+	table.Append(lua.LString("two"))
+	table.Append(lua.LFalse)
+	table.Append(replyTable(state, "ok", "fine"))
+	table.RawSetInt(6, lua.LString("after a hole"))
+
+	for _, testCase := range []struct {
+		value    lua.LValue
+		expected string
+	}{
+		{lua.LNumber(42), ":42\n"},
+		{lua.LString("tasty"), "$5\ntasty\n"},
+		{lua.LTrue, ":1\n"},
+		{lua.LFalse, "$-1\n"},
+		{lua.LNil, "$-1\n"},
+		{replyTable(state, "ok", "OK"), "+OK\n"},
+		{replyTable(state, "err", "ERR bacon"), "-ERR bacon\n"},
+		{table, "*4\n:1\n$3\ntwo\n$-1\n+fine\n"},
+	} {
+		s.Equal(testCase.expected, luaToReply(testCase.value))
+	}
+}
+
+func (s *scriptingTestSuite) TestReplyToLua() {
+	state := lua.NewState()
+	defer state.Close()
+
+	s.Equal(lua.LNumber(42), replyToLua(state, int64(42)))
+	s.Equal(lua.LString("tasty"), replyToLua(state, "tasty"))
+	s.Equal(lua.LFalse, replyToLua(state, nil))
+	s.Equal(lua.LString("OK"), replyToLua(state, statusReply("OK")).(*lua.LTable).RawGetString("ok"))
+	s.Equal(lua.LString("ERR bacon"), replyToLua(state, errorReply("ERR bacon")).(*lua.LTable).RawGetString("err"))
+
+	table := replyToLua(state, []interface{}{int64(1), nil}).(*lua.LTable)
+	s.Equal(2, table.Len())
+	s.Equal(lua.LFalse, table.RawGetInt(2))
+}
+
+func TestScripting(t *testing.T) {
+	suite.Run(t, new(scriptingTestSuite))
+}
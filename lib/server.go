@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// Server holds the state shared by all client sessions.
+type Server struct {
+	PubSub             *PubSub
+	PubSubOutputLimits OutputBufferLimits
+	Store              Store
+
+	// Databases is the number of databases clients can SELECT.
+	Databases int
+
+	// ScriptTimeLimit is how long a script can run before other clients are
+	// told the server is busy, and it can be killed with SCRIPT KILL.
+	ScriptTimeLimit time.Duration
+
+	// FlushTimeLimit is how long FLUSHDB and FLUSHALL without ASYNC delete
+	// keys before replying. Keys left by then are deleted in the background.
+	FlushTimeLimit time.Duration
+
+	access    *accessTracker
+	functions *functionRegistry
+	scripts   *scripting
+
+	// lock is held for reading while executing regular commands, and for
+	// writing while executing commands which need to appear atomic to all
+	// other sessions, like EXEC.
+	lock *sync.RWMutex
+}
+
+// NewServer returns a Server backed by the given Store, applying the default
+// Redis output buffer limits to pub/sub clients, the default time limit to
+// scripts and flushes, and the default number of databases.
+func NewServer(store Store) *Server {
+	return &Server{
+		PubSub:             NewPubSub(),
+		PubSubOutputLimits: DefaultPubSubOutputLimits,
+		Store:              store,
+		Databases:          DefaultDatabases,
+		ScriptTimeLimit:    DefaultScriptTimeLimit,
+		FlushTimeLimit:     DefaultFlushTimeLimit,
+		access:             newAccessTracker(maxTrackedKeys),
+		functions:          newFunctionRegistry(),
+		scripts:            newScripting(),
+		lock:               new(sync.RWMutex),
+	}
+}
@@ -5,33 +5,61 @@ import (
 	"fmt"
 	"io"
 	"net/textproto"
-	"strings"
 
-	"github.com/google/shlex"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 // SessionHandler handles a single client connection.
 type SessionHandler struct {
-	buffer *textproto.Reader
-	conn   io.ReadWriteCloser
-	logger *logrus.Entry
-	store  Store
+	buffer     *textproto.Reader
+	conn       io.ReadWriteCloser
+	consistent bool
+	db         int
+	logger     *logrus.Entry
+	multi      *transaction
+	output     *clientOutput
+	server     *Server
+	subscriber *subscriber
+	watched    map[string]uint64
+
+	// root is the store holding all databases - normally the server store,
+	// but writes are buffered while a transaction or a script is executed.
+	// store is the view of the selected database within it.
+	root  Store
+	store *databaseStore
+
+	// writer is where replies go - normally the client output, but replies
+	// are captured while a transaction is being executed.
+	writer io.Writer
 }
 
 // NewSessionHandler builds a fully usable SessionHandler.
-func NewSessionHandler(conn io.ReadWriteCloser, logger *logrus.Entry, store Store) *SessionHandler {
-	return &SessionHandler{
+func NewSessionHandler(conn io.ReadWriteCloser, logger *logrus.Entry, server *Server) *SessionHandler {
+	ret := &SessionHandler{
 		buffer: textproto.NewReader(bufio.NewReader(conn)),
 		conn:   conn,
 		logger: logger,
-		store:  store,
+		server: server,
 	}
+
+	ret.use(server.Store, 0)
+
+	ret.output = newClientOutput(conn, server.PubSubOutputLimits, ret.overflow)
+	ret.writer = ret.output
+
+	return ret
+}
+
+// use points the session at a database within the root store.
+func (s *SessionHandler) use(root Store, db int) {
+	s.db, s.root = db, root
+	s.store = &databaseStore{root: root, db: db, consistent: s.consistent}
 }
 
 func (s *SessionHandler) badArgs(command string) error {
-	_, err := fmt.Fprintf(s.conn, "-ERR wrong number of arguments for '%s' command\n", command)
+	_, err := fmt.Fprintf(s.writer, "-ERR wrong number of arguments for '%s' command\n", command)
 	return err
 }
 
@@ -39,6 +67,7 @@ func (s *SessionHandler) badArgs(command string) error {
 func (s *SessionHandler) Handle() {
 	defer s.logger.Info("Closed connection")
 	defer s.conn.Close()
+	defer s.unsubscribeAll()
 
 	for {
 		if !s.handleLine() {
@@ -48,15 +77,28 @@ func (s *SessionHandler) Handle() {
 }
 
 func (s *SessionHandler) handleLine() (keepOpen bool) {
-	command, err := s.buffer.ReadLine()
-	if err == io.EOF {
+	args, command, err := s.readCommand()
+	switch err.(type) {
+	case nil:
+	case malformedLine:
+		_, err = fmt.Fprintf(s.writer, "-ERR %v\n", err)
+		return err == nil
+	case protocolError:
+		s.logger.Warnf("Closing client for a protocol error: %v", err)
+		io.WriteString(s.writer, errorString("ERR "+err.Error()))
 		return false
-	} else if err != nil {
-		s.logger.Errorf("Could not read command: %v", err)
+	default:
+		if err != io.EOF {
+			s.logger.Errorf("Could not read command: %v", err)
+		}
 		return false
 	}
 
-	err = s.handleCommand(command)
+	if len(args) == 0 {
+		return true
+	}
+
+	err = s.dispatch(args)
 	if err == nil {
 		return true
 	}
@@ -68,25 +110,6 @@ func (s *SessionHandler) handleLine() (keepOpen bool) {
 	return false
 }
 
-func (s *SessionHandler) handleCommand(command string) error {
-	args, err := shlex.Split(command)
-	if err != nil {
-		_, err := fmt.Fprintf(s.conn, "-ERR malformed line: %v\n", err)
-		return err
-	}
-
-	switch strings.ToLower(args[0]) {
-	case "get":
-		return s.handleGet(args[1:])
-	case "ping":
-		return s.handlePing(args[1:])
-	case "set":
-		return s.handleSet(args[1:])
-	default:
-		return s.handleUnknown(args)
-	}
-}
-
 func (s *SessionHandler) handleGet(args []string) error {
 	if len(args) != 1 {
 		return s.badArgs("get")
@@ -98,11 +121,13 @@ func (s *SessionHandler) handleGet(args []string) error {
 	}
 
 	if !found {
-		_, err := fmt.Fprintln(s.conn, "$-1")
+		_, err := fmt.Fprintln(s.writer, "$-1")
 		return err
 	}
 
-	_, err = fmt.Fprintf(s.conn, "$%d\n%s\n", len(value), value)
+	s.server.access.touch(accessKey(s.db, args[0]))
+
+	_, err = fmt.Fprintf(s.writer, "$%d\n%s\n", len(value), value)
 	return err
 }
 
@@ -111,15 +136,36 @@ func (s *SessionHandler) handlePing(args []string) error {
 		return s.badArgs("ping")
 	}
 
+	if s.subscribed() {
+		// In subscribed mode clients expect every reply to be a push-style
+		// array, so PING replies accordingly.
+		var message string
+		if len(args) == 1 {
+			message = args[0]
+		}
+
+		_, err := io.WriteString(s.writer, arrayHeader(2)+bulkString("pong")+bulkString(message))
+		return err
+	}
+
 	response := "PONG"
 	if len(args) == 1 {
 		response = args[0]
 	}
 
-	_, err := fmt.Fprintf(s.conn, "%q\n", response)
+	_, err := fmt.Fprintf(s.writer, "%q\n", response)
 	return err
 }
 
+func (s *SessionHandler) handleQuit(args []string) error {
+	if _, err := fmt.Fprintln(s.writer, "+OK"); err != nil {
+		return err
+	}
+
+	// Returning EOF closes the connection without logging an error.
+	return io.EOF
+}
+
 func (s *SessionHandler) handleSet(args []string) error {
 	if len(args) < 2 {
 		return s.badArgs("set")
@@ -129,11 +175,52 @@ func (s *SessionHandler) handleSet(args []string) error {
 		return errors.Wrap(err, "could not write to the store")
 	}
 
-	_, err := fmt.Fprintln(s.conn, "+OK")
+	s.server.access.touch(accessKey(s.db, args[0]))
+
+	_, err := fmt.Fprintln(s.writer, "+OK")
 	return err
 }
 
 func (s *SessionHandler) handleUnknown(args []string) error {
-	_, err := fmt.Fprintf(s.conn, "-ERR unknown command `%s`, with args beginning with %s\n", args[0], args[1:])
+	_, err := fmt.Fprintf(s.writer, "-ERR unknown command `%s`, with args beginning with %s\n", args[0], args[1:])
 	return err
 }
+
+// replyStoreError replies to the client with an error when the store fails in
+// a way which says nothing about the connection, so that the client can try
+// again instead of being disconnected. Any other error is returned as it is.
+func (s *SessionHandler) replyStoreError(err error) error {
+	var reply string
+	switch cause := errors.Cause(err); cause {
+	case nil:
+		return nil
+	case ErrTimeout:
+		reply = "TIMEOUT " + ErrTimeout.Error()
+	case ErrOutcomeUnknown:
+		reply = "ERR " + ErrOutcomeUnknown.Error()
+	case ErrThrottled:
+		reply = "TRYAGAIN " + ErrThrottled.Error()
+	case ErrRetryBudgetExhausted:
+		reply = "BUSY " + ErrRetryBudgetExhausted.Error()
+	case ErrCircuitOpen:
+		reply = "TRYAGAIN " + ErrCircuitOpen.Error()
+	case ErrValueTooLarge:
+		reply = "ERR " + ErrValueTooLarge.Error()
+	default:
+		awsErr, ok := cause.(awserr.Error)
+		if !ok {
+			return err
+		}
+		reply = fmt.Sprintf("ERR %s: %s: %s", apiErrorMessage, awsErr.Code(), awsErr.Message())
+	}
+
+	s.logger.Warnf("Replying with a store error: %v", err)
+
+	_, err = io.WriteString(s.writer, errorString(reply))
+	return err
+}
+
+func (s *SessionHandler) overflow() {
+	s.logger.Warn("Closing client for overcoming output buffer limits")
+	s.conn.Close()
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
@@ -18,6 +19,7 @@ type sessionHandlerTestSuite struct {
 	buffer    *bytes.Buffer
 	conn      *mockReadWriteCloser
 	logOutput *bytes.Buffer
+	server    *Server
 	store     *mockStore
 
 	sut *SessionHandler
@@ -29,13 +31,19 @@ func (s *sessionHandlerTestSuite) SetupTest() {
 	s.logOutput = bytes.NewBuffer(nil)
 	s.store = new(mockStore)
 
+	// Databases have never been swapped nor flushed, unless a test says so.
+	s.store.On("Get", databasesKey).Return("", false, nil)
+	s.store.On("Version", databasesKey).Return(uint64(0), nil)
+
 	logger := logrus.New()
 	logger.SetOutput(s.logOutput)
 
+	s.server = NewServer(s.store)
+
 	s.sut = NewSessionHandler(
 		s.conn,
 		logger.WithField("test", true),
-		s.store,
+		s.server,
 	)
 }
 
@@ -82,6 +90,60 @@ func (s *sessionHandlerTestSuite) TestGet_StoreError() {
 	s.loggedError("Could not handle command GET bacon: could not read from the store: store error")
 }
 
+func (s *sessionHandlerTestSuite) TestGet_Timeout() {
+	fmt.Fprintln(s.conn, `GET bacon`)
+
+	s.store.On("Get", "bacon").Return("", false, ErrTimeout)
+
+	s.True(s.sut.handleLine())
+	s.responded("-TIMEOUT DynamoDB request timed out")
+}
+
+func (s *sessionHandlerTestSuite) TestGet_Throttled() {
+	fmt.Fprintln(s.conn, `GET bacon`)
+
+	s.store.On("Get", "bacon").Return("", false, ErrThrottled)
+
+	s.True(s.sut.handleLine())
+	s.responded("-TRYAGAIN DynamoDB kept throttling requests")
+}
+
+func (s *sessionHandlerTestSuite) TestSet_RetryBudgetExhausted() {
+	fmt.Fprintln(s.conn, `SET bacon tasty`)
+
+	s.store.On("Set", "bacon", "tasty").Return(ErrRetryBudgetExhausted)
+
+	s.True(s.sut.handleLine())
+	s.responded("-BUSY too many DynamoDB requests are failing to retry them")
+}
+
+func (s *sessionHandlerTestSuite) TestSet_CircuitOpen() {
+	fmt.Fprintln(s.conn, `SET bacon tasty`)
+
+	s.store.On("Set", "bacon", "tasty").Return(ErrCircuitOpen)
+
+	s.True(s.sut.handleLine())
+	s.responded("-TRYAGAIN authority unavailable, circuit breaker open")
+}
+
+func (s *sessionHandlerTestSuite) TestSet_ValueTooLarge() {
+	fmt.Fprintln(s.conn, `SET bacon tasty`)
+
+	s.store.On("Set", "bacon", "tasty").Return(ErrValueTooLarge)
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+}
+
+func (s *sessionHandlerTestSuite) TestGet_APIError() {
+	fmt.Fprintln(s.conn, `GET bacon`)
+
+	s.store.On("Get", "bacon").Return("", false, awserr.New("ValidationException", "Bad\nbacon", nil))
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR DynamoDB API error: ValidationException: Bad bacon")
+}
+
 func (s *sessionHandlerTestSuite) TestPing_NoArgs() {
 	fmt.Fprintln(s.conn, "PING")
 
@@ -142,6 +204,99 @@ func (s *sessionHandlerTestSuite) TestUnknown_Malformed() {
 	s.responded("-ERR malformed line: EOF found when expecting closing quote")
 }
 
+func (s *sessionHandlerTestSuite) TestRESP_Binary() {
+	fmt.Fprint(s.conn, "*3\r\n$3\r\nSET\r\n$5\r\nbacon\r\n$8\r\n\xff\x00\r\nta\\y\r\n")
+
+	s.store.On("Set", "bacon", "\xff\x00\r\nta\\y").Return(nil)
+
+	s.True(s.sut.handleLine())
+	s.responded("+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestRESP_Empty() {
+	fmt.Fprint(s.conn, "*0\r\n")
+
+	s.True(s.sut.handleLine())
+	s.Empty(s.buffer.String())
+}
+
+func (s *sessionHandlerTestSuite) TestRESP_LoggedError() {
+	fmt.Fprint(s.conn, "*2\r\n$3\r\nGET\r\n$5\r\nbacon\r\n")
+
+	s.store.On("Get", "bacon").Return("", false, errors.New("store error"))
+
+	s.False(s.sut.handleLine())
+	s.loggedError("Could not handle command GET bacon: could not read from the store: store error")
+}
+
+func (s *sessionHandlerTestSuite) TestRESP_InvalidMultiBulkLength() {
+	fmt.Fprint(s.conn, "*bacon\r\n")
+
+	s.False(s.sut.handleLine())
+	s.responded("-ERR Protocol error: invalid multibulk length")
+}
+
+func (s *sessionHandlerTestSuite) TestRESP_ExpectedBulkString() {
+	fmt.Fprint(s.conn, "*1\r\nPING\r\n")
+
+	s.False(s.sut.handleLine())
+	s.responded("-ERR Protocol error: expected '$', got 'P'")
+}
+
+func (s *sessionHandlerTestSuite) TestRESP_InvalidBulkLength() {
+	fmt.Fprintf(s.conn, "*1\r\n$%d\r\n", MaxValueSize+1)
+
+	s.False(s.sut.handleLine())
+	s.responded("-ERR Protocol error: invalid bulk length")
+}
+
+func (s *sessionHandlerTestSuite) TestRESP_Unterminated() {
+	fmt.Fprint(s.conn, "*1\r\n$4\r\nPINGPONG\r\n")
+
+	s.False(s.sut.handleLine())
+	s.responded("-ERR Protocol error: bulk string not terminated by CRLF")
+}
+
+func (s *sessionHandlerTestSuite) TestRESP_Truncated() {
+	fmt.Fprint(s.conn, "*1\r\n$4\r\nPI")
+
+	s.False(s.sut.handleLine())
+	s.loggedError("Could not read command: truncated bulk string: EOF")
+}
+
+func (s *sessionHandlerTestSuite) TestDispatch_ReservedKeys() {
+	for _, args := range [][]string{
+		{"SET", functionsKey, "x"},
+		{"GET", "\x00db3:secret"},
+		{"RENAME", "bacon", databasesKey},
+		{"TOUCH", "bacon", "\x00db1:bacon"},
+		{"OBJECT", "FREQ", functionsKey},
+	} {
+		s.Require().NoError(s.sut.dispatch(args))
+	}
+
+	s.responded(
+		"-ERR key \"\\x00goredis:functions\" is reserved for goredis\n" +
+			"-ERR key \"\\x00db3:secret\" is reserved for goredis\n" +
+			"-ERR key \"\\x00goredis:databases\" is reserved for goredis\n" +
+			"-ERR key \"\\x00db1:bacon\" is reserved for goredis\n" +
+			"-ERR key \"\\x00goredis:functions\" is reserved for goredis",
+	)
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestDispatch_ReservedKeysAbortTransaction() {
+	for _, args := range [][]string{{"MULTI"}, {"SET", functionsKey, "x"}, {"EXEC"}} {
+		s.Require().NoError(s.sut.dispatch(args))
+	}
+
+	s.responded(
+		"+OK\n" +
+			"-ERR key \"\\x00goredis:functions\" is reserved for goredis\n" +
+			"-EXECABORT Transaction discarded because of previous errors.",
+	)
+}
+
 func (s *sessionHandlerTestSuite) loggedError(message string) {
 	s.Contains(s.logOutput.String(), fmt.Sprintf(`level=error msg="%s"`, message))
 }
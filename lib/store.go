@@ -1,7 +1,124 @@
 package lib
 
-// Store is capable of storing and retrieving elements.
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrConditionFailed is returned by Apply when any of the conditions is
+	// not met, in which case none of the writes are performed.
+	ErrConditionFailed = errors.New("condition failed")
+
+	// ErrValueTooLarge is returned when writing a value larger than
+	// MaxValueSize.
+	ErrValueTooLarge = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+
+	// ErrMalformedCursor is returned by Scan when given a cursor it could not
+	// have returned, since clients may pass SCAN any cursor.
+	ErrMalformedCursor = errors.New("malformed cursor")
+)
+
+// MaxValueSize is the size of the largest value stores accept, matching the
+// default proto-max-bulk-len of Redis.
+const MaxValueSize = 512 << 20
+
+// internalKeyPrefix marks keys reserved for goredis itself, which are hidden
+// from clients iterating over the keyspace.
+const internalKeyPrefix = "\x00"
+
+// Store is capable of storing and retrieving elements. Values are byte
+// strings which need not be valid UTF-8, and are returned exactly as written.
 type Store interface {
 	Get(key string) (value string, found bool, err error)
 	Set(key string, value string) error
+
+	// Version returns a number which changes every time the key is written.
+	// Keys which have never been written are at version zero.
+	Version(key string) (uint64, error)
+
+	// Apply performs all writes atomically - either all of them succeed, or
+	// none of them do. If a key is written more than once, the last write
+	// wins. The writes are only performed if all keys in conditions are at
+	// the expected versions, otherwise ErrConditionFailed is returned.
+	Apply(writes []Write, conditions []Condition) error
+
+	// Scan returns up to count keys following the cursor, along with the
+	// cursor to continue from. Cursors are opaque - iteration starts with an
+	// empty cursor, and is complete when an empty cursor is returned. Keys
+	// which exist throughout the iteration are returned at least once.
+	Scan(cursor string, count int) (keys []string, next string, err error)
+}
+
+// ContextGetter is implemented by stores whose reads can be cancelled, or
+// given a deadline, through a context.
+type ContextGetter interface {
+	GetContext(ctx context.Context, key string) (value string, found bool, err error)
+}
+
+type consistentReadKey struct{}
+
+// WithConsistentRead returns a context for reads which must reflect all writes
+// acknowledged before they started, so that stores read them from the
+// authority with strong consistency rather than serving what they've cached.
+func WithConsistentRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistentReadKey{}, true)
+}
+
+func consistentRead(ctx context.Context) bool {
+	consistent, _ := ctx.Value(consistentReadKey{}).(bool)
+	return consistent
+}
+
+// getContext reads the key through the context if the store supports it.
+func getContext(ctx context.Context, store Store, key string) (value string, found bool, err error) {
+	if getter, ok := store.(ContextGetter); ok {
+		return getter.GetContext(ctx, key)
+	}
+	return store.Get(key)
+}
+
+// Write is a single change applied as part of an atomic batch. It either sets
+// the key to the value, or deletes the key altogether.
+type Write struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+// Condition requires a key to be at a given version.
+type Condition struct {
+	Key     string
+	Version uint64
+}
+
+// coalesce removes all but the last write to each key, preserving the order
+// in which keys were first written.
+func coalesce(writes []Write) []Write {
+	index := make(map[string]int, len(writes))
+	ret := make([]Write, 0, len(writes))
+
+	for _, write := range writes {
+		if i, exists := index[write.Key]; exists {
+			ret[i] = write
+			continue
+		}
+
+		index[write.Key] = len(ret)
+		ret = append(ret, write)
+	}
+
+	return ret
+}
+
+// checkValueSizes returns ErrValueTooLarge if any of the writes sets a value
+// larger than MaxValueSize.
+func checkValueSizes(writes []Write) error {
+	for _, write := range writes {
+		if !write.Delete && len(write.Value) > MaxValueSize {
+			return ErrValueTooLarge
+		}
+	}
+	return nil
 }
@@ -0,0 +1,366 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxFrameSize is the size of the largest channel or message sent over
+	// the bus, which is the default hard output limit of pub/sub clients,
+	// since no subscriber within the default limits could receive a larger
+	// message anyway.
+	maxFrameSize = 32 * 1024 * 1024
+
+	// tcpPeerQueueSize is the number of messages buffered for a peer which
+	// is temporarily unreachable. Further messages are dropped, which
+	// matches the at-most-once delivery guarantee of Redis pub/sub.
+	tcpPeerQueueSize = 10000
+
+	tcpMaxBackoff = 5 * time.Second
+)
+
+// TCPBus is a peer-to-peer MessageBus. Every node listens for connections
+// from its peers and keeps an outgoing connection to each of them, so
+// messages are only ever forwarded directly by the node which received the
+// PUBLISH. The same peer list can be used on every node, since connections
+// a node makes to itself are detected and dropped.
+//
+// Peers are not authenticated, so anyone who can reach the bus port can
+// publish messages to clients of every node. The port must only be reachable
+// by the peers, as within a private network.
+type TCPBus struct {
+	id       string
+	listener net.Listener
+	logger   *logrus.Entry
+	peers    []*tcpPeer
+
+	deliver func(channel, message string)
+
+	closed chan struct{}
+	conns  map[net.Conn]struct{}
+	lock   *sync.Mutex
+}
+
+// NewTCPBus starts listening for peer connections on the given address and
+// starts connecting to the peers.
+func NewTCPBus(listenAddr string, peers []string, logger *logrus.Entry) (*TCPBus, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not listen for peers")
+	}
+
+	id, err := newNodeID()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	ret := &TCPBus{
+		id:       id,
+		listener: listener,
+		logger:   logger,
+		closed:   make(chan struct{}),
+		conns:    make(map[net.Conn]struct{}),
+		lock:     new(sync.Mutex),
+	}
+
+	for _, addr := range peers {
+		ret.peers = append(ret.peers, &tcpPeer{
+			addr:  addr,
+			bus:   ret,
+			queue: make(chan []byte, tcpPeerQueueSize),
+		})
+	}
+
+	return ret, nil
+}
+
+// Addr returns the address the bus is listening on.
+func (b *TCPBus) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// Broadcast queues the message for delivery to all peers. Messages too large
+// for peers to accept are dropped.
+func (b *TCPBus) Broadcast(channel, message string) error {
+	if len(channel) > maxFrameSize || len(message) > maxFrameSize {
+		return errors.Errorf("message too large for peers: %d bytes", len(channel)+len(message))
+	}
+
+	frame := encodeFrame(channel, message)
+
+	var dropped int
+	for _, peer := range b.peers {
+		if !peer.send(frame) {
+			dropped++
+		}
+	}
+
+	if dropped > 0 {
+		return errors.Errorf("message dropped for %d peer(s)", dropped)
+	}
+
+	return nil
+}
+
+// Listen starts accepting messages from peers and connecting to them.
+func (b *TCPBus) Listen(deliver func(channel, message string)) {
+	b.deliver = deliver
+
+	go b.accept()
+
+	for _, peer := range b.peers {
+		go peer.run()
+	}
+}
+
+// Close stops listening and disconnects from all peers.
+func (b *TCPBus) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	select {
+	case <-b.closed:
+		return nil
+	default:
+	}
+
+	close(b.closed)
+
+	for conn := range b.conns {
+		conn.Close()
+	}
+
+	return b.listener.Close()
+}
+
+func (b *TCPBus) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			select {
+			case <-b.closed:
+			default:
+				b.logger.Errorf("Could not accept peer connection: %v", err)
+			}
+			return
+		}
+
+		if !b.track(conn) {
+			conn.Close()
+			return
+		}
+
+		go b.receive(conn)
+	}
+}
+
+func (b *TCPBus) receive(conn net.Conn) {
+	defer b.untrack(conn)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	peerID, err := readString(reader)
+	if err != nil {
+		b.logger.Warnf("Could not read handshake from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if err := writeString(conn, b.id); err != nil || peerID == b.id {
+		return
+	}
+
+	for {
+		channel, err := readString(reader)
+		if err != nil {
+			if err != io.EOF {
+				b.logger.Warnf("Could not read message from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		message, err := readString(reader)
+		if err != nil {
+			b.logger.Warnf("Could not read message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		b.deliver(channel, message)
+	}
+}
+
+func (b *TCPBus) track(conn net.Conn) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	select {
+	case <-b.closed:
+		return false
+	default:
+		b.conns[conn] = struct{}{}
+		return true
+	}
+}
+
+func (b *TCPBus) untrack(conn net.Conn) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.conns, conn)
+}
+
+// tcpPeer is an outgoing connection to a single peer, re-established with
+// exponential backoff whenever it breaks.
+type tcpPeer struct {
+	addr  string
+	bus   *TCPBus
+	queue chan []byte
+	self  bool
+}
+
+func (p *tcpPeer) send(frame []byte) bool {
+	select {
+	case p.queue <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *tcpPeer) run() {
+	backoff := 100 * time.Millisecond
+
+	for !p.self {
+		if err := p.connect(); err != nil {
+			p.bus.logger.Warnf("Connection to peer %s failed: %v", p.addr, err)
+		} else {
+			backoff = 100 * time.Millisecond
+		}
+
+		select {
+		case <-p.bus.closed:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > tcpMaxBackoff {
+			backoff = tcpMaxBackoff
+		}
+	}
+
+	// Connected to ourselves - no need to keep the queue around.
+	for {
+		select {
+		case <-p.bus.closed:
+			return
+		case <-p.queue:
+		}
+	}
+}
+
+func (p *tcpPeer) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, time.Second)
+	if err != nil {
+		return err
+	}
+
+	if !p.bus.track(conn) {
+		conn.Close()
+		return nil
+	}
+	defer p.bus.untrack(conn)
+	defer conn.Close()
+
+	if err := writeString(conn, p.bus.id); err != nil {
+		return errors.Wrap(err, "could not send handshake")
+	}
+
+	peerID, err := readString(bufio.NewReader(conn))
+	if err != nil {
+		return errors.Wrap(err, "could not read handshake")
+	}
+
+	if peerID == p.bus.id {
+		p.self = true
+		return nil
+	}
+
+	for {
+		select {
+		case <-p.bus.closed:
+			return nil
+		case frame := <-p.queue:
+			if _, err := conn.Write(frame); err != nil {
+				return errors.Wrap(err, "could not send message")
+			}
+		}
+	}
+}
+
+func newNodeID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "could not generate node ID")
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func encodeFrame(fields ...string) []byte {
+	var size int
+	for _, field := range fields {
+		size += 4 + len(field)
+	}
+
+	frame := make([]byte, 0, size)
+	for _, field := range fields {
+		frame = appendString(frame, field)
+	}
+
+	return frame
+}
+
+func appendString(buf []byte, value string) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(value)))
+	return append(append(buf, length[:]...), value...)
+}
+
+func writeString(w io.Writer, value string) error {
+	_, err := w.Write(appendString(nil, value))
+	return err
+}
+
+// readString reads a string as its bytes arrive, so that a peer can't make
+// the node allocate more than it actually sends.
+func readString(r io.Reader) (string, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxFrameSize {
+		return "", errors.Errorf("frame too large: %d bytes", size)
+	}
+
+	var value bytes.Buffer
+	if _, err := io.CopyN(&value, r, int64(size)); err == io.EOF {
+		return "", errors.Wrap(io.ErrUnexpectedEOF, "truncated frame")
+	} else if err != nil {
+		return "", errors.Wrap(err, "truncated frame")
+	}
+
+	return value.String(), nil
+}
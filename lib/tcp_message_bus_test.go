@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type tcpBusTestSuite struct {
+	suite.Suite
+
+	logger *logrus.Entry
+}
+
+func (t *tcpBusTestSuite) SetupTest() {
+	logger := logrus.New()
+	logger.SetOutput(bytes.NewBuffer(nil))
+	t.logger = logger.WithField("test", true)
+}
+
+func (t *tcpBusTestSuite) TestBroadcast() {
+	type message struct{ channel, message string }
+	received := make(chan message, 1)
+
+	receiver, err := NewTCPBus("127.0.0.1:0", nil, t.logger)
+	t.Require().NoError(err)
+	defer receiver.Close()
+
+	receiver.Listen(func(channel, msg string) { received <- message{channel, msg} })
+
+	sender, err := NewTCPBus("127.0.0.1:0", []string{receiver.Addr().String()}, t.logger)
+	t.Require().NoError(err)
+	defer sender.Close()
+
+	sender.Listen(func(string, string) { t.Fail("sender should not receive messages") })
+
+	t.NoError(sender.Broadcast("news", "hello"))
+
+	select {
+	case msg := <-received:
+		t.Equal(message{"news", "hello"}, msg)
+	case <-time.After(5 * time.Second):
+		t.Fail("message not received")
+	}
+}
+
+func (t *tcpBusTestSuite) TestBroadcast_QueueFull() {
+	sut, err := NewTCPBus("127.0.0.1:0", []string{"127.0.0.1:1"}, t.logger)
+	t.Require().NoError(err)
+	defer sut.Close()
+
+	// Not listening, so nothing drains the queue.
+	for i := 0; i < tcpPeerQueueSize; i++ {
+		t.Require().NoError(sut.Broadcast("news", "hello"))
+	}
+
+	t.EqualError(sut.Broadcast("news", "hello"), "message dropped for 1 peer(s)")
+}
+
+func (t *tcpBusTestSuite) TestBroadcast_TooLarge() {
+	sut, err := NewTCPBus("127.0.0.1:0", []string{"127.0.0.1:1"}, t.logger)
+	t.Require().NoError(err)
+	defer sut.Close()
+
+	message := strings.Repeat("x", maxFrameSize+1)
+	t.EqualError(sut.Broadcast("news", message), fmt.Sprintf("message too large for peers: %d bytes", maxFrameSize+5))
+}
+
+func (t *tcpBusTestSuite) TestFrameRoundTrip() {
+	frame := bytes.NewBuffer(encodeFrame("news", ""))
+
+	channel, err := readString(frame)
+	t.NoError(err)
+	t.Equal("news", channel)
+
+	message, err := readString(frame)
+	t.NoError(err)
+	t.Empty(message)
+}
+
+func (t *tcpBusTestSuite) TestFrameTruncated() {
+	frame := encodeFrame("news")
+
+	_, err := readString(bytes.NewBuffer(frame[:len(frame)-1]))
+	t.EqualError(err, "truncated frame: unexpected EOF")
+}
+
+func (t *tcpBusTestSuite) TestFrameTooLarge() {
+	frame := appendString(nil, "news")
+	binary.BigEndian.PutUint32(frame, maxFrameSize+1)
+
+	_, err := readString(bytes.NewBuffer(frame))
+	t.EqualError(err, fmt.Sprintf("frame too large: %d bytes", maxFrameSize+1))
+}
+
+func TestTCPBus(t *testing.T) {
+	suite.Run(t, new(tcpBusTestSuite))
+}
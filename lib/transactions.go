@@ -0,0 +1,268 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// transaction holds the commands queued between MULTI and EXEC.
+type transaction struct {
+	commands [][]string
+
+	// dirty is set when a command failed to queue, which causes the whole
+	// transaction to be discarded on EXEC.
+	dirty bool
+}
+
+func (s *SessionHandler) flagTransaction() {
+	if s.multi != nil {
+		s.multi.dirty = true
+	}
+}
+
+func (s *SessionHandler) queue(cmd *command, name string, args []string) error {
+	if cmd.is(flagNoMulti) {
+		s.flagTransaction()
+		_, err := fmt.Fprintf(s.writer, "-ERR Command '%s' not allowed inside a transaction\n", name)
+		return err
+	}
+
+	s.multi.commands = append(s.multi.commands, args)
+
+	_, err := fmt.Fprintln(s.writer, "+QUEUED")
+	return err
+}
+
+func (s *SessionHandler) handleMulti(args []string) error {
+	if s.multi != nil {
+		_, err := fmt.Fprintln(s.writer, "-ERR MULTI calls can not be nested")
+		return err
+	}
+
+	s.multi = new(transaction)
+
+	_, err := fmt.Fprintln(s.writer, "+OK")
+	return err
+}
+
+func (s *SessionHandler) handleDiscard(args []string) error {
+	if s.multi == nil {
+		_, err := fmt.Fprintln(s.writer, "-ERR DISCARD without MULTI")
+		return err
+	}
+
+	s.multi = nil
+	s.watched = nil
+
+	_, err := fmt.Fprintln(s.writer, "+OK")
+	return err
+}
+
+// handleWatch records the current versions of keys, so that EXEC can be
+// made conditional on none of them changing in the meantime.
+func (s *SessionHandler) handleWatch(args []string) error {
+	if s.multi != nil {
+		_, err := fmt.Fprintln(s.writer, "-ERR WATCH inside MULTI is not allowed")
+		return err
+	}
+
+	if s.watched == nil {
+		s.watched = make(map[string]uint64, len(args))
+	}
+
+	// Swapping or flushing databases changes the mapping rather than keys
+	// themselves, so it's watched along with them.
+	keys := []string{databasesKey}
+
+	for _, key := range args {
+		key, err := s.store.key(key)
+		if err != nil {
+			return errors.Wrap(err, "could not read version from the store")
+		}
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		if _, watched := s.watched[key]; watched {
+			continue
+		}
+
+		version, err := s.root.Version(key)
+		if err != nil {
+			return errors.Wrap(err, "could not read version from the store")
+		}
+
+		s.watched[key] = version
+	}
+
+	_, err := fmt.Fprintln(s.writer, "+OK")
+	return err
+}
+
+func (s *SessionHandler) handleUnwatch(args []string) error {
+	s.watched = nil
+
+	_, err := fmt.Fprintln(s.writer, "+OK")
+	return err
+}
+
+// handleExec runs queued commands while holding the server lock exclusively,
+// buffering their writes so that they can be applied to the store in a single
+// atomic batch, conditional on watched keys not having changed.
+func (s *SessionHandler) handleExec(args []string) error {
+	if s.multi == nil {
+		_, err := fmt.Fprintln(s.writer, "-ERR EXEC without MULTI")
+		return err
+	}
+
+	tx, watched := s.multi, s.watched
+	s.multi, s.watched = nil, nil
+
+	if tx.dirty {
+		_, err := fmt.Fprintln(s.writer, "-EXECABORT Transaction discarded because of previous errors.")
+		return err
+	}
+
+	store := newTransactionStore(s.root, watched)
+	replies := bytes.NewBuffer(nil)
+
+	if err := s.execQueued(tx, store, replies); err != nil {
+		return err
+	}
+
+	conditions := make([]Condition, 0, len(watched))
+	for key, version := range watched {
+		conditions = append(conditions, Condition{Key: key, Version: version})
+	}
+	sort.Slice(conditions, func(i, j int) bool { return conditions[i].Key < conditions[j].Key })
+
+	if err := store.commit(conditions); errors.Cause(err) == ErrConditionFailed {
+		_, err := fmt.Fprintln(s.writer, "*-1")
+		return err
+	} else if err != nil {
+		return errors.Wrap(err, "could not commit transaction")
+	}
+
+	_, err := io.WriteString(s.writer, arrayHeader(len(tx.commands))+replies.String())
+	return err
+}
+
+func (s *SessionHandler) execQueued(tx *transaction, store Store, replies io.Writer) error {
+	// The database selected within the transaction stays selected.
+	originalRoot, originalWriter := s.root, s.writer
+	defer func() {
+		s.use(originalRoot, s.db)
+		s.writer = originalWriter
+	}()
+
+	s.use(store, s.db)
+	s.writer = replies
+
+	for _, args := range tx.commands {
+		cmd := commands[strings.ToLower(args[0])]
+		if err := cmd.handler(s, args[1:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// transactionStore buffers writes made by commands within a transaction, so
+// that they can be applied to the underlying store atomically on commit.
+// Reads see the buffered writes, but scans only see committed keys. Watched
+// keys are read with strong consistency, since the commit is conditional on
+// their versions, which a cached value may be older than.
+type transactionStore struct {
+	Store
+
+	conditions []Condition
+	writes     []Write
+	index      map[string]int
+	watched    map[string]uint64
+}
+
+func newTransactionStore(store Store, watched map[string]uint64) *transactionStore {
+	return &transactionStore{Store: store, index: make(map[string]int), watched: watched}
+}
+
+func (t *transactionStore) Get(key string) (value string, found bool, err error) {
+	return t.GetContext(context.Background(), key)
+}
+
+// GetContext is Get passing the context on to the underlying store.
+func (t *transactionStore) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	if i, buffered := t.index[key]; buffered {
+		write := t.writes[i]
+		return write.Value, !write.Delete, nil
+	} else if _, watched := t.watched[key]; watched {
+		ctx = WithConsistentRead(ctx)
+	}
+
+	return getContext(ctx, t.Store, key)
+}
+
+func (t *transactionStore) Set(key string, value string) error {
+	return t.Apply([]Write{{Key: key, Value: value}}, nil)
+}
+
+// Apply buffers the writes. Conditions are deferred until the commit, which
+// fails as a whole if any of them is not met by then. Versions are always
+// read from the underlying store, so that's what they're checked against.
+func (t *transactionStore) Apply(writes []Write, conditions []Condition) error {
+	t.conditions = append(t.conditions, conditions...)
+
+	for _, write := range writes {
+		if i, buffered := t.index[write.Key]; buffered {
+			t.writes[i] = write
+			continue
+		}
+
+		t.index[write.Key] = len(t.writes)
+		t.writes = append(t.writes, write)
+	}
+
+	return nil
+}
+
+func (t *transactionStore) commit(conditions []Condition) error {
+	if len(t.conditions) > 0 {
+		var consistent bool
+		if conditions, consistent = mergeConditions(conditions, t.conditions); !consistent {
+			return ErrConditionFailed
+		}
+	}
+
+	if len(t.writes) == 0 && len(conditions) == 0 {
+		return nil
+	}
+
+	return t.Store.Apply(t.writes, conditions)
+}
+
+// mergeConditions returns the conditions with duplicates removed, since
+// stores are not required to handle more than one condition per key. A key
+// expected at two different versions has certainly changed, which makes the
+// conditions inconsistent.
+func mergeConditions(conditions, more []Condition) (merged []Condition, consistent bool) {
+	expected := make(map[string]uint64, len(conditions)+len(more))
+
+	for _, list := range [][]Condition{conditions, more} {
+		for _, condition := range list {
+			if version, exists := expected[condition.Key]; !exists {
+				expected[condition.Key] = condition.Version
+				merged = append(merged, condition)
+			} else if version != condition.Version {
+				return nil, false
+			}
+		}
+	}
+
+	return merged, true
+}
@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/mock"
+)
+
+func (s *sessionHandlerTestSuite) TestMulti_Exec() {
+	fmt.Fprint(s.conn, "MULTI\nSET bacon tasty\nGET bacon\nGET cabbage\nEXEC\n")
+
+	s.store.On("Get", "cabbage").Return("healthy", true, nil)
+	s.store.On("Apply", []Write{{Key: "bacon", Value: "tasty"}}, []Condition{}).Return(nil)
+
+	s.handleLines(5)
+	s.responded("+OK\n+QUEUED\n+QUEUED\n+QUEUED\n*3\n+OK\n$5\ntasty\n$7\nhealthy")
+	s.Nil(s.sut.multi)
+}
+
+func (s *sessionHandlerTestSuite) TestMulti_ExecEmpty() {
+	fmt.Fprint(s.conn, "MULTI\nEXEC\n")
+
+	s.handleLines(2)
+	s.responded("+OK\n*0")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestMulti_Nested() {
+	fmt.Fprint(s.conn, "MULTI\nMULTI\n")
+
+	s.handleLines(2)
+	s.responded("+OK\n-ERR MULTI calls can not be nested")
+	s.False(s.sut.multi.dirty)
+}
+
+func (s *sessionHandlerTestSuite) TestExec_WithoutMulti() {
+	fmt.Fprintln(s.conn, "EXEC")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR EXEC without MULTI")
+}
+
+func (s *sessionHandlerTestSuite) TestExec_AbortsOnUnknownCommand() {
+	fmt.Fprint(s.conn, "MULTI\nSET bacon tasty\nBACON\nEXEC\n")
+
+	s.handleLines(4)
+	s.responded("+OK\n+QUEUED\n-ERR unknown command `BACON`, with args beginning with []\n-EXECABORT Transaction discarded because of previous errors.")
+	s.Nil(s.sut.multi)
+}
+
+func (s *sessionHandlerTestSuite) TestExec_AbortsOnWrongArity() {
+	fmt.Fprint(s.conn, "MULTI\nSET bacon\nEXEC\n")
+
+	s.handleLines(3)
+	s.responded("+OK\n-ERR wrong number of arguments for 'set' command\n-EXECABORT Transaction discarded because of previous errors.")
+}
+
+func (s *sessionHandlerTestSuite) TestExec_AbortsOnForbiddenCommand() {
+	fmt.Fprint(s.conn, "MULTI\nSUBSCRIBE news\nEXEC\n")
+
+	s.handleLines(3)
+	s.responded("+OK\n-ERR Command 'subscribe' not allowed inside a transaction\n-EXECABORT Transaction discarded because of previous errors.")
+}
+
+func (s *sessionHandlerTestSuite) TestExec_CommitError() {
+	fmt.Fprint(s.conn, "MULTI\nSET bacon tasty\nEXEC\n")
+
+	s.store.On("Apply", []Write{{Key: "bacon", Value: "tasty"}}, []Condition{}).Return(errors.New("store error"))
+
+	s.True(s.sut.handleLine())
+	s.True(s.sut.handleLine())
+	s.False(s.sut.handleLine())
+	s.loggedError("Could not handle command EXEC: could not commit transaction: store error")
+}
+
+func (s *sessionHandlerTestSuite) TestExec_CommandError() {
+	fmt.Fprint(s.conn, "MULTI\nGET bacon\nEXEC\n")
+
+	s.store.On("Get", "bacon").Return("", false, errors.New("store error"))
+
+	s.True(s.sut.handleLine())
+	s.True(s.sut.handleLine())
+	s.False(s.sut.handleLine())
+	s.loggedError("Could not handle command EXEC: could not read from the store: store error")
+	s.Equal(s.store, s.sut.root)
+}
+
+func (s *sessionHandlerTestSuite) TestDiscard() {
+	fmt.Fprint(s.conn, "MULTI\nSET bacon tasty\nDISCARD\n")
+
+	s.handleLines(3)
+	s.responded("+OK\n+QUEUED\n+OK")
+	s.Nil(s.sut.multi)
+}
+
+func (s *sessionHandlerTestSuite) TestDiscard_WithoutMulti() {
+	fmt.Fprintln(s.conn, "DISCARD")
+
+	s.True(s.sut.handleLine())
+	s.responded("-ERR DISCARD without MULTI")
+}
+
+func (s *sessionHandlerTestSuite) TestWatch_Exec() {
+	fmt.Fprint(s.conn, "WATCH bacon cabbage\nMULTI\nSET bacon tasty\nEXEC\n")
+
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Version", "cabbage").Return(uint64(0), nil)
+	s.store.On(
+		"Apply",
+		[]Write{{Key: "bacon", Value: "tasty"}},
+		[]Condition{{Key: databasesKey, Version: 0}, {Key: "bacon", Version: 3}, {Key: "cabbage", Version: 0}},
+	).Return(nil)
+
+	s.handleLines(4)
+	s.responded("+OK\n+OK\n+QUEUED\n*1\n+OK")
+	s.Nil(s.sut.watched)
+}
+
+func (s *sessionHandlerTestSuite) TestWatch_ModifiedKeyAbortsExec() {
+	fmt.Fprint(s.conn, "WATCH bacon\nMULTI\nGET bacon\nEXEC\n")
+
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On(
+		"Apply",
+		[]Write(nil),
+		[]Condition{{Key: databasesKey, Version: 0}, {Key: "bacon", Version: 3}},
+	).Return(ErrConditionFailed)
+
+	s.handleLines(4)
+	s.responded("+OK\n+OK\n+QUEUED\n*-1")
+}
+
+func (s *sessionHandlerTestSuite) TestWatch_RenamedAndSetAgain() {
+	store := &DynamoDBStore{API: newFakeDynamo(), TableName: "table"}
+	s.server.Store = store
+	s.sut.use(store, 0)
+	other := NewSessionHandler(s.conn, logrus.NewEntry(logrus.New()), s.server)
+
+	fmt.Fprint(s.conn, "SET bacon tasty\nWATCH bacon\n")
+	s.handleLines(2)
+	s.buffer.Reset()
+
+	// The key is deleted by renaming it, and ends up as it was, but at
+	// another version.
+	fmt.Fprint(s.conn, "RENAME bacon cabbage\nSET bacon tasty\n")
+	s.True(other.handleLine())
+	s.True(other.handleLine())
+	s.responded("+OK\n+OK")
+	s.buffer.Reset()
+
+	fmt.Fprint(s.conn, "MULTI\nSET bacon crispy\nEXEC\nGET bacon\n")
+	s.handleLines(4)
+	s.responded("+OK\n+QUEUED\n*-1\n$5\ntasty")
+}
+
+func (s *sessionHandlerTestSuite) TestExec_DefersConditions() {
+	fmt.Fprint(s.conn, "MULTI\nRENAME bacon cabbage\nEXEC\n")
+
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+	s.store.On(
+		"Apply",
+		[]Write{{Key: "bacon", Delete: true}, {Key: "cabbage", Value: "tasty"}},
+		[]Condition{{Key: "bacon", Version: 3}},
+	).Return(nil)
+
+	s.handleLines(3)
+	s.responded("+OK\n+QUEUED\n*1\n+OK")
+}
+
+func (s *sessionHandlerTestSuite) TestExec_InconsistentConditions() {
+	fmt.Fprint(s.conn, "WATCH bacon\nMULTI\nRENAME bacon cabbage\nEXEC\n")
+
+	s.store.On("Version", "bacon").Return(uint64(3), nil).Once()
+	s.store.On("Version", "bacon").Return(uint64(4), nil).Once()
+	s.store.On("Get", "bacon").Return("tasty", true, nil)
+
+	s.handleLines(4)
+	s.responded("+OK\n+OK\n+QUEUED\n*-1")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestWatch_InsideMulti() {
+	fmt.Fprint(s.conn, "MULTI\nWATCH bacon\n")
+
+	s.handleLines(2)
+	s.responded("+OK\n-ERR WATCH inside MULTI is not allowed")
+	s.False(s.sut.multi.dirty)
+}
+
+func (s *sessionHandlerTestSuite) TestWatch_StoreError() {
+	fmt.Fprintln(s.conn, "WATCH bacon")
+
+	s.store.On("Version", "bacon").Return(uint64(0), errors.New("store error"))
+
+	s.False(s.sut.handleLine())
+	s.loggedError("Could not handle command WATCH bacon: could not read version from the store: store error")
+}
+
+func (s *sessionHandlerTestSuite) TestUnwatch() {
+	fmt.Fprint(s.conn, "WATCH bacon\nUNWATCH\nMULTI\nEXEC\n")
+
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+
+	s.handleLines(4)
+	s.responded("+OK\n+OK\n+OK\n*0")
+	s.store.AssertNotCalled(s.T(), "Apply", mock.Anything, mock.Anything)
+}
+
+func (s *sessionHandlerTestSuite) TestDiscard_Unwatches() {
+	fmt.Fprint(s.conn, "WATCH bacon\nMULTI\nDISCARD\n")
+
+	s.store.On("Version", "bacon").Return(uint64(3), nil)
+
+	s.handleLines(3)
+	s.Nil(s.sut.watched)
+}
+
+func (s *sessionHandlerTestSuite) handleLines(count int) {
+	for i := 0; i < count; i++ {
+		s.Require().True(s.sut.handleLine())
+	}
+}
@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// walSegmentSuffix is the extension of write-ahead log segment files,
+	// which are named after their zero-padded sequence numbers so that they
+	// sort in the order they were written.
+	walSegmentSuffix = ".wal"
+
+	// walHeaderSize is the size of the header of each record - its length
+	// followed by its checksum.
+	walHeaderSize = 8
+
+	walFlagDelete = 1
+
+	// walSetAsideFile holds writes which were set aside rather than applied,
+	// as records like the ones in segments. It's not a segment itself, so
+	// it's never replayed.
+	walSetAsideFile = "set-aside.log"
+)
+
+// errWALCorrupt is returned when a segment other than the last one can't be
+// read to its end, which a crash while appending can't explain.
+var errWALCorrupt = errors.New("corrupt write-ahead log segment")
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// writeAheadLog is an append-only log of batches of writes, split into
+// segments so that the part already applied elsewhere can be dropped. Every
+// batch is synced to disk before append returns.
+type writeAheadLog struct {
+	dir     string
+	file    *os.File
+	segment uint64
+
+	// written tells whether any batch was appended to the current segment.
+	written bool
+}
+
+// openWriteAheadLog reads all batches left in the directory, oldest first,
+// and starts a new segment for batches appended from now on. A batch only
+// partly written by a crash at the end of the last segment is dropped, since
+// it was never acknowledged.
+func openWriteAheadLog(dir string) (*writeAheadLog, [][]Write, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, errors.Wrap(err, "could not create write-ahead log directory")
+	}
+
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var batches [][]Write
+	for i, segment := range segments {
+		path := walSegmentPath(dir, segment)
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not read write-ahead log segment")
+		}
+
+		read, valid := decodeWALRecords(data)
+		batches = append(batches, read...)
+
+		if valid == len(data) {
+			continue
+		} else if i < len(segments)-1 {
+			return nil, nil, errors.Wrap(errWALCorrupt, path)
+		} else if err := os.Truncate(path, int64(valid)); err != nil {
+			return nil, nil, errors.Wrap(err, "could not truncate write-ahead log segment")
+		}
+	}
+
+	ret := &writeAheadLog{dir: dir}
+	if len(segments) > 0 {
+		ret.segment = segments[len(segments)-1]
+	}
+
+	if err := ret.startSegment(); err != nil {
+		return nil, nil, err
+	}
+
+	return ret, batches, nil
+}
+
+// append writes the batch to the current segment and syncs it to disk.
+func (w *writeAheadLog) append(writes []Write) error {
+	if _, err := w.file.Write(encodeWALRecord(writes)); err != nil {
+		return errors.Wrap(err, "could not append to write-ahead log")
+	}
+	w.written = true
+	return errors.Wrap(w.file.Sync(), "could not sync write-ahead log")
+}
+
+// setAside appends the writes to the file of writes set aside, so that they
+// are kept, but not replayed.
+func (w *writeAheadLog) setAside(writes []Write) error {
+	file, err := os.OpenFile(filepath.Join(w.dir, walSetAsideFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open file of writes set aside")
+	}
+	defer file.Close()
+
+	if _, err := file.Write(encodeWALRecord(writes)); err != nil {
+		return errors.Wrap(err, "could not append to file of writes set aside")
+	}
+	return errors.Wrap(file.Sync(), "could not sync file of writes set aside")
+}
+
+// rotate starts a new segment, returning the sequence number of the one it
+// replaces, which is the last one containing any batch appended so far. A
+// segment with no batches is kept instead of being replaced by another.
+func (w *writeAheadLog) rotate() (uint64, error) {
+	if !w.written {
+		return w.segment - 1, nil
+	}
+
+	previous := w.segment
+	if err := w.file.Close(); err != nil {
+		return 0, errors.Wrap(err, "could not close write-ahead log segment")
+	}
+	return previous, w.startSegment()
+}
+
+// release removes segments up to and including the given one, once all the
+// batches in them no longer need to be replayed.
+func (w *writeAheadLog) release(upTo uint64) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if segment > upTo {
+			break
+		}
+		if err := os.Remove(walSegmentPath(w.dir, segment)); err != nil {
+			return errors.Wrap(err, "could not remove write-ahead log segment")
+		}
+	}
+
+	return w.syncDir()
+}
+
+func (w *writeAheadLog) close() error {
+	return errors.Wrap(w.file.Close(), "could not close write-ahead log segment")
+}
+
+func (w *writeAheadLog) startSegment() error {
+	w.segment++
+
+	file, err := os.OpenFile(walSegmentPath(w.dir, w.segment), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not create write-ahead log segment")
+	}
+
+	w.file, w.written = file, false
+	return w.syncDir()
+}
+
+// syncDir makes sure that segments created or removed stay that way after a
+// crash.
+func (w *writeAheadLog) syncDir() error {
+	dir, err := os.Open(w.dir)
+	if err != nil {
+		return errors.Wrap(err, "could not open write-ahead log directory")
+	}
+	defer dir.Close()
+
+	return errors.Wrap(dir.Sync(), "could not sync write-ahead log directory")
+}
+
+// walSegments returns the sequence numbers of segments in the directory, in
+// ascending order. Files which aren't segments are left alone.
+func walSegments(dir string) ([]uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list write-ahead log segments")
+	}
+
+	var ret []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentSuffix), 10, 64)
+		if err == nil {
+			ret = append(ret, segment)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+func walSegmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", segment, walSegmentSuffix))
+}
+
+// encodeWALRecord serializes a batch as a record, whose payload is the number
+// of writes followed by each of them as flags, key and value.
+func encodeWALRecord(writes []Write) []byte {
+	ret := make([]byte, walHeaderSize, walHeaderSize+binary.MaxVarintLen64)
+	ret = appendUvarint(ret, uint64(len(writes)))
+
+	for _, write := range writes {
+		var flags byte
+		if write.Delete {
+			flags |= walFlagDelete
+		}
+
+		ret = append(ret, flags)
+		ret = appendUvarint(ret, uint64(len(write.Key)))
+		ret = append(ret, write.Key...)
+		ret = appendUvarint(ret, uint64(len(write.Value)))
+		ret = append(ret, write.Value...)
+	}
+
+	payload := ret[walHeaderSize:]
+	binary.BigEndian.PutUint32(ret[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(ret[4:walHeaderSize], crc32.Checksum(payload, walChecksumTable))
+
+	return ret
+}
+
+// decodeWALRecords returns the batches in records, stopping at the first one
+// which is incomplete or fails its checksum, along with the number of bytes
+// read up to that point.
+func decodeWALRecords(data []byte) (batches [][]Write, valid int) {
+	for len(data)-valid >= walHeaderSize {
+		header := data[valid : valid+walHeaderSize]
+		length := int(binary.BigEndian.Uint32(header[:4]))
+
+		end := valid + walHeaderSize + length
+		if length > len(data)-valid-walHeaderSize {
+			break
+		}
+
+		payload := data[valid+walHeaderSize : end]
+		if crc32.Checksum(payload, walChecksumTable) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+
+		writes, ok := decodeWALPayload(payload)
+		if !ok {
+			break
+		}
+
+		batches, valid = append(batches, writes), end
+	}
+	return
+}
+
+func decodeWALPayload(payload []byte) ([]Write, bool) {
+	count, read := binary.Uvarint(payload)
+	if read <= 0 || count > uint64(len(payload)) {
+		return nil, false
+	}
+	payload = payload[read:]
+
+	ret := make([]Write, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(payload) == 0 {
+			return nil, false
+		}
+		write := Write{Delete: payload[0]&walFlagDelete != 0}
+		payload = payload[1:]
+
+		var ok bool
+		if write.Key, payload, ok = readWALString(payload); !ok {
+			return nil, false
+		}
+		if write.Value, payload, ok = readWALString(payload); !ok {
+			return nil, false
+		}
+
+		ret = append(ret, write)
+	}
+
+	return ret, len(payload) == 0
+}
+
+func readWALString(data []byte) (value string, rest []byte, ok bool) {
+	length, read := binary.Uvarint(data)
+	if read <= 0 || length > uint64(len(data)-read) {
+		return "", nil, false
+	}
+
+	end := read + int(length)
+	return string(data[read:end]), data[end:], true
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutUvarint(scratch[:], value)]...)
+}
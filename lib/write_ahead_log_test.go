@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type writeAheadLogTestSuite struct {
+	suite.Suite
+
+	dir string
+	sut *writeAheadLog
+}
+
+func (w *writeAheadLogTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "wal")
+	w.Require().NoError(err)
+	w.dir = dir
+
+	w.sut = w.open(nil)
+}
+
+func (w *writeAheadLogTestSuite) TearDownTest() {
+	w.sut.close()
+	os.RemoveAll(w.dir)
+}
+
+// open opens the log in the directory, expecting the batches to be replayed.
+func (w *writeAheadLogTestSuite) open(expected [][]Write) *writeAheadLog {
+	log, batches, err := openWriteAheadLog(w.dir)
+	w.Require().NoError(err)
+	w.Equal(expected, batches)
+	return log
+}
+
+func (w *writeAheadLogTestSuite) reopen(expected [][]Write) {
+	w.Require().NoError(w.sut.close())
+	w.sut = w.open(expected)
+}
+
+func (w *writeAheadLogTestSuite) segments() []uint64 {
+	ret, err := walSegments(w.dir)
+	w.Require().NoError(err)
+	return ret
+}
+
+func (w *writeAheadLogTestSuite) TestReplay() {
+	batches := [][]Write{
+		{{Key: "bacon", Value: "tasty"}, {Key: "cabbage", Delete: true}},
+		{{Key: "", Value: ""}},
+		{{Key: "bacon", Value: "\x00\xffbinary"}},
+	}
+	for _, batch := range batches {
+		w.NoError(w.sut.append(batch))
+	}
+
+	w.reopen(batches)
+	w.reopen(batches)
+	w.Equal([]uint64{1, 2, 3}, w.segments())
+}
+
+func (w *writeAheadLogTestSuite) TestRelease() {
+	w.NoError(w.sut.append([]Write{{Key: "bacon", Value: "tasty"}}))
+
+	segment, err := w.sut.rotate()
+	w.NoError(err)
+	w.Equal(uint64(1), segment)
+
+	w.NoError(w.sut.append([]Write{{Key: "cabbage", Value: "yuck"}}))
+	w.NoError(w.sut.release(segment))
+	w.Equal([]uint64{2}, w.segments())
+
+	w.reopen([][]Write{{{Key: "cabbage", Value: "yuck"}}})
+}
+
+func (w *writeAheadLogTestSuite) TestTornTail() {
+	w.NoError(w.sut.append([]Write{{Key: "bacon", Value: "tasty"}}))
+	w.NoError(w.sut.append([]Write{{Key: "cabbage", Value: "yuck"}}))
+
+	info, err := w.sut.file.Stat()
+	w.Require().NoError(err)
+	w.Require().NoError(os.Truncate(walSegmentPath(w.dir, 1), info.Size()-1))
+
+	w.reopen([][]Write{{{Key: "bacon", Value: "tasty"}}})
+
+	// Once truncated, the segment is no longer the last one, but it can
+	// still be read to its end.
+	w.reopen([][]Write{{{Key: "bacon", Value: "tasty"}}})
+}
+
+func (w *writeAheadLogTestSuite) TestCorruptSegment() {
+	w.NoError(w.sut.append([]Write{{Key: "bacon", Value: "tasty"}}))
+	_, err := w.sut.rotate()
+	w.Require().NoError(err)
+	w.Require().NoError(w.sut.close())
+
+	data, err := ioutil.ReadFile(walSegmentPath(w.dir, 1))
+	w.Require().NoError(err)
+	data[len(data)-1] ^= 0xff
+	w.Require().NoError(ioutil.WriteFile(walSegmentPath(w.dir, 1), data, 0600))
+
+	_, _, err = openWriteAheadLog(w.dir)
+	w.EqualError(err, walSegmentPath(w.dir, 1)+": corrupt write-ahead log segment")
+
+	w.Require().NoError(os.Remove(walSegmentPath(w.dir, 1)))
+	w.sut = w.open(nil)
+}
+
+func (w *writeAheadLogTestSuite) TestIgnoresOtherFiles() {
+	w.Require().NoError(ioutil.WriteFile(w.dir+"/README", []byte("bacon"), 0600))
+	w.reopen(nil)
+	w.Equal([]uint64{1, 2}, w.segments())
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	suite.Run(t, new(writeAheadLogTestSuite))
+}
@@ -0,0 +1,352 @@
+package lib
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultWriteBehindInterval is how often pending writes are flushed to
+	// the authority.
+	DefaultWriteBehindInterval = 100 * time.Millisecond
+
+	// DefaultWriteBehindBatchSize is the number of keys flushed to the
+	// authority at once, which is as many as a DynamoDB transaction takes.
+	DefaultWriteBehindBatchSize = maxTransactionItems
+
+	// DefaultWriteBehindBatchBytes is the size of the keys and values
+	// flushed to the authority at once, leaving room within the 4MB a
+	// DynamoDB transaction takes for attribute names and versions.
+	DefaultWriteBehindBatchBytes = 3 << 20
+)
+
+// pendingWrite is the latest write to a key not yet flushed to the authority.
+// Its sequence number tells whether the key has been written again while
+// being flushed.
+type pendingWrite struct {
+	write    Write
+	sequence uint64
+}
+
+// WriteBehind holds writes acknowledged by a CachingStore before they reach
+// its authority. They are appended to a write-ahead log on local disk first,
+// so that writes which were acknowledged but not flushed when the process
+// stopped are flushed once it's started again with the same directory.
+//
+// Repeated writes to the same key are coalesced, so only the last one is
+// flushed. Writes the authority rejects for what they are, as when they're too
+// large, are set aside in a file next to the log rather than being retried
+// forever, and the keys they were made to are dropped from the cache.
+type WriteBehind struct {
+	// FlushInterval is how often pending writes are flushed when there are
+	// fewer of them than BatchSize.
+	FlushInterval time.Duration
+
+	// BatchSize is the number of keys applied to the authority at once, and
+	// BatchBytes the size of their keys and values, unless a single write is
+	// larger. BatchSize is kept between 1 and as many keys as a DynamoDB
+	// transaction takes. Each batch is applied atomically, but writes applied
+	// together through the CachingStore may be split across batches.
+	BatchSize  int
+	BatchBytes int
+
+	// WhenUnavailable limits writing behind to when the authority is a
+	// CircuitBreaker which is open, so that writes are queued rather than
+	// rejected during an outage, but otherwise go straight to the authority.
+	WhenUnavailable bool
+
+	log      *writeAheadLog
+	logger   logrus.FieldLogger
+	pending  map[string]pendingWrite
+	sequence uint64
+	setAside int
+	lock     *sync.Mutex
+
+	// flushLock makes flushes take turns, so that each one covers all
+	// writes acknowledged before it started.
+	flushLock *sync.Mutex
+	full      chan struct{}
+}
+
+// OpenWriteBehind opens the write-ahead log in the directory, creating it if
+// needed. Writes left in it are pending again, until they are flushed.
+func OpenWriteBehind(dir string, logger logrus.FieldLogger) (*WriteBehind, error) {
+	log, batches, err := openWriteAheadLog(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &WriteBehind{
+		FlushInterval: DefaultWriteBehindInterval,
+		BatchSize:     DefaultWriteBehindBatchSize,
+		BatchBytes:    DefaultWriteBehindBatchBytes,
+		log:           log,
+		logger:        logger,
+		pending:       make(map[string]pendingWrite),
+		lock:          new(sync.Mutex),
+		flushLock:     new(sync.Mutex),
+		full:          make(chan struct{}, 1),
+	}
+
+	for _, batch := range batches {
+		ret.queue(batch)
+	}
+
+	return ret, nil
+}
+
+// Len returns the number of keys with writes pending.
+func (w *WriteBehind) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return len(w.pending)
+}
+
+// SetAside returns the number of writes set aside since the WriteBehind was
+// opened.
+func (w *WriteBehind) SetAside() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.setAside
+}
+
+func (w *WriteBehind) batchSize() int {
+	switch {
+	case w.BatchSize < 1:
+		return 1
+	case w.BatchSize > maxTransactionItems:
+		return maxTransactionItems
+	}
+	return w.BatchSize
+}
+
+func (w *WriteBehind) batchBytes() int {
+	if w.BatchBytes <= 0 {
+		return DefaultWriteBehindBatchBytes
+	}
+	return w.BatchBytes
+}
+
+// batches splits the writes being flushed into batches.
+func (w *WriteBehind) batches(flushing []pendingWrite) [][]Write {
+	var ret [][]Write
+	var batch []Write
+	var size int
+
+	for _, pending := range flushing {
+		length := len(pending.write.Key) + len(pending.write.Value)
+		if len(batch) > 0 && (len(batch) >= w.batchSize() || size+length > w.batchBytes()) {
+			ret, batch, size = append(ret, batch), nil, 0
+		}
+		batch, size = append(batch, pending.write), size+length
+	}
+
+	if len(batch) > 0 {
+		ret = append(ret, batch)
+	}
+	return ret
+}
+
+// lookup returns the write pending for the key, if there's one.
+func (w *WriteBehind) lookup(key string) (Write, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	pending, exists := w.pending[key]
+	return pending.write, exists
+}
+
+// append logs the writes and makes them pending.
+func (w *WriteBehind) append(writes []Write) error {
+	w.lock.Lock()
+	err := w.log.append(writes)
+	if err == nil {
+		w.queue(writes)
+	}
+	full := len(w.pending) >= w.batchSize()
+	w.lock.Unlock()
+
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+
+	return err
+}
+
+// queue must be called with the lock held.
+func (w *WriteBehind) queue(writes []Write) {
+	for _, write := range writes {
+		w.sequence++
+		w.pending[write.Key] = pendingWrite{write: write, sequence: w.sequence}
+	}
+}
+
+// RunWriteBehind flushes pending writes until the context is done, and once
+// more after that. Errors are logged and the writes retried on the next
+// flush, since they are safe in the write-ahead log meanwhile.
+func (l *CachingStore) RunWriteBehind(ctx context.Context) error {
+	ticker := time.NewTicker(l.WriteBehind.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		l.flushInBackground()
+
+		select {
+		case <-ctx.Done():
+			l.flushInBackground()
+			return ctx.Err()
+		case <-ticker.C:
+		case <-l.WriteBehind.full:
+		}
+	}
+}
+
+// flushInBackground logs flush errors, except for the authority being
+// unavailable, which the circuit breaker has already noticed.
+func (l *CachingStore) flushInBackground() {
+	if err := l.Flush(); errors.Cause(err) == ErrCircuitOpen {
+		l.WriteBehind.logger.Debugf("Could not flush pending writes: %v", err)
+	} else if err != nil {
+		l.WriteBehind.logger.Errorf("Could not flush pending writes: %v", err)
+	}
+}
+
+// Flush applies all writes pending when it's called to the authority, and
+// drops them from the write-ahead log. It's a no-op unless the CachingStore
+// writes behind.
+func (l *CachingStore) Flush() error {
+	w := l.WriteBehind
+	if w == nil {
+		return nil
+	}
+
+	// Pending writes stay in the segment they're in while the authority is
+	// unavailable, rather than every attempt to flush them starting another.
+	if authority, ok := l.Authority.(availabilityReporter); ok && !authority.available() && w.Len() > 0 {
+		return errors.Wrap(ErrCircuitOpen, "could not apply writes to authority")
+	}
+
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+
+	w.lock.Lock()
+	flushing := make([]pendingWrite, 0, len(w.pending))
+	for _, pending := range w.pending {
+		flushing = append(flushing, pending)
+	}
+
+	var segment uint64
+	var err error
+	if len(flushing) > 0 {
+		// Writes from now on go to a new segment, so that the ones being
+		// flushed can be dropped along with their segments.
+		segment, err = w.log.rotate()
+	}
+	w.lock.Unlock()
+
+	if len(flushing) == 0 || err != nil {
+		return err
+	}
+
+	sort.Slice(flushing, func(i, j int) bool { return flushing[i].sequence < flushing[j].sequence })
+
+	rejected := make(map[string]bool)
+	for _, batch := range w.batches(flushing) {
+		if err := l.flushBatch(batch, rejected); err != nil {
+			return errors.Wrap(err, "could not apply writes to authority")
+		}
+	}
+
+	// Writes made while flushing may have reached the cache out of order,
+	// so it's brought up to date with what's been flushed, unless the key
+	// has been written again since. Keys of writes set aside are dropped
+	// from it instead.
+	w.lock.Lock()
+	flushed := make([]Write, 0, len(flushing))
+	for _, pending := range flushing {
+		key := pending.write.Key
+		if current := w.pending[key]; current.sequence != pending.sequence {
+			continue
+		}
+
+		delete(w.pending, key)
+		if rejected[key] {
+			l.reads.invalidate(key)
+			flushed = append(flushed, Write{Key: key, Delete: true})
+		} else {
+			flushed = append(flushed, pending.write)
+		}
+	}
+	err = l.applyToCache(flushed)
+	w.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return w.log.release(segment)
+}
+
+// flushBatch applies the batch to the authority. Should the authority reject
+// it, its writes are applied one by one, setting aside the ones it rejects as
+// well, rather than having them keep all others from being flushed.
+func (l *CachingStore) flushBatch(batch []Write, rejected map[string]bool) error {
+	err := l.Authority.Apply(batch, nil)
+	if err == nil || !isRejected(err) {
+		return err
+	}
+
+	if len(batch) > 1 {
+		for _, write := range batch {
+			if err := l.flushBatch([]Write{write}, rejected); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := l.WriteBehind
+	w.logger.Errorf("Setting aside write to key %q, which the authority rejected: %v", batch[0].Key, err)
+	if err := w.log.setAside(batch); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	w.setAside++
+	w.lock.Unlock()
+
+	rejected[batch[0].Key] = true
+	return nil
+}
+
+// writeBehind acknowledges the writes once they're logged and cached, as
+// they're flushed to the authority later.
+func (l *CachingStore) writeBehind(writes []Write) error {
+	// Writes the authority would reject must not get stuck in the log.
+	if err := checkValueSizes(writes); err != nil {
+		return err
+	}
+
+	if err := l.WriteBehind.append(writes); err != nil {
+		return err
+	}
+
+	for _, write := range writes {
+		if !write.Delete {
+			l.KnownMissing.Remove(write.Key)
+		}
+		l.reads.invalidate(write.Key)
+	}
+
+	return l.applyToCache(writes)
+}
@@ -0,0 +1,380 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+// recordingStore records batches applied to it, and fails them with err when
+// it's set. Batches with writes to the rejected key fail as too large.
+type recordingStore struct {
+	Store
+
+	applied  [][]Write
+	err      error
+	rejected string
+	during   func()
+	lock     *sync.Mutex
+}
+
+func (r *recordingStore) Apply(writes []Write, conditions []Condition) error {
+	r.lock.Lock()
+	r.applied = append(r.applied, writes)
+	err, during := r.err, r.during
+	for _, write := range writes {
+		if r.rejected != "" && write.Key == r.rejected {
+			err = ErrValueTooLarge
+		}
+	}
+	r.lock.Unlock()
+
+	if during != nil {
+		during()
+	}
+	if err != nil {
+		return err
+	}
+	return r.Store.Apply(writes, conditions)
+}
+
+func (r *recordingStore) batches() [][]Write {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.applied
+}
+
+type writeBehindTestSuite struct {
+	suite.Suite
+
+	dir       string
+	authority *recordingStore
+
+	sut *CachingStore
+}
+
+func (w *writeBehindTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "write-behind")
+	w.Require().NoError(err)
+	w.dir = dir
+
+	w.authority = &recordingStore{Store: NewInMemoryStore(), lock: new(sync.Mutex)}
+	w.sut = w.open()
+}
+
+func (w *writeBehindTestSuite) TearDownTest() {
+	w.sut.WriteBehind.log.close()
+	os.RemoveAll(w.dir)
+}
+
+// open returns a CachingStore writing behind to the directory, with a cache
+// of its own.
+func (w *writeBehindTestSuite) open() *CachingStore {
+	writeBehind, err := OpenWriteBehind(w.dir, logrus.New())
+	w.Require().NoError(err)
+
+	ret := NewCachingStore(w.authority, NewInMemoryStore())
+	ret.WriteBehind = writeBehind
+	return ret
+}
+
+func (w *writeBehindTestSuite) get(store Store, key string) (string, bool) {
+	value, found, err := store.Get(key)
+	w.Require().NoError(err)
+	return value, found
+}
+
+func (w *writeBehindTestSuite) TestSet() {
+	w.NoError(w.sut.Set("bacon", "tasty"))
+
+	_, found := w.get(w.authority, "bacon")
+	w.False(found)
+
+	value, _ := w.get(w.sut, "bacon")
+	w.Equal("tasty", value)
+	value, _ = w.get(w.sut.Cache, "bacon")
+	w.Equal("tasty", value)
+
+	w.NoError(w.sut.Flush())
+	value, _ = w.get(w.authority, "bacon")
+	w.Equal("tasty", value)
+	w.Zero(w.sut.WriteBehind.Len())
+}
+
+func (w *writeBehindTestSuite) TestSet_ServedWhenEvicted() {
+	w.NoError(w.sut.Set("bacon", "tasty"))
+	w.NoError(w.sut.Cache.Apply([]Write{{Key: "bacon", Delete: true}}, nil))
+
+	value, found := w.get(w.sut, "bacon")
+	w.Equal("tasty", value)
+	w.True(found)
+}
+
+func (w *writeBehindTestSuite) TestCoalesces() {
+	w.NoError(w.sut.Set("bacon", "raw"))
+	w.NoError(w.sut.Set("cabbage", "yuck"))
+	w.NoError(w.sut.Apply([]Write{{Key: "bacon", Value: "tasty"}, {Key: "cabbage", Delete: true}}, nil))
+
+	w.NoError(w.sut.Flush())
+	w.Equal([][]Write{{{Key: "bacon", Value: "tasty"}, {Key: "cabbage", Delete: true}}}, w.authority.batches())
+}
+
+func (w *writeBehindTestSuite) TestDelete() {
+	w.NoError(w.authority.Set("bacon", "tasty"))
+	w.NoError(w.sut.Apply([]Write{{Key: "bacon", Delete: true}}, nil))
+
+	_, found := w.get(w.sut, "bacon")
+	w.False(found)
+
+	w.NoError(w.sut.Flush())
+	_, found = w.get(w.authority, "bacon")
+	w.False(found)
+}
+
+func (w *writeBehindTestSuite) TestBatches() {
+	w.sut.WriteBehind.BatchSize = 2
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		w.NoError(w.sut.Set(key, key))
+	}
+
+	w.NoError(w.sut.Flush())
+	w.Equal([][]Write{
+		{{Key: "a", Value: "a"}, {Key: "b", Value: "b"}},
+		{{Key: "c", Value: "c"}, {Key: "d", Value: "d"}},
+		{{Key: "e", Value: "e"}},
+	}, w.authority.batches())
+}
+
+func (w *writeBehindTestSuite) TestBatches_Bytes() {
+	w.sut.WriteBehind.BatchBytes = 10
+	w.NoError(w.sut.Set("a", "tasty"))
+	w.NoError(w.sut.Set("b", "yuck"))
+	w.NoError(w.sut.Set("c", "crispy bacon"))
+	w.NoError(w.sut.Set("d", "ok"))
+
+	w.NoError(w.sut.Flush())
+	w.Equal([][]Write{
+		{{Key: "a", Value: "tasty"}},
+		{{Key: "b", Value: "yuck"}},
+		{{Key: "c", Value: "crispy bacon"}},
+		{{Key: "d", Value: "ok"}},
+	}, w.authority.batches())
+}
+
+func (w *writeBehindTestSuite) TestBatches_SizeClamped() {
+	w.sut.WriteBehind.BatchSize = 0
+	w.NoError(w.sut.Set("a", "a"))
+	w.NoError(w.sut.Set("b", "b"))
+
+	w.NoError(w.sut.Flush())
+	w.Equal([][]Write{{{Key: "a", Value: "a"}}, {{Key: "b", Value: "b"}}}, w.authority.batches())
+
+	w.sut.WriteBehind.BatchSize = 1000
+	writes := make([]Write, maxTransactionItems+1)
+	for i := range writes {
+		writes[i] = Write{Key: strconv.Itoa(i), Value: "x"}
+	}
+	w.NoError(w.sut.Apply(writes, nil))
+
+	w.NoError(w.sut.Flush())
+	batches := w.authority.batches()
+	w.Require().Len(batches, 4)
+	w.Len(batches[2], maxTransactionItems)
+	w.Len(batches[3], 1)
+}
+
+func (w *writeBehindTestSuite) TestReplay() {
+	w.NoError(w.sut.Set("bacon", "tasty"))
+	w.NoError(w.sut.WriteBehind.log.close())
+
+	w.sut = w.open()
+	w.Equal(1, w.sut.WriteBehind.Len())
+
+	value, _ := w.get(w.sut, "bacon")
+	w.Equal("tasty", value)
+
+	w.NoError(w.sut.Flush())
+	value, _ = w.get(w.authority, "bacon")
+	w.Equal("tasty", value)
+
+	w.NoError(w.sut.WriteBehind.log.close())
+	w.sut = w.open()
+	w.Zero(w.sut.WriteBehind.Len())
+}
+
+func (w *writeBehindTestSuite) TestFlush_Error() {
+	w.authority.err = errors.New("bacon")
+	w.NoError(w.sut.Set("bacon", "tasty"))
+
+	w.EqualError(w.sut.Flush(), "could not apply writes to authority: bacon")
+	w.Equal(1, w.sut.WriteBehind.Len())
+
+	w.NoError(w.sut.WriteBehind.log.close())
+	w.sut = w.open()
+	w.Equal(1, w.sut.WriteBehind.Len())
+
+	w.authority.err = nil
+	w.NoError(w.sut.Flush())
+	w.Zero(w.sut.WriteBehind.Len())
+}
+
+func (w *writeBehindTestSuite) TestFlush_ErrorKeepsSegment() {
+	w.authority.err = errors.New("bacon")
+	w.NoError(w.sut.Set("bacon", "tasty"))
+
+	for i := 0; i < 3; i++ {
+		w.Error(w.sut.Flush())
+	}
+
+	segments, err := walSegments(w.dir)
+	w.Equal([]uint64{1, 2}, segments)
+	w.NoError(err)
+}
+
+func (w *writeBehindTestSuite) TestFlush_SetsAsideRejected() {
+	w.authority.rejected = "bacon"
+	w.NoError(w.sut.Set("bacon", "too large"))
+	w.NoError(w.sut.Set("cabbage", "yuck"))
+
+	w.NoError(w.sut.Flush())
+	w.Zero(w.sut.WriteBehind.Len())
+	w.Equal(1, w.sut.WriteBehind.SetAside())
+
+	value, _ := w.get(w.authority, "cabbage")
+	w.Equal("yuck", value)
+	_, found := w.get(w.sut, "bacon")
+	w.False(found)
+
+	data, err := ioutil.ReadFile(filepath.Join(w.dir, walSetAsideFile))
+	w.Require().NoError(err)
+	batches, _ := decodeWALRecords(data)
+	w.Equal([][]Write{{{Key: "bacon", Value: "too large"}}}, batches)
+
+	// Writes set aside are never replayed.
+	w.NoError(w.sut.WriteBehind.log.close())
+	w.sut = w.open()
+	w.Zero(w.sut.WriteBehind.Len())
+}
+
+func (w *writeBehindTestSuite) TestFlush_WrittenWhileFlushing() {
+	w.NoError(w.sut.Set("bacon", "raw"))
+
+	w.authority.during = func() {
+		w.authority.during = nil
+		w.NoError(w.sut.Set("bacon", "tasty"))
+		w.NoError(w.sut.Cache.Set("bacon", "raw"))
+	}
+	w.NoError(w.sut.Flush())
+
+	w.Equal(1, w.sut.WriteBehind.Len())
+	value, _ := w.get(w.sut, "bacon")
+	w.Equal("tasty", value)
+
+	w.NoError(w.sut.Flush())
+	value, _ = w.get(w.sut.Cache, "bacon")
+	w.Equal("tasty", value)
+}
+
+func (w *writeBehindTestSuite) TestVersion_FlushesFirst() {
+	w.NoError(w.sut.Set("bacon", "tasty"))
+
+	version, err := w.sut.Version("bacon")
+	w.Equal(uint64(1), version)
+	w.NoError(err)
+}
+
+func (w *writeBehindTestSuite) TestApply_Conditions() {
+	w.NoError(w.sut.Set("bacon", "raw"))
+
+	err := w.sut.Apply([]Write{{Key: "bacon", Value: "tasty"}}, []Condition{{Key: "bacon", Version: 0}})
+	w.Equal(ErrConditionFailed, errors.Cause(err))
+
+	w.NoError(w.sut.Apply([]Write{{Key: "bacon", Value: "tasty"}}, []Condition{{Key: "bacon", Version: 1}}))
+	w.Zero(w.sut.WriteBehind.Len())
+
+	value, _ := w.get(w.authority, "bacon")
+	w.Equal("tasty", value)
+}
+
+func (w *writeBehindTestSuite) TestScan_FlushesFirst() {
+	w.NoError(w.sut.Set("bacon", "tasty"))
+
+	keys, _, err := w.sut.Scan("", 10)
+	w.Equal([]string{"bacon"}, keys)
+	w.NoError(err)
+}
+
+func (w *writeBehindTestSuite) TestRunWriteBehind() {
+	w.sut.WriteBehind.BatchSize = 2
+	w.sut.WriteBehind.FlushInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.sut.RunWriteBehind(ctx) }()
+
+	// A full batch is flushed without waiting for the interval.
+	w.NoError(w.sut.Set("bacon", "tasty"))
+	w.NoError(w.sut.Set("cabbage", "yuck"))
+	for deadline := time.Now().Add(5 * time.Second); w.sut.WriteBehind.Len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	w.Zero(w.sut.WriteBehind.Len())
+
+	// Whatever is pending is flushed once more when done.
+	w.NoError(w.sut.Set("bacon", "crispy"))
+	cancel()
+	w.Equal(context.Canceled, <-done)
+
+	value, _ := w.get(w.authority, "bacon")
+	w.Equal("crispy", value)
+}
+
+func (w *writeBehindTestSuite) TestWhenUnavailable() {
+	breaker := NewCircuitBreaker(w.authority)
+	w.sut.Authority = breaker
+	w.sut.WriteBehind.WhenUnavailable = true
+
+	w.NoError(w.sut.Set("bacon", "raw"))
+	w.Zero(w.sut.WriteBehind.Len())
+
+	breaker.lock.Lock()
+	breaker.trip()
+	breaker.lock.Unlock()
+
+	w.NoError(w.sut.Set("bacon", "tasty"))
+	w.Equal(1, w.sut.WriteBehind.Len())
+	w.Equal(ErrCircuitOpen, errors.Cause(w.sut.Flush()))
+
+	value, _ := w.get(w.sut, "bacon")
+	w.Equal("tasty", value)
+
+	breaker.lock.Lock()
+	breaker.state = circuitClosed
+	breaker.lock.Unlock()
+
+	// Writes keep going behind until the ones pending are flushed.
+	w.NoError(w.sut.Set("bacon", "crispy"))
+	w.Equal(1, w.sut.WriteBehind.Len())
+	value, _ = w.get(w.authority, "bacon")
+	w.Equal("raw", value)
+
+	w.NoError(w.sut.Flush())
+	w.NoError(w.sut.Set("cabbage", "yuck"))
+	w.Zero(w.sut.WriteBehind.Len())
+
+	value, _ = w.get(w.authority, "bacon")
+	w.Equal("crispy", value)
+}
+
+func TestWriteBehind(t *testing.T) {
+	suite.Run(t, new(writeBehindTestSuite))
+}